@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	adminAddress = flag.String("admin-address", "",
+		"Address to serve the admin API on at /routes, to list, add and remove the routes of the config file "+
+			"(HTTP, disabled if empty)")
+	adminToken = flag.String("admin-token", "",
+		"Token the requests to the admin API must carry as Authorization: Bearer <token>")
+)
+
+// validateAdmin checks that the admin API has a token to authenticate its
+// requests and a config file to write its changes to.
+func validateAdmin() error {
+	if *adminAddress == "" {
+		return nil
+	}
+	if *adminToken == "" {
+		return errors.New("-admin-address requires -admin-token")
+	}
+	if *configFile == "" {
+		return errors.New("-admin-address requires -config to save the routes to")
+	}
+	return nil
+}
+
+// adminHandler serves the admin API:
+//
+//	GET /routes lists the routes in effect as JSON, with their backends
+//	PUT /routes/<domain> with a JSON list of backends adds or replaces a route
+//	DELETE /routes/<domain> removes a route
+//
+// Changes are made to the routes of the config file, which is saved and
+// applied like on SIGHUP. A change which makes the configuration invalid is
+// rejected and the file left as it was.
+type adminHandler struct {
+	token string
+	mu    sync.Mutex // serializes the changes to the config file
+}
+
+func newAdminHandler(token string) *adminHandler {
+	return &adminHandler{token: token}
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/routes" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(loadSettings().routes)
+		return
+	}
+	domain := strings.TrimPrefix(r.URL.Path, "/routes/")
+	if domain == r.URL.Path || domain == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var code int
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var backends []string
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&backends); err != nil {
+			http.Error(w, fmt.Sprintf("invalid backends, must be a JSON list: %v", err), http.StatusBadRequest)
+			return
+		}
+		code, err = h.change(func(cfg *config) error {
+			// Validated like in buildSettings, before anything is saved.
+			s := &settings{routes: make(map[string][]string), weights: make(map[string]map[string]int)}
+			if err := s.addRoute(domain, backends); err != nil {
+				return err
+			}
+			removeConfigRoute(cfg, domain)
+			if cfg.Routes == nil {
+				cfg.Routes = make(map[string][]string)
+			}
+			cfg.Routes[domain] = backends
+			return nil
+		})
+	case http.MethodDelete:
+		code, err = h.change(func(cfg *config) error {
+			if !removeConfigRoute(cfg, domain) {
+				return errNoConfigRoute
+			}
+			return nil
+		})
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	log.Printf("admin: %v route %v", strings.ToLower(r.Method), domain)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errNoConfigRoute is the error of removing a route which is not in the
+// config file, such as one given with -route.
+var errNoConfigRoute = errors.New("no such route in the config file")
+
+// change applies f to the config file, saves it and swaps in the settings
+// built from it. If they are invalid the previous file is restored. It
+// returns the HTTP status of a failure: the request is bad if f or the new
+// settings fail.
+func (h *adminHandler) change(f func(*config) error) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := f(cfg); err == errNoConfigRoute {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := saveConfig(*configFile, cfg); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	s, err := buildSettings()
+	if err != nil {
+		if rerr := replaceFile(*configFile, old); rerr != nil {
+			log.Printf("admin: restoring %v failed: %v", *configFile, rerr)
+		}
+		return http.StatusBadRequest, err
+	}
+	swapSettings(s)
+	return 0, nil
+}
+
+// removeConfigRoute removes from cfg the route for domain, however it is
+// written, and returns whether there was one.
+func removeConfigRoute(cfg *config, domain string) bool {
+	name := normalizeDomain(domain)
+	found := false
+	for d := range cfg.Routes {
+		if normalizeDomain(d) == name {
+			delete(cfg.Routes, d)
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// adminDo sends an admin request to h with token, and returns its response.
+func adminDo(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminRoutes(t *testing.T) {
+	captureLog(t)
+	useConfig(t, "default: 192.0.2.1:53\nroutes:\n  .example.com.: [192.0.2.2:53]\nroute-dnssec: [.example.com.]\n")
+	h := newAdminHandler("secret")
+
+	w := adminDo(h, http.MethodGet, "/routes", "secret", "")
+	var routes map[string][]string
+	if err := json.NewDecoder(w.Body).Decode(&routes); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("GET /routes: %v %v", w.Code, err)
+	}
+	if got := routes[".example.com."]; len(got) != 1 || got[0] != "192.0.2.2:53" {
+		t.Errorf("routes listed %v, want those of the config file", routes)
+	}
+
+	if w := adminDo(h, http.MethodPut, "/routes/.Example.org.", "secret", `["192.0.2.3:53", "192.0.2.4:53#2"]`); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %v %v", w.Code, w.Body)
+	}
+	if backends, _ := loadSettings().router.Match("www.example.org.", dns.TypeA); len(backends) != 2 {
+		t.Errorf("route added matched %v, want its 2 backends", backends)
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Routes[".Example.org."]; len(got) != 2 {
+		t.Errorf("routes saved %v, want the route added", cfg.Routes)
+	}
+	// Replaced, however the domain is written.
+	if w := adminDo(h, http.MethodPut, "/routes/.example.org.", "secret", `["192.0.2.5:53"]`); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT again: %v %v", w.Code, w.Body)
+	}
+	if backends, _ := loadSettings().router.Match("www.example.org.", dns.TypeA); len(backends) != 1 || backends[0] != "192.0.2.5:53" {
+		t.Errorf("route replaced matched %v, want 192.0.2.5:53", backends)
+	}
+	if w := adminDo(h, http.MethodDelete, "/routes/.example.org.", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %v %v", w.Code, w.Body)
+	}
+	if backends, _ := loadSettings().router.Match("www.example.org.", dns.TypeA); len(backends) != 1 || backends[0] != "192.0.2.1:53" {
+		t.Errorf("route removed still matched %v, want the default", backends)
+	}
+
+	saved, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		{http.MethodGet, "/routes", "", "", http.StatusUnauthorized},
+		{http.MethodPut, "/routes/.example.net.", "wrong", `["192.0.2.3:53"]`, http.StatusUnauthorized},
+		{http.MethodPut, "/routes/.example.net.", "secret", `"192.0.2.3:53"`, http.StatusBadRequest},
+		{http.MethodPut, "/routes/.example.net.", "secret", `["nowhere"]`, http.StatusBadRequest},
+		{http.MethodPut, "/routes/.example.net.", "secret", `[]`, http.StatusBadRequest},
+		{http.MethodDelete, "/routes/.example.net.", "secret", "", http.StatusNotFound},
+		// route-dnssec names it, the configuration would be invalid.
+		{http.MethodDelete, "/routes/.example.com.", "secret", "", http.StatusBadRequest},
+		{http.MethodPost, "/routes", "secret", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/routes/.example.net.", "secret", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/", "secret", "", http.StatusNotFound},
+	} {
+		if w := adminDo(h, tt.method, tt.path, tt.token, tt.body); w.Code != tt.code {
+			t.Errorf("%v %v %v: got %v, want %v", tt.method, tt.path, tt.body, w.Code, tt.code)
+		}
+	}
+	if now, _ := ioutil.ReadFile(*configFile); string(now) != string(saved) {
+		t.Errorf("config file changed by rejected requests:\n%s\nwant:\n%s", now, saved)
+	}
+	if backends, _ := loadSettings().router.Match("www.example.com.", dns.TypeA); len(backends) != 1 {
+		t.Errorf("route of a rejected removal matched %v, want it kept", backends)
+	}
+}
+
+func TestValidateAdmin(t *testing.T) {
+	setFlag(t, "admin-address", "127.0.0.1:8054")
+	setFlag(t, "config", "")
+	setFlag(t, "admin-token", "")
+	if err := validateAdmin(); err == nil {
+		t.Error("admin API without token accepted")
+	}
+	setFlag(t, "admin-token", "secret")
+	if err := validateAdmin(); err == nil {
+		t.Error("admin API without config file accepted")
+	}
+	setFlag(t, "config", writeFile(t, "config.yaml", "default: 192.0.2.1:53\n"))
+	if err := validateAdmin(); err != nil {
+		t.Errorf("validateAdmin: %v", err)
+	}
+}
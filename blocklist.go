@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	blocklistFile = flag.String("blocklist", "",
+		"File of domains to block, one per line: example.com. blocks the name, "+
+			".example.com. or *.example.com. its subdomains")
+	blocklistSinkhole = flag.String("blocklist-sinkhole", "",
+		"IP to answer blocked queries with instead of NXDOMAIN")
+)
+
+// blockTTL is the TTL of the answers to blocked queries.
+const blockTTL = 60
+
+// blocklist is a set of blocked names and suffixes.
+type blocklist struct {
+	names    map[string]bool
+	suffixes map[string]bool // with a leading dot
+}
+
+// loadBlocklist reads a blocklist file. Empty lines and comments starting
+// with # are ignored.
+func loadBlocklist(path string) (*blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := &blocklist{names: make(map[string]bool), suffixes: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "*.") {
+			line = line[1:]
+		}
+		name := normalizeDomain(line)
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(name, ".")); !ok {
+			return nil, fmt.Errorf("%v:%d: invalid domain %q", path, n, line)
+		}
+		if strings.HasPrefix(name, ".") {
+			b.suffixes[name] = true
+		} else {
+			b.names[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// blocked returns whether the lowercase name is blocked.
+func (b *blocklist) blocked(name string) bool {
+	if b == nil {
+		return false
+	}
+	if b.names[name] {
+		return true
+	}
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '.' && b.suffixes[name[i:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of entries of the blocklist.
+func (b *blocklist) len() int {
+	return len(b.names) + len(b.suffixes)
+}
+
+// answerBlocked answers a blocked query with NXDOMAIN, or the sinkhole IP
+// if any and the query type matches its family.
+func answerBlocked(w dns.ResponseWriter, req *dns.Msg, sinkhole net.IP) {
+	m := new(dns.Msg)
+	if sinkhole == nil {
+		m.SetRcode(req, dns.RcodeNameError)
+		writeLocal(w, req, m)
+		return
+	}
+	m.SetReply(req)
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockTTL}
+	if ip4 := sinkhole.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+	} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: sinkhole})
+	}
+	writeLocal(w, req, m)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	breakerErrorRate = flag.Float64("circuit-breaker-error-rate", 0,
+		"Rate of failed queries to a backend within -circuit-breaker-window at which it is skipped "+
+			"for -circuit-breaker-cooldown (0 disables the circuit breaker)")
+	breakerWindow = flag.Duration("circuit-breaker-window", 30*time.Second,
+		"Window over which the error rate of a backend is measured")
+	breakerMinQueries = flag.Int("circuit-breaker-min-queries", 10,
+		"Queries to a backend within a window below which its circuit breaker does not open")
+	breakerCooldown = flag.Duration("circuit-breaker-cooldown", 30*time.Second,
+		"Time a backend is skipped once its circuit breaker opened, before a single query probes it")
+
+	breakers *circuitBreakers // nil if the circuit breaker is disabled
+)
+
+// breakerState is the state of the circuit breaker of a backend.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // queries are sent
+	breakerHalfOpen                     // a single query probes the backend
+	breakerOpen                         // the backend is skipped
+)
+
+// errBreakerOpen is the error of a query not sent to a backend whose circuit
+// breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breaker is the circuit breaker of a backend.
+type breaker struct {
+	state       breakerState
+	windowStart time.Time
+	queries     int // within the window
+	failures    int
+	openUntil   time.Time
+	probing     bool // the probe of a half-open breaker is in flight
+}
+
+// circuitBreakers skip the backends failing too many queries: once the rate
+// of failures within a window reaches errorRate, a backend is open, skipped
+// for cooldown, then half-open: a single query probes it, closing the breaker
+// if it succeeds or opening it again if it fails.
+type circuitBreakers struct {
+	errorRate  float64
+	window     time.Duration
+	minQueries int
+	cooldown   time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*breaker
+}
+
+func newCircuitBreakers(errorRate float64, window time.Duration, minQueries int, cooldown time.Duration) (*circuitBreakers, error) {
+	if errorRate <= 0 || errorRate > 1 {
+		return nil, fmt.Errorf("invalid -circuit-breaker-error-rate, must be between 0 and 1")
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid -circuit-breaker-window, must be positive")
+	}
+	if minQueries <= 0 {
+		return nil, fmt.Errorf("invalid -circuit-breaker-min-queries, must be positive")
+	}
+	if cooldown <= 0 {
+		return nil, fmt.Errorf("invalid -circuit-breaker-cooldown, must be positive")
+	}
+	return &circuitBreakers{
+		errorRate:  errorRate,
+		window:     window,
+		minQueries: minQueries,
+		cooldown:   cooldown,
+		backends:   make(map[string]*breaker),
+	}, nil
+}
+
+// allow returns whether a query may be sent to addr at now. Once the cooldown
+// of an open breaker elapsed the query allowed is its probe, whose result
+// must be recorded.
+func (c *circuitBreakers) allow(addr string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.backends[addr]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		log.Printf("backend %v circuit breaker half-open, probing", addr)
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record records the result of a query allowed to addr at now: err, or the
+// rcode of resp, SERVFAIL being a failure. Queries cancelled for their
+// client, once answered by another backend, or shed under the QPS limit of
+// addr tell nothing of it.
+func (c *circuitBreakers) record(addr string, resp *dns.Msg, err error, now time.Time) {
+	if err == nil && resp != nil && resp.Rcode == dns.RcodeServerFailure {
+		err = fmt.Errorf("rcode %v", dns.RcodeToString[resp.Rcode])
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.backends[addr]
+	if !ok {
+		b = &breaker{windowStart: now}
+		c.backends[addr] = b
+	}
+	if errors.Is(err, context.Canceled) || err == errPaced || err == errQueueFull {
+		b.probing = false
+		return
+	}
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = false
+		if err != nil {
+			log.Printf("backend %v circuit breaker open again, probe failed: %v", addr, err)
+			b.state = breakerOpen
+			b.openUntil = now.Add(c.cooldown)
+			return
+		}
+		log.Printf("backend %v circuit breaker closed", addr)
+		*b = breaker{windowStart: now}
+		return
+	case breakerOpen:
+		// A query allowed before the breaker opened.
+		return
+	}
+	if now.Sub(b.windowStart) >= c.window {
+		b.windowStart, b.queries, b.failures = now, 0, 0
+	}
+	b.queries++
+	if err != nil {
+		b.failures++
+	}
+	if b.queries >= c.minQueries && float64(b.failures) >= c.errorRate*float64(b.queries) {
+		log.Printf("backend %v circuit breaker open for %v after %d failed of %d queries",
+			addr, c.cooldown, b.failures, b.queries)
+		b.state = breakerOpen
+		b.openUntil = now.Add(c.cooldown)
+	}
+}
+
+// states returns the state of the breaker of every backend queried.
+func (c *circuitBreakers) states() map[string]breakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]breakerState, len(c.backends))
+	for addr, b := range c.backends {
+		states[addr] = b.state
+	}
+	return states
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	captureLog(t)
+	const addr = "192.0.2.1:53"
+	c, err := newCircuitBreakers(0.5, time.Minute, 4, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	failed := errors.New("timeout")
+	servfail := new(dns.Msg)
+	servfail.Rcode = dns.RcodeServerFailure
+	ok := new(dns.Msg)
+	state := func(want breakerState, what string) {
+		t.Helper()
+		if got := c.states()[addr]; got != want {
+			t.Fatalf("%v: state %v, want %v", what, got, want)
+		}
+	}
+
+	// Failures of another window are forgotten.
+	c.record(addr, nil, failed, now)
+	c.record(addr, servfail, nil, now)
+	now = now.Add(time.Minute)
+	c.record(addr, ok, nil, now)
+	c.record(addr, nil, failed, now)
+	state(breakerClosed, "1 failed of 2 queries in the window")
+	// Queries shed or cancelled tell nothing of the backend.
+	c.record(addr, nil, context.Canceled, now)
+	c.record(addr, nil, errQueueFull, now)
+	state(breakerClosed, "queries cancelled")
+	c.record(addr, servfail, nil, now)
+	state(breakerClosed, "2 failed of 3 queries, under -circuit-breaker-min-queries")
+	c.record(addr, ok, nil, now)
+	state(breakerOpen, "2 failed of 4 queries")
+
+	if c.allow(addr, now.Add(9*time.Second)) {
+		t.Error("query allowed within the cooldown")
+	}
+	now = now.Add(10 * time.Second)
+	if !c.allow(addr, now) {
+		t.Fatal("probe not allowed after the cooldown")
+	}
+	state(breakerHalfOpen, "probe")
+	if c.allow(addr, now) {
+		t.Error("second query allowed while probing")
+	}
+	c.record(addr, nil, context.Canceled, now)
+	if !c.allow(addr, now) {
+		t.Fatal("probe not allowed again after the previous one was cancelled")
+	}
+	c.record(addr, servfail, nil, now)
+	state(breakerOpen, "probe failed")
+	if c.allow(addr, now.Add(9*time.Second)) {
+		t.Error("query allowed within the cooldown after a failed probe")
+	}
+	now = now.Add(10 * time.Second)
+	if !c.allow(addr, now) {
+		t.Fatal("probe not allowed after the second cooldown")
+	}
+	c.record(addr, ok, nil, now)
+	state(breakerClosed, "probe succeeded")
+	for i := 0; i < 3; i++ {
+		if !c.allow(addr, now) {
+			t.Fatal("query not allowed once closed")
+		}
+		c.record(addr, nil, failed, now)
+	}
+	state(breakerClosed, "3 failed queries of a new window, under -circuit-breaker-min-queries")
+}
+
+func TestCircuitBreakerProxy(t *testing.T) {
+	captureLog(t)
+	h, n := counting(answerRcode(dns.RcodeServerFailure))
+	up := startUpstream(t, h)
+	useBreakers(t, 3)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	before := breakerRejections.snapshot()[up]
+	for i := 0; i < 5; i++ {
+		if r := query(t, "udp", addr, fmt.Sprintf("www%d.example.com.", i), dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+			t.Errorf("query %d: got %v, want SERVFAIL", i, dns.RcodeToString[r.Rcode])
+		}
+	}
+	if got := atomic.LoadInt64(n); got != 3 {
+		t.Errorf("backend queried %d times, want 3 until its circuit breaker opened", got)
+	}
+	if got := breakerRejections.snapshot()[up] - before; got != 2 {
+		t.Errorf("%d queries counted rejected by the circuit breaker, want 2", got)
+	}
+	if got := breakerStates()[up]; got != float64(breakerOpen) {
+		t.Errorf("circuit breaker state metric %v, want open (%d)", got, breakerOpen)
+	}
+}
+
+func TestCircuitBreakerInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		rate       float64
+		window     time.Duration
+		minQueries int
+		cooldown   time.Duration
+	}{
+		{1.5, time.Minute, 10, time.Minute},
+		{-0.5, time.Minute, 10, time.Minute},
+		{0.5, 0, 10, time.Minute},
+		{0.5, time.Minute, 0, time.Minute},
+		{0.5, time.Minute, 10, 0},
+	} {
+		if _, err := newCircuitBreakers(tt.rate, tt.window, tt.minQueries, tt.cooldown); err == nil {
+			t.Errorf("newCircuitBreakers%v accepted", tt)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheKey identifies a cached response. The upstream is part of the key so
+// that routes merging several backends still combine their answers, the
+// client subnet so that answers tailored to it are not served to others, and
+// whether it was validated so that unvalidated answers are not served to
+// routes validating DNSSEC, and the TTL set by the route, if any, so that it
+// does not apply to the other routes of the backend. The DO and CD bits of the query are too, so that
+// answers with signatures are not served to clients which did not ask for
+// them and answers not checked by the backend to clients which wanted them
+// checked.
+type cacheKey struct {
+	addr      string
+	name      string
+	qtype     uint16
+	qclass    uint16
+	subnet    string
+	validated bool
+	ttl       uint32 // of the route, 0 if it keeps those of the backend
+	do        bool
+	cd        bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	expire      time.Time
+	hits        int
+	prefetching bool // a refresh was triggered
+}
+
+// prefetchMinHits is the number of hits making an entry popular enough to be
+// prefetched.
+const prefetchMinHits = 2
+
+// maxStale is how long expired entries can be served stale, within the 1 to
+// 3 days recommended by RFC 8767.
+const maxStale = 24 * time.Hour
+
+// cache is a size-bounded LRU cache of upstream responses which honors the
+// TTL of the records it holds.
+type cache struct {
+	mu       sync.Mutex
+	size     int
+	prefetch float64       // share of the TTL after which popular entries are refreshed, 0 disables
+	stale    time.Duration // how long expired entries are kept to be served stale
+	entries  map[cacheKey]*list.Element
+	lru      *list.List // front is most recently used
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func newCacheKey(addr string, req *dns.Msg, validated bool, ttl uint32) cacheKey {
+	q := req.Question[0]
+	key := cacheKey{addr: addr, name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, validated: validated,
+		ttl: ttl, cd: req.CheckingDisabled}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		if e := findECS(opt); e != nil {
+			key.subnet = fmt.Sprintf("%v/%d", e.Address, e.SourceNetmask)
+		}
+	}
+	return key
+}
+
+// get returns a copy of the response cached for req sent to addr, validated
+// or not and for a route setting the TTL routeTTL or 0, with its TTLs
+// decremented by the time spent in the cache, or nil.
+// It also returns whether the caller should refresh the entry, a popular one
+// close to its expiry, which is only the case for one of them.
+func (c *cache) get(addr string, req *dns.Msg, validated bool, routeTTL uint32) (*dns.Msg, bool) {
+	if !cacheable(req) {
+		return nil, false
+	}
+	key := newCacheKey(addr, req, validated, routeTTL)
+	now := time.Now()
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expire) {
+		if now.After(e.expire.Add(c.stale)) {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	e.hits++
+	prefetch := c.prefetch > 0 && !e.prefetching && e.hits >= prefetchMinHits &&
+		now.Sub(e.stored) >= time.Duration(c.prefetch*float64(e.expire.Sub(e.stored)))
+	if prefetch {
+		e.prefetching = true
+	}
+	c.mu.Unlock()
+
+	m := e.msg.Copy()
+	m.Id = req.Id
+	m.Question = req.Question
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	forEachRR(m, func(rr dns.RR) {
+		h := rr.Header()
+		if h.Ttl > elapsed {
+			h.Ttl -= elapsed
+		} else {
+			h.Ttl = 0
+		}
+	})
+	return m, prefetch
+}
+
+// getStale returns a copy of the response cached for req sent to addr,
+// validated or not and for a route setting the TTL routeTTL or 0, even if it
+// expired less than c.stale ago, with its TTLs set to ttl, or nil.
+func (c *cache) getStale(addr string, req *dns.Msg, validated bool, routeTTL, ttl uint32) *dns.Msg {
+	if !cacheable(req) {
+		return nil
+	}
+	key := newCacheKey(addr, req, validated, routeTTL)
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expire.Add(c.stale)) {
+		c.remove(el)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	m := e.msg.Copy()
+	m.Id = req.Id
+	m.Question = req.Question
+	forEachRR(m, func(rr dns.RR) {
+		rr.Header().Ttl = ttl
+	})
+	return m
+}
+
+// set stores resp as the response to req sent to addr, validated or not and
+// for a route setting the TTL routeTTL or 0, if it is cacheable.
+func (c *cache) set(addr string, req *dns.Msg, validated bool, routeTTL uint32, resp *dns.Msg) {
+	if isTransfer(req) || resp.Truncated || !cacheable(req) {
+		return
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+	msg := resp.Copy()
+	var ttl uint32
+	var ok bool
+	if isNegative(msg) {
+		ttl, ok = negativeTTL(msg)
+	} else {
+		ttl, ok = minTTL(msg)
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		key:    newCacheKey(addr, req, validated, routeTTL),
+		msg:    msg,
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// len returns the number of cached responses.
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove deletes an element, c.mu must be held.
+func (c *cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// cacheable returns whether the response to req can be cached: only queries
+// are, not NOTIFY or UPDATE messages. EDNS options unknown to the proxy are
+// forwarded to the backend as they are, and as the response may depend on
+// them it is neither served from nor stored in the cache. The client subnet
+// is part of the key, and the other options known do not change the answer.
+func cacheable(req *dns.Msg) bool {
+	if req.Opcode != dns.OpcodeQuery {
+		return false
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return true
+	}
+	for _, o := range opt.Option {
+		switch o.Option() {
+		case dns.EDNS0COOKIE, dns.EDNS0SUBNET, dns.EDNS0NSID, dns.EDNS0PADDING, dns.EDNS0TCPKEEPALIVE:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// forEachRR calls f on every record of m except the OPT pseudo-record.
+func forEachRR(m *dns.Msg, f func(dns.RR)) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			f(rr)
+		}
+	}
+}
+
+// clampTTLs raises the TTLs of the records of m below min and lowers those
+// above max, unless max is 0. It is applied to responses before caching so
+// that cached entries expire with the TTLs served.
+func clampTTLs(m *dns.Msg, min, max uint32) {
+	if min == 0 && max == 0 {
+		return
+	}
+	forEachRR(m, func(rr dns.RR) {
+		h := rr.Header()
+		if h.Ttl < min {
+			h.Ttl = min
+		}
+		if max > 0 && h.Ttl > max {
+			h.Ttl = max
+		}
+	})
+}
+
+// setTTLs sets the TTLs of the records of m to ttl. Like clampTTLs it is
+// applied before caching.
+func setTTLs(m *dns.Msg, ttl uint32) {
+	forEachRR(m, func(rr dns.RR) {
+		rr.Header().Ttl = ttl
+	})
+}
+
+// minTTL returns the lowest TTL of the records in m, if it has any.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	forEachRR(m, func(rr dns.RR) {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	})
+	return ttl, found
+}
+
+// isNegative returns whether m is a negative response: NXDOMAIN, or NODATA
+// (no error but no answer).
+func isNegative(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+}
+
+// negativeTTL returns how long the negative response m can be cached per RFC
+// 2308: the lowest of the TTL and the MINIMUM field of the SOA record of its
+// authority section, to which the TTL of that record is lowered so that the
+// cached response counts down from it. Without SOA record it returns false,
+// such responses not being cached.
+func negativeTTL(m *dns.Msg) (uint32, bool) {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				soa.Hdr.Ttl = soa.Minttl
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func rrWithTTL(name string, ttl uint32) dns.RR {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IPv4(192, 0, 2, 1)}
+}
+
+func TestClampTTLs(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{rrWithTTL("a.example.", 5), rrWithTTL("b.example.", 300)}
+	m.Ns = []dns.RR{rrWithTTL("c.example.", 86400)}
+	m.Extra = []dns.RR{rrWithTTL("d.example.", 0)}
+	m.SetEdns0(1232, true)
+	optTTL := m.IsEdns0().Hdr.Ttl
+
+	clampTTLs(m, 60, 3600)
+	for _, tt := range []struct {
+		rr   dns.RR
+		want uint32
+	}{
+		{m.Answer[0], 60},
+		{m.Answer[1], 300},
+		{m.Ns[0], 3600},
+		{m.Extra[0], 60},
+	} {
+		if got := tt.rr.Header().Ttl; got != tt.want {
+			t.Errorf("TTL of %v = %d, want %d", tt.rr.Header().Name, got, tt.want)
+		}
+	}
+	if m.IsEdns0().Hdr.Ttl != optTTL || !m.IsEdns0().Do() {
+		t.Error("OPT record modified")
+	}
+
+	m.Answer = []dns.RR{rrWithTTL("a.example.", 5), rrWithTTL("b.example.", 86400)}
+	clampTTLs(m, 0, 0)
+	if m.Answer[0].Header().Ttl != 5 || m.Answer[1].Header().Ttl != 86400 {
+		t.Error("TTLs modified without -min-ttl nor -max-ttl")
+	}
+	clampTTLs(m, 60, 0)
+	if m.Answer[0].Header().Ttl != 60 || m.Answer[1].Header().Ttl != 86400 {
+		t.Error("-min-ttl alone capped TTLs")
+	}
+}
+
+func TestClampTTLsCached(t *testing.T) {
+	h, n := counting(answerTTL(5))
+	up := startUpstream(t, h)
+	setFlag(t, "min-ttl", "60")
+	setFlag(t, "max-ttl", "3600")
+	c := useCache(t, 10)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	for i := 0; i < 2; i++ {
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if len(r.Answer) != 1 || r.Answer[0].Header().Ttl < 59 || r.Answer[0].Header().Ttl > 60 {
+			t.Fatalf("query %d: answer %v, want a TTL raised to 60", i, r.Answer)
+		}
+	}
+	if got := atomic.LoadInt64(n); got != 1 {
+		t.Errorf("%d queries to the backend, want 1 the cache answering the other", got)
+	}
+
+	// The response handed out by the cache is a copy.
+	req := newQ("www.example.com.", dns.TypeA)
+	resp, _ := c.get(up, req, false, 0)
+	resp.Answer[0].Header().Ttl = 1
+	if again, _ := c.get(up, req, false, 0); again.Answer[0].Header().Ttl < 59 {
+		t.Errorf("cached TTL changed to %d by a client of the cache", again.Answer[0].Header().Ttl)
+	}
+}
+
+func TestRouteTTLs(t *testing.T) {
+	h, n := counting(answerTTL(5))
+	up, fixed := startUpstream(t, answerTTL(5)), startUpstream(t, h)
+	c := useCache(t, 10)
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .fixed.example.: [%v]\nroute-ttls:\n  .fixed.example.: 600\n", up, fixed))
+	addr := startProxy(t)
+
+	for i := 0; i < 2; i++ {
+		r := query(t, "udp", addr, "www.fixed.example.", dns.TypeA)
+		if len(r.Answer) != 1 || r.Answer[0].Header().Ttl < 599 || r.Answer[0].Header().Ttl > 600 {
+			t.Fatalf("query %d: answer %v, want a TTL of 600", i, r.Answer)
+		}
+	}
+	if got := atomic.LoadInt64(n); got != 1 {
+		t.Errorf("%d queries to the backend of the route, want 1 the cache answering the other", got)
+	}
+	if resp, _ := c.get(fixed, newQ("www.fixed.example.", dns.TypeA), false, 600); resp == nil || resp.Answer[0].Header().Ttl < 599 {
+		t.Errorf("cached %v, want the response for the TTL of the route", resp)
+	}
+
+	r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl > 5 {
+		t.Errorf("another route: answer %v, want the TTL of the backend", r.Answer)
+	}
+
+	for _, config := range []string{
+		"route-ttls:\n  .other.example.: 60\n",
+		"route-ttls:\n  .fixed.example.: 0\n",
+		"route-ttls:\n  .fixed.example.: -1\n",
+	} {
+		setFlag(t, "config", writeFile(t, "config.yaml", fmt.Sprintf("routes:\n  .fixed.example.: [%v]\n%v", fixed, config)))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("config %q accepted", config)
+		}
+	}
+}
+
+func TestRouteTTLsSharedBackend(t *testing.T) {
+	h, n := counting(answerTTL(5))
+	up := startUpstream(t, h)
+	useCache(t, 10)
+	setList(t, &clientGroupLists, "internal=10.0.0.0/8")
+	setList(t, &clientRouteLists, "internal:.example.com.="+up)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v]\nroute-ttls:\n  .example.com.: 600\n", up))
+
+	for i := 0; i < 2; i++ {
+		for _, tt := range []struct {
+			client   string
+			min, max uint32
+		}{
+			{"192.168.1.1:5353", 599, 600},
+			{"10.1.2.3:5353", 0, 5},
+		} {
+			w := newStubWriter("udp", tt.client)
+			route(w, newQ("www.example.com.", dns.TypeA))
+			if len(w.msgs) != 1 {
+				t.Fatalf("client %v: %d responses written, want 1", tt.client, len(w.msgs))
+			}
+			if r := w.msgs[0]; len(r.Answer) != 1 || r.Answer[0].Header().Ttl < tt.min || r.Answer[0].Header().Ttl > tt.max {
+				t.Errorf("query %d from %v: answer %v, want a TTL between %d and %d", i, tt.client, r.Answer, tt.min, tt.max)
+			}
+		}
+	}
+	if got := atomic.LoadInt64(n); got != 2 {
+		t.Errorf("%d queries to the backend, want 2 the cache answering the others per route", got)
+	}
+}
+
+// answerSigned answers every query with an A record, signed if the query has
+// the DO bit.
+func answerSigned(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	name := r.Question[0].Name
+	m.Answer = append(m.Answer, rrWithTTL(name, 300))
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		if opt.Do() {
+			m.Answer = append(m.Answer, &dns.RRSIG{
+				Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				TypeCovered: dns.TypeA, Algorithm: dns.ECDSAP256SHA256, Labels: 2, OrigTtl: 300,
+				Expiration: 2000000000, Inception: 1000000000, KeyTag: 1, SignerName: "example.", Signature: "AAAA",
+			})
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func hasRRSIG(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCacheKeyDNSSECBits(t *testing.T) {
+	const addr = "192.0.2.53:53"
+	c := newCache(10)
+	c.stale = maxStale
+	do := newQ("www.example.", dns.TypeA)
+	do.SetEdns0(1232, true)
+	resp := new(dns.Msg)
+	resp.SetReply(do)
+	resp.Answer = []dns.RR{rrWithTTL("www.example.", 300)}
+	c.set(addr, do, false, 0, resp)
+
+	noEDNS := newQ("www.example.", dns.TypeA)
+	noDO := newQ("www.example.", dns.TypeA)
+	noDO.SetEdns0(1232, false)
+	cd := do.Copy()
+	cd.CheckingDisabled = true
+	for name, req := range map[string]*dns.Msg{"without EDNS": noEDNS, "DO=0": noDO, "CD=1": cd} {
+		if m, _ := c.get(addr, req, false, 0); m != nil {
+			t.Errorf("query %v served the entry of a DO=1 CD=0 query", name)
+		}
+		if m := c.getStale(addr, req, false, 0, 30); m != nil {
+			t.Errorf("query %v served the stale entry of a DO=1 CD=0 query", name)
+		}
+	}
+	if m, _ := c.get(addr, do, false, 0); m == nil {
+		t.Error("DO=1 query not served from the cache")
+	}
+}
+
+func TestCacheNoSignaturesWithoutDO(t *testing.T) {
+	h, n := counting(answerSigned)
+	up := startUpstream(t, h)
+	useCache(t, 10)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	do := newQ("www.example.", dns.TypeA)
+	do.SetEdns0(1232, true)
+	if r := ask(t, "udp", addr, do); !hasRRSIG(r) {
+		t.Fatal("DO=1 query answered without signatures")
+	}
+	for _, req := range []*dns.Msg{newQ("www.example.", dns.TypeA), ednsQ("www.example.", dns.TypeA, dns.ClassINET, 1232)} {
+		if r := ask(t, "udp", addr, req); hasRRSIG(r) {
+			t.Errorf("DO=0 query answered with the signatures cached for DO=1: %v", r.Answer)
+		}
+	}
+	if r := ask(t, "udp", addr, do); !hasRRSIG(r) {
+		t.Error("DO=1 query answered without signatures from the cache")
+	}
+	// The DO=0 queries share an entry, and the DO=1 one is still cached.
+	if got := atomic.LoadInt64(n); got != 2 {
+		t.Errorf("%d queries to the backend, want 2", got)
+	}
+}
+
+// answerNegative answers every query with rcode and no answer, with a SOA
+// record of TTL ttl and MINIMUM minttl in the authority section unless ttl
+// is 0.
+func answerNegative(rcode int, ttl, minttl uint32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if ttl > 0 {
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+				Ns:  "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: 1,
+				Refresh: 3600, Retry: 600, Expire: 86400, Minttl: minttl,
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	for _, tt := range []struct {
+		ttl, minttl, want uint32
+	}{
+		{3600, 300, 300},
+		{60, 300, 60},
+		{300, 300, 300},
+	} {
+		w := newStubWriter("udp", "127.0.0.1:5353")
+		answerNegative(dns.RcodeNameError, tt.ttl, tt.minttl)(w, newQ("www.example.com.", dns.TypeA))
+		m := w.msgs[0]
+		if !isNegative(m) {
+			t.Fatal("NXDOMAIN not negative")
+		}
+		got, ok := negativeTTL(m)
+		if !ok || got != tt.want || m.Ns[0].Header().Ttl != tt.want {
+			t.Errorf("negativeTTL of SOA TTL %d MINIMUM %d = %d, %v with SOA TTL %d; want %d",
+				tt.ttl, tt.minttl, got, ok, m.Ns[0].Header().Ttl, tt.want)
+		}
+	}
+	if _, ok := negativeTTL(new(dns.Msg)); ok {
+		t.Error("negativeTTL of a response without SOA succeeded")
+	}
+	if isNegative(&dns.Msg{Answer: []dns.RR{rrWithTTL("www.example.com.", 300)}}) {
+		t.Error("response with an answer is negative")
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	nx, nNX := counting(answerNegative(dns.RcodeNameError, 3600, 1))
+	nodata, nNodata := counting(answerNegative(dns.RcodeSuccess, 0, 0))
+	useCache(t, 10)
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .nodata.example.: [%v]\n", startUpstream(t, nx), startUpstream(t, nodata)))
+	addr := startProxy(t)
+
+	for i := 0; i < 3; i++ {
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+			t.Fatalf("query %d: got %v %v, want NXDOMAIN with the SOA", i, dns.RcodeToString[r.Rcode], r.Ns)
+		}
+		if i > 0 && r.Ns[0].Header().Ttl > 1 {
+			t.Errorf("cached response %d: SOA TTL %d, want at most its MINIMUM 1", i, r.Ns[0].Header().Ttl)
+		}
+	}
+	if got := atomic.LoadInt64(nNX); got != 1 {
+		t.Errorf("%d NXDOMAIN queries to the backend, want 1 the cache answering the others", got)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if r := query(t, "udp", addr, "www.example.com.", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Fatalf("after expiry: got %v, want NXDOMAIN", dns.RcodeToString[r.Rcode])
+	}
+	if got := atomic.LoadInt64(nNX); got != 2 {
+		t.Errorf("%d NXDOMAIN queries to the backend after the negative TTL, want 2", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		query(t, "udp", addr, "www.nodata.example.", dns.TypeA)
+	}
+	if got := atomic.LoadInt64(nNodata); got != 2 {
+		t.Errorf("%d NODATA queries without SOA to the backend, want 2 as not cached", got)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	h, n := counting(answerTTL(2))
+	up := startUpstream(t, h)
+	c := useCache(t, 10)
+	c.prefetch = 0.5
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	query(t, "udp", addr, "www.example.com.", dns.TypeA)
+	// Not yet at half of the TTL.
+	for i := 0; i < 3; i++ {
+		query(t, "udp", addr, "www.example.com.", dns.TypeA)
+	}
+	if got := atomic.LoadInt64(n); got != 1 {
+		t.Fatalf("%d queries to the backend before the prefetch threshold, want 1", got)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+			r, _, err := client.Exchange(newQ("www.example.com.", dns.TypeA), addr)
+			if err != nil || len(r.Answer) != 1 {
+				t.Errorf("query past the threshold: %v %v, want the cached answer", err, r)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the prefetch", func() bool { return atomic.LoadInt64(n) >= 2 })
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt64(n); got != 2 {
+		t.Errorf("%d queries to the backend after 20 concurrent hits past the threshold, want a single prefetch", got)
+	}
+	// The refreshed entry counts down from the whole TTL again.
+	waitFor(t, "the refreshed entry", func() bool {
+		resp, _ := c.get(up, newQ("www.example.com.", dns.TypeA), false, 0)
+		return resp != nil && resp.Answer[0].Header().Ttl == 2
+	})
+}
+
+// switchable answers with h unless down is set, then not at all.
+func switchable(h dns.HandlerFunc) (dns.HandlerFunc, *int32) {
+	down := new(int32)
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.LoadInt32(down) == 0 {
+			h(w, r)
+		}
+	}, down
+}
+
+func TestServeStale(t *testing.T) {
+	setFlag(t, "serve-stale-ttl", "5")
+	setFlag(t, "timeout", "100ms")
+	setFlag(t, "strategy", strategyRoundRobin)
+
+	t.Run("stale", func(t *testing.T) {
+		h, down := switchable(answerTTL(1))
+		h2, down2 := switchable(answerTTL(1))
+		up, up2 := startUpstream(t, h), startUpstream(t, h2)
+		c := useCache(t, 10)
+		c.stale = maxStale
+		useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .example.com.: [%v, %v]\n", up, up, up2))
+		addr := startProxy(t)
+
+		// Cached from each backend of the route.
+		for _, name := range []string{"www.example.org.", "www.example.com.", "www.example.com."} {
+			if r := query(t, "udp", addr, name, dns.TypeA); len(r.Answer) != 1 {
+				t.Fatalf("%v: got %v, want the answer", name, r.Answer)
+			}
+		}
+		time.Sleep(1100 * time.Millisecond)
+
+		atomic.StoreInt32(down, 1)
+		before := staleResponses.snapshot()[""]
+		r := query(t, "udp", addr, "www.example.org.", dns.TypeA)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 5 {
+			t.Errorf("backend down: got %v %v, want the stale answer with the TTL of -serve-stale-ttl", dns.RcodeToString[r.Rcode], r.Answer)
+		}
+		if n := staleResponses.snapshot()[""] - before; n != 1 {
+			t.Errorf("%d stale responses counted, want 1", n)
+		}
+		// Stale answers only come after all the backends failed.
+		for i := 0; i < 2; i++ {
+			r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+			if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 1 {
+				t.Errorf("query %d with a backend of the route down: got %v, want the fresh answer of the other", i, r.Answer)
+			}
+		}
+		atomic.StoreInt32(down2, 1)
+		time.Sleep(1100 * time.Millisecond)
+		if r := query(t, "udp", addr, "www.example.com.", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 5 {
+			t.Errorf("all backends of the route down: got %v, want the stale answer", r.Answer)
+		}
+	})
+
+	t.Run("without -serve-stale", func(t *testing.T) {
+		h, down := switchable(answerTTL(1))
+		up := startUpstream(t, h)
+		useCache(t, 10)
+		useConfig(t, fmt.Sprintf("default: %v\n", up))
+		addr := startProxy(t)
+		if r := query(t, "udp", addr, "www.example.org.", dns.TypeA); len(r.Answer) != 1 {
+			t.Fatalf("got %v, want the answer", r.Answer)
+		}
+		time.Sleep(1100 * time.Millisecond)
+		atomic.StoreInt32(down, 1)
+		if r := query(t, "udp", addr, "www.example.org.", dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+			t.Errorf("got %v, want SERVFAIL", dns.RcodeToString[r.Rcode])
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	captureFile = flag.String("capture", "",
+		"File to dump every query and its response to in presentation format, for debugging")
+	captureMaxSize = flag.Int64("capture-max-size", 100<<20,
+		"Size in bytes of the -capture file after which it is rotated to file.1")
+
+	capture *captureWriter // nil if capture is disabled
+)
+
+// captureWriter dumps queries and their responses to a file from its own
+// goroutine, like the query log: dumps are dropped if it falls behind and
+// failures to write are logged, never failing queries.
+type captureWriter struct {
+	path    string
+	maxSize int64
+	f       *os.File // nil after a failure, reopened on the next dump
+	size    int64
+	dumps   chan string
+	done    sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+func newCaptureWriter(path string, maxSize int64) (*captureWriter, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid -capture-max-size, must be positive")
+	}
+	c := &captureWriter{path: path, maxSize: maxSize, dumps: make(chan string, 1024)}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	c.done.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// open opens the file to append to it.
+func (c *captureWriter) open() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.f, c.size = f, fi.Size()
+	return nil
+}
+
+// rotate renames the file to file.1, replacing the previous one, and opens a
+// new one.
+func (c *captureWriter) rotate() error {
+	c.f.Close()
+	c.f = nil
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+// dump queues the query req of the client and its response resp.
+func (c *captureWriter) dump(id string, client net.Addr, req, resp *dns.Msg) {
+	if c == nil {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, ";; %v id=%s client=%v\n", time.Now().Format(time.RFC3339Nano), id, client)
+	if req != nil {
+		fmt.Fprintf(&b, ";; QUERY\n%v\n", req)
+	}
+	fmt.Fprintf(&b, ";; RESPONSE\n%v\n\n", resp)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.dumps <- b.String():
+	default:
+		c.dropped++
+	}
+}
+
+func (c *captureWriter) run() {
+	defer c.done.Done()
+	for d := range c.dumps {
+		if err := c.write(d); err != nil {
+			captureErrorLog.printf("capture to %v failed: %v", c.path, err)
+		}
+	}
+	if c.f != nil {
+		c.f.Close()
+	}
+}
+
+func (c *captureWriter) write(d string) error {
+	if c.f == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+	if c.size > 0 && c.size+int64(len(d)) > c.maxSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.f.WriteString(d)
+	c.size += int64(n)
+	return err
+}
+
+// close flushes the queued dumps and closes the file.
+func (c *captureWriter) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.closed = true
+	close(c.dumps)
+	c.mu.Unlock()
+	c.done.Wait()
+	if c.dropped > 0 {
+		log.Printf("capture dropped %d dumps", c.dropped)
+	}
+}
+
+// captureErrorLog logs the failures to capture, which repeat until the file
+// can be written again.
+var captureErrorLog = &limitedLog{interval: time.Second}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useCapture captures to path, rotated after maxSize bytes, for the duration
+// of the test.
+func useCapture(t *testing.T, path string, maxSize int64) *captureWriter {
+	t.Helper()
+	c, err := newCaptureWriter(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := capture
+	capture = c
+	t.Cleanup(func() { capture = old })
+	return c
+}
+
+func TestCaptureRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.log")
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	c := useCapture(t, path, 1000)
+	addr := startProxy(t)
+	for i := 0; i < 10; i++ {
+		query(t, "udp", addr, fmt.Sprintf("q%d.example.com.", i), dns.TypeA)
+	}
+	c.close()
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("no rotated file: %v", err)
+	}
+	for name, b := range map[string][]byte{path: current, path + ".1": rotated} {
+		if len(b) == 0 || len(b) > 1000 {
+			t.Errorf("%v has %d bytes, want at most -capture-max-size 1000", name, len(b))
+		}
+	}
+	if !strings.Contains(string(current), "q9.example.com.\t300\tIN\tA\t192.0.2.1") ||
+		!strings.Contains(string(current), ";; QUERY") || !strings.Contains(string(current), ";; RESPONSE") {
+		t.Errorf("last query and response not dumped in presentation format:\n%s", current)
+	}
+	if strings.Contains(string(rotated), "q9.example.com.") {
+		t.Error("last query in the rotated file")
+	}
+
+	if _, err := newCaptureWriter(path, 0); err == nil {
+		t.Error("-capture-max-size 0 accepted")
+	}
+}
+
+func TestCaptureFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "capture")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	c := useCapture(t, filepath.Join(dir, "capture.log"), 300)
+	addr := startProxy(t)
+	buf := captureLog(t)
+	oldLog := captureErrorLog
+	captureErrorLog = &limitedLog{interval: time.Second}
+	t.Cleanup(func() { captureErrorLog = oldLog })
+	// Rotating and reopening the file fail.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if ips := answerIPs(query(t, "udp", addr, "www.example.com.", dns.TypeA)); len(ips) != 1 {
+			t.Errorf("query %d while capture fails: answer %v", i, ips)
+		}
+	}
+	c.close()
+	if !strings.Contains(buf.String(), "capture to "+filepath.Join(dir, "capture.log")+" failed") {
+		t.Errorf("capture failure not logged:\n%v", buf)
+	}
+	c.dump("00000000", &net.UDPAddr{}, nil, new(dns.Msg)) // after close, ignored
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	coalesceQueries = flag.Bool("coalesce-queries", false,
+		"Send identical queries in flight at once to a backend only once and share its response")
+
+	coalesced *coalescer // nil if queries are not coalesced
+)
+
+// coalesceKey identifies identical queries: those sharing a cache entry and
+// sent over the same transport.
+type coalesceKey struct {
+	cacheKey
+	transport string
+}
+
+// flight is an exchange in flight, whose response is shared once done.
+type flight struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// coalescer fetches a query from a backend only once while identical queries
+// wait for its response, such as the many clients of a popular name which
+// just expired from the cache.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[coalesceKey]*flight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: make(map[coalesceKey]*flight)}
+}
+
+// fetch is fetch, unless an identical query is in flight to addr in which
+// case its response is returned, shared being true: the outcome of the
+// exchange is then that of the query in flight, not of this one. A query
+// whose response may depend on EDNS options unknown to the proxy, like those
+// not cached, is always sent.
+func (c *coalescer) fetch(addr, transport string, opts routeOptions, req *dns.Msg) (resp *dns.Msg, shared bool, err error) {
+	if !cacheable(req) {
+		resp, err = fetch(addr, transport, opts, req)
+		return resp, false, err
+	}
+	key := coalesceKey{
+		cacheKey:  newCacheKey(addr, req, opts.dnssec, opts.ttl),
+		transport: transport,
+	}
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-opts.ctx.Done():
+			return nil, true, opts.ctx.Err()
+		}
+		if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+			// The query in flight was given up for its client only.
+			resp, err = fetch(addr, transport, opts, req)
+			return resp, false, err
+		}
+		if f.err != nil {
+			return nil, true, f.err
+		}
+		coalescedQueries.inc()
+		traceOf(opts.ctx).tracef("response from %v shared with an identical query", addr)
+		m := f.resp.Copy()
+		m.Id = req.Id
+		m.Question = req.Question
+		return m, true, nil
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	resp, err = fetch(addr, transport, opts, req)
+	if err == nil {
+		// The response is modified in reply to the client.
+		f.resp = resp.Copy()
+	}
+	f.err = err
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(f.done)
+	return resp, false, err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useCoalescer coalesces identical queries for the duration of the test.
+func useCoalescer(t *testing.T) {
+	old := coalesced
+	coalesced = newCoalescer()
+	t.Cleanup(func() { coalesced = old })
+}
+
+// useBreakers enables circuit breakers opening after minQueries failed, for
+// the duration of the test, and returns them.
+func useBreakers(t *testing.T, minQueries int) *circuitBreakers {
+	t.Helper()
+	b, err := newCircuitBreakers(1, time.Minute, minQueries, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := breakers
+	breakers = b
+	t.Cleanup(func() { breakers = old })
+	return b
+}
+
+// recorded returns the queries and failures recorded by b for addr.
+func recorded(b *circuitBreakers, addr string) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.backends[addr]; ok {
+		return s.queries, s.failures
+	}
+	return 0, 0
+}
+
+// held answers queries with rcode once open is closed, counting them.
+func held(open chan struct{}, rcode int) (dns.HandlerFunc, *int64) {
+	return counting(func(w dns.ResponseWriter, r *dns.Msg) {
+		<-open
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Rcode = rcode
+		if rcode == dns.RcodeSuccess {
+			m.Answer = append(m.Answer, rrWithTTL(r.Question[0].Name, 300))
+		}
+		w.WriteMsg(m)
+	})
+}
+
+// askAll sends A queries for names to addr at once, and returns their
+// responses. The backend counting its exchanges is held until the first
+// query reaches it and the others had time to wait for it.
+func askAll(t *testing.T, addr string, names []string, open chan struct{}, exchanges *int64) []*dns.Msg {
+	t.Helper()
+	resps := make([]*dns.Msg, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			c := &dns.Client{Timeout: 5 * time.Second}
+			resps[i], _, errs[i] = c.Exchange(newQ(name, dns.TypeA), addr)
+		}(i, name)
+	}
+	waitFor(t, "a query to the backend", func() bool { return atomic.LoadInt64(exchanges) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	close(open)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resps
+}
+
+func TestCoalesceQueries(t *testing.T) {
+	const clients = 10
+	useCoalescer(t)
+	b := useBreakers(t, 100)
+	open := make(chan struct{})
+	h, exchanges := held(open, dns.RcodeSuccess)
+	up := startUpstream(t, h)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	before := coalescedQueries.snapshot()[""]
+	names := make([]string, clients)
+	for i := range names {
+		names[i] = "www.example.com."
+	}
+	for i, r := range askAll(t, addr, names, open, exchanges) {
+		if ips := answerIPs(r); r.Rcode != dns.RcodeSuccess || len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Errorf("client %d: got %v %v, want the shared answer", i, dns.RcodeToString[r.Rcode], ips)
+		}
+	}
+	if got := atomic.LoadInt64(exchanges); got != 1 {
+		t.Errorf("%d exchanges with the backend for %d identical queries, want 1", got, clients)
+	}
+	if got := coalescedQueries.snapshot()[""] - before; got != clients-1 {
+		t.Errorf("%d coalesced queries counted, want %d", got, clients-1)
+	}
+	if queries, _ := recorded(b, up); queries != 1 {
+		t.Errorf("%d queries recorded by the circuit breaker, want the single exchange", queries)
+	}
+
+	// Queries for other names are not coalesced.
+	open = make(chan struct{})
+	h, exchanges = held(open, dns.RcodeSuccess)
+	useConfig(t, fmt.Sprintf("default: %v\n", startUpstream(t, h)))
+	askAll(t, addr, []string{"a.example.com.", "b.example.com.", "a.example.com."}, open, exchanges)
+	if got := atomic.LoadInt64(exchanges); got != 2 {
+		t.Errorf("%d exchanges with the backend for 2 names, want 2", got)
+	}
+}
+
+func TestCoalescedFailureRecordedOnce(t *testing.T) {
+	useCoalescer(t)
+	b := useBreakers(t, 2)
+	open := make(chan struct{})
+	h, exchanges := held(open, dns.RcodeServerFailure)
+	up := startUpstream(t, h)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	for _, r := range askAll(t, addr, []string{"www.example.com.", "www.example.com.", "www.example.com."}, open, exchanges) {
+		if r.Rcode != dns.RcodeServerFailure {
+			t.Errorf("got %v, want the shared SERVFAIL", dns.RcodeToString[r.Rcode])
+		}
+	}
+	// A single failure, under the 2 opening the breaker.
+	if queries, failures := recorded(b, up); queries != 1 || failures != 1 {
+		t.Errorf("circuit breaker recorded %d failed of %d queries, want 1 of 1", failures, queries)
+	}
+	if state := b.states()[up]; state != breakerClosed {
+		t.Errorf("circuit breaker %v after a single failed exchange, want closed", state)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	maxConcurrentUpstream = flag.Int("max-concurrent-upstream", 0,
+		"Maximum exchanges with upstreams in flight at once, further ones waiting for a free slot "+
+			"until the query times out (0 for no limit)")
+	maxConcurrentUpstreamReject = flag.Bool("max-concurrent-upstream-reject", false,
+		"Fail exchanges over -max-concurrent-upstream at once instead of waiting")
+
+	upstreamSlots *concurrencyLimiter // nil if exchanges are not limited
+)
+
+// upstreamInFlight is the number of exchanges with upstreams in flight.
+var upstreamInFlight int64
+
+// errUpstreamBusy is the error of exchanges over -max-concurrent-upstream.
+var errUpstreamBusy = errors.New("too many exchanges with upstreams in flight")
+
+// concurrencyLimiter is a semaphore bounding the exchanges in flight.
+type concurrencyLimiter struct {
+	slots  chan struct{}
+	reject bool // fail at once when there is no free slot
+}
+
+func newConcurrencyLimiter(max int, reject bool) (*concurrencyLimiter, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("invalid -max-concurrent-upstream %d, must be positive", max)
+	}
+	return &concurrencyLimiter{slots: make(chan struct{}, max), reject: reject}, nil
+}
+
+// acquire takes a slot, waiting until ctx is done unless l rejects at once.
+// Exchanges which could not get one are counted as rejected.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if !l.reject {
+		select {
+		case l.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// Another backend answered first.
+				return ctx.Err()
+			}
+		}
+	}
+	upstreamRejections.inc()
+	return errUpstreamBusy
+}
+
+// release frees a slot taken by acquire.
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// startExchange accounts for an exchange with an upstream, taking a slot if
+// they are limited. On success endExchange must be called once it is over.
+func startExchange(ctx context.Context) error {
+	if upstreamSlots != nil {
+		if err := upstreamSlots.acquire(ctx); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&upstreamInFlight, 1)
+	return nil
+}
+
+func endExchange() {
+	atomic.AddInt64(&upstreamInFlight, -1)
+	if upstreamSlots != nil {
+		upstreamSlots.release()
+	}
+}
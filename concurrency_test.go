@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useUpstreamSlots limits the exchanges in flight to max for the duration of
+// the test.
+func useUpstreamSlots(t *testing.T, max int, reject bool) {
+	t.Helper()
+	l, err := newConcurrencyLimiter(max, reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := upstreamSlots
+	upstreamSlots = l
+	t.Cleanup(func() { upstreamSlots = old })
+}
+
+// gated answers queries once open is closed, recording how many it had at
+// once at most.
+type gated struct {
+	open chan struct{}
+
+	mu           sync.Mutex
+	current, max int
+}
+
+func (g *gated) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	g.mu.Lock()
+	g.current++
+	if g.current > g.max {
+		g.max = g.current
+	}
+	g.mu.Unlock()
+	<-g.open
+	g.mu.Lock()
+	g.current--
+	g.mu.Unlock()
+	answerA("192.0.2.1")(w, r)
+}
+
+// exchangeAll runs n exchanges with addr at once and returns their errors.
+func exchangeAll(addr string, n int, timeout time.Duration) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			opts := routeOptions{timeout: timeout, ctx: ctx}
+			_, errs[i] = exchange(addr, "tcp", opts, newQ("example.com.", dns.TypeA))
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestMaxConcurrentUpstreamWait(t *testing.T) {
+	useUpstreamSlots(t, 2, false)
+	g := &gated{open: make(chan struct{})}
+	addr := startServer(t, g)
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		errs = exchangeAll(addr, 5, 5*time.Second)
+		close(done)
+	}()
+	waitFor(t, "2 exchanges in flight", func() bool { return atomic.LoadInt64(&upstreamInFlight) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	close(g.open)
+	<-done
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("exchange %d: %v, want the answer after waiting", i, err)
+		}
+	}
+	if g.max != 2 {
+		t.Errorf("backend had %d exchanges at once, want the limit of 2", g.max)
+	}
+	if n := atomic.LoadInt64(&upstreamInFlight); n != 0 {
+		t.Errorf("%d exchanges in flight after they are over", n)
+	}
+}
+
+func TestMaxConcurrentUpstreamReject(t *testing.T) {
+	useUpstreamSlots(t, 2, true)
+	g := &gated{open: make(chan struct{})}
+	addr := startServer(t, g)
+	before := upstreamRejections.snapshot()[""]
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		errs = exchangeAll(addr, 2, 5*time.Second)
+		close(done)
+	}()
+	waitFor(t, "2 exchanges in flight", func() bool { return atomic.LoadInt64(&upstreamInFlight) == 2 })
+	for i, err := range exchangeAll(addr, 3, 5*time.Second) {
+		if !errors.Is(err, errUpstreamBusy) {
+			t.Errorf("exchange %d over the limit: %v, want %v", i, err, errUpstreamBusy)
+		}
+	}
+	close(g.open)
+	<-done
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("exchange %d within the limit: %v", i, err)
+		}
+	}
+	if n := upstreamRejections.snapshot()[""] - before; n != 3 {
+		t.Errorf("%d rejections counted, want 3", n)
+	}
+}
+
+func TestMaxConcurrentUpstreamDeadline(t *testing.T) {
+	useUpstreamSlots(t, 1, false)
+	g := &gated{open: make(chan struct{})}
+	addr := startServer(t, g)
+	done := make(chan struct{})
+	go func() {
+		exchangeAll(addr, 1, 5*time.Second)
+		close(done)
+	}()
+	waitFor(t, "1 exchange in flight", func() bool { return atomic.LoadInt64(&upstreamInFlight) == 1 })
+	start := time.Now()
+	if err := exchangeAll(addr, 1, 100*time.Millisecond)[0]; !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("exchange waiting past its deadline: %v, want %v", err, errUpstreamBusy)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("exchange failed after %v, before its deadline", elapsed)
+	}
+	close(g.open)
+	<-done
+
+	if _, err := newConcurrencyLimiter(-1, false); err == nil {
+		t.Error("negative -max-concurrent-upstream accepted")
+	}
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the proxy configuration as loaded from a YAML, JSON or TOML file.
+// Values given on the command line take precedence over it. Empty values
+// are left out when it is saved by the admin API.
+type config struct {
+	Address       string              `yaml:"address,omitempty" json:"address,omitempty" toml:"address,omitempty"`
+	Default       string              `yaml:"default,omitempty" json:"default,omitempty" toml:"default,omitempty"`
+	DefaultQtype  map[string]string   `yaml:"default-qtype,omitempty" json:"default-qtype,omitempty" toml:"default-qtype,omitempty"`
+	Routes        map[string][]string `yaml:"routes,omitempty" json:"routes,omitempty" toml:"routes,omitempty"`
+	AllowTransfer []string            `yaml:"allow-transfer,omitempty" json:"allow-transfer,omitempty" toml:"allow-transfer,omitempty"`
+	AllowQuery    []string            `yaml:"allow-query,omitempty" json:"allow-query,omitempty" toml:"allow-query,omitempty"`
+	AllowQtypes   []string            `yaml:"allow-qtypes,omitempty" json:"allow-qtypes,omitempty" toml:"allow-qtypes,omitempty"`
+	AllowOpcodes  []string            `yaml:"allow-opcodes,omitempty" json:"allow-opcodes,omitempty" toml:"allow-opcodes,omitempty"`
+	RouteTimeouts map[string]string   `yaml:"route-timeouts,omitempty" json:"route-timeouts,omitempty" toml:"route-timeouts,omitempty"`
+
+	RouteTLSServerNames map[string]string      `yaml:"route-tls-servernames,omitempty" json:"route-tls-servernames,omitempty" toml:"route-tls-servernames,omitempty"`
+	UpstreamTLS         map[string]upstreamTLS `yaml:"upstream-tls,omitempty" json:"upstream-tls,omitempty" toml:"upstream-tls,omitempty"`
+	RouteDNSSEC         []string               `yaml:"route-dnssec,omitempty" json:"route-dnssec,omitempty" toml:"route-dnssec,omitempty"`
+	RouteStripAAAA      []string               `yaml:"route-strip-aaaa,omitempty" json:"route-strip-aaaa,omitempty" toml:"route-strip-aaaa,omitempty"`
+	RouteClearRD        []string               `yaml:"route-clear-rd,omitempty" json:"route-clear-rd,omitempty" toml:"route-clear-rd,omitempty"`
+	RouteLog            []string               `yaml:"route-log,omitempty" json:"route-log,omitempty" toml:"route-log,omitempty"`
+	RoutePadding        []string               `yaml:"route-padding,omitempty" json:"route-padding,omitempty" toml:"route-padding,omitempty"`
+
+	RouteQPS              map[string]float64 `yaml:"route-qps,omitempty" json:"route-qps,omitempty" toml:"route-qps,omitempty"`
+	RouteUpstreamQPS      map[string]float64 `yaml:"route-upstream-qps,omitempty" json:"route-upstream-qps,omitempty" toml:"route-upstream-qps,omitempty"`
+	RouteMaxResponseSizes map[string]int     `yaml:"route-max-response-sizes,omitempty" json:"route-max-response-sizes,omitempty" toml:"route-max-response-sizes,omitempty"`
+	RouteTTLs             map[string]int     `yaml:"route-ttls,omitempty" json:"route-ttls,omitempty" toml:"route-ttls,omitempty"`
+
+	ClientGroups map[string][]string            `yaml:"client-groups,omitempty" json:"client-groups,omitempty" toml:"client-groups,omitempty"`
+	ClientRoutes map[string]map[string][]string `yaml:"client-routes,omitempty" json:"client-routes,omitempty" toml:"client-routes,omitempty"`
+
+	Static     map[string][]string `yaml:"static,omitempty" json:"static,omitempty" toml:"static,omitempty"`
+	Overrides  map[string][]string `yaml:"overrides,omitempty" json:"overrides,omitempty" toml:"overrides,omitempty"`
+	LocalZones map[string]string   `yaml:"local-zones,omitempty" json:"local-zones,omitempty" toml:"local-zones,omitempty"`
+	ZoneKeys   map[string][]string `yaml:"zone-keys,omitempty" json:"zone-keys,omitempty" toml:"zone-keys,omitempty"`
+}
+
+// upstreamTLS are the TLS settings of a DNS-over-TLS backend: the CA file to
+// verify its certificate against instead of the system ones, the pins of its
+// public key, and the name to verify it against.
+type upstreamTLS struct {
+	CAFile     string   `yaml:"ca-file,omitempty" json:"ca-file,omitempty" toml:"ca-file,omitempty"`
+	SPKIPins   []string `yaml:"spki-pins,omitempty" json:"spki-pins,omitempty" toml:"spki-pins,omitempty"`
+	ServerName string   `yaml:"server-name,omitempty" json:"server-name,omitempty" toml:"server-name,omitempty"`
+}
+
+// loadConfig reads the configuration at path, as JSON or TOML if its
+// extension is .json or .toml, else as YAML. Unknown keys are rejected.
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".toml":
+		var md toml.MetaData
+		if md, err = toml.Decode(string(b), cfg); err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown key %v", md.Undecoded()[0])
+		}
+	default:
+		err = yaml.UnmarshalStrict(b, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// saveConfig writes cfg to the file at path in the format loadConfig reads
+// it in.
+func saveConfig(path string, cfg *config) error {
+	var b []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if b, err = json.MarshalIndent(cfg, "", "  "); err == nil {
+			b = append(b, '\n')
+		}
+	case ".toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(cfg)
+		b = buf.Bytes()
+	default:
+		b, err = yaml.Marshal(cfg)
+	}
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, b)
+}
+
+// replaceFile replaces the content of the file at path with b at once,
+// keeping its permissions, so that it is never read half written.
+func replaceFile(path string, b []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(fi.Mode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// applyEnv overrides the values of cfg with those of the environment variables
+// DNS_PROXY_ADDRESS, DNS_PROXY_DEFAULT and DNS_PROXY_ALLOW_TRANSFER, if set.
+func applyEnv(cfg *config) {
+	if v := os.Getenv("DNS_PROXY_ADDRESS"); v != "" {
+		cfg.Address = v
+	}
+	if v := os.Getenv("DNS_PROXY_DEFAULT"); v != "" {
+		cfg.Default = v
+	}
+	if v := os.Getenv("DNS_PROXY_ALLOW_TRANSFER"); v != "" {
+		cfg.AllowTransfer = strings.Split(v, ",")
+	}
+}
+
+// envRoutes returns the routes of the environment variable DNS_PROXY_ROUTES,
+// in the format of -route and separated by semicolons.
+func envRoutes() []string {
+	var routes []string
+	for _, r := range strings.Split(os.Getenv("DNS_PROXY_ROUTES"), ";") {
+		if r = strings.TrimSpace(r); r != "" {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+func flagsSet() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// parseRouteFlag parses a -route value of the form domain=host:port,...
+// where a domain with a leading = is an exact match route.
+func parseRouteFlag(s string) (string, []string, error) {
+	exact := strings.HasPrefix(s, "=")
+	kv := strings.SplitN(strings.TrimPrefix(s, "="), "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return "", nil, fmt.Errorf("invalid -route, must be [=]domain=host:port,[host:port,...]")
+	}
+	if exact {
+		kv[0] = "=" + kv[0]
+	}
+	return kv[0], strings.Split(kv[1], ","), nil
+}
+
+// regexRoute is a route matching names with a regular expression. Its name,
+// the pattern prefixed with ~, is its key in the routes.
+type regexRoute struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// parseRouteRegexFlag parses a -route-regex value of the form
+// pattern=host:port,...
+func parseRouteRegexFlag(s string) (regexRoute, []string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return regexRoute{}, nil, fmt.Errorf("invalid -route-regex, must be pattern=host:port,[host:port,...]")
+	}
+	// Names are matched lowercase, make patterns case-insensitive to match.
+	re, err := regexp.Compile("(?i)" + kv[0])
+	if err != nil {
+		return regexRoute{}, nil, fmt.Errorf("invalid -route-regex pattern %q: %v", kv[0], err)
+	}
+	return regexRoute{name: "~" + kv[0], re: re}, strings.Split(kv[1], ","), nil
+}
+
+// addRoute adds a route for domain, normalized, to backends given as
+// addr[#weight].
+func (s *settings) addRoute(domain string, backends []string) error {
+	if len(domain) == 0 || len(backends) == 0 {
+		return fmt.Errorf("invalid route %q, must have a domain and backends", domain)
+	}
+	if strings.HasPrefix(domain, "~") {
+		return fmt.Errorf("invalid route %q, regex routes are given with -route-regex", domain)
+	}
+	return s.setRoute(normalizeDomain(domain), backends)
+}
+
+// setRoute validates the backends of the route name, given as addr[#weight],
+// and sets them.
+func (s *settings) setRoute(name string, backends []string) error {
+	weights := make(map[string]int, len(backends))
+	addrs := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		addr, weight := backend, 1
+		if i := strings.LastIndex(backend, "#"); i >= 0 {
+			addr = backend[:i]
+			w, err := strconv.Atoi(backend[i+1:])
+			if err != nil || w < 0 {
+				return fmt.Errorf("invalid weight for %v, must be a non-negative integer", backend)
+			}
+			weight = w
+		}
+		if !validBackend(addr) {
+			return fmt.Errorf("invalid host:port for %v", addr)
+		}
+		addrs = append(addrs, addr)
+		weights[addr] = weight
+	}
+	s.routes[name] = addrs
+	s.weights[name] = weights
+	return nil
+}
+
+// parseQtypes parses a list of query types, such as A or MX.
+func parseQtypes(list []string) (map[uint16]bool, error) {
+	qtypes := make(map[uint16]bool)
+	for _, name := range list {
+		t, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", name)
+		}
+		qtypes[t] = true
+	}
+	return qtypes, nil
+}
+
+// parseOpcodes parses a list of opcodes, such as QUERY or NOTIFY.
+func parseOpcodes(list []string) (map[int]bool, error) {
+	opcodes := make(map[int]bool)
+	for _, name := range list {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		op, ok := dns.StringToOpcode[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode %q", name)
+		}
+		opcodes[op] = true
+	}
+	return opcodes, nil
+}
+
+// addQtypeDefault sets in defaults the server of the queries of type qtype,
+// given by name.
+func addQtypeDefault(defaults map[uint16]string, qtype, server string) error {
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return fmt.Errorf("invalid default for %v: unknown query type", qtype)
+	}
+	if !validBackend(server) {
+		return fmt.Errorf("invalid host:port for %v", server)
+	}
+	defaults[t] = server
+	return nil
+}
+
+// parseIPNets parses a list of IPs and CIDR subnets. Empty entries are
+// ignored.
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid subnet %q: %v", entry, err)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid %q, must be an IP or CIDR", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// normalizeDomain returns the lowercase fully qualified form of a route
+// domain, keeping the leading = of exact match routes. A leading *. is the
+// same as a leading dot, matching subdomains only. Regex routes, ~pattern,
+// are returned as is.
+func normalizeDomain(domain string) string {
+	if strings.HasPrefix(domain, "~") {
+		return domain
+	}
+	if strings.HasPrefix(domain, "*.") {
+		domain = domain[1:]
+	}
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	return strings.ToLower(domain)
+}
+
+// reverseZones are the routes of -ptr-server.
+var reverseZones = []string{".in-addr.arpa.", ".ip6.arpa."}
+
+// settings is the state used to answer queries, built from the configuration
+// file and flags. It is never modified once built: a reload stores a new one,
+// so queries in flight keep using the settings they started with.
+type settings struct {
+	addresses    []string
+	router       *Router
+	routes       map[string][]string // as in RouterConfig
+	next         map[string]*uint64  // round-robin position of each route
+	weights      map[string]map[string]int
+	timeouts     map[string]time.Duration
+	tlsNames     map[string]string
+	upstreamTLS  map[string]*upstreamTLSSettings // per DNS-over-TLS backend
+	dnssec       map[string]bool                 // routes validating DNSSEC
+	stripAAAA    map[string]bool                 // routes removing AAAA records
+	clearRD      map[string]bool                 // routes clearing RD in queries
+	padding      map[string]bool                 // routes padding queries and responses
+	logRoutes    map[string]bool                 // routes logging their queries and steps
+	qps          map[string]*rateLimiter         // QPS limit per route
+	upstreamQPS  map[string]float64              // QPS limit per backend of a route
+	maxSizes     map[string]int                  // maximum response size per route
+	ttls         map[string]uint32               // TTL of the responses per route
+	transferNets []*net.IPNet                    // empty denies all transfers
+	queryNets    []*net.IPNet                    // empty denies all queries
+	qtypes       map[uint16]bool                 // empty allows all query types
+	opcodes      map[int]bool                    // opcodes forwarded, others answered NOTIMP
+	blocklist    *blocklist
+	static       *staticTable // nil if there are no static answers
+	overrides    *staticTable // nil if there are no overrides
+	zones        []*localZone // most specific origin first
+	sinkhole     net.IP
+}
+
+var current atomic.Value // *settings
+
+// loadSettings returns the settings currently in use.
+func loadSettings() *settings {
+	return current.Load().(*settings)
+}
+
+// buildSettings loads the configuration file if any, applies the environment
+// then the flags on top and validates the result.
+func buildSettings() (*settings, error) {
+	cfg := &config{}
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	applyEnv(cfg)
+	set := flagsSet()
+	s := &settings{
+		addresses: addressLists,
+		routes:    make(map[string][]string),
+		weights:   make(map[string]map[string]int),
+	}
+	rc := RouterConfig{
+		Default:       *defaultServer,
+		QtypeDefaults: make(map[uint16]string),
+		Routes:        s.routes,
+		RegexFirst:    *routeRegexFirst,
+	}
+	if len(s.addresses) == 0 {
+		s.addresses = []string{":53"}
+		if cfg.Address != "" {
+			s.addresses = []string{cfg.Address}
+		}
+	}
+	if !set["default"] && cfg.Default != "" {
+		if !validBackend(cfg.Default) {
+			return nil, fmt.Errorf("invalid host:port for %v", cfg.Default)
+		}
+		rc.Default = cfg.Default
+	}
+	for qtype, server := range cfg.DefaultQtype {
+		if err := addQtypeDefault(rc.QtypeDefaults, qtype, server); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range defaultQtypeLists {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid -default-qtype %q, must be qtype=host:port", v)
+		}
+		if err := addQtypeDefault(rc.QtypeDefaults, kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+	transfer := strings.Split(*allowTransfer, ",")
+	if !set["allow-transfer"] && len(cfg.AllowTransfer) > 0 {
+		transfer = cfg.AllowTransfer
+	}
+	var err error
+	if s.transferNets, err = parseIPNets(transfer); err != nil {
+		return nil, fmt.Errorf("allow-transfer: %v", err)
+	}
+	query := strings.Split(*allowQuery, ",")
+	if !set["allow-query"] && len(cfg.AllowQuery) > 0 {
+		query = cfg.AllowQuery
+	}
+	if s.queryNets, err = parseIPNets(query); err != nil {
+		return nil, fmt.Errorf("allow-query: %v", err)
+	}
+	var qtypes []string
+	if *allowQtypes != "" {
+		qtypes = strings.Split(*allowQtypes, ",")
+	}
+	if !set["allow-qtypes"] && len(cfg.AllowQtypes) > 0 {
+		qtypes = cfg.AllowQtypes
+	}
+	if s.qtypes, err = parseQtypes(qtypes); err != nil {
+		return nil, fmt.Errorf("allow-qtypes: %v", err)
+	}
+	opcodes := strings.Split(*allowOpcodes, ",")
+	if !set["allow-opcodes"] && len(cfg.AllowOpcodes) > 0 {
+		opcodes = cfg.AllowOpcodes
+	}
+	if s.opcodes, err = parseOpcodes(opcodes); err != nil {
+		return nil, fmt.Errorf("allow-opcodes: %v", err)
+	}
+
+	for domain, backends := range cfg.Routes {
+		if err := s.addRoute(domain, backends); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range envRoutes() {
+		domain, backends, err := parseRouteFlag(r)
+		if err != nil {
+			return nil, fmt.Errorf("DNS_PROXY_ROUTES: %v", err)
+		}
+		if err := s.addRoute(domain, backends); err != nil {
+			return nil, fmt.Errorf("DNS_PROXY_ROUTES: %v", err)
+		}
+	}
+	for _, routeList := range routeLists {
+		domain, backends, err := parseRouteFlag(routeList)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.addRoute(domain, backends); err != nil {
+			return nil, err
+		}
+	}
+	for _, routeRegex := range routeRegexLists {
+		r, backends, err := parseRouteRegexFlag(routeRegex)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.setRoute(r.name, backends); err != nil {
+			return nil, err
+		}
+		rc.RegexRoutes = append(rc.RegexRoutes, r)
+	}
+	if *ptrServer != "" {
+		for _, zone := range reverseZones {
+			if _, ok := s.routes[zone]; ok {
+				// An explicit route for the zone takes precedence.
+				continue
+			}
+			if err := s.setRoute(zone, []string{*ptrServer}); err != nil {
+				return nil, fmt.Errorf("-ptr-server: %v", err)
+			}
+		}
+	}
+	if rc.Groups, err = s.addGroups(cfg); err != nil {
+		return nil, err
+	}
+	s.timeouts = make(map[string]time.Duration)
+	for domain, timeout := range cfg.RouteTimeouts {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid timeout for %v: no such route", domain)
+		}
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q for %v", timeout, domain)
+		}
+		s.timeouts[name] = d
+	}
+	s.tlsNames = make(map[string]string)
+	for domain, serverName := range cfg.RouteTLSServerNames {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid TLS server name for %v: no such route", domain)
+		}
+		s.tlsNames[name] = serverName
+	}
+	s.upstreamTLS = make(map[string]*upstreamTLSSettings)
+	for addr, u := range cfg.UpstreamTLS {
+		if s.upstreamTLS[addr], err = newUpstreamTLSSettings(addr, u); err != nil {
+			return nil, err
+		}
+	}
+	if *normalizeNames && len(cfg.RouteDNSSEC) > 0 {
+		return nil, fmt.Errorf("route-dnssec cannot be used with -normalize-names")
+	}
+	s.dnssec = make(map[string]bool)
+	for _, domain := range cfg.RouteDNSSEC {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid DNSSEC validation for %v: no such route", domain)
+		}
+		s.dnssec[name] = true
+	}
+	s.stripAAAA = make(map[string]bool)
+	for _, domain := range cfg.RouteStripAAAA {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid AAAA stripping for %v: no such route", domain)
+		}
+		s.stripAAAA[name] = true
+	}
+	s.clearRD = make(map[string]bool)
+	for _, domain := range cfg.RouteClearRD {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid RD clearing for %v: no such route", domain)
+		}
+		s.clearRD[name] = true
+	}
+	s.padding = make(map[string]bool)
+	for _, domain := range cfg.RoutePadding {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid padding for %v: no such route", domain)
+		}
+		s.padding[name] = true
+	}
+	s.logRoutes = make(map[string]bool)
+	for _, domain := range cfg.RouteLog {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid logging for %v: no such route", domain)
+		}
+		s.logRoutes[name] = true
+	}
+	s.qps = make(map[string]*rateLimiter)
+	for domain, qps := range cfg.RouteQPS {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid QPS limit for %v: no such route", domain)
+		}
+		if qps <= 0 {
+			return nil, fmt.Errorf("invalid QPS limit %v for %v, must be positive", qps, domain)
+		}
+		// A single bucket for the route, allowing a second of queries at once.
+		s.qps[name], _ = newRateLimiter(qps, int(math.Ceil(qps)), 1)
+	}
+	s.upstreamQPS = make(map[string]float64)
+	for domain, qps := range cfg.RouteUpstreamQPS {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid upstream QPS limit for %v: no such route", domain)
+		}
+		if qps <= 0 {
+			return nil, fmt.Errorf("invalid upstream QPS limit %v for %v, must be positive", qps, domain)
+		}
+		s.upstreamQPS[name] = qps
+	}
+	s.maxSizes = make(map[string]int)
+	for domain, size := range cfg.RouteMaxResponseSizes {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid maximum response size for %v: no such route", domain)
+		}
+		if size < dns.MinMsgSize || size > dns.MaxMsgSize {
+			return nil, fmt.Errorf("invalid maximum response size %d for %v, must be between %d and %d",
+				size, domain, dns.MinMsgSize, dns.MaxMsgSize)
+		}
+		s.maxSizes[name] = size
+	}
+	s.ttls = make(map[string]uint32)
+	for domain, ttl := range cfg.RouteTTLs {
+		name := normalizeDomain(domain)
+		if _, ok := s.routes[name]; !ok {
+			return nil, fmt.Errorf("invalid TTL for %v: no such route", domain)
+		}
+		if ttl <= 0 || ttl > math.MaxInt32 {
+			return nil, fmt.Errorf("invalid TTL %d for %v, must be between 1 and %d", ttl, domain, math.MaxInt32)
+		}
+		s.ttls[name] = uint32(ttl)
+	}
+	if *blocklistFile != "" {
+		var err error
+		if s.blocklist, err = loadBlocklist(*blocklistFile); err != nil {
+			return nil, err
+		}
+	}
+	if s.static, err = buildStatic(cfg); err != nil {
+		return nil, err
+	}
+	if s.overrides, err = buildOverrides(cfg); err != nil {
+		return nil, err
+	}
+	if s.zones, err = buildLocalZones(cfg); err != nil {
+		return nil, err
+	}
+	if *blocklistSinkhole != "" {
+		if s.sinkhole = net.ParseIP(*blocklistSinkhole); s.sinkhole == nil {
+			return nil, fmt.Errorf("invalid -blocklist-sinkhole %q", *blocklistSinkhole)
+		}
+	}
+	s.router = NewRouter(rc)
+	s.next = make(map[string]*uint64, len(s.routes))
+	for name := range s.routes {
+		s.next[name] = new(uint64)
+	}
+	return s, nil
+}
+
+// sortRouteNames returns the route domains ordered by descending length, so
+// that the most specific suffix is tried first. Ties are broken
+// alphabetically to keep the order deterministic.
+func sortRouteNames(routes map[string][]string) []string {
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// options returns the options of exchanges with the backends of a route, the
+// empty name being the default server, for a query answered within ctx.
+func (s *settings) options(ctx context.Context, name string) routeOptions {
+	opts := routeOptions{
+		timeout:       *timeout,
+		tlsServerName: s.tlsNames[name],
+		dnssec:        *dnssecValidate || s.dnssec[name],
+		stripAAAA:     *stripAAAA || s.stripAAAA[name],
+		clearRD:       *clearRD || s.clearRD[name],
+		padding:       *padding || s.padding[name],
+		maxSize:       s.maxSizes[name],
+		ttl:           s.ttls[name],
+		upstreamQPS:   *upstreamQPS,
+		route:         name,
+		ctx:           ctx,
+	}
+	if d, ok := s.timeouts[name]; ok {
+		opts.timeout = d
+	}
+	if qps, ok := s.upstreamQPS[name]; ok {
+		opts.upstreamQPS = qps
+	}
+	return opts
+}
+
+// summary writes the resolved settings to w, for -check and SIGUSR1.
+func (s *settings) summary(w io.Writer) {
+	fmt.Fprintf(w, "address: %v\n", strings.Join(s.addresses, ", "))
+	if s.router.defaultServer != "" {
+		fmt.Fprintf(w, "default: %v\n", s.router.defaultServer)
+	}
+	qtypes := make([]string, 0, len(s.router.qtypeDefaults))
+	for qtype := range s.router.qtypeDefaults {
+		qtypes = append(qtypes, dns.TypeToString[qtype])
+	}
+	sort.Strings(qtypes)
+	for _, qtype := range qtypes {
+		fmt.Fprintf(w, "default %v: %v\n", qtype, s.router.qtypeDefaults[dns.StringToType[qtype]])
+	}
+	for _, name := range sortRouteNames(s.routes) {
+		var backends []string
+		for _, addr := range s.routes[name] {
+			if weight := s.weights[name][addr]; weight != 1 {
+				addr = fmt.Sprintf("%v#%d", addr, weight)
+			}
+			backends = append(backends, addr)
+		}
+		fmt.Fprintf(w, "route %v: %v\n", name, strings.Join(backends, ", "))
+	}
+	for _, g := range s.router.groups {
+		var nets []string
+		for _, n := range g.nets {
+			nets = append(nets, n.String())
+		}
+		fmt.Fprintf(w, "client group %v: %v\n", g.name, strings.Join(nets, ", "))
+	}
+	fmt.Fprintf(w, "allow-query: %v\n", formatIPNets(s.queryNets))
+	if len(s.qtypes) > 0 {
+		var names []string
+		for t := range s.qtypes {
+			names = append(names, dns.TypeToString[t])
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "allow-qtypes: %v\n", strings.Join(names, ", "))
+	}
+	var opcodes []string
+	for op := range s.opcodes {
+		opcodes = append(opcodes, dns.OpcodeToString[op])
+	}
+	sort.Strings(opcodes)
+	if len(opcodes) == 0 {
+		opcodes = []string{"none"}
+	}
+	fmt.Fprintf(w, "allow-opcodes: %v\n", strings.Join(opcodes, ", "))
+	fmt.Fprintf(w, "allow-transfer: %v\n", formatIPNets(s.transferNets))
+	if s.blocklist != nil {
+		fmt.Fprintf(w, "blocklist: %d domains\n", s.blocklist.len())
+	}
+	if s.static != nil {
+		fmt.Fprintf(w, "static: %d names\n", s.static.len())
+	}
+	if s.overrides != nil {
+		fmt.Fprintf(w, "overrides: %d names\n", s.overrides.len())
+	}
+	for _, z := range s.zones {
+		fmt.Fprintf(w, "local zone: %v (%d names)\n", z.origin, len(z.records))
+	}
+}
+
+func formatIPNets(nets []*net.IPNet) string {
+	if len(nets) == 0 {
+		return "none"
+	}
+	list := make([]string, len(nets))
+	for i, n := range nets {
+		list[i] = n.String()
+	}
+	return strings.Join(list, ", ")
+}
+
+// backends returns the set of all the backends in use: routes and defaults.
+func (s *settings) backends() map[string]bool {
+	addrs := make(map[string]bool)
+	for _, addr := range s.router.defaults() {
+		addrs[addr] = true
+	}
+	for _, backends := range s.routes {
+		for _, addr := range backends {
+			addrs[addr] = true
+		}
+	}
+	return addrs
+}
+
+// reload rebuilds the settings and swaps them in. If the new configuration
+// is invalid the current settings are kept.
+func reload() {
+	s, err := buildSettings()
+	if err != nil {
+		log.Printf("reload failed, keeping previous configuration: %v", err)
+		return
+	}
+	swapSettings(s)
+}
+
+// swapSettings replaces the current settings with s, logging the route
+// changes.
+func swapSettings(s *settings) {
+	old := loadSettings()
+	if strings.Join(s.addresses, ",") != strings.Join(old.addresses, ",") {
+		log.Printf("reload: address change to %v requires a restart", s.addresses)
+	}
+	var added, removed, changed []string
+	for _, name := range sortRouteNames(s.routes) {
+		backends, ok := old.routes[name]
+		if !ok {
+			added = append(added, name)
+		} else if strings.Join(backends, ",") != strings.Join(s.routes[name], ",") {
+			changed = append(changed, name)
+		}
+	}
+	for _, name := range sortRouteNames(old.routes) {
+		if _, ok := s.routes[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	current.Store(s)
+	log.Printf("reload: %d routes, added %v, removed %v, changed %v",
+		len(s.routes), added, removed, changed)
+	if s.blocklist != nil {
+		log.Printf("reload: %d blocked domains", s.blocklist.len())
+	}
+	if s.static != nil {
+		log.Printf("reload: %d static names", s.static.len())
+	}
+	if s.overrides != nil {
+		log.Printf("reload: %d override names", s.overrides.len())
+	} else if old.overrides != nil {
+		log.Printf("reload: overrides removed")
+	}
+	for _, z := range s.zones {
+		log.Printf("reload: local zone %v, %d names", z.origin, len(z.records))
+	}
+}
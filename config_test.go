@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRegexRouteOptions(t *testing.T) {
+	setList(t, &routeRegexLists, `^db[0-9]+\.internal\.$=192.0.2.2:53`)
+	s := useConfig(t, `route-timeouts:
+  ~^db[0-9]+\.internal\.$: 300ms
+`)
+	if d := s.timeouts[`~^db[0-9]+\.internal\.$`]; d != 300*time.Millisecond {
+		t.Errorf("timeout of the regex route = %v, want 300ms", d)
+	}
+	setFlag(t, "config", writeFile(t, "config.yaml", "routes:\n  ~^db: [192.0.2.2:53]\n"))
+	if _, err := buildSettings(); err == nil {
+		t.Error("regex route in routes accepted")
+	}
+}
+
+func TestExactRouteFlag(t *testing.T) {
+	setList(t, &routeLists, "=Example.COM=192.0.2.2:53", ".example.com.=192.0.2.3:53")
+	s := useConfig(t, "")
+	if got := s.routes["=example.com."]; len(got) != 1 || got[0] != "192.0.2.2:53" {
+		t.Errorf("exact route = %v, want 192.0.2.2:53", got)
+	}
+	if got := s.routes[".example.com."]; len(got) != 1 || got[0] != "192.0.2.3:53" {
+		t.Errorf("suffix route = %v, want 192.0.2.3:53", got)
+	}
+}
+
+func TestRouteWeights(t *testing.T) {
+	setList(t, &routeLists, ".example.com.=192.0.2.1:53#90,192.0.2.2:53#10,192.0.2.3:53")
+	s := useConfig(t, "")
+	want := map[string]int{"192.0.2.1:53": 90, "192.0.2.2:53": 10, "192.0.2.3:53": 1}
+	for addr, weight := range want {
+		if got := s.weights[".example.com."][addr]; got != weight {
+			t.Errorf("weight of %v = %d, want %d", addr, got, weight)
+		}
+	}
+	if got := s.routes[".example.com."]; len(got) != 3 || got[0] != "192.0.2.1:53" {
+		t.Errorf("backends = %v, want them without weights", got)
+	}
+
+	for _, backend := range []string{"192.0.2.1:53#-1", "192.0.2.1:53#x", "192.0.2.1:53#"} {
+		setList(t, &routeLists, ".example.com.="+backend)
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("weight of %v accepted", backend)
+		}
+	}
+}
+
+func TestParseIPNets(t *testing.T) {
+	nets, err := parseIPNets([]string{"192.0.2.1", " 10.0.0.0/8", "2001:db8::1", "2001:db8:1::/48", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 4 {
+		t.Fatalf("parseIPNets returned %d subnets, want 4", len(nets))
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"::ffff:192.0.2.1", true},
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"2001:db8:1:2::3", true},
+		{"2001:db8:2::1", false},
+	} {
+		if got := containsIP(nets, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("containsIP(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	for _, list := range [][]string{{"192.0.2.300"}, {"10.0.0.0/33"}, {"example.com"}} {
+		if _, err := parseIPNets(list); err == nil {
+			t.Errorf("parseIPNets(%q) succeeded", list)
+		}
+	}
+}
+
+func TestAllowTransfer(t *testing.T) {
+	axfr := newQ("example.com.", dns.TypeAXFR)
+	for _, tt := range []struct {
+		allow, client string
+		want          bool
+	}{
+		{"", "127.0.0.1:5353", false},
+		{"127.0.0.1", "127.0.0.1:5353", true},
+		{"127.0.0.1", "127.0.0.2:5353", false},
+		{"127.0.0.0/8", "127.0.0.2:5353", true},
+		{"::1", "[::1]:5353", true},
+		{"2001:db8::/32", "[::1]:5353", false},
+	} {
+		setFlag(t, "allow-transfer", tt.allow)
+		s := useConfig(t, "")
+		if got := s.allowed(newStubWriter("tcp", tt.client), axfr); got != tt.want {
+			t.Errorf("allow-transfer %q: transfer from %v allowed %v, want %v", tt.allow, tt.client, got, tt.want)
+		}
+		if !s.allowed(newStubWriter("tcp", tt.client), newQ("example.com.", dns.TypeA)) {
+			t.Errorf("allow-transfer %q: query from %v not allowed", tt.allow, tt.client)
+		}
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	config := writeFile(t, "config.yaml", `address: 127.0.0.1:5301
+default: 192.0.2.1:53
+allow-transfer: [10.0.0.0/8]
+routes:
+  .example.com.: [192.0.2.1:53]
+`)
+	env := map[string]string{
+		"DNS_PROXY_ADDRESS":        "127.0.0.1:5302",
+		"DNS_PROXY_DEFAULT":        "192.0.2.2:53",
+		"DNS_PROXY_ALLOW_TRANSFER": "172.16.0.0/12",
+		"DNS_PROXY_ROUTES":         ".example.com.=192.0.2.2:53; .example.org.=192.0.2.2:53",
+	}
+	for _, tt := range []struct {
+		name                   string
+		env, flags             bool
+		address, server, route string
+		transfer               string // client allowed to transfer
+	}{
+		{"file", false, false, "127.0.0.1:5301", "192.0.2.1:53", "192.0.2.1:53", "10.0.0.1"},
+		{"env", true, false, "127.0.0.1:5302", "192.0.2.2:53", "192.0.2.2:53", "172.16.0.1"},
+		{"flags", true, true, "127.0.0.1:5303", "192.0.2.3:53", "192.0.2.3:53", "192.168.0.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, "config", config)
+			for key, value := range env {
+				if !tt.env {
+					value = ""
+				}
+				setEnv(t, key, value)
+			}
+			if tt.flags {
+				setList(t, &addressLists, "127.0.0.1:5303")
+				giveFlags(t, map[string]string{"default": "192.0.2.3:53", "allow-transfer": "192.168.0.0/16"})
+				setList(t, &routeLists, ".example.com.=192.0.2.3:53")
+			}
+			s, err := buildSettings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(s.addresses, ","); got != tt.address {
+				t.Errorf("address %v, want %v", got, tt.address)
+			}
+			if got, _ := s.router.Default(dns.TypeA); got != tt.server {
+				t.Errorf("default %v, want %v", got, tt.server)
+			}
+			if got := s.routes[".example.com."]; len(got) != 1 || got[0] != tt.route {
+				t.Errorf("route %v, want [%v]", got, tt.route)
+			}
+			if got := s.routes[".example.org."]; tt.env != (len(got) == 1) {
+				t.Errorf("route from DNS_PROXY_ROUTES only = %v", got)
+			}
+			if !containsIP(s.transferNets, net.ParseIP(tt.transfer)) {
+				t.Errorf("transfer from %v not allowed", tt.transfer)
+			}
+		})
+	}
+
+	for _, tt := range []struct{ key, value string }{
+		{"DNS_PROXY_DEFAULT", "nowhere"},
+		{"DNS_PROXY_ALLOW_TRANSFER", "10.0.0.0/33"},
+		{"DNS_PROXY_ROUTES", ".example.com."},
+		{"DNS_PROXY_ROUTES", ".example.com.=nowhere"},
+		{"DNS_PROXY_ROUTES", "~example=192.0.2.2:53"},
+	} {
+		t.Run(tt.key, func(t *testing.T) {
+			setEnv(t, tt.key, tt.value)
+			if _, err := buildSettings(); err == nil {
+				t.Errorf("%v=%q accepted", tt.key, tt.value)
+			}
+		})
+	}
+}
+
+func TestDefaultQtype(t *testing.T) {
+	setList(t, &defaultQtypeLists, "mx=192.0.2.2:53")
+	s := useConfig(t, "default-qtype:\n  TXT: 192.0.2.3:53\n")
+	for qtype, want := range map[uint16]string{dns.TypeMX: "192.0.2.2:53", dns.TypeTXT: "192.0.2.3:53"} {
+		if got, _ := s.router.Default(qtype); got != want {
+			t.Errorf("default of %v = %q, want %q", dns.TypeToString[qtype], got, want)
+		}
+	}
+
+	for _, v := range []string{"NOSUCHTYPE=192.0.2.2:53", "MX=nowhere", "MX"} {
+		setList(t, &defaultQtypeLists, v)
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("-default-qtype %v accepted", v)
+		}
+	}
+}
+
+func TestPTRServer(t *testing.T) {
+	setFlag(t, "ptr-server", "192.0.2.2:53")
+	v4, _ := dns.ReverseAddr("192.0.2.1")
+	v6, _ := dns.ReverseAddr("2001:db8::1")
+	for _, tt := range []struct {
+		config   string
+		name     string
+		backends string
+	}{
+		{"default: 192.0.2.1:53\n", v4, "[192.0.2.2:53]"},
+		{"default: 192.0.2.1:53\n", v6, "[192.0.2.2:53]"},
+		{"default: 192.0.2.1:53\n", "www.example.com.", "[192.0.2.1:53]"},
+		// Explicit routes take precedence, and more specific ones match first.
+		{"routes:\n  .ip6.arpa.: [192.0.2.3:53]\n", v6, "[192.0.2.3:53]"},
+		{"routes:\n  .ip6.arpa.: [192.0.2.3:53]\n", v4, "[192.0.2.2:53]"},
+		{"routes:\n  .2.0.192.in-addr.arpa.: [192.0.2.4:53]\n", v4, "[192.0.2.4:53]"},
+		{"routes:\n  .2.0.192.in-addr.arpa.: [192.0.2.4:53]\n", "1.0.0.10.in-addr.arpa.", "[192.0.2.2:53]"},
+	} {
+		s := useConfig(t, tt.config)
+		if backends, _ := s.router.Match(tt.name, dns.TypePTR); fmt.Sprint(backends) != tt.backends {
+			t.Errorf("%q: Match(%v) = %v, want %v", tt.config, tt.name, backends, tt.backends)
+		}
+	}
+
+	setFlag(t, "ptr-server", "nowhere")
+	setFlag(t, "config", writeFile(t, "config.yaml", "default: 192.0.2.1:53\n"))
+	if _, err := buildSettings(); err == nil {
+		t.Error("-ptr-server nowhere accepted")
+	}
+}
+
+func TestWildcardRoute(t *testing.T) {
+	for _, tt := range []struct{ domain, want string }{
+		{"*.example.com.", ".example.com."},
+		{"*.Example.COM", ".example.com."},
+		{".example.com", ".example.com."},
+		{"example.com", "example.com."},
+		{"=example.com", "=example.com."},
+	} {
+		if got := normalizeDomain(tt.domain); got != tt.want {
+			t.Errorf("normalizeDomain(%v) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	s := useConfig(t, `routes:
+  "*.example.com.": [192.0.2.2:53]
+route-timeouts:
+  .example.com.: 300ms
+`)
+	for _, tt := range []struct{ name, route string }{
+		{"www.example.com.", ".example.com."},
+		{"a.b.example.com.", ".example.com."},
+		{"example.com.", ""},
+		{"badexample.com.", ""},
+	} {
+		route, ok := s.router.Route(tt.name, nil)
+		if ok != (tt.route != "") || route != tt.route {
+			t.Errorf("Route(%v) = %q, %v; want %q", tt.name, route, ok, tt.route)
+		}
+	}
+	if d := s.timeouts[".example.com."]; d != 300*time.Millisecond {
+		t.Errorf("timeout of the route given as .example.com. = %v, want 300ms", d)
+	}
+}
+
+// configFormats is a same configuration in each format.
+var configFormats = map[string]string{
+	"config.yaml": `default: 192.0.2.1:53
+routes:
+  .example.com.: [192.0.2.2:53, 192.0.2.3:53]
+  =example.org.: [192.0.2.4:53]
+route-timeouts:
+  .example.com.: 300ms
+`,
+	"config.yml": `default: 192.0.2.1:53
+routes:
+  .example.com.:
+    - 192.0.2.2:53
+    - 192.0.2.3:53
+  =example.org.: [192.0.2.4:53]
+route-timeouts: {.example.com.: 300ms}
+`,
+	"config.json": `{
+  "default": "192.0.2.1:53",
+  "routes": {
+    ".example.com.": ["192.0.2.2:53", "192.0.2.3:53"],
+    "=example.org.": ["192.0.2.4:53"]
+  },
+  "route-timeouts": {".example.com.": "300ms"}
+}
+`,
+	"config.toml": `default = "192.0.2.1:53"
+
+[routes]
+".example.com." = ["192.0.2.2:53", "192.0.2.3:53"]
+"=example.org." = ["192.0.2.4:53"]
+
+[route-timeouts]
+".example.com." = "300ms"
+`,
+}
+
+func TestConfigFormats(t *testing.T) {
+	want, err := loadConfig(writeFile(t, "config.yaml", configFormats["config.yaml"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Routes) != 2 || want.Default != "192.0.2.1:53" {
+		t.Fatalf("YAML config %+v, want its default and 2 routes", want)
+	}
+	for name, content := range configFormats {
+		path := writeFile(t, name, content)
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%v: %+v, want %+v", name, cfg, want)
+		}
+		setFlag(t, "config", path)
+		s, err := buildSettings()
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.routes, map[string][]string{
+			".example.com.": {"192.0.2.2:53", "192.0.2.3:53"},
+			"=example.org.": {"192.0.2.4:53"},
+		}) || s.timeouts[".example.com."] != 300*time.Millisecond {
+			t.Errorf("%v: routes %v, timeouts %v", name, s.routes, s.timeouts)
+		}
+
+		// Saved in the same format, it loads the same.
+		if err := saveConfig(path, cfg); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if saved, err := loadConfig(path); err != nil || !reflect.DeepEqual(saved, want) {
+			t.Errorf("%v saved: %+v, %v; want %+v", name, saved, err, want)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"unknown.yaml": "defaults: 192.0.2.1:53\n",
+		"unknown.json": `{"defaults": "192.0.2.1:53"}`,
+		"unknown.toml": `defaults = "192.0.2.1:53"`,
+		"invalid.json": `{"default": `,
+	} {
+		if _, err := loadConfig(writeFile(t, name, content)); err == nil {
+			t.Errorf("%v loaded", name)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	cookiesEnabled = flag.Bool("cookies", false,
+		"Answer DNS cookies (RFC 7873) of clients and send our own to backends")
+	cookieSecret = flag.String("cookie-secret", "",
+		"Secret of server cookies as 32 hex digits, shared by instances behind a same address "+
+			"(random if empty)")
+
+	cookies *cookieJar // nil if cookies are disabled
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16 // as built by serverCookie
+	// serverCookieLifetime bounds the age of server cookies accepted, per
+	// RFC 9018.
+	serverCookieLifetime = time.Hour
+	serverCookieSkew     = 5 * time.Minute
+)
+
+// cookieJar builds the server cookies returned to clients and keeps the
+// server cookies of the backends.
+type cookieJar struct {
+	secret []byte
+
+	mu      sync.Mutex
+	servers map[string]string // server cookie of each backend, hex encoded
+}
+
+// newCookieJar returns a jar using the secret given in hex, or a random one
+// if empty.
+func newCookieJar(secret string) (*cookieJar, error) {
+	j := &cookieJar{servers: make(map[string]string)}
+	if secret == "" {
+		j.secret = make([]byte, 16)
+		if _, err := rand.Read(j.secret); err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+	b, err := hex.DecodeString(secret)
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid -cookie-secret, must be 32 hex digits")
+	}
+	j.secret = b
+	return j, nil
+}
+
+// mac returns the first 8 bytes of the HMAC of the parts with the secret.
+func (j *cookieJar) mac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, j.secret)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)[:8]
+}
+
+// serverCookie returns the server cookie of a client cookie from ip at now,
+// in the layout of RFC 9018: version, reserved bytes, timestamp and hash.
+func (j *cookieJar) serverCookie(client []byte, ip net.IP, now time.Time) []byte {
+	c := make([]byte, 8, serverCookieLen)
+	c[0] = 1
+	binary.BigEndian.PutUint32(c[4:], uint32(now.Unix()))
+	return append(c, j.mac(client, c, ip.To16())...)
+}
+
+// validServerCookie returns whether server is a cookie returned to the
+// client cookie from ip which has not expired.
+func (j *cookieJar) validServerCookie(client, server []byte, ip net.IP, now time.Time) bool {
+	if len(server) != serverCookieLen || server[0] != 1 {
+		return false
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if t.Before(now.Add(-serverCookieLifetime)) || t.After(now.Add(serverCookieSkew)) {
+		return false
+	}
+	return hmac.Equal(server[8:], j.mac(client, server[:8], ip.To16()))
+}
+
+// findCookie returns the cookie option of opt, or nil.
+func findCookie(opt *dns.OPT) *dns.EDNS0_COOKIE {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+func withoutCookie(options []dns.EDNS0) []dns.EDNS0 {
+	kept := options[:0]
+	for _, o := range options {
+		if o.Option() != dns.EDNS0COOKIE {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// splitCookie returns the client and server cookies of c, or an error if it
+// is malformed.
+func splitCookie(c *dns.EDNS0_COOKIE) ([]byte, []byte, error) {
+	b, err := hex.DecodeString(c.Cookie)
+	if err != nil || len(b) < clientCookieLen || (len(b) > clientCookieLen && (len(b) < 16 || len(b) > 40)) {
+		return nil, nil, errors.New("malformed cookie")
+	}
+	return b[:clientCookieLen], b[clientCookieLen:], nil
+}
+
+// checkClientCookie returns the response code to a query req from ip for its
+// cookie: success if it has none or a valid one, or a client cookie only,
+// FORMERR if it is malformed and BADCOOKIE if its server cookie is invalid.
+func (j *cookieJar) checkClientCookie(req *dns.Msg, ip net.IP, now time.Time) int {
+	c := findCookie(req.IsEdns0())
+	if c == nil {
+		return dns.RcodeSuccess
+	}
+	client, server, err := splitCookie(c)
+	if err != nil {
+		return dns.RcodeFormatError
+	}
+	if len(server) > 0 && !j.validServerCookie(client, server, ip, now) {
+		return dns.RcodeBadCookie
+	}
+	return dns.RcodeSuccess
+}
+
+// authenticated returns whether the query req has a server cookie, which
+// checkClientCookie found valid, so that its client is known not to be
+// spoofed.
+func (j *cookieJar) authenticated(req *dns.Msg) bool {
+	c := findCookie(req.IsEdns0())
+	if c == nil {
+		return false
+	}
+	_, server, err := splitCookie(c)
+	return err == nil && len(server) > 0
+}
+
+// answerBadCookie answers a query whose cookie failed checkClientCookie.
+func answerBadCookie(w dns.ResponseWriter, req *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	opt := req.IsEdns0()
+	m.SetEdns0(opt.UDPSize(), opt.Do())
+	writeLocal(w, req, m)
+}
+
+// cookieResponse sets the cookie of resp to the client cookie of req
+// followed by a fresh server cookie, if the client sent a valid one, adding
+// EDNS to resp if needed.
+func cookieResponse(w dns.ResponseWriter, req, resp *dns.Msg) {
+	if cookies == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt != nil {
+		opt.Option = withoutCookie(opt.Option)
+	}
+	reqOpt := req.IsEdns0()
+	c := findCookie(reqOpt)
+	if c == nil {
+		return
+	}
+	client, _, err := splitCookie(c)
+	if err != nil {
+		return
+	}
+	if opt == nil {
+		// The backend does not do EDNS but we do.
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+	server := cookies.serverCookie(client, remoteIP(w), time.Now())
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(client) + hex.EncodeToString(server),
+	})
+}
+
+// clientCookie returns the client cookie sent to the backend addr, fixed
+// per backend so that it can recognize us.
+func (j *cookieJar) clientCookie(addr string) []byte {
+	return j.mac([]byte("client"), []byte(addr))
+}
+
+// exchange exchanges req with the backend addr with our cookie and the last
+// server cookie it returned. A response with another client cookie is
+// rejected as spoofed, and on BADCOOKIE the exchange is retried once with
+// the new server cookie. Cookies are removed from the response.
+func (j *cookieJar) exchange(addr, transport string, opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	if req.IsEdns0() == nil {
+		return exchangeDNS(addr, transport, opts, req)
+	}
+	client := hex.EncodeToString(j.clientCookie(addr))
+	for attempt := 0; ; attempt++ {
+		j.mu.Lock()
+		server := j.servers[addr]
+		j.mu.Unlock()
+		m := req.Copy()
+		opt := m.IsEdns0()
+		opt.Option = append(withoutCookie(opt.Option), &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + server})
+		resp, err := exchangeDNS(addr, transport, opts, m)
+		if err != nil {
+			return nil, err
+		}
+		respOpt := resp.IsEdns0()
+		if c := findCookie(respOpt); c != nil {
+			if len(c.Cookie) < 2*clientCookieLen || c.Cookie[:2*clientCookieLen] != client {
+				return nil, fmt.Errorf("%v: response with another client cookie", addr)
+			}
+			j.mu.Lock()
+			j.servers[addr] = c.Cookie[2*clientCookieLen:]
+			j.mu.Unlock()
+			respOpt.Option = withoutCookie(respOpt.Option)
+		}
+		if resp.Rcode != dns.RcodeBadCookie || attempt > 0 {
+			return resp, nil
+		}
+	}
+}
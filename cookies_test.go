@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testCookieSecret = "000102030405060708090a0b0c0d0e0f"
+
+// useCookies enables cookies with testCookieSecret for the duration of the
+// test, and returns the jar.
+func useCookies(t *testing.T) *cookieJar {
+	t.Helper()
+	j, err := newCookieJar(testCookieSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cookies
+	cookies = j
+	t.Cleanup(func() { cookies = old })
+	return j
+}
+
+// cookieQ returns a query with EDNS for name with the cookie given in hex.
+func cookieQ(name, cookie string) *dns.Msg {
+	m := ednsQ(name, dns.TypeA, dns.ClassINET, 1232)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return m
+}
+
+func TestServerCookieDeterministic(t *testing.T) {
+	a, _ := newCookieJar(testCookieSecret)
+	b, _ := newCookieJar(testCookieSecret)
+	other, _ := newCookieJar("0f0e0d0c0b0a09080706050403020100")
+	client := []byte("12345678")
+	ip := net.ParseIP("192.0.2.53")
+	now := time.Unix(1700000000, 0)
+
+	c := a.serverCookie(client, ip, now)
+	if len(c) != serverCookieLen || c[0] != 1 {
+		t.Fatalf("serverCookie = %x, want version 1 of %d bytes", c, serverCookieLen)
+	}
+	if d := b.serverCookie(client, ip, now); !bytes.Equal(c, d) {
+		t.Errorf("serverCookie with the same secret = %x and %x, want equal for instances sharing it", c, d)
+	}
+	if d := a.serverCookie(client, ip, now); !bytes.Equal(c, d) {
+		t.Errorf("serverCookie twice = %x and %x, want equal", c, d)
+	}
+	if d := other.serverCookie(client, ip, now); bytes.Equal(c, d) {
+		t.Error("serverCookie with another secret is the same")
+	}
+	if d := a.serverCookie(client, net.ParseIP("192.0.2.54"), now); bytes.Equal(c, d) {
+		t.Error("serverCookie of another client address is the same")
+	}
+	if !bytes.Equal(a.clientCookie("192.0.2.1:53"), b.clientCookie("192.0.2.1:53")) {
+		t.Error("clientCookie of a backend differs with the same secret")
+	}
+	if bytes.Equal(a.clientCookie("192.0.2.1:53"), a.clientCookie("192.0.2.2:53")) {
+		t.Error("clientCookie is the same for two backends")
+	}
+
+	if _, err := newCookieJar("0011"); err == nil {
+		t.Error("short -cookie-secret accepted")
+	}
+	if _, err := newCookieJar(strings.Repeat("zz", 16)); err == nil {
+		t.Error("non-hex -cookie-secret accepted")
+	}
+}
+
+func TestValidServerCookie(t *testing.T) {
+	j, _ := newCookieJar(testCookieSecret)
+	other, _ := newCookieJar("0f0e0d0c0b0a09080706050403020100")
+	client := []byte("12345678")
+	ip := net.ParseIP("192.0.2.53")
+	now := time.Unix(1700000000, 0)
+	server := j.serverCookie(client, ip, now)
+
+	for _, tt := range []struct {
+		what   string
+		j      *cookieJar
+		client []byte
+		server []byte
+		ip     string
+		now    time.Time
+		valid  bool
+	}{
+		{"same", j, client, server, "192.0.2.53", now, true},
+		{"half an hour later", j, client, server, "192.0.2.53", now.Add(30 * time.Minute), true},
+		{"other client cookie", j, []byte("87654321"), server, "192.0.2.53", now, false},
+		{"other address", j, client, server, "192.0.2.54", now, false},
+		{"other secret", other, client, server, "192.0.2.53", now, false},
+		{"expired", j, client, server, "192.0.2.53", now.Add(serverCookieLifetime + time.Minute), false},
+		{"from the future", j, client, server, "192.0.2.53", now.Add(-serverCookieSkew - time.Minute), false},
+		{"truncated", j, client, server[:12], "192.0.2.53", now, false},
+		{"tampered", j, client, append(append([]byte(nil), server[:15]...), server[15]^1), "192.0.2.53", now, false},
+	} {
+		if got := tt.j.validServerCookie(tt.client, tt.server, net.ParseIP(tt.ip), tt.now); got != tt.valid {
+			t.Errorf("%v: validServerCookie = %v, want %v", tt.what, got, tt.valid)
+		}
+	}
+}
+
+func TestCheckClientCookie(t *testing.T) {
+	j, _ := newCookieJar(testCookieSecret)
+	ip := net.ParseIP("192.0.2.53")
+	now := time.Now()
+	client := "0102030405060708"
+	valid := client + hex.EncodeToString(j.serverCookie([]byte{1, 2, 3, 4, 5, 6, 7, 8}, ip, now))
+	bad := client + strings.Repeat("00", serverCookieLen)
+
+	for _, tt := range []struct {
+		what  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"no EDNS", newQ("example.com.", dns.TypeA), dns.RcodeSuccess},
+		{"no cookie", ednsQ("example.com.", dns.TypeA, dns.ClassINET, 1232), dns.RcodeSuccess},
+		{"client cookie only", cookieQ("example.com.", client), dns.RcodeSuccess},
+		{"valid server cookie", cookieQ("example.com.", valid), dns.RcodeSuccess},
+		{"invalid server cookie", cookieQ("example.com.", bad), dns.RcodeBadCookie},
+		{"short client cookie", cookieQ("example.com.", "0102"), dns.RcodeFormatError},
+		{"short server cookie", cookieQ("example.com.", client+"0102"), dns.RcodeFormatError},
+	} {
+		if got := j.checkClientCookie(tt.req, ip, now); got != tt.rcode {
+			t.Errorf("%v: checkClientCookie = %v, want %v", tt.what, dns.RcodeToString[got], dns.RcodeToString[tt.rcode])
+		}
+	}
+	if !j.authenticated(cookieQ("example.com.", valid)) || j.authenticated(cookieQ("example.com.", client)) {
+		t.Error("authenticated should hold for queries with a server cookie only")
+	}
+}
+
+func TestCookiesProxy(t *testing.T) {
+	useCookies(t)
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+	client := "0102030405060708"
+
+	r := ask(t, "udp", addr, cookieQ("example.com.", client))
+	c := findCookie(r.IsEdns0())
+	if r.Rcode != dns.RcodeSuccess || c == nil || !strings.HasPrefix(c.Cookie, client) || len(c.Cookie) != 2*(clientCookieLen+serverCookieLen) {
+		t.Fatalf("response to a client cookie: %v %v, want success with a server cookie", dns.RcodeToString[r.Rcode], c)
+	}
+	if r := ask(t, "udp", addr, cookieQ("example.com.", c.Cookie)); r.Rcode != dns.RcodeSuccess || len(answerIPs(r)) != 1 {
+		t.Errorf("query with the server cookie returned: got %v, want the answer", dns.RcodeToString[r.Rcode])
+	}
+	bad := client + strings.Repeat("00", serverCookieLen)
+	if r := ask(t, "udp", addr, cookieQ("example.com.", bad)); r.Rcode != dns.RcodeBadCookie || len(r.Answer) != 0 {
+		t.Errorf("query over UDP with an invalid server cookie: got %v, want BADCOOKIE", dns.RcodeToString[r.Rcode])
+	}
+	if r := ask(t, "udp", addr, cookieQ("example.com.", "0102")); r.Rcode != dns.RcodeFormatError {
+		t.Errorf("query with a malformed cookie: got %v, want FORMERR", dns.RcodeToString[r.Rcode])
+	}
+}
+
+// cookieBackend answers with an A record, the client cookie received and
+// server cookie; BADCOOKIE to the first query if badFirst.
+type cookieBackend struct {
+	server   string // hex
+	badFirst bool
+	spoof    bool // answer another client cookie
+
+	mu      sync.Mutex
+	cookies []string // received
+}
+
+func (b *cookieBackend) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	b.mu.Lock()
+	c := findCookie(r.IsEdns0())
+	received := ""
+	if c != nil {
+		received = c.Cookie
+	}
+	b.cookies = append(b.cookies, received)
+	first := len(b.cookies) == 1
+	b.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetEdns0(1232, false)
+	client := received
+	if len(client) > 2*clientCookieLen {
+		client = client[:2*clientCookieLen]
+	}
+	if b.spoof {
+		client = strings.Repeat("ff", clientCookieLen)
+	}
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + b.server})
+	if b.badFirst && first {
+		m.Rcode = dns.RcodeBadCookie
+	} else {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+	w.WriteMsg(m)
+}
+
+func TestCookiesUpstream(t *testing.T) {
+	j, _ := newCookieJar(testCookieSecret)
+	b := &cookieBackend{server: strings.Repeat("ab", 16), badFirst: true}
+	addr := startServer(t, b)
+	client := hex.EncodeToString(j.clientCookie(addr))
+
+	req := ednsQ("example.com.", dns.TypeA, dns.ClassINET, 1232)
+	resp, err := j.exchange(addr, "udp", testOptions(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("after BADCOOKIE: got %v, want the answer of the retry", dns.RcodeToString[resp.Rcode])
+	}
+	if findCookie(resp.IsEdns0()) != nil {
+		t.Error("cookie of the backend not removed from the response")
+	}
+	if _, err := j.exchange(addr, "udp", testOptions(), req); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint([]string{client, client + b.server, client + b.server})
+	b.mu.Lock()
+	got := fmt.Sprint(b.cookies)
+	b.mu.Unlock()
+	if got != want {
+		t.Errorf("cookies sent = %v, want %v", got, want)
+	}
+
+	spoofed := startServer(t, &cookieBackend{spoof: true})
+	if _, err := j.exchange(spoofed, "udp", testOptions(), req); err == nil {
+		t.Error("response with another client cookie accepted")
+	}
+}
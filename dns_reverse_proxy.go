@@ -4,7 +4,7 @@ Binary dns_reverse_proxy is a DNS reverse proxy to route queries to DNS servers.
 To illustrate, imagine an HTTP reverse proxy but for DNS.
 It listens on both TCP/UDP IPv4/IPv6 on specified port.
 Since the upstream servers will not see the real client IPs but the proxy,
-you can specify a list of IPs allowed to transfer (AXFR/IXFR).
+you can specify a list of IPs or CIDR subnets allowed to transfer (AXFR/IXFR).
 
 Example usage:
 
@@ -18,18 +18,25 @@ A query for example.net or example.com will go to 8.8.8.8:53, the default.
 However, a query for subdomain.example.com will go to 8.8.4.4:53. -default
 is optional - if it is not given then the server will return a failure for
 queries for domains where a route has not been given.
+
+Settings can also be loaded from a YAML, JSON or TOML file with -config.
+See README.md for the other features and the config file, and -help for all
+the flags.
 */
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -48,68 +55,451 @@ func (i *flagStringList) Set(value string) error {
 }
 
 var (
-	address = flag.String("address", ":53", "Address to listen to (TCP and UDP)")
+	configFile = flag.String("config", "",
+		"YAML, JSON (.json) or TOML (.toml) file to load address, default, routes and allow-transfer from "+
+			"(flags override it)")
+	check = flag.Bool("check", false,
+		"Check the configuration and print it, then exit without serving")
+
+	addressLists flagStringList
+
+	udpAddress = flag.String("udp-address", "", "Address to listen to over UDP (-address if empty)")
+	tcpAddress = flag.String("tcp-address", "", "Address to listen to over TCP (-address if empty)")
+	listenUDP  = flag.Bool("udp", true, "Listen over UDP")
+	listenTCP  = flag.Bool("tcp", true, "Listen over TCP")
+	network    = flag.String("net", "",
+		"IP version to listen with: 4 for IPv4 only, 6 for IPv6 only, empty for both")
+	tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 8*time.Second,
+		"Time after which TCP connections of clients without a query in flight are closed")
 
 	defaultServer = flag.String("default", "",
 		"Default DNS server where to send queries if no route matched (host:port)")
+	ptrServer = flag.String("ptr-server", "",
+		"DNS server where to send the reverse queries, under in-addr.arpa. and ip6.arpa., which no "+
+			"explicit route for these zones matched (host:port)")
+	fallbackToDefault = flag.Bool("fallback-to-default", false,
+		"Send queries to the default server when all the backends of their route failed")
+	noRouteRcode = flag.String("no-route-rcode", "servfail",
+		"Response code to queries matching no route without default: servfail, refused or nxdomain")
 
-	routeLists flagStringList
-	routes     map[string][]string
+	defaultQtypeLists flagStringList
+
+	routeLists      flagStringList
+	routeRegexLists flagStringList
+	routeRegexFirst = flag.Bool("route-regex-first", false,
+		"Try -route-regex routes before suffix routes instead of after")
 
 	allowTransfer = flag.String("allow-transfer", "",
-		"List of IPs allowed to transfer (AXFR/IXFR)")
-	transferIPs []string
+		"List of IPs or CIDR subnets allowed to transfer (AXFR/IXFR), none if empty")
+	allowQuery = flag.String("allow-query", "0.0.0.0/0,::/0",
+		"List of IPs or CIDR subnets allowed to query, none if empty")
+	allowQtypes = flag.String("allow-qtypes", "",
+		"List of query types answered, such as A,AAAA,MX, others being refused, all if empty")
+	allowOpcodes = flag.String("allow-opcodes", "QUERY,NOTIFY",
+		"List of opcodes forwarded, such as QUERY,NOTIFY,UPDATE, others being answered NOTIMP, none if empty")
+
+	refuseANY = flag.Bool("refuse-any", false, "Answer queries of type ANY with REFUSED")
+	anyHINFO  = flag.Bool("refuse-any-hinfo", false,
+		"Answer queries of type ANY with a HINFO record as per RFC 8482 instead of REFUSED")
+	stripAAAA = flag.Bool("strip-aaaa", false,
+		"Remove AAAA records from responses, for all routes (route-strip-aaaa in the config file "+
+			"enables it per route)")
+	minimalResponses = flag.Bool("minimal-responses", false,
+		"Remove the authority and additional records of responses with an answer, but the OPT record "+
+			"and with DNSSEC the proofs of wildcard answers")
+	normalizeNames = flag.Bool("normalize-names", false,
+		"Lowercase the owner names of records in responses to clients not asking for DNSSEC records "+
+			"(not with DNSSEC validation)")
+	udpMaxResponseSize = flag.Int("udp-max-response-size", 0,
+		"Maximum size in bytes of UDP responses to clients without a valid server cookie, whatever their "+
+			"EDNS payload size, larger ones being truncated against amplification (0 for no limit)")
+	noTCPRetry = flag.Bool("no-tcp-retry", false,
+		"Return truncated UDP responses of upstreams as is instead of querying them again over TCP")
+	clearRD = flag.Bool("clear-rd", false,
+		"Clear recursion desired in queries to upstreams, for all routes (route-clear-rd in the "+
+			"config file enables it per route)")
+
+	cacheEnabled  = flag.Bool("cache", false, "Cache upstream responses according to their TTL")
+	cacheSize     = flag.Int("cache-size", 10000, "Maximum number of responses to cache")
+	cachePrefetch = flag.Bool("cache-prefetch", false,
+		"Refresh in the background cached responses queried again close to their expiry")
+	cachePrefetchThreshold = flag.Float64("cache-prefetch-threshold", 0.9,
+		"Share of the TTL of a cached response after which a query refreshes it with -cache-prefetch")
+	serveStale = flag.Bool("serve-stale", false,
+		"Answer from cached responses expired for less than a day when the backends fail (RFC 8767)")
+	serveStaleTTL = flag.Uint("serve-stale-ttl", 30, "TTL of the stale answers of -serve-stale")
+	responseCache *cache
+
+	ttlMin = flag.Uint("min-ttl", 0, "Raise lower TTLs of responses to this many seconds (0 disables)")
+	ttlMax = flag.Uint("max-ttl", 0, "Cap higher TTLs of responses to this many seconds (0 disables)")
+
+	timeout = flag.Duration("timeout", 2*time.Second,
+		"Timeout of exchanges with upstreams, can be overridden per route in the config file")
+	queryTimeout = flag.Duration("query-timeout", 5*time.Second,
+		"Overall time to answer a query, bounding upstream exchanges and retries")
+	retries      = flag.Int("retries", 0, "Retries of an upstream on timeout or connection error")
+	retryBackoff = flag.Duration("retry-backoff", 100*time.Millisecond,
+		"Delay before the first retry, doubled at each following one")
+
+	strategy = flag.String("strategy", strategyMerge,
+		"How to use the backends of a route: "+strategyMerge+" sends the query to all of them and "+
+			"merges their answers, "+strategyRoundRobin+" sends each query to a single backend in "+
+			"turn, trying the next ones only on error, "+strategyWeighted+" picks that backend at "+
+			"random according to the weights given as host:port#weight, "+strategyFastest+
+			" sends the query to all of them at once and keeps the first successful answer, "+
+			strategyLatency+" sends each query to the backend with the lowest average latency, "+
+			strategyHappyEyeballs+" races the IPv6 and IPv4 addresses of each resolver")
+	mergeMaxAnswers = flag.Int("merge-max-answers", 0,
+		"Maximum number of records in the answers merged by -strategy merge, those over it being dropped "+
+			"(0 for no limit)")
+	mergeMaxAnswersTC = flag.Bool("merge-max-answers-tc", false,
+		"Set TC on merged answers with records dropped by -merge-max-answers")
+)
+
+// noRouteRcodes are the response codes of -no-route-rcode.
+var noRouteRcodes = map[string]int{
+	"servfail": dns.RcodeServerFailure,
+	"refused":  dns.RcodeRefused,
+	"nxdomain": dns.RcodeNameError,
+}
+
+const (
+	strategyMerge         = "merge"
+	strategyRoundRobin    = "round-robin"
+	strategyWeighted      = "weighted"
+	strategyFastest       = "fastest"
+	strategyLatency       = "latency"
+	strategyHappyEyeballs = "happy-eyeballs"
 )
 
 func init() {
-	rand.Seed(time.Now().Unix())
-	flag.Var(&routeLists, "route", "List of routes where to send queries (domain=host:port,[host:port,...])")
+	flag.Var(&addressLists, "address", "List of addresses to listen to over TCP and UDP (default :53)")
+	flag.Var(&routeLists, "route", "List of routes where to send queries ([=]domain=host:port,[host:port,...]), "+
+		"a leading = matching the domain only, a trailing #weight setting the backend weight, "+
+		"backends may be tcp://host:port to always use TCP, tls://host:port for DNS-over-TLS "+
+		"or https:// URLs for DNS-over-HTTPS")
+	flag.Var(&routeRegexLists, "route-regex", "List of routes matching names with a regular expression, "+
+		"case-insensitive and tried in order (pattern=host:port,[host:port,...])")
+	flag.Var(&defaultQtypeLists, "default-qtype", "List of default servers for a query type, "+
+		"used before -default when no route matched (qtype=host:port)")
+	flag.Var(&clientGroupLists, "client-group", "List of client groups (name=cidr[,cidr...]), "+
+		"a client being in the first group containing its IP")
+	flag.Var(&clientRouteLists, "client-route", "List of routes for the clients of a group, "+
+		"taking precedence over the other routes (group:[=]domain=host:port,[host:port,...])")
+	flag.Var(&staticLists, "static", "List of static answers, taking precedence over routes "+
+		"(name=type:value, type being A, AAAA or CNAME)")
+	flag.Var(&overrideLists, "override", "List of answers overriding everything else, such as "+
+		"during maintenance (name=type:value, value being the data of the record as in a zone file)")
+	flag.Var(&localZoneLists, "local-zone", "List of zones answered authoritatively from a zone "+
+		"file, taking precedence over routes (origin=file)")
+	flag.Var(&zoneKeyLists, "zone-key", "List of DNSSEC keys signing the answers of a local zone "+
+		"on the fly, files written by dnssec-keygen (origin=Korigin+alg+tag)")
+	flag.Var(&chaosTXTLists, "chaos-txt", "List of CHAOS TXT answers, such as authors.bind., "+
+		"answered instead of forwarded (name=text)")
 }
 
 func main() {
 	flag.Parse()
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// run starts the proxy and serves until SIGINT or SIGTERM. Startup failures
+// are returned as a *startupError telling the exit code.
+func run() error {
+	if *showVersion {
+		fmt.Println(versionString())
+		return nil
+	}
+
+	if err := validateECS(); err != nil {
+		return validationError(err)
+	}
+	if err := validateAppendDomain(); err != nil {
+		return validationError(err)
+	}
+	if *randomSeed != 0 {
+		random = newRandom(*randomSeed)
+	}
+	var err error
+	if chaosRecords, err = parseChaosTXT(chaosTXTLists); err != nil {
+		return validationError(err)
+	}
+	if *timeout <= 0 || *queryTimeout <= 0 {
+		return validationError(errors.New("invalid -timeout or -query-timeout, must be positive"))
+	}
+	if *tcpIdleTimeout <= 0 {
+		return validationError(errors.New("invalid -tcp-idle-timeout, must be positive"))
+	}
+	if err := validKeepaliveTimeout(*tcpKeepaliveTimeout); err != nil {
+		return validationError(err)
+	}
+	if *retries < 0 || *retryBackoff < 0 {
+		return validationError(errors.New("invalid -retries or -retry-backoff, must not be negative"))
+	}
+	if err := validateAdmin(); err != nil {
+		return validationError(err)
+	}
+	if *udpMaxResponseSize != 0 && *udpMaxResponseSize < dns.MinMsgSize {
+		return validationError(fmt.Errorf("invalid -udp-max-response-size, must be 0 or at least %d", dns.MinMsgSize))
+	}
+	if *mergeMaxAnswers < 0 {
+		return validationError(errors.New("invalid -merge-max-answers, must not be negative"))
+	}
+	if *upstreamQPS < 0 {
+		return validationError(errors.New("invalid -upstream-qps, must not be negative"))
+	}
+	if *ttlMax > 0 && *ttlMin > *ttlMax {
+		return validationError(errors.New("invalid -min-ttl, must not be above -max-ttl"))
+	}
+	switch *network {
+	case "", "4", "6":
+	default:
+		return validationError(fmt.Errorf("invalid -net %q, must be 4, 6 or empty", *network))
+	}
+	if _, ok := noRouteRcodes[*noRouteRcode]; !ok {
+		return validationError(fmt.Errorf("invalid -no-route-rcode %q, must be servfail, refused or nxdomain", *noRouteRcode))
+	}
+	switch *strategy {
+	case strategyMerge, strategyRoundRobin, strategyWeighted, strategyFastest, strategyLatency, strategyHappyEyeballs:
+	default:
+		return validationError(fmt.Errorf("invalid -strategy %q, must be %v, %v, %v, %v, %v or %v", *strategy,
+			strategyMerge, strategyRoundRobin, strategyWeighted, strategyFastest, strategyLatency, strategyHappyEyeballs))
+	}
+	if !*listenUDP && !*listenTCP {
+		return validationError(errors.New("-udp and -tcp cannot both be false"))
+	}
+	if *normalizeNames && *dnssecValidate {
+		return validationError(errors.New("-normalize-names cannot be used with -dnssec-validate"))
+	}
+	if *dohAddress != "" && (*dohCert == "") != (*dohKey == "") {
+		return validationError(errors.New("-doh-cert and -doh-key must be given together"))
+	}
+	if *upstreamSourceIP != "" {
+		if err := setUpstreamSource(*upstreamSourceIP); err != nil {
+			return validationError(err)
+		}
+	}
+	if *upstreamProxy != "" {
+		if err := setUpstreamProxy(*upstreamProxy); err != nil {
+			return validationError(err)
+		}
+	}
+	if validator, err = newDNSSECValidator(*dnssecTrustAnchors); err != nil {
+		return configError(err)
+	}
+	if *recursive {
+		if recursor, err = newResolver(*rootHints); err != nil {
+			return configError(err)
+		}
+	}
+	if *cookiesEnabled {
+		if cookies, err = newCookieJar(*cookieSecret); err != nil {
+			return validationError(err)
+		}
+	}
+	s, err := buildSettings()
+	if err != nil {
+		return configError(err)
+	}
+	current.Store(s)
+	if *upstreamMaxIdleConns > 0 {
+		if conns, err = newConnPool(*upstreamMaxIdleConns, *upstreamIdleTimeout); err != nil {
+			return validationError(err)
+		}
+	}
+	if *healthCheckInterval > 0 {
+		if health, err = newHealthChecker(*healthCheckInterval, *healthCheckName, *healthCheckThreshold); err != nil {
+			return validationError(err)
+		}
+	}
+	if *rateLimit > 0 {
+		if limiter, err = newRateLimiter(*rateLimit, *rateLimitBurst, *rateLimitClients); err != nil {
+			return validationError(err)
+		}
+	}
+	if *maxConcurrentUpstream != 0 {
+		if upstreamSlots, err = newConcurrencyLimiter(*maxConcurrentUpstream, *maxConcurrentUpstreamReject); err != nil {
+			return validationError(err)
+		}
+	}
+	if *upstreamMaxInFlight != 0 {
+		if backendQueues, err = newUpstreamQueues(*upstreamMaxInFlight, *upstreamQueueSize, *upstreamQueuePolicy); err != nil {
+			return validationError(err)
+		}
+	}
+	// Started even without -log-queries for the routes with route-log.
+	if queries, err = newQueryLogger(*logFormat, os.Stderr); err != nil {
+		return validationError(err)
+	}
+	if *captureFile != "" {
+		if capture, err = newCaptureWriter(*captureFile, *captureMaxSize); err != nil {
+			return validationError(err)
+		}
+	}
+	if *cacheEnabled {
+		if *cacheSize <= 0 {
+			return validationError(errors.New("invalid -cache-size, must be positive"))
+		}
+		responseCache = newCache(*cacheSize)
+		if *cachePrefetch {
+			if *cachePrefetchThreshold <= 0 || *cachePrefetchThreshold >= 1 {
+				return validationError(errors.New("invalid -cache-prefetch-threshold, must be between 0 and 1"))
+			}
+			responseCache.prefetch = *cachePrefetchThreshold
+		}
+		if *serveStale {
+			responseCache.stale = maxStale
+		}
+	}
+	if *coalesceQueries {
+		coalesced = newCoalescer()
+	}
+	if *breakerErrorRate != 0 {
+		if breakers, err = newCircuitBreakers(*breakerErrorRate, *breakerWindow, *breakerMinQueries, *breakerCooldown); err != nil {
+			return validationError(err)
+		}
+	}
+	if *check {
+		s.summary(os.Stdout)
+		return nil
+	}
+
+	// Everything is bound before serving so that an address in use fails
+	// the startup. Errors serving afterwards stop the proxy.
+	errs := make(chan error, 1)
+	serveHTTP := func(srv *http.Server, serve func(net.Listener) error) error {
+		l, err := listenHTTP(srv)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := serve(l); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+		return nil
+	}
+
+	var httpServers []*http.Server
+	if *metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", serveMetrics)
+		metricsServer := &http.Server{Addr: *metricsAddress, Handler: mux}
+		if err := serveHTTP(metricsServer, metricsServer.Serve); err != nil {
+			return err
+		}
+		httpServers = append(httpServers, metricsServer)
+	}
 
-	transferIPs = strings.Split(*allowTransfer, ",")
-	routes = make(map[string][]string)
-	for _, routeList := range routeLists {
-		s := strings.SplitN(routeList, "=", 2)
-		if len(s) != 2 || len(s[0]) == 0 || len(s[1]) == 0 {
-			log.Fatal("invalid -route, must be domain=host:port,[host:port,...]")
-		}
-		var backends []string
-		for _, backend := range strings.Split(s[1], ",") {
-			if !validHostPort(backend) {
-				log.Fatalf("invalid host:port for %v", backend)
+	if *statsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/stats", newStatsHandler())
+		statsServer := &http.Server{Addr: *statsAddress, Handler: mux}
+		if err := serveHTTP(statsServer, statsServer.Serve); err != nil {
+			return err
+		}
+		httpServers = append(httpServers, statsServer)
+	}
+
+	if *adminAddress != "" {
+		mux := http.NewServeMux()
+		admin := newAdminHandler(*adminToken)
+		mux.Handle("/routes", admin)
+		mux.Handle("/routes/", admin)
+		adminServer := &http.Server{Addr: *adminAddress, Handler: mux}
+		if err := serveHTTP(adminServer, adminServer.Serve); err != nil {
+			return err
+		}
+		httpServers = append(httpServers, adminServer)
+	}
+
+	var dnsServers []*dns.Server
+	pcs, ls, err := activationSockets()
+	if err != nil {
+		return bindError(err)
+	}
+	if len(pcs)+len(ls) > 0 {
+		// Socket activated: systemd bound the addresses.
+		log.Printf("serving on %d UDP and %d TCP sockets passed by systemd", len(pcs), len(ls))
+		dnsServers = activatedServers(pcs, ls)
+	} else {
+		dnsServers = newDNSServers(s.addresses)
+		for _, srv := range dnsServers {
+			if err := listenDNS(srv); err != nil {
+				return err
 			}
-			backends = append(backends, backend)
 		}
-		if !strings.HasSuffix(s[0], ".") {
-			s[0] += "."
+	}
+	// Set before the probes are served, not to report live with none bound.
+	atomic.StoreInt32(&serving.servers, int32(len(dnsServers)))
+
+	if *healthAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", serveHealthz)
+		mux.HandleFunc("/readyz", serveReadyz)
+		healthServer := &http.Server{Addr: *healthAddress, Handler: mux}
+		if err := serveHTTP(healthServer, healthServer.Serve); err != nil {
+			return err
 		}
-		routes[strings.ToLower(s[0])] = backends
+		httpServers = append(httpServers, healthServer)
 	}
 
-	udpServer := &dns.Server{Addr: *address, Net: "udp"}
-	tcpServer := &dns.Server{Addr: *address, Net: "tcp"}
 	dns.HandleFunc(".", route)
-	go func() {
-		if err := udpServer.ListenAndServe(); err != nil {
-			log.Fatal(err)
+
+	if *dohAddress != "" {
+		dohServer := newDoHServer(*dohAddress, dns.DefaultServeMux)
+		serve := dohServer.Serve
+		if *dohCert != "" {
+			serve = func(l net.Listener) error { return dohServer.ServeTLS(l, *dohCert, *dohKey) }
 		}
-	}()
-	go func() {
-		if err := tcpServer.ListenAndServe(); err != nil {
-			log.Fatal(err)
+		if err := serveHTTP(dohServer, serve); err != nil {
+			return err
 		}
-	}()
+		httpServers = append(httpServers, dohServer)
+	}
+	if conns != nil {
+		go conns.run()
+	}
+	if health != nil {
+		go health.run()
+	}
+	for _, srv := range dnsServers {
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				errs <- err
+			}
+		}(srv)
+	}
 
-	// Wait for SIGINT or SIGTERM
+	// Reload on SIGHUP, dump the statistics on SIGUSR1, wait for SIGINT or
+	// SIGTERM. Dumps have their own deltas, since the previous dump.
+	dumps := newStatsHandler()
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				reload()
+			case syscall.SIGUSR1:
+				dumps.dump()
+			default:
+				break wait
+			}
+		case err := <-errs:
+			return err
+		}
+	}
 
-	udpServer.Shutdown()
-	tcpServer.Shutdown()
+	shutdown(*shutdownTimeout, dnsServers, httpServers)
+	queries.close()
+	capture.close()
+	return nil
 }
 
 func validHostPort(s string) bool {
@@ -120,64 +510,597 @@ func validHostPort(s string) bool {
 	return true
 }
 
-func route(w dns.ResponseWriter, req *dns.Msg) {
-	if len(req.Question) == 0 || !allowed(w, req) {
-		dns.HandleFailed(w, req)
+func route(rw dns.ResponseWriter, req *dns.Msg) {
+	startQuery()
+	defer endQuery()
+	w := newQueryWriter(rw, req)
+	defer queries.log(w, req)
+	queriesTotal.inc()
+	if limiter != nil && !limiter.allow(remoteIP(w).String(), time.Now()) {
+		w.setRoute("ratelimited")
+		if !*rateLimitDrop {
+			refuse(w, req)
+		}
+		return
+	}
+	s := loadSettings()
+	if !containsIP(s.queryNets, remoteIP(w)) {
+		w.setRoute("refused")
+		refuse(w, req)
 		return
 	}
+	if !s.opcodes[req.Opcode] {
+		w.setRoute("notimp")
+		notImplemented(w, req)
+		return
+	}
+	stripKeepalive(req)
+	if len(req.Question) == 0 || !s.allowed(w, req) {
+		w.setRoute("refused")
+		serverFailure(w, req)
+		return
+	}
+	if len(s.qtypes) > 0 && !s.qtypes[req.Question[0].Qtype] {
+		w.setRoute("refused")
+		refuse(w, req)
+		return
+	}
+	if cookies != nil {
+		rcode := cookies.checkClientCookie(req, remoteIP(w), time.Now())
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); rcode == dns.RcodeFormatError || (rcode == dns.RcodeBadCookie && udp) {
+			// Over TCP the client is known not to be spoofed.
+			w.setRoute("badcookie")
+			answerBadCookie(w, req, rcode)
+			return
+		}
+	}
+	if req.Question[0].Qtype == dns.TypeANY && (*refuseANY || *anyHINFO) {
+		w.setRoute("any")
+		answerANY(w, req)
+		return
+	}
+	if name := chaosQuery(req); name != "" {
+		if txt := chaosTXT(name); txt != "" {
+			w.setRoute(strings.TrimSuffix(name, "."))
+			answerChaos(w, req, txt)
+			return
+		}
+		if *refuseBind && name != idServer {
+			w.setRoute("refused")
+			refuse(w, req)
+			return
+		}
+	}
 
 	lcName := strings.ToLower(req.Question[0].Name)
-	var finishResp *dns.Msg
-	finishResp = nil
-	for name, addrs := range routes {
-		if strings.HasSuffix(lcName, name) {
-			addr := addrs[0]
-			collectedAddrs := map[string]bool{}
-
-			for n := range addrs {
-				addr = addrs[n]
-
-				resp, err := proxy(addr, w, req)
+	if m := s.overrides.answer(req); m != nil {
+		w.setRoute("override")
+		writeLocal(w, req, m)
+		return
+	}
+	if m := s.static.answer(req); m != nil {
+		w.setRoute("static")
+		writeLocal(w, req, m)
+		return
+	}
+	if z := s.localZone(lcName); z != nil && req.Question[0].Qclass == dns.ClassINET && !isTransfer(req) {
+		w.setRoute("local-zone")
+		writeLocal(w, req, z.answer(req))
+		return
+	}
+	if s.blocklist.blocked(lcName) {
+		w.setRoute("blocked")
+		blockedQueries.inc()
+		answerBlocked(w, req, s.sinkhole)
+		return
+	}
+	ureq := req // query sent upstream
+	ctx, cancel := context.WithDeadline(withTrace(context.Background(), w.trace), w.start.Add(*queryTimeout))
+	defer cancel()
+	if !isTransfer(req) {
+		ureq = ecsRequest(req, remoteIP(w))
+	}
+	fallback := false // to the default server after the route failed
+	if name, ok := s.router.Route(lcName, remoteIP(w)); ok {
+		if s.logRoutes[name] {
+			w.logRoute = true
+			w.trace.verbose = true
+		}
+		w.setRoute(name)
+		if l := s.qps[name]; l != nil && !l.allow("", time.Now()) {
+			routeRateLimited.inc(name)
+			refuse(w, req)
+			return
+		}
+		canFallback := *fallbackToDefault && !isTransfer(req)
+		addrs := health.filter(s.router.Backends(name))
+		if len(addrs) == 0 && !canFallback {
+			serverFailure(w, req)
+			return
+		}
+		if len(addrs) > 0 {
+			opts := s.options(ctx, name)
+			rreq := ureq
+			if opts.dnssec && !isTransfer(req) {
+				rreq = dnssecRequest(ureq)
+			}
+			resp, err := s.forward(name, addrs, opts, w, rreq)
+			if err == nil {
+				resp = s.searchDomain(ctx, w, ureq, resp)
+			}
+			if err == nil || !canFallback || ctx.Err() != nil {
 				if err != nil {
-					dns.HandleFailed(w, req)
-				}
-				if resp != nil {
-					if finishResp == nil {
-						finishResp = resp
-						for _, d := range resp.Answer {
-							find := strings.Split(d.String(), "\t")[4]
-							collectedAddrs[find] = true
-						}
-					} else {
-						for _, d := range resp.Answer {
-							find := strings.Split(d.String(), "\t")[4]
-							if _, ok := collectedAddrs[find]; !ok {
-								collectedAddrs[find] = true
-								finishResp.Answer = append(finishResp.Answer, d)
-							}
-						}
-					}
+					resp, err = staleResponse(w, opts, rreq, err)
 				}
+				reply(w, req, opts, resp, err)
+				return
 			}
-			w.WriteMsg(finishResp)
-			return
 		}
+		fallback = true
 	}
 
-	if *defaultServer == "" {
-		dns.HandleFailed(w, req)
+	server, routeName := s.router.Default(req.Question[0].Qtype)
+	if server == "" && fallback {
+		serverFailure(w, req)
+		return
+	}
+	if server == "" && recursor != nil && !isTransfer(req) {
+		w.setRoute(recursiveAddr)
+		opts := s.options(ctx, "")
+		resp, err := recursor.answer(opts, req)
+		reply(w, req, opts, resp, err)
+		return
+	}
+	if server == "" {
+		w.setRoute("none")
+		m := new(dns.Msg)
+		m.SetRcode(req, noRouteRcodes[*noRouteRcode])
+		writeLocal(w, req, m)
+		return
+	}
+	if !fallback {
+		w.setRoute(routeName)
+	}
+	if !health.healthy(server) {
+		serverFailure(w, req)
 		return
 	}
 
-	resp, err := proxy(*defaultServer, w, req)
+	opts := s.options(ctx, "")
+	if opts.dnssec && !isTransfer(req) {
+		ureq = dnssecRequest(ureq)
+	}
+	w.upstreams = append(w.upstreams, server)
+	resp, err := proxy(server, opts, w, ureq)
+	if err == nil {
+		resp = s.searchDomain(ctx, w, ureq, resp)
+	} else {
+		resp, err = staleResponse(w, opts, ureq, err)
+	}
+	reply(w, req, opts, resp, err)
+}
+
+// forward sends req to the backends addrs of the route name with -strategy.
+// Transfers go to one backend at a time.
+func (s *settings) forward(name string, addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	switch {
+	case *strategy == strategyWeighted:
+		return weighted(s.weights[name], addrs, opts, w, req)
+	case *strategy == strategyFastest && !isTransfer(req):
+		return fastest(addrs, opts, w, req)
+	case *strategy == strategyLatency && !isTransfer(req):
+		return fastestAverage(addrs, opts, w, req)
+	case *strategy == strategyHappyEyeballs && !isTransfer(req):
+		return happyEyeballs(addrs, opts, w, req)
+	case *strategy == strategyRoundRobin || isTransfer(req):
+		return roundRobin(s.next[name], addrs, opts, w, req)
+	}
+	return merge(addrs, opts, w, req)
+}
+
+// staleResponse returns with -serve-stale the response cached for req from
+// any of the backends tried, which all failed with err, even if it expired,
+// else err.
+func staleResponse(w *queryWriter, opts routeOptions, req *dns.Msg, err error) (*dns.Msg, error) {
+	if responseCache == nil || responseCache.stale == 0 || isTransfer(req) {
+		return nil, err
+	}
+	for _, addr := range w.upstreams {
+		if resp := responseCache.getStale(addr, req, opts.dnssec, opts.ttl, uint32(*serveStaleTTL)); resp != nil {
+			staleResponses.inc()
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// reply writes the single response to a query: a failure if err is set,
+// otherwise resp unless it is nil because proxy already wrote a transfer.
+func reply(w dns.ResponseWriter, req *dns.Msg, opts routeOptions, resp *dns.Msg, err error) {
 	if err != nil {
-		dns.HandleFailed(w, req)
+		serverFailure(w, req)
+		return
 	}
 	if resp != nil {
+		// The backend echoed the RD bit of its query, which may be cleared.
+		resp.RecursionDesired = req.RecursionDesired
+		if opts.dnssec {
+			dnssecResponse(req, resp)
+		}
+		ecsResponse(req, resp)
+		if opts.stripAAAA {
+			stripAAAARecords(resp)
+		}
+		if *minimalResponses {
+			minimizeResponse(req, resp)
+		}
+		if opt := req.IsEdns0(); *normalizeNames && (opt == nil || !opt.Do()) {
+			lowercaseNames(resp)
+		}
+		nsidResponse(req, resp)
+		cookieResponse(w, req, resp)
+		keepaliveResponse(w, req, resp)
+		truncate(w, req, resp)
+		if opts.maxSize > 0 && resp.Len() > opts.maxSize {
+			routeTruncated.inc(opts.route)
+			resp.Truncate(opts.maxSize)
+		}
+		if opts.padding {
+			padResponse(w, req, resp, opts.maxSize)
+		}
 		w.WriteMsg(resp)
 	}
 }
 
+// writeLocal writes the response m to req made by the proxy itself, with the
+// NSID, cookie and keepalive options, truncation and padding of forwarded
+// responses.
+func writeLocal(w dns.ResponseWriter, req, m *dns.Msg) {
+	nsidResponse(req, m)
+	cookieResponse(w, req, m)
+	keepaliveResponse(w, req, m)
+	truncate(w, req, m)
+	if *padding {
+		padResponse(w, req, m, 0)
+	}
+	w.WriteMsg(m)
+}
+
+// truncate removes from resp the records which do not fit in udpLimit,
+// setting TC so that the client retries over TCP. Responses over other
+// transports are left as is.
+func truncate(w dns.ResponseWriter, req, resp *dns.Msg) {
+	size, capped := udpLimit(w, req)
+	if size == 0 {
+		return
+	}
+	if capped && resp.Len() > size {
+		udpCapped.inc()
+	}
+	resp.Truncate(size)
+}
+
+// udpLimit returns the size of the response to req over UDP: the payload
+// size advertised by the client, 512 bytes without EDNS, but at most
+// -udp-max-response-size unless the client is authenticated by a server
+// cookie, in which case capped is true. It is 0 over other transports.
+func udpLimit(w dns.ResponseWriter, req *dns.Msg) (size int, capped bool) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return 0, false
+	}
+	size = dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	if *udpMaxResponseSize > 0 && size > *udpMaxResponseSize && !(cookies != nil && cookies.authenticated(req)) {
+		return *udpMaxResponseSize, true
+	}
+	return size, false
+}
+
+// stripAAAARecords removes the AAAA records of resp and their signatures, a
+// AAAA query being then answered with no records.
+func stripAAAARecords(resp *dns.Msg) {
+	filter := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeAAAA {
+				continue
+			}
+			if rr.Header().Rrtype != dns.TypeAAAA {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Extra = filter(resp.Extra)
+}
+
+// minimizeResponse removes the additional records of resp but its OPT record
+// and, if it has an answer, its authority records. Negative answers and
+// referrals keep their authority section, for the SOA record of negative
+// caching and the name servers, and referrals their glue, without which the
+// servers of a zone named within it could not be reached. The NSEC and NSEC3
+// records proving that a wildcard answer is the closest match are kept for
+// clients asking for DNSSEC records.
+func minimizeResponse(req, resp *dns.Msg) {
+	servers := make(map[string]bool)
+	if len(resp.Answer) == 0 {
+		for _, rr := range resp.Ns {
+			if ns, ok := rr.(*dns.NS); ok {
+				servers[strings.ToLower(ns.Ns)] = true
+			}
+		}
+	}
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		t := rr.Header().Rrtype
+		if t == dns.TypeOPT || (t == dns.TypeA || t == dns.TypeAAAA) && servers[strings.ToLower(rr.Header().Name)] {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	if len(resp.Answer) == 0 {
+		return
+	}
+	opt := req.IsEdns0()
+	ns := resp.Ns[:0]
+	for _, rr := range resp.Ns {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		if opt != nil && opt.Do() && (t == dns.TypeNSEC || t == dns.TypeNSEC3) {
+			ns = append(ns, rr)
+		}
+	}
+	resp.Ns = ns
+}
+
+// lowercaseNames lowercases the owner names of the records of resp, which
+// would invalidate their signatures.
+func lowercaseNames(resp *dns.Msg) {
+	forEachRR(resp, func(rr dns.RR) {
+		h := rr.Header()
+		h.Name = strings.ToLower(h.Name)
+	})
+}
+
+// merge sends req to all the backends and merges the answers of those which
+// responded, up to -merge-max-answers records. It returns the error of the
+// last backend tried if none did.
+func merge(addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	var finishResp *dns.Msg
+	var lastErr error
+	collected := map[string]bool{}
+	for _, addr := range addrs {
+		w.upstreams = append(w.upstreams, addr)
+		resp, err := proxy(addr, opts, w, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if finishResp == nil {
+			finishResp = resp
+			for _, rr := range resp.Answer {
+				collected[recordKey(rr)] = true
+			}
+		} else {
+			for _, rr := range resp.Answer {
+				if key := recordKey(rr); !collected[key] {
+					collected[key] = true
+					finishResp.Answer = append(finishResp.Answer, rr)
+				}
+			}
+		}
+	}
+	if finishResp == nil {
+		return nil, lastErr
+	}
+	if *mergeMaxAnswers > 0 && len(finishResp.Answer) > *mergeMaxAnswers {
+		mergeCapped.inc()
+		finishResp.Answer = finishResp.Answer[:*mergeMaxAnswers]
+		if *mergeMaxAnswersTC {
+			finishResp.Truncated = true
+		}
+	}
+	return finishResp, nil
+}
+
+// recordKey identifies a record by its name, class, type and data, ignoring
+// its TTL, to merge the answers of several backends.
+func recordKey(rr dns.RR) string {
+	h := rr.Header()
+	data := strings.TrimPrefix(rr.String(), h.String())
+	return fmt.Sprintf("%s %d %d %s", strings.ToLower(h.Name), h.Class, h.Rrtype, data)
+}
+
+// roundRobin sends req to the next backend in rotation, falling back to the
+// following ones on error. It returns the error of the last backend tried if
+// they all failed.
+func roundRobin(next *uint64, addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	start := atomic.AddUint64(next, 1) - 1
+	var err error
+	for i := range addrs {
+		addr := addrs[(start+uint64(i))%uint64(len(addrs))]
+		w.upstreams = append(w.upstreams, addr)
+		var resp *dns.Msg
+		if resp, err = proxy(addr, opts, w, req); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// newDNSServers returns the servers listening to each of the addresses over
+// UDP and TCP, unless -udp-address or -tcp-address replace them or either
+// transport is disabled.
+func newDNSServers(addresses []string) []*dns.Server {
+	var servers []*dns.Server
+	if *listenUDP {
+		for _, addr := range listenAddresses(*udpAddress, addresses) {
+			servers = append(servers, &dns.Server{Addr: addr, Net: "udp" + *network, MsgAcceptFunc: acceptMsg, NotifyStartedFunc: serverStarted})
+		}
+	}
+	if *listenTCP {
+		for _, addr := range listenAddresses(*tcpAddress, addresses) {
+			servers = append(servers, &dns.Server{Addr: addr, Net: "tcp" + *network, MsgAcceptFunc: acceptMsg,
+				IdleTimeout: idleTimeout, NotifyStartedFunc: serverStarted})
+		}
+	}
+	return servers
+}
+
+// listenAddresses returns addr, or the common addresses if it is empty.
+func listenAddresses(addr string, common []string) []string {
+	if addr == "" {
+		return common
+	}
+	return []string{addr}
+}
+
+// refuse answers req with REFUSED.
+func refuse(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	writeLocal(w, req, m)
+}
+
+// notImplemented answers req with NOTIMP, for opcodes not forwarded.
+func notImplemented(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNotImplemented)
+	writeLocal(w, req, m)
+}
+
+// serverFailure answers req with SERVFAIL.
+func serverFailure(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	writeLocal(w, req, m)
+}
+
+// idleTimeout is the IdleTimeout of the TCP servers: -tcp-keepalive-timeout
+// if it is advertised to clients, else -tcp-idle-timeout.
+func idleTimeout() time.Duration {
+	if *tcpKeepaliveTimeout > 0 {
+		return *tcpKeepaliveTimeout
+	}
+	return *tcpIdleTimeout
+}
+
+// acceptMsg is the MsgAcceptFunc of the DNS servers: that of the dns package,
+// except that messages of any opcode are accepted for route to forward them
+// or answer NOTIMP as told by -allow-opcodes, not only queries and NOTIFY.
+// UPDATE messages have records in every section.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+	if opcode := int(dh.Bits>>11) & 0xF; dh.Bits&qr == 0 && opcode != dns.OpcodeQuery && opcode != dns.OpcodeNotify {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// answerANY answers a query of type ANY without forwarding it: REFUSED, or
+// with -refuse-any-hinfo the minimal HINFO answer of RFC 8482.
+func answerANY(w dns.ResponseWriter, req *dns.Msg) {
+	if !*anyHINFO {
+		refuse(w, req)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: blockTTL},
+		Cpu: "RFC8482",
+	})
+	writeLocal(w, req, m)
+}
+
+// remoteIP returns the IP address of the client.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	return net.ParseIP(host)
+}
+
+// fastest sends req to all the backends at once and returns the first NOERROR
+// response, cancelling the other exchanges. If none succeeds, the first
+// response received is returned, or the last error.
+func fastest(addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(opts.ctx)
+	defer cancel()
+	opts.ctx = ctx
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	// Buffered so that the exchanges still running on return do not block.
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		w.upstreams = append(w.upstreams, addr)
+		go func(addr string) {
+			resp, err := proxy(addr, opts, w, req)
+			results <- result{resp, err}
+		}(addr)
+	}
+	var first *dns.Msg
+	var err error
+	for range addrs {
+		r := <-results
+		switch {
+		case r.err != nil:
+			err = r.err
+		case r.resp.Rcode == dns.RcodeSuccess:
+			return r.resp, nil
+		case first == nil:
+			first = r.resp
+		}
+	}
+	if first != nil {
+		return first, nil
+	}
+	return nil, err
+}
+
+// weighted sends req to a backend picked at random according to weights,
+// falling back to the following ones on error. If all the weights are zero
+// the backends are picked uniformly.
+func weighted(weights map[string]int, addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	total := 0
+	for _, addr := range addrs {
+		total += weights[addr]
+	}
+	start := 0
+	if total == 0 {
+		start = random.Intn(len(addrs))
+	} else {
+		n := random.Intn(total)
+		for i, addr := range addrs {
+			if n -= weights[addr]; n < 0 {
+				start = i
+				break
+			}
+		}
+	}
+	var err error
+	for i := range addrs {
+		addr := addrs[(start+i)%len(addrs)]
+		w.upstreams = append(w.upstreams, addr)
+		var resp *dns.Msg
+		if resp, err = proxy(addr, opts, w, req); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
 func isTransfer(req *dns.Msg) bool {
 	for _, q := range req.Question {
 		switch q.Qtype {
@@ -188,20 +1111,25 @@ func isTransfer(req *dns.Msg) bool {
 	return false
 }
 
-func allowed(w dns.ResponseWriter, req *dns.Msg) bool {
+func (s *settings) allowed(w dns.ResponseWriter, req *dns.Msg) bool {
 	if !isTransfer(req) {
 		return true
 	}
-	remote, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-	for _, ip := range transferIPs {
-		if ip == remote {
+	ip := remoteIP(w)
+	return ip != nil && containsIP(s.transferNets, ip)
+}
+
+// containsIP returns whether one of nets contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
-func proxy(addr string, w dns.ResponseWriter, req *dns.Msg) (*dns.Msg, error) {
+func proxy(addr string, opts routeOptions, w dns.ResponseWriter, req *dns.Msg) (*dns.Msg, error) {
 	transport := "udp"
 	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		transport = "tcp"
@@ -210,21 +1138,119 @@ func proxy(addr string, w dns.ResponseWriter, req *dns.Msg) (*dns.Msg, error) {
 		if transport != "tcp" {
 			return nil, fmt.Errorf("trnasfer only by tcp")
 		}
-		t := new(dns.Transfer)
-		c, err := t.In(req, addr)
+		started, err := relayTransfer(addr, opts, w, req)
+		if err != nil && !started {
+			return nil, err
+		}
+		// Once the transfer started the client cannot get another response.
 		if err != nil {
+			traceOf(opts.ctx).logf("transfer from %v failed: %v", addr, err)
+		}
+		return nil, nil
+	}
+	if opts.clearRD && req.RecursionDesired {
+		req = req.Copy()
+		req.RecursionDesired = false
+	}
+	if responseCache != nil {
+		if resp, prefetch := responseCache.get(addr, req, opts.dnssec, opts.ttl); resp != nil {
+			cacheLookups.inc("hit")
+			traceOf(opts.ctx).tracef("cached response from %v", addr)
+			if prefetch {
+				cachePrefetches.inc()
+				go prefetchResponse(addr, transport, opts, req.Copy())
+			}
+			return resp, nil
+		}
+		cacheLookups.inc("miss")
+	}
+	if breakers != nil {
+		if !breakers.allow(addr, time.Now()) {
+			breakerRejections.inc(addr)
+			traceOf(opts.ctx).tracef("%v skipped, circuit breaker open", addr)
+			return nil, fmt.Errorf("%v: %w", addr, errBreakerOpen)
+		}
+	}
+	var resp *dns.Msg
+	var shared bool // the outcome is recorded by the identical query in flight
+	var err error
+	if coalesced != nil {
+		resp, shared, err = coalesced.fetch(addr, transport, opts, req)
+	} else {
+		resp, err = fetch(addr, transport, opts, req)
+	}
+	if breakers != nil && !shared {
+		breakers.record(addr, resp, err, time.Now())
+	}
+	return resp, err
+}
+
+// prefetchResponse refreshes the cached response to req from addr, with a
+// context of its own as the query which triggered it is already answered.
+func prefetchResponse(addr, transport string, opts routeOptions, req *dns.Msg) {
+	ctx, cancel := context.WithTimeout(withTrace(context.Background(), traceOf(opts.ctx)), opts.timeout)
+	defer cancel()
+	opts.ctx = ctx
+	traceOf(ctx).tracef("prefetching from %v", addr)
+	fetch(addr, transport, opts, req)
+}
+
+// fetch exchanges req with the backend addr, validates its response and
+// caches it.
+func fetch(addr, transport string, opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	if opts.upstreamQPS > 0 {
+		if err := pacing.wait(opts.ctx, addr, opts.upstreamQPS); err != nil {
 			return nil, err
 		}
-		if err = t.Out(w, req, c); err != nil {
+	}
+	if backendQueues != nil {
+		if err := backendQueues.acquire(opts.ctx, addr); err != nil {
 			return nil, err
 		}
-		return nil, nil
+		defer backendQueues.release(addr)
 	}
-	c := &dns.Client{Net: transport}
-	resp, _, err := c.Exchange(req, addr)
+	start := time.Now()
+	resp, err := exchangeRetry(addr, transport, opts, req)
+	if err == nil && resp.Truncated && transport == "udp" && !*noTCPRetry {
+		// The full answer is truncated again in reply if it does not fit
+		// the payload size of the client either.
+		resp, err = exchangeRetry(addr, "tcp", opts, req)
+	}
+	if errors.Is(err, context.Canceled) {
+		// Another backend answered first.
+		upstreamResponses.inc(addr, "cancelled")
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	upstreamDuration.observe(elapsed, addr)
 	if err != nil {
+		// A failing backend counts as slow as the timeout.
+		latencies.observe(addr, opts.timeout)
+		if malformed(err) {
+			upstreamResponses.inc(addr, "malformed")
+			// Traced only, not to flood the log with those of a broken backend.
+			traceOf(opts.ctx).tracef("%v from %v: malformed response: %v", req.Question[0].Name, addr, err)
+		} else {
+			upstreamResponses.inc(addr, "error")
+		}
 		return nil, err
 	}
+	latencies.observe(addr, elapsed)
+	if opts.dnssec {
+		if err := validator.validate(addr, opts, resp); err != nil {
+			upstreamResponses.inc(addr, "bogus")
+			traceOf(opts.ctx).logf("%v from %v: %v", req.Question[0].Name, addr, err)
+			return nil, err
+		}
+	}
+	upstreamResponses.inc(addr, "success")
+	clampTTLs(resp, uint32(*ttlMin), uint32(*ttlMax))
+	if opts.ttl > 0 {
+		setTTLs(resp, opts.ttl)
+	}
+	if responseCache != nil {
+		responseCache.set(addr, req, opts.dnssec, opts.ttl, resp)
+	}
 
 	//w.WriteMsg(resp)
 	return resp, nil
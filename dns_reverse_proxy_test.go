@@ -0,0 +1,1185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTimeoutFailover(t *testing.T) {
+	slow := startUpstream(t, blackhole)
+	fast := startUpstream(t, answerA("192.0.2.1"))
+	setFlag(t, "strategy", strategyRoundRobin)
+	setFlag(t, "timeout", "200ms")
+	useConfig(t, fmt.Sprintf(`default: %v
+routes:
+  .example.com.: [%v, %v]
+route-timeouts:
+  .example.com.: 50ms
+`, slow, slow, fast))
+	addr := startProxy(t)
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if ips := answerIPs(r); r.Rcode != dns.RcodeSuccess || len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Fatalf("query %d: got %v %v, want the answer of the fast backend", i, dns.RcodeToString[r.Rcode], ips)
+		}
+		// The route timeout applies, not the global one.
+		if elapsed := time.Since(start); elapsed > 190*time.Millisecond {
+			t.Errorf("query %d answered in %v, after the route timeout of 50ms", i, elapsed)
+		}
+	}
+
+	start := time.Now()
+	r := query(t, "udp", addr, "example.org.", dns.TypeA)
+	elapsed := time.Since(start)
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query to a slow default: got %v, want SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("query to a slow default failed in %v, want the global timeout of 200ms", elapsed)
+	}
+}
+
+func TestSingleWriteOnUpstreamFailure(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	down := closedAddr(t)
+	setFlag(t, "strategy", strategyMerge)
+	useConfig(t, fmt.Sprintf(`default: %v
+routes:
+  .partial.example.: [%v, %v, %v]
+  .down.example.: [%v, %v]
+`, down, down, up, down, down, down))
+
+	for _, tt := range []struct {
+		name  string
+		rcode int
+	}{
+		{"www.partial.example.", dns.RcodeSuccess},
+		{"www.down.example.", dns.RcodeServerFailure},
+		{"example.org.", dns.RcodeServerFailure},
+	} {
+		w := newStubWriter("udp", "127.0.0.1:5353")
+		route(w, newQ(tt.name, dns.TypeA))
+		if len(w.msgs) != 1 {
+			t.Errorf("%v: %d responses written, want 1", tt.name, len(w.msgs))
+			continue
+		}
+		if r := w.msgs[0]; r.Rcode != tt.rcode {
+			t.Errorf("%v: got %v, want %v", tt.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+// ednsQ returns a query for name of type qtype and class qclass with EDNS
+// and a payload size of size.
+func ednsQ(name string, qtype, qclass uint16, size uint16) *dns.Msg {
+	m := newQ(name, qtype)
+	m.Question[0].Qclass = qclass
+	m.SetEdns0(size, false)
+	return m
+}
+
+func hasOption(m *dns.Msg, code uint16) bool {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestLocalAnswerTruncated(t *testing.T) {
+	old := chaosRecords
+	chaosRecords = map[string]string{"big.example.": strings.Repeat("x", 250)}
+	t.Cleanup(func() { chaosRecords = old })
+	setFlag(t, "nsid", strings.Repeat("n", 300))
+	useConfig(t, "")
+
+	req := ednsQ("big.example.", dns.TypeTXT, dns.ClassCHAOS, dns.MinMsgSize)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+
+	w := newStubWriter("udp", "127.0.0.1:5353")
+	route(w, req.Copy())
+	if len(w.msgs) != 1 {
+		t.Fatalf("%d responses written, want 1", len(w.msgs))
+	}
+	if r := w.msgs[0]; !r.Truncated || r.Len() > dns.MinMsgSize {
+		t.Errorf("UDP answer of %d bytes, TC %v; want truncated to %d", r.Len(), r.Truncated, dns.MinMsgSize)
+	}
+
+	w = newStubWriter("tcp", "127.0.0.1:5353")
+	route(w, req.Copy())
+	if r := w.msgs[0]; r.Truncated || len(r.Answer) != 1 {
+		t.Errorf("TCP answer truncated (TC %v, %d records), want it whole", r.Truncated, len(r.Answer))
+	}
+}
+
+func TestLocalAnswersKeepalive(t *testing.T) {
+	setFlag(t, "tcp-keepalive-timeout", "1s")
+	setFlag(t, "refuse-any", "true")
+	setFlag(t, "nsid", "proxy1")
+	setFlag(t, "blocklist", writeFile(t, "blocklist.txt", "blocked.example.\n"))
+	useConfig(t, "")
+
+	for _, tt := range []struct {
+		name          string
+		qtype, qclass uint16
+		rcode         int
+	}{
+		{"blocked.example.", dns.TypeA, dns.ClassINET, dns.RcodeNameError},
+		{"example.org.", dns.TypeANY, dns.ClassINET, dns.RcodeRefused},
+		{idServer, dns.TypeTXT, dns.ClassCHAOS, dns.RcodeSuccess},
+		{"example.org.", dns.TypeA, dns.ClassINET, noRouteRcodes[*noRouteRcode]},
+	} {
+		w := newStubWriter("tcp", "127.0.0.1:5353")
+		route(w, ednsQ(tt.name, tt.qtype, tt.qclass, 1232))
+		if len(w.msgs) != 1 {
+			t.Errorf("%v %v: %d responses written, want 1", tt.name, dns.TypeToString[tt.qtype], len(w.msgs))
+			continue
+		}
+		r := w.msgs[0]
+		if r.Rcode != tt.rcode {
+			t.Errorf("%v %v: got %v, want %v", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if !hasOption(r, dns.EDNS0TCPKEEPALIVE) {
+			t.Errorf("%v %v: answer without the TCP keepalive option", tt.name, dns.TypeToString[tt.qtype])
+		}
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	old := random
+	random = newRandom(1)
+	t.Cleanup(func() { random = old })
+	h1, n1 := counting(answerA("192.0.2.1"))
+	h2, n2 := counting(answerA("192.0.2.2"))
+	h3, n3 := counting(answerA("192.0.2.3"))
+	a1, a2, a3 := startUpstream(t, h1), startUpstream(t, h2), startUpstream(t, h3)
+	setFlag(t, "strategy", strategyWeighted)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v#90, %v#10, %v#0]\n", a1, a2, a3))
+
+	const queries = 2000
+	for i := 0; i < queries; i++ {
+		w := newStubWriter("udp", "127.0.0.1:5353")
+		route(w, newQ("www.example.com.", dns.TypeA))
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeSuccess {
+			t.Fatalf("query %d failed: %v", i, w.msgs)
+		}
+	}
+	if got := float64(atomic.LoadInt64(n1)) / queries; got < 0.87 || got > 0.93 {
+		t.Errorf("backend of weight 90 got %.3f of the queries, want about 0.9", got)
+	}
+	if got := float64(atomic.LoadInt64(n2)) / queries; got < 0.07 || got > 0.13 {
+		t.Errorf("backend of weight 10 got %.3f of the queries, want about 0.1", got)
+	}
+	if n := atomic.LoadInt64(n3); n != 0 {
+		t.Errorf("backend of weight 0 got %d queries, want none", n)
+	}
+}
+
+func TestWeightedFallback(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	setFlag(t, "strategy", strategyWeighted)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v#100, %v#0]\n", closedAddr(t), up))
+	w := newStubWriter("udp", "127.0.0.1:5353")
+	route(w, newQ("www.example.com.", dns.TypeA))
+	if ips := answerIPs(w.msgs[0]); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("answer %v, want that of the backend of weight 0 after the other failed", ips)
+	}
+}
+
+func TestRefuseANY(t *testing.T) {
+	h, n := counting(answerA("192.0.2.1"))
+	up := startUpstream(t, h)
+	setFlag(t, "refuse-any", "true")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+
+	t.Run("refused", func(t *testing.T) {
+		addr := startProxy(t)
+		if r := query(t, "udp", addr, "example.com.", dns.TypeANY); r.Rcode != dns.RcodeRefused {
+			t.Errorf("ANY: got %v, want REFUSED", dns.RcodeToString[r.Rcode])
+		}
+		if got := atomic.LoadInt64(n); got != 0 {
+			t.Errorf("ANY forwarded to the backend %d times", got)
+		}
+		if r := query(t, "udp", addr, "example.com.", dns.TypeA); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Errorf("A: got %v with %d records, want the answer of the backend", dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+	})
+
+	t.Run("hinfo", func(t *testing.T) {
+		setFlag(t, "refuse-any-hinfo", "true")
+		addr := startProxy(t)
+		r := query(t, "udp", addr, "example.com.", dns.TypeANY)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Fatalf("ANY with -refuse-any-hinfo: got %v with %d records, want a HINFO answer",
+				dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+		if hinfo, ok := r.Answer[0].(*dns.HINFO); !ok || hinfo.Cpu != "RFC8482" {
+			t.Errorf("ANY with -refuse-any-hinfo answered %v, want the HINFO of RFC 8482", r.Answer[0])
+		}
+		if got := atomic.LoadInt64(n); got != 1 {
+			t.Errorf("%d queries forwarded, want only the A one", got)
+		}
+	})
+}
+
+// answerMany answers every query with n A records, truncated to the payload
+// size of the query over UDP.
+func answerMany(n int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 0; i < n; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(10, 0, byte(i/256), byte(i)),
+			})
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			size := dns.MinMsgSize
+			if opt := r.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+				m.SetEdns0(opt.UDPSize(), false)
+			}
+			m.Truncate(size)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestTruncateToClientSize(t *testing.T) {
+	const records = 120
+	up := startUpstream(t, answerMany(records))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	for _, tt := range []struct {
+		netw      string
+		size      uint16 // 0 without EDNS
+		truncated bool
+	}{
+		{"udp", 0, true},
+		{"udp", 1232, true},
+		{"udp", 4096, false},
+		{"tcp", 0, false},
+	} {
+		req := newQ("www.example.com.", dns.TypeA)
+		limit := dns.MaxMsgSize
+		if tt.netw == "udp" {
+			limit = dns.MinMsgSize
+		}
+		if tt.size > 0 {
+			req.SetEdns0(tt.size, false)
+			limit = int(tt.size)
+		}
+		c := &dns.Client{Net: tt.netw, UDPSize: dns.MaxMsgSize}
+		r, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("%v size %d: %v", tt.netw, tt.size, err)
+		}
+		if r.Truncated != tt.truncated {
+			t.Errorf("%v size %d: TC %v, want %v", tt.netw, tt.size, r.Truncated, tt.truncated)
+		}
+		r.Compress = true
+		if r.Len() > limit {
+			t.Errorf("%v size %d: response of %d bytes, over %d", tt.netw, tt.size, r.Len(), limit)
+		}
+		if !tt.truncated && len(r.Answer) != records {
+			t.Errorf("%v size %d: %d records, want all %d", tt.netw, tt.size, len(r.Answer), records)
+		}
+		if tt.truncated && (len(r.Answer) == 0 || len(r.Answer) == records) {
+			t.Errorf("%v size %d: %d records, want those fitting", tt.netw, tt.size, len(r.Answer))
+		}
+	}
+}
+
+func TestUDPMaxResponseSize(t *testing.T) {
+	const records, max = 60, 600
+	up := startUpstream(t, answerMany(records))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	setFlag(t, "udp-max-response-size", fmt.Sprint(max))
+	useCookies(t)
+	addr := startProxy(t)
+
+	// The server cookie of the client, presented once known.
+	client := "0102030405060708"
+	c := findCookie(ask(t, "tcp", addr, cookieQ("www.example.com.", client)).IsEdns0())
+	if c == nil {
+		t.Fatal("no server cookie")
+	}
+
+	for _, tt := range []struct {
+		what   string
+		netw   string
+		req    *dns.Msg
+		capped bool
+	}{
+		{"UDP", "udp", ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 4096), true},
+		{"UDP with a client cookie", "udp", cookieQ("www.example.com.", client), true},
+		{"UDP with a server cookie", "udp", cookieQ("www.example.com.", c.Cookie), false},
+		{"TCP", "tcp", ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 4096), false},
+	} {
+		before := udpCapped.snapshot()[""]
+		r := ask(t, tt.netw, addr, tt.req)
+		r.Compress = true
+		if tt.capped {
+			if !r.Truncated || r.Len() > max || len(r.Answer) == records {
+				t.Errorf("%v: TC %v, %d records in %d bytes, want truncated to %d bytes", tt.what, r.Truncated, len(r.Answer), r.Len(), max)
+			}
+		} else if r.Truncated || len(r.Answer) != records {
+			t.Errorf("%v: TC %v, %d records, want all %d", tt.what, r.Truncated, len(r.Answer), records)
+		}
+		if n := udpCapped.snapshot()[""] - before; n != map[bool]uint64{true: 1}[tt.capped] {
+			t.Errorf("%v: %d capped responses counted", tt.what, n)
+		}
+	}
+}
+
+func TestAllowQuery(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	for _, tt := range []struct {
+		allow  string
+		client string
+		rcode  int
+	}{
+		{"", "192.0.2.100:5353", dns.RcodeSuccess},
+		{"10.0.0.0/8,::1", "10.1.2.3:5353", dns.RcodeSuccess},
+		{"10.0.0.0/8,::1", "[::1]:5353", dns.RcodeSuccess},
+		{"10.0.0.0/8,::1", "192.0.2.100:5353", dns.RcodeRefused},
+		{"10.0.0.0/8,::1", "[2001:db8::1]:5353", dns.RcodeRefused},
+		{"192.0.2.100", "192.0.2.101:5353", dns.RcodeRefused},
+	} {
+		if tt.allow != "" {
+			setFlag(t, "allow-query", tt.allow)
+		}
+		useConfig(t, fmt.Sprintf("default: %v\n", up))
+		for _, netw := range []string{"udp", "tcp"} {
+			w := newStubWriter(netw, tt.client)
+			route(w, newQ("www.example.com.", dns.TypeA))
+			if len(w.msgs) != 1 || w.msgs[0].Rcode != tt.rcode {
+				t.Errorf("allow-query %q, %v client %v: got %v, want %v", tt.allow, netw, tt.client,
+					w.msgs, dns.RcodeToString[tt.rcode])
+			}
+		}
+	}
+}
+
+// answerRecords answers every query with the records of its type among rrs,
+// given in zone file format.
+func answerRecords(rrs ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				panic(err)
+			}
+			if rr.Header().Rrtype == r.Question[0].Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	key := func(s string) string {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recordKey(rr)
+	}
+	for _, tt := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"example.com. 300 IN MX 10 mx1.example.com.", "EXAMPLE.com. 60 IN MX 10 mx1.example.com.", true},
+		{"example.com. 300 IN MX 10 mx1.example.com.", "example.com. 300 IN MX 20 mx1.example.com.", false},
+		{`example.com. 300 IN TXT "a b" "c"`, `example.com. 30 IN TXT "a b" "c"`, true},
+		{`example.com. 300 IN TXT "a b" "c"`, `example.com. 300 IN TXT "a" "b c"`, false},
+		{"_sip._tcp.example.com. 300 IN SRV 10 5 5060 sip.example.com.", "_sip._tcp.example.com. 5 IN SRV 10 5 5060 sip.example.com.", true},
+		{"_sip._tcp.example.com. 300 IN SRV 10 5 5060 sip.example.com.", "_sip._tcp.example.com. 300 IN SRV 10 5 5061 sip.example.com.", false},
+		{"example.com. 300 IN A 192.0.2.1", "example.com. 300 IN AAAA ::ffff:192.0.2.1", false},
+	} {
+		if got := key(tt.a) == key(tt.b); got != tt.equal {
+			t.Errorf("recordKey(%v) == recordKey(%v) is %v, want %v", tt.a, tt.b, got, tt.equal)
+		}
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	a := startUpstream(t, answerRecords(
+		"example.com. 300 IN MX 10 mx1.example.com.",
+		"example.com. 300 IN MX 20 mx2.example.com.",
+		`example.com. 300 IN TXT "v=spf1 -all"`,
+		`example.com. 300 IN TXT "a b" "c"`,
+		"example.com. 300 IN SRV 10 5 5060 sip1.example.com.",
+	))
+	b := startUpstream(t, answerRecords(
+		"example.com. 60 IN MX 20 mx2.example.com.",
+		"example.com. 60 IN MX 30 mx3.example.com.",
+		`example.com. 60 IN TXT "a b" "c"`,
+		`example.com. 60 IN TXT "a" "b c"`,
+		"example.com. 60 IN SRV 10 5 5060 sip1.example.com.",
+		"example.com. 60 IN SRV 20 5 5060 sip2.example.com.",
+	))
+	setFlag(t, "strategy", strategyMerge)
+	useConfig(t, fmt.Sprintf("routes:\n  example.com.: [%v, %v]\n", a, b))
+	addr := startProxy(t)
+
+	for _, tt := range []struct {
+		qtype uint16
+		want  []string
+	}{
+		{dns.TypeMX, []string{"10 mx1.example.com.", "20 mx2.example.com.", "30 mx3.example.com."}},
+		{dns.TypeTXT, []string{`"v=spf1 -all"`, `"a b" "c"`, `"a" "b c"`}},
+		{dns.TypeSRV, []string{"10 5 5060 sip1.example.com.", "20 5 5060 sip2.example.com."}},
+	} {
+		r := query(t, "udp", addr, "example.com.", tt.qtype)
+		var got []string
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype != tt.qtype {
+				t.Errorf("%v answer has a %v record", dns.TypeToString[tt.qtype], dns.TypeToString[rr.Header().Rrtype])
+			}
+			got = append(got, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("merged %v answer %q, want %q", dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
+
+func TestMergeMaxAnswers(t *testing.T) {
+	var backends []string
+	for i := 0; i < 3; i++ {
+		var rrs []string
+		for j := 1; j <= 4; j++ {
+			rrs = append(rrs, fmt.Sprintf("www.example.com. 60 IN A 10.0.%d.%d", i, j))
+		}
+		backends = append(backends, startUpstream(t, answerRecords(rrs...)))
+	}
+	setFlag(t, "strategy", strategyMerge)
+	useConfig(t, fmt.Sprintf("routes:\n  example.com.: [%v]\n", strings.Join(backends, ", ")))
+
+	for _, tt := range []struct {
+		max     string
+		tc      string
+		answers int
+		capped  bool
+	}{
+		{"0", "false", 12, false},
+		{"20", "true", 12, false},
+		{"5", "false", 5, true},
+		{"5", "true", 5, true},
+	} {
+		t.Run(tt.max+"/"+tt.tc, func(t *testing.T) {
+			setFlag(t, "merge-max-answers", tt.max)
+			setFlag(t, "merge-max-answers-tc", tt.tc)
+			addr := startProxy(t)
+			before := mergeCapped.snapshot()[""]
+			r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+			if len(r.Answer) != tt.answers {
+				t.Errorf("-merge-max-answers %v: %d answers, want %d", tt.max, len(r.Answer), tt.answers)
+			}
+			if want := tt.capped && tt.tc == "true"; r.Truncated != want {
+				t.Errorf("-merge-max-answers %v -merge-max-answers-tc %v: TC %v, want %v", tt.max, tt.tc, r.Truncated, want)
+			}
+			if got := mergeCapped.snapshot()[""] - before; got != map[bool]uint64{true: 1}[tt.capped] {
+				t.Errorf("-merge-max-answers %v: %d capped answers counted", tt.max, got)
+			}
+			if tt.capped {
+				// The answers of the first backends are kept first.
+				if got := fmt.Sprint(answerIPs(r)); got != "[10.0.0.1 10.0.0.2 10.0.0.3 10.0.0.4 10.0.1.1]" {
+					t.Errorf("-merge-max-answers %v: kept %v, want those of the first backends", tt.max, got)
+				}
+			}
+		})
+	}
+}
+
+// localOption returns the data of the local EDNS option code of m, and
+// whether it has it.
+func localOption(m *dns.Msg, code uint16) (string, bool) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == code {
+				return string(l.Data), true
+			}
+		}
+	}
+	return "", false
+}
+
+func TestEDNSOptionsForwarded(t *testing.T) {
+	const toBackend, toClient = 65001, 65002
+	h, n := counting(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		// Echo the option of the client and add another.
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		data, _ := localOption(r, toBackend)
+		m.IsEdns0().Option = append(m.IsEdns0().Option,
+			&dns.EDNS0_LOCAL{Code: toBackend, Data: []byte("echo " + data)},
+			&dns.EDNS0_LOCAL{Code: toClient, Data: []byte("from backend")})
+		w.WriteMsg(m)
+	})
+	useCache(t, 100)
+	useConfig(t, fmt.Sprintf("default: %v\n", startUpstream(t, h)))
+	addr := startProxy(t)
+
+	for i, netw := range []string{"udp", "tcp", "udp"} {
+		req := ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, dns.DefaultMsgSize)
+		req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: toBackend, Data: []byte("from client")})
+		r := ask(t, netw, addr, req)
+		if got, _ := localOption(r, toBackend); got != "echo from client" {
+			t.Errorf("%v: option %d of the client echoed as %q, want it forwarded to the backend", netw, toBackend, got)
+		}
+		if got, _ := localOption(r, toClient); got != "from backend" {
+			t.Errorf("%v: option %d of the backend returned as %q", netw, toClient, got)
+		}
+		// Never from the cache, the response may depend on the option.
+		if got := atomic.LoadInt64(n); got != int64(i+1) {
+			t.Errorf("%v: backend queried %d times after %d queries with an unknown option", netw, got, i+1)
+		}
+	}
+
+	query(t, "udp", addr, "www.example.com.", dns.TypeA)
+	query(t, "udp", addr, "www.example.com.", dns.TypeA)
+	if got := atomic.LoadInt64(n); got != 4 {
+		t.Errorf("backend queried %d times for 2 queries without option, want 1 and the cache", got-3)
+	}
+}
+
+func TestNoRouteRcode(t *testing.T) {
+	useConfig(t, "routes:\n  .example.com.: [192.0.2.1:53]\n")
+	for value, rcode := range map[string]int{
+		"servfail": dns.RcodeServerFailure,
+		"refused":  dns.RcodeRefused,
+		"nxdomain": dns.RcodeNameError,
+	} {
+		setFlag(t, "no-route-rcode", value)
+		w := newStubWriter("udp", "127.0.0.1:5353")
+		route(w, newQ("example.org.", dns.TypeA))
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != rcode {
+			t.Errorf("-no-route-rcode %v: got %v, want %v", value, w.msgs, dns.RcodeToString[rcode])
+		}
+	}
+	if _, ok := noRouteRcodes["noerror"]; ok {
+		t.Error("-no-route-rcode noerror accepted")
+	}
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	setList(t, &addressLists, "127.0.0.1:0", "127.0.0.2:0")
+	s := useConfig(t, fmt.Sprintf("default: %v\n", up))
+	servers := newDNSServers(s.addresses)
+	if len(servers) != 4 {
+		t.Fatalf("%d servers, want one per address and transport", len(servers))
+	}
+	for _, srv := range servers {
+		if err := listenDNS(srv); err != nil {
+			t.Fatal(err)
+		}
+		srv.Handler = dns.HandlerFunc(route)
+		go srv.ActivateAndServe()
+		defer srv.Shutdown()
+	}
+	for _, srv := range servers {
+		netw, addr := "udp", ""
+		if srv.PacketConn != nil {
+			addr = srv.PacketConn.LocalAddr().String()
+		} else {
+			netw, addr = "tcp", srv.Listener.Addr().String()
+		}
+		if ips := answerIPs(query(t, netw, addr, "www.example.com.", dns.TypeA)); len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Errorf("%v listener %v: answer %v, want that of the default", netw, addr, ips)
+		}
+	}
+}
+
+func TestTransportAddresses(t *testing.T) {
+	setFlag(t, "udp-address", "127.0.0.1:5300")
+	servers := newDNSServers([]string{"127.0.0.1:53", "127.0.0.2:53"})
+	var got []string
+	for _, srv := range servers {
+		got = append(got, srv.Net+" "+srv.Addr)
+	}
+	want := "[udp 127.0.0.1:5300 tcp 127.0.0.1:53 tcp 127.0.0.2:53]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("servers %v, want %v", got, want)
+	}
+	setFlag(t, "tcp", "false")
+	if servers := newDNSServers([]string{"127.0.0.1:53"}); len(servers) != 1 || servers[0].Net != "udp" {
+		t.Errorf("%d servers with -tcp=false, want the UDP one", len(servers))
+	}
+}
+
+func TestStripAAAA(t *testing.T) {
+	up := startUpstream(t, answerRecords(
+		"www.example.com. 300 IN CNAME host.example.com.",
+		"host.example.com. 300 IN A 192.0.2.1",
+		"host.example.com. 300 IN AAAA 2001:db8::1",
+	))
+	// chain answers with the CNAME and its target, and the AAAA record as
+	// additional data of A queries.
+	chain := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		cname, _ := dns.NewRR("www.example.com. 300 IN CNAME host.example.com.")
+		a, _ := dns.NewRR("host.example.com. 300 IN A 192.0.2.1")
+		aaaa, _ := dns.NewRR("host.example.com. 300 IN AAAA 2001:db8::1")
+		m.Answer = []dns.RR{cname}
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, a)
+			m.Extra = []dns.RR{aaaa}
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, aaaa)
+		}
+		w.WriteMsg(m)
+	}
+	stripped := startUpstream(t, chain)
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .strip.example.: [%v]\nroute-strip-aaaa: [.strip.example.]\n", up, stripped))
+	addr := startProxy(t)
+
+	r := query(t, "udp", addr, "www.strip.example.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("stripped AAAA query: got %v %v, want NODATA with the CNAME only", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+	r = query(t, "udp", addr, "www.strip.example.", dns.TypeA)
+	if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.1" || len(r.Extra) != 0 {
+		t.Errorf("A query on a stripped route: answer %v, additional %v; want the A record only", ips, r.Extra)
+	}
+	if ips := answerIPs(query(t, "udp", addr, "host.example.com.", dns.TypeAAAA)); len(ips) != 1 || ips[0] != "2001:db8::1" {
+		t.Errorf("AAAA query on another route: answer %v, want it kept", ips)
+	}
+
+	setFlag(t, "strip-aaaa", "true")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	if r := query(t, "tcp", addr, "host.example.com.", dns.TypeAAAA); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("AAAA query with -strip-aaaa: got %v %v, want NODATA", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+	if ips := answerIPs(query(t, "tcp", addr, "host.example.com.", dns.TypeA)); len(ips) != 1 {
+		t.Errorf("A query with -strip-aaaa: answer %v, want it kept", ips)
+	}
+}
+
+func TestFallbackToDefault(t *testing.T) {
+	def := startUpstream(t, answerA("192.0.2.1"))
+	down := closedAddr(t)
+	unhealthy := startUpstream(t, answerA("192.0.2.2"))
+	h, err := newHealthChecker(time.Minute, ".", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.record(unhealthy, errors.New("probe failed"))
+	old := health
+	health = h
+	t.Cleanup(func() { health = old })
+	useConfig(t, fmt.Sprintf(`default: %v
+routes:
+  .down.example.: [%v]
+  .unhealthy.example.: [%v]
+`, def, down, unhealthy))
+
+	for _, fallback := range []bool{false, true} {
+		fallback := fallback
+		t.Run(fmt.Sprint(fallback), func(t *testing.T) {
+			setFlag(t, "fallback-to-default", fmt.Sprint(fallback))
+			addr := startProxy(t)
+			for _, name := range []string{"www.down.example.", "www.unhealthy.example."} {
+				r := query(t, "udp", addr, name, dns.TypeA)
+				ips := answerIPs(r)
+				if fallback && (r.Rcode != dns.RcodeSuccess || len(ips) != 1 || ips[0] != "192.0.2.1") {
+					t.Errorf("%v with -fallback-to-default: got %v %v, want the answer of the default", name, dns.RcodeToString[r.Rcode], ips)
+				}
+				if !fallback && r.Rcode != dns.RcodeServerFailure {
+					t.Errorf("%v without -fallback-to-default: got %v %v, want SERVFAIL", name, dns.RcodeToString[r.Rcode], ips)
+				}
+			}
+		})
+	}
+}
+
+// recordRD answers every query with an A record, recording whether its last
+// query had the RD bit.
+func recordRD(rd *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		v := int32(0)
+		if r.RecursionDesired {
+			v = 1
+		}
+		atomic.StoreInt32(rd, v)
+		answerA("192.0.2.1")(w, r)
+	}
+}
+
+func TestClearRD(t *testing.T) {
+	var authRD, recRD int32
+	auth := startUpstream(t, recordRD(&authRD))
+	rec := startUpstream(t, recordRD(&recRD))
+	useConfig(t, fmt.Sprintf(`default: %v
+routes:
+  .auth.example.: [%v]
+route-clear-rd: [.auth.example.]
+`, rec, auth))
+
+	t.Run("route", func(t *testing.T) {
+		addr := startProxy(t)
+		for _, tt := range []struct {
+			name     string
+			clientRD bool
+			rd       *int32
+			want     int32
+		}{
+			{"www.auth.example.", true, &authRD, 0},
+			{"www.auth.example.", false, &authRD, 0},
+			{"www.example.org.", true, &recRD, 1},
+			{"www.example.org.", false, &recRD, 0},
+		} {
+			m := newQ(tt.name, dns.TypeA)
+			m.RecursionDesired = tt.clientRD
+			r := ask(t, "udp", addr, m)
+			if got := atomic.LoadInt32(tt.rd); got != tt.want {
+				t.Errorf("%v with RD %v: backend got RD %v, want %v", tt.name, tt.clientRD, got == 1, tt.want == 1)
+			}
+			if r.Id != m.Id || r.RecursionDesired != tt.clientRD || len(answerIPs(r)) != 1 {
+				t.Errorf("%v with RD %v: response ID %v RD %v, want those of the query and the answer",
+					tt.name, tt.clientRD, r.Id, r.RecursionDesired)
+			}
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		setFlag(t, "clear-rd", "true")
+		addr := startProxy(t)
+		query(t, "udp", addr, "www.example.org.", dns.TypeA)
+		if atomic.LoadInt32(&recRD) != 0 {
+			t.Error("-clear-rd: backend of the default got RD")
+		}
+	})
+}
+
+func TestRouteQPS(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf(`routes:
+  .limited.example.: [%v]
+  .example.: [%v]
+route-qps:
+  .limited.example.: 2
+`, up, up))
+	addr := startProxy(t)
+	before := routeRateLimited.snapshot()[".limited.example."]
+
+	var rcodes []string
+	for i := 0; i < 4; i++ {
+		rcodes = append(rcodes, dns.RcodeToString[query(t, "udp", addr, "www.limited.example.", dns.TypeA).Rcode])
+	}
+	if got := fmt.Sprint(rcodes); got != "[NOERROR NOERROR REFUSED REFUSED]" {
+		t.Errorf("queries over the QPS of the route: %v, want 2 answered then refused", got)
+	}
+	if n := routeRateLimited.snapshot()[".limited.example."] - before; n != 2 {
+		t.Errorf("%d queries counted as limited, want 2", n)
+	}
+	for i := 0; i < 4; i++ {
+		if r := query(t, "udp", addr, "www.example.", dns.TypeA); r.Rcode != dns.RcodeSuccess {
+			t.Errorf("query %d to another route: got %v, want it answered", i, dns.RcodeToString[r.Rcode])
+		}
+	}
+
+	for _, qps := range []string{"0", "-1"} {
+		setFlag(t, "config", writeFile(t, "config.yaml",
+			fmt.Sprintf("routes:\n  .example.: [%v]\nroute-qps:\n  .example.: %v\n", up, qps)))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("route-qps %v accepted", qps)
+		}
+	}
+}
+
+func TestRouteMaxResponseSize(t *testing.T) {
+	up := startUpstream(t, answerMany(60))
+	useConfig(t, fmt.Sprintf(`routes:
+  .small.example.: [%v]
+  .example.: [%v]
+route-max-response-sizes:
+  .small.example.: 512
+`, up, up))
+	addr := startProxy(t)
+	before := routeTruncated.snapshot()[".small.example."]
+
+	r := query(t, "tcp", addr, "www.small.example.", dns.TypeA)
+	r.Compress = true // as sent
+	if !r.Truncated || r.Len() > 512 || len(r.Answer) == 0 {
+		t.Errorf("response of %d bytes over TCP with TC %v, want it truncated to 512 bytes", r.Len(), r.Truncated)
+	}
+	if n := routeTruncated.snapshot()[".small.example."] - before; n != 1 {
+		t.Errorf("%d responses counted as truncated, want 1", n)
+	}
+	if r := query(t, "tcp", addr, "www.example.", dns.TypeA); r.Truncated || len(r.Answer) != 60 {
+		t.Errorf("response of another route: TC %v and %d records, want the 60", r.Truncated, len(r.Answer))
+	}
+
+	setFlag(t, "config", writeFile(t, "config.yaml",
+		fmt.Sprintf("routes:\n  .example.: [%v]\nroute-max-response-sizes:\n  .example.: 100\n", up)))
+	if _, err := buildSettings(); err == nil {
+		t.Error("route-max-response-sizes below 512 accepted")
+	}
+}
+
+func TestListenTransports(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	for _, tt := range []struct {
+		udp, tcp bool
+		want     string
+	}{
+		{true, true, "[udp tcp]"},
+		{false, true, "[tcp]"},
+		{true, false, "[udp]"},
+	} {
+		setFlag(t, "udp", fmt.Sprint(tt.udp))
+		setFlag(t, "tcp", fmt.Sprint(tt.tcp))
+		servers := newDNSServers([]string{"127.0.0.1:0"})
+		var nets []string
+		for _, srv := range servers {
+			nets = append(nets, srv.Net)
+		}
+		if fmt.Sprint(nets) != tt.want {
+			t.Errorf("-udp=%v -tcp=%v: servers %v, want %v", tt.udp, tt.tcp, nets, tt.want)
+			continue
+		}
+		for _, srv := range servers {
+			if err := listenDNS(srv); err != nil {
+				t.Fatal(err)
+			}
+			srv.Handler = dns.HandlerFunc(route)
+			go srv.ActivateAndServe()
+			defer srv.Shutdown()
+			addr := ""
+			if srv.PacketConn != nil {
+				addr = srv.PacketConn.LocalAddr().String()
+			} else {
+				addr = srv.Listener.Addr().String()
+			}
+			if ips := answerIPs(query(t, srv.Net, addr, "www.example.com.", dns.TypeA)); len(ips) != 1 {
+				t.Errorf("-udp=%v -tcp=%v: %v listener answered %v", tt.udp, tt.tcp, srv.Net, ips)
+			}
+		}
+	}
+
+	setFlag(t, "udp", "false")
+	setFlag(t, "tcp", "false")
+	err := run()
+	if err == nil || exitCode(err) != exitValidation || !strings.Contains(err.Error(), "-udp and -tcp") {
+		t.Errorf("run with -udp=false -tcp=false: %v (exit code %d), want a validation error", err, exitCode(err))
+	}
+}
+
+// answerMixedCase answers every query with an A record and a NS record in
+// the authority section owned by names in mixed case.
+func answerMixedCase(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	m.Answer = append(m.Answer, rrWithTTL("WWW.Example.COM.", 300))
+	m.Ns = append(m.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "Example.COM.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}, Ns: "ns.example.com."})
+	w.WriteMsg(m)
+}
+
+func TestNormalizeNames(t *testing.T) {
+	up := startUpstream(t, answerMixedCase)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	owners := func(r *dns.Msg) string {
+		return r.Answer[0].Header().Name + " " + r.Ns[0].Header().Name
+	}
+
+	t.Run("off", func(t *testing.T) {
+		addr := startProxy(t)
+		if got := owners(query(t, "udp", addr, "www.example.com.", dns.TypeA)); got != "WWW.Example.COM. Example.COM." {
+			t.Errorf("without -normalize-names: owners %v, want those of the backend", got)
+		}
+	})
+	t.Run("on", func(t *testing.T) {
+		setFlag(t, "normalize-names", "true")
+		addr := startProxy(t)
+		r := query(t, "udp", addr, "WWW.example.com.", dns.TypeA)
+		if got := owners(r); got != "www.example.com. example.com." {
+			t.Errorf("with -normalize-names: owners %v, want them lowercase", got)
+		}
+		if r.Question[0].Name != "WWW.example.com." {
+			t.Errorf("with -normalize-names: question %v, want that of the client", r.Question[0].Name)
+		}
+		do := newQ("www.example.com.", dns.TypeA)
+		do.SetEdns0(1232, true)
+		if got := owners(ask(t, "udp", addr, do)); got != "WWW.Example.COM. Example.COM." {
+			t.Errorf("with -normalize-names and DO: owners %v, want those of the backend for their signatures", got)
+		}
+	})
+
+	setFlag(t, "normalize-names", "true")
+
+	setFlag(t, "dnssec-validate", "true")
+	if err := run(); exitCode(err) != exitValidation || !strings.Contains(err.Error(), "-normalize-names") {
+		t.Errorf("run with -normalize-names and -dnssec-validate: %v, want a validation error", err)
+	}
+}
+
+func TestAllowQtypes(t *testing.T) {
+	h, n := counting(answerRecords(
+		"www.example.com. 60 IN A 192.0.2.1",
+		"www.example.com. 60 IN AAAA 2001:db8::1",
+		`www.example.com. 60 IN TXT "text"`,
+	))
+	up := startUpstream(t, h)
+	setFlag(t, "allow-transfer", "127.0.0.1")
+	setFlag(t, "allow-qtypes", "A, aaaa,MX")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	for _, tt := range []struct {
+		netw    string
+		qtype   uint16
+		allowed bool
+	}{
+		{"udp", dns.TypeA, true},
+		{"udp", dns.TypeAAAA, true},
+		{"udp", dns.TypeTXT, false},
+		{"udp", dns.TypeANY, false},
+		{"tcp", dns.TypeAXFR, false},
+	} {
+		before := atomic.LoadInt64(n)
+		r := query(t, tt.netw, addr, "www.example.com.", tt.qtype)
+		forwarded := atomic.LoadInt64(n) > before
+		if tt.allowed && (r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || !forwarded) {
+			t.Errorf("%v allowed: got %v with %d records, want the answer of the backend",
+				dns.TypeToString[tt.qtype], dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+		if !tt.allowed && (r.Rcode != dns.RcodeRefused || forwarded) {
+			t.Errorf("%v not allowed: got %v, forwarded %v; want REFUSED", dns.TypeToString[tt.qtype], dns.RcodeToString[r.Rcode], forwarded)
+		}
+	}
+
+	// From the config file without the flag.
+	setFlag(t, "allow-qtypes", "")
+	useConfig(t, fmt.Sprintf("default: %v\nallow-qtypes: [TXT]\n", up))
+	if r := query(t, "udp", addr, "www.example.com.", dns.TypeTXT); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("TXT allowed by the config file: got %v, want the answer", dns.RcodeToString[r.Rcode])
+	}
+	if r := query(t, "udp", addr, "www.example.com.", dns.TypeA); r.Rcode != dns.RcodeRefused {
+		t.Errorf("A not allowed by the config file: got %v, want REFUSED", dns.RcodeToString[r.Rcode])
+	}
+
+	setFlag(t, "allow-qtypes", "A,BOGUS")
+	setFlag(t, "config", writeFile(t, "config.yaml", fmt.Sprintf("default: %v\n", up)))
+	if _, err := buildSettings(); err == nil {
+		t.Error("-allow-qtypes with an unknown type accepted")
+	}
+}
+
+func TestMinimalResponses(t *testing.T) {
+	// full answers www.example.com. with name servers, their addresses and
+	// the proof of a wildcard, and other names with NXDOMAIN and the SOA
+	// record, echoing the EDNS of the query.
+	full := func(w dns.ResponseWriter, r *dns.Msg) {
+		rrs := func(records ...string) []dns.RR {
+			var out []dns.RR
+			for _, s := range records {
+				rr, err := dns.NewRR(s)
+				if err != nil {
+					panic(err)
+				}
+				out = append(out, rr)
+			}
+			return out
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "www.example.com." {
+			m.Answer = rrs("www.example.com. 300 IN A 192.0.2.1")
+			m.Ns = rrs(
+				"example.com. 300 IN NS ns.example.com.",
+				"*.example.com. 300 IN NSEC z.example.com. A RRSIG NSEC",
+				"*.example.com. 300 IN RRSIG NSEC 13 3 300 20300101000000 20200101000000 1 example.com. AAAA",
+			)
+		} else {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = rrs("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+		}
+		m.Extra = rrs("ns.example.com. 300 IN A 192.0.2.53")
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		w.WriteMsg(m)
+	}
+	up := startUpstream(t, full)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+
+	t.Run("off", func(t *testing.T) {
+		addr := startProxy(t)
+		if r := query(t, "udp", addr, "www.example.com.", dns.TypeA); len(r.Ns) != 3 || len(r.Extra) != 1 {
+			t.Errorf("without -minimal-responses: %d authority and %d additional records, want all kept", len(r.Ns), len(r.Extra))
+		}
+	})
+
+	t.Run("on", func(t *testing.T) {
+		setFlag(t, "minimal-responses", "true")
+		addr := startProxy(t)
+		for _, netw := range []string{"udp", "tcp"} {
+			r := query(t, netw, addr, "www.example.com.", dns.TypeA)
+			if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.1" {
+				t.Errorf("%v: answer %v, want that of the backend", netw, ips)
+			}
+			if len(r.Ns) != 0 || len(r.Extra) != 0 {
+				t.Errorf("%v: authority %v and additional %v, want none", netw, r.Ns, r.Extra)
+			}
+		}
+
+		m := newQ("www.example.com.", dns.TypeA)
+		m.SetEdns0(1232, false)
+		r := ask(t, "udp", addr, m)
+		if len(r.Answer) != 1 || len(r.Ns) != 0 {
+			t.Errorf("with EDNS: %d answers and authority %v, want the answer only", len(r.Answer), r.Ns)
+		}
+		if opt := r.IsEdns0(); opt == nil || len(r.Extra) != 1 {
+			t.Errorf("with EDNS: additional %v, want the OPT record only", r.Extra)
+		}
+
+		m = newQ("www.example.com.", dns.TypeA)
+		m.SetEdns0(1232, true)
+		r = ask(t, "udp", addr, m)
+		if len(r.Ns) != 2 || r.Ns[0].Header().Rrtype != dns.TypeNSEC || r.Ns[1].Header().Rrtype != dns.TypeRRSIG {
+			t.Errorf("with DNSSEC: authority %v, want the NSEC record and its signature only", r.Ns)
+		}
+		if r.IsEdns0() == nil || len(r.Extra) != 1 {
+			t.Errorf("with DNSSEC: additional %v, want the OPT record only", r.Extra)
+		}
+
+		r = query(t, "udp", addr, "nx.example.com.", dns.TypeA)
+		if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("negative answer: %v with authority %v, want NXDOMAIN with the SOA record", dns.RcodeToString[r.Rcode], r.Ns)
+		}
+		if len(r.Extra) != 0 {
+			t.Errorf("negative answer: additional %v, want none", r.Extra)
+		}
+	})
+}
+
+func TestAllowOpcodes(t *testing.T) {
+	h, n := counting(answerRcode(dns.RcodeSuccess))
+	up := startUpstream(t, h)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+	rr, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	update.Insert([]dns.RR{rr})
+	msgs := map[string]*dns.Msg{"QUERY": newQ("www.example.com.", dns.TypeA), "NOTIFY": notify, "UPDATE": update}
+
+	for _, tt := range []struct {
+		flag    string
+		allowed []string
+	}{
+		{"QUERY,NOTIFY", []string{"QUERY", "NOTIFY"}}, // the default
+		{"QUERY", []string{"QUERY"}},
+		{"query, update", []string{"QUERY", "UPDATE"}},
+		{"", nil},
+	} {
+		setFlag(t, "allow-opcodes", tt.flag)
+		useConfig(t, fmt.Sprintf("default: %v\n", up))
+		for _, op := range []string{"QUERY", "NOTIFY", "UPDATE"} {
+			allowed := false
+			for _, a := range tt.allowed {
+				allowed = allowed || a == op
+			}
+			for _, netw := range []string{"udp", "tcp"} {
+				before := atomic.LoadInt64(n)
+				r := ask(t, netw, addr, msgs[op].Copy())
+				forwarded := atomic.LoadInt64(n) > before
+				if allowed && (r.Rcode != dns.RcodeSuccess || !forwarded) {
+					t.Errorf("-allow-opcodes %q: %v %v got %v, forwarded %v; want it forwarded",
+						tt.flag, netw, op, dns.RcodeToString[r.Rcode], forwarded)
+				}
+				if !allowed && (r.Rcode != dns.RcodeNotImplemented || forwarded) {
+					t.Errorf("-allow-opcodes %q: %v %v got %v, forwarded %v; want NOTIMP",
+						tt.flag, netw, op, dns.RcodeToString[r.Rcode], forwarded)
+				}
+				if r.Opcode != msgs[op].Opcode {
+					t.Errorf("-allow-opcodes %q: %v %v answered with opcode %v", tt.flag, netw, op, dns.OpcodeToString[r.Opcode])
+				}
+			}
+		}
+	}
+
+	// From the config file without the flag.
+	setFlag(t, "allow-opcodes", "QUERY,NOTIFY")
+	useConfig(t, fmt.Sprintf("default: %v\nallow-opcodes: [QUERY]\n", up))
+	if r := ask(t, "udp", addr, notify.Copy()); r.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("NOTIFY not allowed by the config file: got %v, want NOTIMP", dns.RcodeToString[r.Rcode])
+	}
+
+	setFlag(t, "allow-opcodes", "QUERY,BOGUS")
+	setFlag(t, "config", writeFile(t, "config.yaml", fmt.Sprintf("default: %v\n", up)))
+	if _, err := buildSettings(); err == nil {
+		t.Error("-allow-opcodes with an unknown opcode accepted")
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	setFlag(t, "tcp-idle-timeout", "200ms")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	conn, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		if err := conn.WriteMsg(newQ("www.example.com.", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		r, err := conn.ReadMsg()
+		if err != nil || len(answerIPs(r)) != 1 {
+			t.Fatalf("query %d: %v, %v; want the answer", i, r, err)
+		}
+		// Queries within the timeout keep the connection open.
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.ReadMsg(); err == nil {
+		t.Fatal("message read from an idle connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("idle connection not closed by the proxy")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle connection closed after %v, want the idle timeout of 200ms", elapsed)
+	}
+}
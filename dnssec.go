@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dnssecValidate = flag.Bool("dnssec-validate", false,
+		"Validate the DNSSEC signatures of answers and answer SERVFAIL if invalid, "+
+			"for all routes (route-dnssec in the config file enables it per route)")
+	dnssecTrustAnchors = flag.String("dnssec-trust-anchors", "",
+		"File of DS or DNSKEY records to trust for DNSSEC validation (root keys if empty)")
+
+	validator *dnssecValidator
+)
+
+// rootTrustAnchors are the DS records of the root key signing keys, KSK-2017
+// and KSK-2024, as published by IANA.
+const rootTrustAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// maxKeysTTL bounds the time validated keys are kept.
+const maxKeysTTL = time.Hour
+
+// dnssecValidator validates DNSSEC signatures up to trust anchors, fetching
+// the DNSKEY and DS records needed from the backends. Validated keys are
+// kept for their TTL.
+type dnssecValidator struct {
+	anchors map[string][]*dns.DS // per zone
+
+	mu   sync.Mutex
+	keys map[string]zoneKeys
+}
+
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// newDNSSECValidator returns a validator trusting the records of the file at
+// path, or the root keys if empty.
+func newDNSSECValidator(path string) (*dnssecValidator, error) {
+	var r io.Reader = strings.NewReader(rootTrustAnchors)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	v := &dnssecValidator{anchors: make(map[string][]*dns.DS), keys: make(map[string]zoneKeys)}
+	zp := dns.NewZoneParser(r, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = rr
+		case *dns.DNSKEY:
+			ds = rr.ToDS(dns.SHA256)
+		default:
+			return nil, fmt.Errorf("%v: trust anchor %v is not a DS or DNSKEY", path, rr)
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(v.anchors) == 0 {
+		return nil, fmt.Errorf("%v: no trust anchor", path)
+	}
+	return v, nil
+}
+
+// dnssecRequest returns a copy of req asking for DNSSEC records.
+func dnssecRequest(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return m
+}
+
+// dnssecResponse removes from resp the DNSSEC records that the original
+// request req of the client did not ask for, after dnssecRequest.
+func dnssecResponse(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	if reqOpt != nil && reqOpt.Do() {
+		return
+	}
+	qtype := req.Question[0].Qtype
+	filter := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; {
+			case t == dns.TypeOPT && reqOpt == nil:
+			case (t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3) && t != qtype:
+			default:
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = filter(resp.Extra)
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
+
+// validate checks that the records of resp, those of the answer or for a
+// negative response those of the authority section, are signed by keys
+// chaining to a trust anchor. Keys are fetched from the backend addr. The
+// records denying the existence of a name are checked for their signatures
+// only.
+func (v *dnssecValidator) validate(addr string, opts routeOptions, resp *dns.Msg) error {
+	section := resp.Answer
+	if len(section) == 0 {
+		section = resp.Ns
+	}
+	rrsets, sigs := splitRRsets(section)
+	if len(rrsets) == 0 {
+		return errors.New("dnssec: no records to validate")
+	}
+	for _, rrset := range rrsets {
+		if err := v.verify(addr, opts, rrset, sigs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rrsetKey identifies a set of records of the same name, type and class.
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+	class  uint16
+}
+
+// splitRRsets groups the records of a section in sets, in order, and the
+// signatures per set they cover.
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	index := make(map[rrsetKey]int)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{strings.ToLower(h.Name), sig.TypeCovered, h.Class}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey{strings.ToLower(h.Name), h.Rrtype, h.Class}
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return rrsets, sigs
+}
+
+// verify checks that one of sigs is a valid signature of rrset.
+func (v *dnssecValidator) verify(addr string, opts routeOptions, rrset []dns.RR, sigs map[rrsetKey][]*dns.RRSIG) error {
+	h := rrset[0].Header()
+	name := strings.ToLower(h.Name)
+	err := fmt.Errorf("dnssec: %v %v is not signed", h.Name, dns.TypeToString[h.Rrtype])
+	for _, sig := range sigs[rrsetKey{name, h.Rrtype, h.Class}] {
+		signer := strings.ToLower(sig.SignerName)
+		// A DS record is signed by the parent zone.
+		if !dns.IsSubDomain(signer, name) || (h.Rrtype == dns.TypeDS && signer == name) {
+			continue
+		}
+		var keys []*dns.DNSKEY
+		if keys, err = v.zoneKeys(addr, opts, signer); err != nil {
+			continue
+		}
+		if err = verifySig(sig, keys, rrset); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifySig checks that sig is a valid signature of rrset by one of keys.
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	for _, k := range keys {
+		if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(k, rrset); err != nil {
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			return fmt.Errorf("dnssec: signature of %v %v by %v expired or not yet valid",
+				sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], sig.SignerName)
+		}
+		return nil
+	}
+	return fmt.Errorf("dnssec: no valid signature of %v %v by %v",
+		sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], sig.SignerName)
+}
+
+// zoneKeys returns the validated DNSKEY records of zone. They are trusted
+// if signed by a key matching a trust anchor or a validated DS record of the
+// parent zone.
+func (v *dnssecValidator) zoneKeys(addr string, opts routeOptions, zone string) ([]*dns.DNSKEY, error) {
+	v.mu.Lock()
+	z, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(z.expire) {
+		return z.keys, nil
+	}
+
+	resp, err := v.query(addr, opts, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*dns.DNSKEY
+	var keySet []dns.RR
+	for _, rr := range resp.Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(k.Hdr.Name, zone) {
+			keys = append(keys, k)
+			keySet = append(keySet, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("dnssec: no DNSKEY for %v", zone)
+	}
+
+	dsSet, ok := v.anchors[zone]
+	if !ok {
+		if zone == "." {
+			return nil, errors.New("dnssec: no trust anchor for the root")
+		}
+		dsResp, err := v.query(addr, opts, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		var rrset []dns.RR
+		for _, rr := range dsResp.Answer {
+			if ds, ok := rr.(*dns.DS); ok && strings.EqualFold(ds.Hdr.Name, zone) {
+				dsSet = append(dsSet, ds)
+				rrset = append(rrset, ds)
+			}
+		}
+		if len(dsSet) == 0 {
+			return nil, fmt.Errorf("dnssec: no DS for %v", zone)
+		}
+		_, sigs := splitRRsets(dsResp.Answer)
+		if err := v.verify(addr, opts, rrset, sigs); err != nil {
+			return nil, err
+		}
+	}
+
+	var secure []*dns.DNSKEY
+	for _, k := range keys {
+		for _, ds := range dsSet {
+			if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+				continue
+			}
+			if d := k.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+				secure = append(secure, k)
+				break
+			}
+		}
+	}
+	if len(secure) == 0 {
+		return nil, fmt.Errorf("dnssec: no DNSKEY of %v matches its DS", zone)
+	}
+	_, sigs := splitRRsets(resp.Answer)
+	err = fmt.Errorf("dnssec: DNSKEY of %v is not signed", zone)
+	for _, sig := range sigs[rrsetKey{zone, dns.TypeDNSKEY, dns.ClassINET}] {
+		if err = verifySig(sig, secure, keySet); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(keySet[0].Header().Ttl) * time.Second
+	if ttl > maxKeysTTL {
+		ttl = maxKeysTTL
+	}
+	v.mu.Lock()
+	v.keys[zone] = zoneKeys{keys: keys, expire: time.Now().Add(ttl)}
+	v.mu.Unlock()
+	return keys, nil
+}
+
+// query asks the backend addr for the DNSSEC records of name.
+func (v *dnssecValidator) query(addr string, opts routeOptions, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	resp, err := exchange(addr, "tcp", opts, m)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("dnssec: %v %v: %v", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dohAddress = flag.String("doh-address", "",
+		"Address to serve DNS-over-HTTPS on at /dns-query (disabled if empty)")
+	dohCert = flag.String("doh-cert", "", "TLS certificate file for -doh-address (plain HTTP if empty)")
+	dohKey  = flag.String("doh-key", "", "TLS key file for -doh-address")
+)
+
+// newDoHServer returns the DNS-over-HTTPS server answering with handler.
+func newDoHServer(addr string, handler dns.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", dohHandler{handler})
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// dohHandler serves DNS-over-HTTPS requests (RFC 8484) with a DNS handler.
+type dohHandler struct {
+	handler dns.Handler
+}
+
+func (h dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(b) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if b, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+	// A transfer needs several messages, which DoH cannot carry.
+	if isTransfer(req) {
+		http.Error(w, "transfers are not supported", http.StatusBadRequest)
+		return
+	}
+
+	dw := newDoHWriter(r)
+	h.handler.ServeDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	out, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if ttl, ok := minTTL(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(out)
+}
+
+// dohWriter is the dns.ResponseWriter of a DNS-over-HTTPS request. It keeps
+// the response to write it as the HTTP response body.
+type dohWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func newDoHWriter(r *http.Request) *dohWriter {
+	w := &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	if a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		w.remote = a
+	}
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = a
+	}
+	return w
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	if w.msg != nil {
+		return fmt.Errorf("response already written")
+	}
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
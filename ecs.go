@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ecsEnabled = flag.Bool("ecs", false,
+		"Add an EDNS Client Subnet option with the subnet of the client to queries sent upstream")
+	ecsPrefix4 = flag.Int("ecs-prefix4", 24, "Prefix length of the IPv4 client subnet sent with -ecs")
+	ecsPrefix6 = flag.Int("ecs-prefix6", 56, "Prefix length of the IPv6 client subnet sent with -ecs")
+	ecsStrip   = flag.Bool("ecs-strip", false,
+		"Remove the EDNS Client Subnet option of incoming queries (replaced by the client subnet with -ecs)")
+)
+
+func validateECS() error {
+	if *ecsPrefix4 < 0 || *ecsPrefix4 > 32 {
+		return fmt.Errorf("invalid -ecs-prefix4 %d, must be 0 to 32", *ecsPrefix4)
+	}
+	if *ecsPrefix6 < 0 || *ecsPrefix6 > 128 {
+		return fmt.Errorf("invalid -ecs-prefix6 %d, must be 0 to 128", *ecsPrefix6)
+	}
+	return nil
+}
+
+// ecsRequest returns the query to send upstream for req from the client ip,
+// with its EDNS Client Subnet option stripped or added as configured. It
+// returns req itself if there is nothing to change.
+func ecsRequest(req *dns.Msg, ip net.IP) *dns.Msg {
+	if !*ecsEnabled && !*ecsStrip {
+		return req
+	}
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if *ecsStrip && opt != nil {
+		opt.Option = withoutECS(opt.Option)
+	}
+	if *ecsEnabled && ip != nil {
+		if opt == nil {
+			// Keep the size a client without EDNS can receive.
+			m.SetEdns0(dns.MinMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		if findECS(opt) == nil {
+			opt.Option = append(opt.Option, newECS(ip))
+		}
+	}
+	return m
+}
+
+// ecsResponse removes from resp the EDNS data that the original request req
+// of the client did not ask for, after ecsRequest added it.
+func ecsResponse(req, resp *dns.Msg) {
+	if !*ecsEnabled && !*ecsStrip {
+		return
+	}
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return
+	}
+	if findECS(reqOpt) == nil {
+		if opt := resp.IsEdns0(); opt != nil {
+			opt.Option = withoutECS(opt.Option)
+		}
+	}
+}
+
+func newECS(ip net.IP) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = uint8(*ecsPrefix4)
+		e.Address = ip4.Mask(net.CIDRMask(*ecsPrefix4, 32))
+	} else {
+		e.Family = 2
+		e.SourceNetmask = uint8(*ecsPrefix6)
+		e.Address = ip.Mask(net.CIDRMask(*ecsPrefix6, 128))
+	}
+	return e
+}
+
+// findECS returns the EDNS Client Subnet option of opt, if any.
+func findECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func withoutECS(options []dns.EDNS0) []dns.EDNS0 {
+	var kept []dns.EDNS0
+	for _, o := range options {
+		if o.Option() != dns.EDNS0SUBNET {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
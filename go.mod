@@ -3,6 +3,8 @@ module github.com/StalkR/dns-reverse-proxy
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/miekg/dns v1.1.50
-	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
 )
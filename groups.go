@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	clientGroupLists flagStringList
+	clientRouteLists flagStringList
+)
+
+// clientGroup is a group of clients with its own routes, taking precedence
+// over the global ones.
+type clientGroup struct {
+	name       string
+	nets       []*net.IPNet
+	routeNames []string // keys of the suffix routes of the group, most specific first
+}
+
+var validGroupName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// parseClientGroupFlag parses a -client-group flag: name=cidr[,cidr...].
+func parseClientGroupFlag(s string) (string, []string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return "", nil, fmt.Errorf("invalid -client-group, must be name=cidr[,cidr...]")
+	}
+	return kv[0], strings.Split(kv[1], ","), nil
+}
+
+// parseClientRouteFlag parses a -client-route flag: group:route, the route
+// being in the format of -route.
+func parseClientRouteFlag(s string) (string, string, []string, error) {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 {
+		return "", "", nil, fmt.Errorf("invalid -client-route, must be group:[=]domain=host:port,[host:port,...]")
+	}
+	domain, backends, err := parseRouteFlag(kv[1])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return kv[0], domain, backends, nil
+}
+
+// groupRouteKey returns the key of the route for domain of the client group.
+func groupRouteKey(group, domain string) string {
+	return group + ":" + domain
+}
+
+// addGroups adds the routes of the client groups of the config file and the
+// flags and returns the groups, those of the config file first in name order.
+func (s *settings) addGroups(cfg *config) ([]clientGroup, error) {
+	var groups []clientGroup
+	index := make(map[string]int)
+	add := func(name string, subnets []string) error {
+		if !validGroupName.MatchString(name) {
+			return fmt.Errorf("invalid client group name %q", name)
+		}
+		nets, err := parseIPNets(subnets)
+		if err != nil {
+			return fmt.Errorf("client group %v: %v", name, err)
+		}
+		if len(nets) == 0 {
+			return fmt.Errorf("client group %v has no subnet", name)
+		}
+		if i, ok := index[name]; ok {
+			groups[i].nets = nets
+			return nil
+		}
+		index[name] = len(groups)
+		groups = append(groups, clientGroup{name: name, nets: nets})
+		return nil
+	}
+	addRoute := func(group, domain string, backends []string) error {
+		if _, ok := index[group]; !ok {
+			return fmt.Errorf("invalid route %v for client group %v: no such group", domain, group)
+		}
+		if len(domain) == 0 || len(backends) == 0 {
+			return fmt.Errorf("invalid route %q for client group %v, must have a domain and backends", domain, group)
+		}
+		return s.setRoute(groupRouteKey(group, normalizeDomain(domain)), backends)
+	}
+
+	names := make([]string, 0, len(cfg.ClientGroups))
+	for name := range cfg.ClientGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := add(name, cfg.ClientGroups[name]); err != nil {
+			return nil, err
+		}
+	}
+	for _, group := range clientGroupLists {
+		name, subnets, err := parseClientGroupFlag(group)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(name, subnets); err != nil {
+			return nil, err
+		}
+	}
+	for group, routes := range cfg.ClientRoutes {
+		for domain, backends := range routes {
+			if err := addRoute(group, domain, backends); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, route := range clientRouteLists {
+		group, domain, backends, err := parseClientRouteFlag(route)
+		if err != nil {
+			return nil, err
+		}
+		if err := addRoute(group, domain, backends); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
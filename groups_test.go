@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientGroupRoutes(t *testing.T) {
+	internal := startUpstream(t, answerA("10.0.0.1"))
+	external := startUpstream(t, answerA("192.0.2.1"))
+	setList(t, &clientGroupLists, "internal=10.0.0.0/8,2001:db8::/32")
+	setList(t, &clientRouteLists, "internal:.example.com.="+internal)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v]\n", external))
+
+	for _, tt := range []struct {
+		client, want string
+	}{
+		{"10.1.2.3:5353", "10.0.0.1"},
+		{"[2001:db8::1]:5353", "10.0.0.1"},
+		{"192.168.1.1:5353", "192.0.2.1"},
+		{"[2001:db9::1]:5353", "192.0.2.1"},
+	} {
+		w := newStubWriter("udp", tt.client)
+		route(w, newQ("www.example.com.", dns.TypeA))
+		if len(w.msgs) != 1 {
+			t.Fatalf("client %v: %d responses written, want 1", tt.client, len(w.msgs))
+		}
+		if ips := answerIPs(w.msgs[0]); len(ips) != 1 || ips[0] != tt.want {
+			t.Errorf("client %v: answer %v, want %v", tt.client, ips, tt.want)
+		}
+	}
+}
+
+func TestClientGroupFallback(t *testing.T) {
+	setList(t, &clientGroupLists, "internal=10.0.0.0/8")
+	setList(t, &clientRouteLists, "internal:.corp.example.=192.0.2.2:53", "internal:=example.com.=192.0.2.3:53")
+	s := useConfig(t, "routes:\n  .example.com.: [192.0.2.1:53]\n")
+	client := net.ParseIP("10.0.0.1")
+	for _, tt := range []struct {
+		name, route string
+	}{
+		{"db.corp.example.", "internal:.corp.example."},
+		{"example.com.", "internal:=example.com."},
+		{"www.example.com.", ".example.com."},
+	} {
+		if route, _ := s.router.Route(tt.name, client); route != tt.route {
+			t.Errorf("Route(%v) for the group = %q, want %q", tt.name, route, tt.route)
+		}
+	}
+	if route, _ := s.router.Route("db.corp.example.", net.ParseIP("192.0.2.100")); route != "" {
+		t.Errorf("route of the group %q taken by a client outside of it", route)
+	}
+}
+
+func TestClientGroupInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		groups, routes []string
+	}{
+		{[]string{"internal=10.0.0.0/33"}, nil},
+		{[]string{"internal=10.0.0.x"}, nil},
+		{[]string{"internal="}, nil},
+		{[]string{"Bad Name=10.0.0.0/8"}, nil},
+		{[]string{"internal=10.0.0.0/8"}, []string{"other:.example.com.=192.0.2.1:53"}},
+	} {
+		setList(t, &clientGroupLists, tt.groups...)
+		setList(t, &clientRouteLists, tt.routes...)
+		setFlag(t, "config", writeFile(t, "config.yaml", ""))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("groups %q with routes %q accepted", tt.groups, tt.routes)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var happyEyeballsDelay = flag.Duration("happy-eyeballs-delay", 250*time.Millisecond,
+	"Time the IPv6 address of a resolver has to answer before its IPv4 address is queried too, "+
+		"with -strategy happy-eyeballs")
+
+// backendFamily returns the address family of the IP of the backend addr,
+// "4" or "6", or "" if it is a name or a DNS-over-HTTPS URL.
+func backendFamily(addr string) string {
+	if strings.HasPrefix(addr, httpsScheme) {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(strings.TrimPrefix(strings.TrimPrefix(addr, tcpScheme), tlsScheme))
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "4"
+	}
+	return "6"
+}
+
+// familyPairs groups addrs in the pairs of addresses of a resolver: its
+// IPv6 then its IPv4 address, the Nth IPv6 backend of a route going with its
+// Nth IPv4 backend. Backends without a pair are alone.
+func familyPairs(addrs []string) [][]string {
+	var v6, v4, others []string
+	for _, addr := range addrs {
+		switch backendFamily(addr) {
+		case "6":
+			v6 = append(v6, addr)
+		case "4":
+			v4 = append(v4, addr)
+		default:
+			others = append(others, addr)
+		}
+	}
+	var pairs [][]string
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		var pair []string
+		if i < len(v6) {
+			pair = append(pair, v6[i])
+		}
+		if i < len(v4) {
+			pair = append(pair, v4[i])
+		}
+		pairs = append(pairs, pair)
+	}
+	for _, addr := range others {
+		pairs = append(pairs, []string{addr})
+	}
+	return pairs
+}
+
+// happyEyeballs sends req to the addresses of a resolver as in RFC 8305: to
+// its IPv6 address, then also to its IPv4 address if the first has not
+// answered within -happy-eyeballs-delay or failed, the first answer winning.
+// The next resolvers are tried only if both addresses fail.
+func happyEyeballs(addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for _, pair := range familyPairs(addrs) {
+		var resp *dns.Msg
+		if resp, err = race(pair, opts, w, req); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// race sends req to the first of addrs, then to the next one after
+// -happy-eyeballs-delay or as soon as it fails, and returns the first
+// response which is not SERVFAIL, else the last response or error.
+func race(addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(opts.ctx)
+	defer cancel()
+	opts.ctx = ctx
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	// Buffered so that the exchanges still running on return do not block.
+	results := make(chan result, len(addrs))
+	started := 0
+	start := func() {
+		addr := addrs[started]
+		started++
+		w.upstreams = append(w.upstreams, addr)
+		go func() {
+			resp, err := proxy(addr, opts, w, req)
+			results <- result{resp, err}
+		}()
+	}
+	start()
+	delay := time.NewTimer(*happyEyeballsDelay)
+	defer delay.Stop()
+	var last result
+	for done := 0; done < len(addrs); {
+		select {
+		case <-delay.C:
+			if started < len(addrs) {
+				traceOf(ctx).tracef("%v slow, racing %v", addrs[0], addrs[started])
+				start()
+			}
+			continue
+		case last = <-results:
+			done++
+		}
+		if last.err == nil && last.resp.Rcode != dns.RcodeServerFailure {
+			return last.resp, nil
+		}
+		if started < len(addrs) {
+			start()
+		}
+	}
+	return last.resp, last.err
+}
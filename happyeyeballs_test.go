@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFamilyPairs(t *testing.T) {
+	got := familyPairs([]string{
+		"[2001:db8::1]:53",
+		"192.0.2.1:53",
+		"dns.example:53",
+		"[2001:db8::2]:53",
+		"tls://192.0.2.2:853",
+		"https://dns.example/dns-query",
+	})
+	want := [][]string{
+		{"[2001:db8::1]:53", "192.0.2.1:53"},
+		{"[2001:db8::2]:53", "tls://192.0.2.2:853"},
+		{"dns.example:53"},
+		{"https://dns.example/dns-query"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("familyPairs = %v, want %v", got, want)
+	}
+}
+
+// useHappyEyeballs sets -strategy happy-eyeballs with a delay of 100ms.
+func useHappyEyeballs(t *testing.T) {
+	setFlag(t, "strategy", strategyHappyEyeballs)
+	setFlag(t, "happy-eyeballs-delay", "100ms")
+	setFlag(t, "timeout", "2s")
+}
+
+// startRace starts a proxy routing .example.com. to the addresses v6 and v4
+// of a resolver.
+func startRace(t *testing.T, v6, v4 string) string {
+	t.Helper()
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%q, %q]\n", v6, v4))
+	return startProxy(t)
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	useHappyEyeballs(t)
+	h4, n4 := counting(answerA("192.0.2.4"))
+	v4 := startUpstream(t, h4)
+	blackholed := startServerAt(t, dns.HandlerFunc(blackhole), "[::1]:0")
+	v6 := startServerAt(t, answerA("192.0.2.6"), "[::1]:0")
+
+	t.Run("blackholed", func(t *testing.T) {
+		// The IPv4 address answers after the delay, not the timeout.
+		addr := startRace(t, blackholed, v4)
+		start := time.Now()
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		elapsed := time.Since(start)
+		if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.4" {
+			t.Errorf("blackholed IPv6: answer %v, want that of IPv4", ips)
+		}
+		if elapsed < 100*time.Millisecond || elapsed > time.Second {
+			t.Errorf("blackholed IPv6: answered in %v, want after the delay of 100ms", elapsed)
+		}
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		// An IPv6 address failing at once has the IPv4 address raced at once.
+		addr := startRace(t, "[::1]:1", v4)
+		start := time.Now()
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.4" {
+			t.Errorf("failing IPv6: answer %v, want that of IPv4", ips)
+		}
+		if elapsed := time.Since(start); elapsed > 90*time.Millisecond {
+			t.Errorf("failing IPv6: answered in %v, want before the delay", elapsed)
+		}
+	})
+
+	t.Run("working", func(t *testing.T) {
+		// A working IPv6 address answers alone.
+		addr := startRace(t, v6, v4)
+		before := atomic.LoadInt64(n4)
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.6" {
+			t.Errorf("working IPv6: answer %v, want that of IPv6", ips)
+		}
+		if atomic.LoadInt64(n4) != before {
+			t.Error("working IPv6: IPv4 queried too")
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	healthCheckInterval = flag.Duration("health-check-interval", 0,
+		"Interval between health probes of the backends (0 disables health checking)")
+	healthCheckName = flag.String("health-check-name", ".",
+		"Name queried (SOA) to probe the health of the backends")
+	healthCheckThreshold = flag.Int("health-check-threshold", 3,
+		"Consecutive failed probes after which a backend is marked down")
+
+	health *healthChecker // nil if health checking is disabled
+)
+
+// backendHealth is the health state of a backend.
+type backendHealth struct {
+	up        bool
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// healthChecker periodically probes the backends of the current settings and
+// tracks which ones are up.
+type healthChecker struct {
+	interval  time.Duration
+	name      string
+	threshold int
+
+	mu       sync.RWMutex
+	backends map[string]*backendHealth
+}
+
+func newHealthChecker(interval time.Duration, name string, threshold int) (*healthChecker, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("invalid -health-check-threshold, must be positive")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid -health-check-name %q", name)
+	}
+	return &healthChecker{
+		interval:  interval,
+		name:      dns.Fqdn(name),
+		threshold: threshold,
+		backends:  make(map[string]*backendHealth),
+	}, nil
+}
+
+// healthy returns whether addr is usable. Backends not probed yet are
+// considered healthy.
+func (h *healthChecker) healthy(addr string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	b, ok := h.backends[addr]
+	return !ok || b.up
+}
+
+// filter returns the healthy backends of addrs.
+func (h *healthChecker) filter(addrs []string) []string {
+	if h == nil {
+		return addrs
+	}
+	var up []string
+	for _, addr := range addrs {
+		if h.healthy(addr) {
+			up = append(up, addr)
+		}
+	}
+	return up
+}
+
+// status returns a copy of the health state of every probed backend.
+func (h *healthChecker) status() map[string]backendHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := make(map[string]backendHealth, len(h.backends))
+	for addr, b := range h.backends {
+		status[addr] = *b
+	}
+	return status
+}
+
+// run probes the backends every interval, forever.
+func (h *healthChecker) run() {
+	for {
+		h.checkAll()
+		time.Sleep(h.interval)
+	}
+}
+
+// checkAll probes concurrently every backend of the current settings.
+func (h *healthChecker) checkAll() {
+	addrs := loadSettings().backends()
+	var wg sync.WaitGroup
+	for addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			h.record(addr, h.probe(addr))
+		}(addr)
+	}
+	wg.Wait()
+
+	// Forget backends no longer configured.
+	h.mu.Lock()
+	for addr := range h.backends {
+		if !addrs[addr] {
+			delete(h.backends, addr)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *healthChecker) probe(addr string) error {
+	req := new(dns.Msg)
+	req.SetQuestion(h.name, dns.TypeSOA)
+	resp, err := exchange(addr, "udp", routeOptions{timeout: h.interval, ctx: context.Background()}, req)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode == dns.RcodeServerFailure {
+		return fmt.Errorf("rcode %v", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (h *healthChecker) record(addr string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.backends[addr]
+	if !ok {
+		b = &backendHealth{up: true}
+		h.backends[addr] = b
+	}
+	b.lastCheck = time.Now()
+	if err == nil {
+		if !b.up {
+			log.Printf("backend %v is up", addr)
+		}
+		b.up = true
+		b.failures = 0
+		b.lastError = ""
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.up && b.failures >= h.threshold {
+		log.Printf("backend %v is down after %d failed probes: %v", addr, b.failures, err)
+		b.up = false
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startServer serves h over UDP and TCP on the same random port of the
+// loopback and returns its address.
+func startServer(t *testing.T, h dns.Handler) string {
+	t.Helper()
+	return startServerAt(t, h, "127.0.0.1:0")
+}
+
+// startServerAt serves h over UDP and TCP at addr and returns its address.
+// With port 0 a port free over both is picked.
+func startServerAt(t *testing.T, h dns.Handler, addr string) string {
+	t.Helper()
+	return serveAt(t, h, addr, nil)
+}
+
+// serveAt is startServerAt with idle, if not nil, the IdleTimeout of the TCP
+// server. The servers are shut down at the end of the test, handlers
+// included, before the cleanups registered earlier restore the globals they
+// read.
+func serveAt(t *testing.T, h dns.Handler, addr string, idle func() time.Duration) string {
+	t.Helper()
+	var pc net.PacketConn
+	var l net.Listener
+	for attempt := 0; ; attempt++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", addr); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		// The port picked for UDP may be taken over TCP.
+		if _, port, _ := net.SplitHostPort(addr); port != "0" || attempt == 10 {
+			t.Fatal(err)
+		}
+	}
+	addr = pc.LocalAddr().String()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	udp := &dns.Server{PacketConn: pc, Handler: h, MsgAcceptFunc: acceptMsg, NotifyStartedFunc: wg.Done}
+	tcp := &dns.Server{Listener: l, Handler: h, MsgAcceptFunc: acceptMsg, IdleTimeout: idle, NotifyStartedFunc: wg.Done}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	wg.Wait()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return addr
+}
+
+// startUpstream starts a backend answering with h.
+func startUpstream(t *testing.T, h dns.HandlerFunc) string {
+	t.Helper()
+	return startServer(t, h)
+}
+
+// startProxy starts the proxy, answering with the current settings. Its
+// handlers read the flags and globals: set them before starting it, so that
+// they are restored once it is shut down.
+func startProxy(t *testing.T) string {
+	t.Helper()
+	return serveAt(t, dns.HandlerFunc(route), "127.0.0.1:0", idleTimeout)
+}
+
+// answerA answers every query with an A record of ip.
+func answerA(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip),
+		})
+		w.WriteMsg(m)
+	}
+}
+
+// answerRcode answers every query with rcode.
+func answerRcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+// blackhole never answers.
+func blackhole(w dns.ResponseWriter, r *dns.Msg) {}
+
+// newQ returns a query for name of type qtype.
+func newQ(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+// ask sends m to addr over netw and returns the response.
+func ask(t *testing.T, netw, addr string, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	c := &dns.Client{Net: netw, Timeout: 5 * time.Second}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("%v query for %v to %v: %v", netw, m.Question[0].Name, addr, err)
+	}
+	return r
+}
+
+// query sends a query for name of type qtype to addr over netw and returns
+// the response.
+func query(t *testing.T, netw, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	return ask(t, netw, addr, newQ(name, qtype))
+}
+
+// answerIPs returns the addresses of the A and AAAA records of the answer of m.
+func answerIPs(m *dns.Msg) []string {
+	var ips []string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		}
+	}
+	return ips
+}
+
+// setFlag sets the flag name to value for the duration of the test. Unlike
+// flag.Set it does not mark the flag as given on the command line, so that
+// the config file still applies. Flags read by the proxy must be set before
+// starting it.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag %v", name)
+	}
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("flag %v: %v", name, err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// giveFlags sets the flags to their values as if given on the command line,
+// taking precedence over the config file, for the duration of the test. The
+// flags given by an earlier call are not any longer.
+func giveFlags(t *testing.T, flags map[string]string) {
+	t.Helper()
+	old := flag.CommandLine
+	fs := flag.NewFlagSet(old.Name(), flag.ContinueOnError)
+	old.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	for name, value := range flags {
+		setFlag(t, name, value)
+		if err := fs.Set(name, value); err != nil {
+			t.Fatalf("flag %v: %v", name, err)
+		}
+	}
+	flag.CommandLine = fs
+	t.Cleanup(func() { flag.CommandLine = old })
+}
+
+// setList sets the repeated flag list to values for the duration of the
+// test.
+func setList(t *testing.T, list *flagStringList, values ...string) {
+	old := *list
+	*list = values
+	t.Cleanup(func() { *list = old })
+}
+
+// writeFile writes content to name in a temporary directory of the test and
+// returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useConfig builds the settings from the YAML config file content and the
+// flags, and makes them current for the duration of the test.
+func useConfig(t *testing.T, content string) *settings {
+	t.Helper()
+	setFlag(t, "config", writeFile(t, "config.yaml", content))
+	s, err := buildSettings()
+	if err != nil {
+		t.Fatalf("buildSettings: %v", err)
+	}
+	old := current.Load()
+	current.Store(s)
+	t.Cleanup(func() {
+		if old != nil {
+			current.Store(old)
+		}
+	})
+	return s
+}
+
+// stubWriter is a ResponseWriter recording the messages written.
+type stubWriter struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+	err    error // returned by WriteMsg
+}
+
+func newStubWriter(network, remote string) *stubWriter {
+	var addr net.Addr
+	if network == "tcp" {
+		addr, _ = net.ResolveTCPAddr("tcp", remote)
+	} else {
+		addr, _ = net.ResolveUDPAddr("udp", remote)
+	}
+	return &stubWriter{remote: addr}
+}
+
+func (w *stubWriter) LocalAddr() net.Addr         { return w.remote }
+func (w *stubWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *stubWriter) WriteMsg(m *dns.Msg) error   { w.msgs = append(w.msgs, m); return w.err }
+func (w *stubWriter) Write(b []byte) (int, error) { return len(b), w.err }
+func (w *stubWriter) Close() error                { return nil }
+func (w *stubWriter) TsigStatus() error           { return nil }
+func (w *stubWriter) TsigTimersOnly(bool)         {}
+func (w *stubWriter) Hijack()                     {}
+
+// closedAddr returns a loopback address nothing listens on, so that
+// exchanges with it fail at once.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+// counting returns h, and the number of queries it answered.
+func counting(h dns.HandlerFunc) (dns.HandlerFunc, *int64) {
+	n := new(int64)
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt64(n, 1)
+		h(w, r)
+	}, n
+}
+
+// useCache enables a response cache of size responses for the duration of
+// the test, and returns it.
+func useCache(t *testing.T, size int) *cache {
+	old := responseCache
+	responseCache = newCache(size)
+	t.Cleanup(func() { responseCache = old })
+	return responseCache
+}
+
+// answerTTL answers every query with an A record of 192.0.2.1 of TTL ttl.
+func answerTTL(ttl uint32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		w.WriteMsg(m)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var tcpKeepaliveTimeout = flag.Duration("tcp-keepalive-timeout", 0,
+	"Idle timeout of TCP connections advertised to clients with the EDNS TCP keepalive option (RFC 7828), "+
+		"and applied instead of -tcp-idle-timeout (0 to not advertise it)")
+
+// keepaliveUnit is the unit of the timeout of the TCP keepalive option.
+const keepaliveUnit = 100 * time.Millisecond
+
+// validKeepaliveTimeout returns an error if d, the -tcp-keepalive-timeout,
+// cannot be sent in the option.
+func validKeepaliveTimeout(d time.Duration) error {
+	if d < 0 || (d > 0 && d < keepaliveUnit) || d > 0xffff*keepaliveUnit {
+		return fmt.Errorf("invalid -tcp-keepalive-timeout %v, must be 0 or within %v and %v",
+			d, keepaliveUnit, 0xffff*keepaliveUnit)
+	}
+	return nil
+}
+
+// stripKeepalive removes the TCP keepalive option from req, which concerns
+// the connection of the client only and must not be sent to backends over
+// UDP.
+func stripKeepalive(req *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil {
+		opt.Option = withoutKeepalive(opt.Option)
+	}
+}
+
+// keepaliveResponse sets the TCP keepalive option of resp, replacing that of
+// the upstream, to -tcp-keepalive-timeout if the client queried over TCP
+// with EDNS, as allowed by RFC 7828 whether or not it sent the option. Over
+// UDP and DNS-over-HTTPS, which has the keepalive of HTTP, it is removed.
+func keepaliveResponse(w dns.ResponseWriter, req, resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt != nil {
+		opt.Option = withoutKeepalive(opt.Option)
+	}
+	reqOpt := req.IsEdns0()
+	if *tcpKeepaliveTimeout == 0 || reqOpt == nil || !overTCP(w) {
+		return
+	}
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: uint16(*tcpKeepaliveTimeout / keepaliveUnit),
+	})
+}
+
+// overTCP returns whether the client of w queried over TCP or TLS, not UDP
+// nor DNS-over-HTTPS.
+func overTCP(w dns.ResponseWriter) bool {
+	if qw, ok := w.(*queryWriter); ok {
+		w = qw.ResponseWriter
+	}
+	if _, ok := w.(*dohWriter); ok {
+		return false
+	}
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
+func withoutKeepalive(options []dns.EDNS0) []dns.EDNS0 {
+	kept := options[:0]
+	for _, o := range options {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
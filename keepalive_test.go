@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// keepaliveOf returns the timeout of the TCP keepalive options of m, in
+// units of 100ms.
+func keepaliveOf(m *dns.Msg) []uint16 {
+	var timeouts []uint16
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				timeouts = append(timeouts, ka.Timeout)
+			}
+		}
+	}
+	return timeouts
+}
+
+// keepaliveQ returns an EDNS query for name with a TCP keepalive option.
+func keepaliveQ(name string) *dns.Msg {
+	m := ednsQ(name, dns.TypeA, dns.ClassINET, 1232)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	return m
+}
+
+func TestKeepalive(t *testing.T) {
+	// The backend answers with a keepalive option of its own, and counts
+	// the queries forwarded with one.
+	var forwarded int64
+	up := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if hasOption(r, dns.EDNS0TCPKEEPALIVE) {
+			atomic.AddInt64(&forwarded, 1)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, rrWithTTL(r.Question[0].Name, 300))
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 9999})
+		}
+		w.WriteMsg(m)
+	})
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+
+	t.Run("advertised", func(t *testing.T) {
+		setFlag(t, "tcp-keepalive-timeout", "1m")
+		addr := startProxy(t)
+
+		for _, tt := range []struct {
+			what string
+			netw string
+			m    *dns.Msg
+			want string
+		}{
+			{"TCP with the option", "tcp", keepaliveQ("www.example.com."), "[600]"},
+			{"TCP with EDNS", "tcp", ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 1232), "[600]"},
+			{"TCP without EDNS", "tcp", newQ("www.example.com.", dns.TypeA), "[]"},
+			{"UDP with the option", "udp", keepaliveQ("www.example.com."), "[]"},
+			{"UDP with EDNS", "udp", ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 1232), "[]"},
+		} {
+			r := ask(t, tt.netw, addr, tt.m)
+			if got := fmt.Sprint(keepaliveOf(r)); got != tt.want || len(r.Answer) != 1 {
+				t.Errorf("%v: keepalive %v, answer %v; want keepalive %v and the answer", tt.what, got, r.Answer, tt.want)
+			}
+		}
+		if n := atomic.LoadInt64(&forwarded); n != 0 {
+			t.Errorf("%d queries forwarded with the keepalive option, want none", n)
+		}
+
+		// DNS-over-HTTPS has the keepalive of HTTP.
+		w := &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		route(w, keepaliveQ("www.example.com."))
+		if w.msg == nil || len(keepaliveOf(w.msg)) != 0 {
+			t.Errorf("DNS-over-HTTPS: response %v, want no keepalive option", w.msg)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		// Not advertised without -tcp-keepalive-timeout.
+		setFlag(t, "tcp-keepalive-timeout", "0")
+		addr := startProxy(t)
+		if r := ask(t, "tcp", addr, keepaliveQ("www.example.com.")); len(keepaliveOf(r)) != 0 {
+			t.Errorf("without -tcp-keepalive-timeout: keepalive %v, want none", keepaliveOf(r))
+		}
+	})
+}
+
+func TestKeepaliveIdleTimeout(t *testing.T) {
+	setFlag(t, "tcp-idle-timeout", "8s")
+	if got := idleTimeout(); got != 8*time.Second {
+		t.Errorf("idle timeout %v, want -tcp-idle-timeout", got)
+	}
+	setFlag(t, "tcp-keepalive-timeout", "2m")
+	if got := idleTimeout(); got != 2*time.Minute {
+		t.Errorf("idle timeout %v, want -tcp-keepalive-timeout", got)
+	}
+
+	for _, tt := range []struct {
+		d     time.Duration
+		valid bool
+	}{
+		{0, true},
+		{keepaliveUnit, true},
+		{0xffff * keepaliveUnit, true},
+		{-time.Second, false},
+		{50 * time.Millisecond, false},
+		{0x10000 * keepaliveUnit, false},
+	} {
+		if err := validKeepaliveTimeout(tt.d); (err == nil) != tt.valid {
+			t.Errorf("validKeepaliveTimeout(%v) = %v, want valid %v", tt.d, err, tt.valid)
+		}
+	}
+}
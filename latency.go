@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// latencyWeight is the weight of the last exchange in the moving average
+	// of the latency of a backend.
+	latencyWeight = 0.3
+	// latencyProbeRate is the share of queries sent first to another backend
+	// than the fastest, to measure it again.
+	latencyProbeRate = 0.05
+)
+
+// latencyTracker keeps the exponentially weighted moving average of the
+// latency of each backend.
+type latencyTracker struct {
+	mu       sync.Mutex
+	averages map[string]time.Duration
+}
+
+var latencies = &latencyTracker{averages: make(map[string]time.Duration)}
+
+// observe adds the latency d of an exchange with addr to its average.
+func (t *latencyTracker) observe(addr string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	avg, ok := t.averages[addr]
+	if !ok {
+		t.averages[addr] = d
+		return
+	}
+	t.averages[addr] = avg + time.Duration(latencyWeight*float64(d-avg))
+}
+
+// snapshot returns the averages per backend.
+func (t *latencyTracker) snapshot() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	averages := make(map[string]time.Duration, len(t.averages))
+	for addr, avg := range t.averages {
+		averages[addr] = avg
+	}
+	return averages
+}
+
+// order returns addrs from the lowest average latency to the highest,
+// backends never measured first. From time to time one of the slower ones
+// comes first so that its average follows its current latency.
+func (t *latencyTracker) order(addrs []string) []string {
+	averages := t.snapshot()
+	sorted := append([]string(nil), addrs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return averages[sorted[i]] < averages[sorted[j]]
+	})
+	if len(sorted) > 1 && random.Float64() < latencyProbeRate {
+		i := 1 + random.Intn(len(sorted)-1)
+		sorted[0], sorted[i] = sorted[i], sorted[0]
+	}
+	return sorted
+}
+
+// fastestAverage sends req to the backend with the lowest average latency,
+// trying the next ones only on error. It returns the error of the last
+// backend tried if none responded.
+func fastestAverage(addrs []string, opts routeOptions, w *queryWriter, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for _, addr := range latencies.order(addrs) {
+		w.upstreams = append(w.upstreams, addr)
+		var resp *dns.Msg
+		if resp, err = proxy(addr, opts, w, req); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
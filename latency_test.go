@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useLatencies starts the test with no latency measured and random picks
+// seeded with 1, restoring both afterwards.
+func useLatencies(t *testing.T) *latencyTracker {
+	oldLatencies, oldRandom := latencies, random
+	latencies, random = &latencyTracker{averages: make(map[string]time.Duration)}, newRandom(1)
+	t.Cleanup(func() { latencies, random = oldLatencies, oldRandom })
+	return latencies
+}
+
+func TestLatencyAverage(t *testing.T) {
+	l := useLatencies(t)
+	l.observe("a", 10*time.Millisecond)
+	if got := l.snapshot()["a"]; got != 10*time.Millisecond {
+		t.Errorf("average of the first exchange = %v, want its latency 10ms", got)
+	}
+	l.observe("a", 20*time.Millisecond)
+	if got := l.snapshot()["a"]; got != 13*time.Millisecond {
+		t.Errorf("average = %v, want 13ms with a weight of %v for the last exchange", got, latencyWeight)
+	}
+}
+
+func TestLatencyOrder(t *testing.T) {
+	l := useLatencies(t)
+	l.observe("slow", 30*time.Millisecond)
+	l.observe("fast", 10*time.Millisecond)
+	first := make(map[string]int)
+	const n = 2000
+	for i := 0; i < n; i++ {
+		order := l.order([]string{"slow", "new", "fast"})
+		if len(order) != 3 {
+			t.Fatalf("order = %v, want the 3 backends", order)
+		}
+		first[order[0]]++
+	}
+	// Backends never measured come first, then by latency, but for probes.
+	if first["new"] < n*90/100 {
+		t.Errorf("backend never measured first %d times of %d, want it the first but for probes", first["new"], n)
+	}
+	if first["slow"] == 0 || first["fast"] == 0 || first["slow"]+first["fast"] > n*latencyProbeRate*2 {
+		t.Errorf("other backends first %d and %d times of %d, want probes at a rate of %v",
+			first["slow"], first["fast"], n, latencyProbeRate)
+	}
+	slowFirst := 0
+	for i := 0; i < n; i++ {
+		if l.order([]string{"slow", "fast"})[0] == "slow" {
+			slowFirst++
+		}
+	}
+	if slowFirst == 0 || slowFirst > n*latencyProbeRate*2 {
+		t.Errorf("slower backend first %d times of %d, want only as probes", slowFirst, n)
+	}
+}
+
+// delayed answers after d.
+func delayed(d time.Duration, h dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(d)
+		h(w, r)
+	}
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	useLatencies(t)
+	slowH, nSlow := counting(delayed(20*time.Millisecond, answerA("192.0.2.1")))
+	fastH, nFast := counting(answerA("192.0.2.2"))
+	slow, fast := startUpstream(t, slowH), startUpstream(t, fastH)
+	setFlag(t, "strategy", strategyLatency)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v, %v]\n", slow, fast))
+	addr := startProxy(t)
+
+	for i := 0; i < 40; i++ {
+		if r := query(t, "udp", addr, fmt.Sprintf("q%d.example.com.", i), dns.TypeA); len(answerIPs(r)) != 1 {
+			t.Fatalf("query %d: got %v, want a single answer", i, r.Answer)
+		}
+	}
+	// Each is measured once, then the fast one is preferred.
+	if s, f := atomic.LoadInt64(nSlow), atomic.LoadInt64(nFast); s < 1 || s > 5 || f < 35 {
+		t.Errorf("%d queries to the slow backend and %d to the fast one, want most to the fast one", s, f)
+	}
+	averages := latencyAverages()
+	if averages[slow] <= averages[fast] || averages[fast] == 0 {
+		t.Errorf("average latencies of %v for the slow backend and %v for the fast one", averages[slow], averages[fast])
+	}
+}
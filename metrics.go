@@ -0,0 +1,330 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var metricsAddress = flag.String("metrics-address", "",
+	"Address to serve Prometheus metrics on at /metrics (HTTP, disabled if empty)")
+
+// Metrics exported in the Prometheus text format.
+var (
+	queriesTotal = newCounterVec("dns_proxy_queries_total",
+		"Total number of queries received.")
+	routeQueries = newCounterVec("dns_proxy_route_queries_total",
+		"Queries per matched route, default, default-<qtype>, none (no route nor default), refused, badcookie, any (ANY refused), id.server, version.bind, hostname.bind, static, local-zone, blocked or ratelimited.", "route")
+	upstreamResponses = newCounterVec("dns_proxy_upstream_responses_total",
+		"Exchanges with upstreams per result (success, error, malformed for unparsable responses, cancelled or bogus for failed DNSSEC validation).", "upstream", "result")
+	upstreamRetries = newCounterVec("dns_proxy_upstream_retries_total",
+		"Exchanges with upstreams retried after a transient error.", "upstream")
+	upstreamDuration = newHistogramVec("dns_proxy_upstream_duration_seconds",
+		"Latency of exchanges with upstreams.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}, "upstream")
+	cacheLookups = newCounterVec("dns_proxy_cache_lookups_total",
+		"Cache lookups per result (hit or miss).", "result")
+	cachePrefetches = newCounterVec("dns_proxy_cache_prefetches_total",
+		"Cached responses refreshed before their expiry with -cache-prefetch.")
+	appendDomainAnswers = newCounterVec("dns_proxy_append_domain_answers_total",
+		"Single-label queries answered NXDOMAIN then answered with -append-domain.")
+	mergeCapped = newCounterVec("dns_proxy_merge_capped_total",
+		"Merged answers with records dropped by -merge-max-answers.")
+	coalescedQueries = newCounterVec("dns_proxy_coalesced_queries_total",
+		"Queries answered with the response to an identical query in flight, with -coalesce-queries.")
+	staleResponses = newCounterVec("dns_proxy_stale_responses_total",
+		"Expired cached responses answered as the backends failed, with -serve-stale.")
+	responsesTotal = newCounterVec("dns_proxy_responses_total",
+		"Responses sent to clients per rcode.", "rcode")
+	blockedQueries = newCounterVec("dns_proxy_blocked_queries_total",
+		"Queries answered from the blocklist.")
+	writeErrors = newCounterVec("dns_proxy_write_errors_total",
+		"Responses which could not be written to clients per transport (udp or tcp).", "transport")
+	routeRateLimited = newCounterVec("dns_proxy_route_ratelimited_total",
+		"Queries refused over the QPS limit of their route.", "route")
+	udpCapped = newCounterVec("dns_proxy_udp_capped_total",
+		"UDP responses truncated to -udp-max-response-size.")
+	routeTruncated = newCounterVec("dns_proxy_route_truncated_total",
+		"Responses truncated to the maximum response size of their route.", "route")
+	upstreamRejections = newCounterVec("dns_proxy_upstream_rejected_total",
+		"Exchanges with upstreams not started for lack of a slot under -max-concurrent-upstream.")
+	upstreamPaced = newCounterVec("dns_proxy_upstream_paced_total",
+		"Queries to upstreams over -upstream-qps, delayed or shed as they could not be sent before their deadline.", "upstream", "result")
+	breakerRejections = newCounterVec("dns_proxy_circuit_breaker_rejected_total",
+		"Queries not sent to upstreams whose circuit breaker is open.", "upstream")
+	upstreamQueued = newCounterVec("dns_proxy_upstream_queue_total",
+		"Queries to upstreams over -upstream-max-in-flight, queued, then rejected, dropped or expired if they got no slot.", "upstream", "result")
+)
+
+// metrics returns all the metrics to export, in order.
+func metrics() []metric {
+	return []metric{queriesTotal, routeQueries, upstreamResponses, upstreamRetries, upstreamDuration,
+		cacheLookups, cachePrefetches, coalescedQueries, staleResponses, mergeCapped, appendDomainAnswers, responsesTotal, writeErrors, blockedQueries, routeRateLimited, routeTruncated, udpCapped,
+		upstreamRejections, upstreamPaced, breakerRejections, upstreamQueued, gaugeFunc{
+			name:   "dns_proxy_circuit_breaker_state",
+			help:   "State of the circuit breaker of a backend: closed (0), half-open (1) or open (2).",
+			labels: []string{"backend"},
+			values: breakerStates,
+		}, gaugeFunc{
+			name:   "dns_proxy_backend_up",
+			help:   "Whether a backend passes health checks (1) or not (0).",
+			labels: []string{"backend"},
+			values: backendUp,
+		}, gaugeFunc{
+			name:   "dns_proxy_upstream_latency_average_seconds",
+			help:   "Exponentially weighted moving average of the latency of exchanges with upstreams.",
+			labels: []string{"upstream"},
+			values: latencyAverages,
+		}, gaugeFunc{
+			name:   "dns_proxy_upstream_in_flight",
+			help:   "Exchanges with upstreams in flight.",
+			values: upstreamsInFlight,
+		}, gaugeFunc{
+			name:   "dns_proxy_upstream_queue_length",
+			help:   "Queries waiting for a slot of their upstream under -upstream-max-in-flight.",
+			labels: []string{"upstream"},
+			values: upstreamQueueLengths,
+		}}
+}
+
+func upstreamQueueLengths() map[string]float64 {
+	values := make(map[string]float64)
+	if backendQueues == nil {
+		return values
+	}
+	for addr, n := range backendQueues.lengths() {
+		values[addr] = float64(n)
+	}
+	return values
+}
+
+func latencyAverages() map[string]float64 {
+	values := make(map[string]float64)
+	for addr, avg := range latencies.snapshot() {
+		values[addr] = avg.Seconds()
+	}
+	return values
+}
+
+func upstreamsInFlight() map[string]float64 {
+	return map[string]float64{"": float64(atomic.LoadInt64(&upstreamInFlight))}
+}
+
+func breakerStates() map[string]float64 {
+	values := make(map[string]float64)
+	if breakers == nil {
+		return values
+	}
+	backends := loadSettings().backends()
+	for addr, state := range breakers.states() {
+		if backends[addr] {
+			values[addr] = float64(state)
+		}
+	}
+	return values
+}
+
+func backendUp() map[string]float64 {
+	values := make(map[string]float64)
+	if health == nil {
+		return values
+	}
+	for addr, b := range health.status() {
+		v := 0.0
+		if b.up {
+			v = 1
+		}
+		values[addr] = v
+	}
+	return values
+}
+
+// metric is a metric family which can write itself in the text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// labelSep separates label values in the keys of the vectors; it cannot
+// appear in a label value written by the proxy.
+const labelSep = "\xff"
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+// snapshot returns a copy of the counter values keyed by joined label values.
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	values := c.snapshot()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key, "", ""), values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels,
+		values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	v := d.Seconds()
+	key := strings.Join(labelValues, labelSep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// snapshot returns a copy of the histograms keyed by joined label values.
+func (h *histogramVec) snapshot() map[string]histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values := make(map[string]histogram, len(h.values))
+	for k, hist := range h.values {
+		values[k] = histogram{counts: append([]uint64(nil), hist.counts...), count: hist.count, sum: hist.sum}
+	}
+	return values
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, key, "le", fmt.Sprint(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key, "", ""), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// gaugeFunc is a gauge with a single label whose values are computed when
+// the metrics are scraped.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	values     func() map[string]float64
+}
+
+func (g gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, formatLabels(g.labels, key, "", ""), values[key])
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the labels of a series, whose values are joined in
+// key, optionally followed by an extra label.
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, labelSep) {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(value)))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics() {
+		m.write(w)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	nsid = flag.String("nsid", "",
+		"Identifier of this instance, returned in responses to queries with an EDNS NSID option "+
+			"and to CHAOS TXT queries for id.server.")
+	versionBind = flag.String("version-bind", "",
+		"Answer CHAOS TXT queries for version.bind. with this string instead of forwarding them")
+	hostnameBind = flag.String("hostname-bind", "",
+		"Answer CHAOS TXT queries for hostname.bind. with this string instead of forwarding them")
+	refuseBind = flag.Bool("refuse-bind", false,
+		"Refuse CHAOS TXT queries for version.bind. and hostname.bind. not answered with "+
+			"-version-bind or -hostname-bind")
+	chaosTXTLists flagStringList
+
+	chaosRecords map[string]string // answers of -chaos-txt per lowercase name
+)
+
+// Names of the CHAOS TXT queries for the server identifier (RFC 4892), and
+// for the version and host name of BIND.
+const (
+	idServer     = "id.server."
+	versionName  = "version.bind."
+	hostnameName = "hostname.bind."
+)
+
+// parseChaosTXT parses the -chaos-txt flags: name=text.
+func parseChaosTXT(list []string) (map[string]string, error) {
+	records := make(map[string]string)
+	for _, s := range list {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid -chaos-txt %q, must be name=text", s)
+		}
+		name := dns.CanonicalName(kv[0])
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid -chaos-txt name %q", kv[0])
+		}
+		records[name] = kv[1]
+	}
+	return records, nil
+}
+
+// chaosQuery returns the lowercase name of req if it is a CHAOS TXT query for
+// id.server., version.bind., hostname.bind. or a name of -chaos-txt, or an
+// empty string.
+func chaosQuery(req *dns.Msg) string {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassCHAOS || q.Qtype != dns.TypeTXT {
+		return ""
+	}
+	name := dns.CanonicalName(q.Name)
+	if _, ok := chaosRecords[name]; ok {
+		return name
+	}
+	switch name {
+	case idServer, versionName, hostnameName:
+		return name
+	}
+	return ""
+}
+
+// chaosTXT returns the string to answer the CHAOS TXT query for name with,
+// or an empty string to forward it. -chaos-txt takes precedence.
+func chaosTXT(name string) string {
+	if txt, ok := chaosRecords[name]; ok {
+		return txt
+	}
+	switch name {
+	case idServer:
+		return *nsid
+	case versionName:
+		return *versionBind
+	case hostnameName:
+		return *hostnameBind
+	}
+	return ""
+}
+
+// answerChaos answers a CHAOS TXT query with txt.
+func answerChaos(w dns.ResponseWriter, req *dns.Msg, txt string) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{txt},
+	})
+	writeLocal(w, req, m)
+}
+
+// nsidResponse sets the NSID option of resp to -nsid if the client asked for
+// it in req, replacing that of the upstream.
+func nsidResponse(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	if *nsid == "" || !hasNSID(reqOpt) {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0NSID {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(*nsid))})
+}
+
+func hasNSID(opt *dns.OPT) bool {
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0NSID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func nsidOf(m *dns.Msg) (string, bool) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o, ok := o.(*dns.EDNS0_NSID); ok {
+				b, _ := hex.DecodeString(o.Nsid)
+				return string(b), true
+			}
+		}
+	}
+	return "", false
+}
+
+// answerNSID answers every query with an A record and the NSID of the
+// backend, whether it was asked for or not.
+func answerNSID(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetEdns0(1232, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("backend"))})
+	w.WriteMsg(m)
+}
+
+func TestNSID(t *testing.T) {
+	up := startUpstream(t, answerNSID)
+	setFlag(t, "nsid", "proxy1")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	asked := ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 1232)
+	asked.IsEdns0().Option = append(asked.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	if id, ok := nsidOf(ask(t, "udp", addr, asked)); !ok || id != "proxy1" {
+		t.Errorf("NSID %q, %v; want that of the proxy, proxy1", id, ok)
+	}
+	if id, ok := nsidOf(ask(t, "udp", addr, ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 1232))); ok && id == "proxy1" {
+		t.Error("NSID of the proxy sent without being asked for")
+	}
+
+	q := newQ(idServer, dns.TypeTXT)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	r := ask(t, "udp", addr, q)
+	if len(r.Answer) != 1 {
+		t.Fatalf("id.server. answered with %d records, want 1", len(r.Answer))
+	}
+	if txt, ok := r.Answer[0].(*dns.TXT); !ok || len(txt.Txt) != 1 || txt.Txt[0] != "proxy1" {
+		t.Errorf("id.server. answered %v, want the TXT record proxy1", r.Answer[0])
+	}
+}
+
+func TestNSIDUnset(t *testing.T) {
+	up := startUpstream(t, answerNSID)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+	asked := ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 1232)
+	asked.IsEdns0().Option = append(asked.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	if id, ok := nsidOf(ask(t, "udp", addr, asked)); !ok || id != "backend" {
+		t.Errorf("NSID %q, %v; want that of the backend without -nsid", id, ok)
+	}
+}
+
+// chaosQ returns a CHAOS TXT query for name.
+func chaosQ(name string) *dns.Msg {
+	m := newQ(name, dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	return m
+}
+
+// txtOf returns the text of the single TXT record answered in m, or false.
+func txtOf(m *dns.Msg) (string, bool) {
+	if len(m.Answer) != 1 {
+		return "", false
+	}
+	txt, ok := m.Answer[0].(*dns.TXT)
+	if !ok || len(txt.Txt) != 1 || txt.Hdr.Class != dns.ClassCHAOS {
+		return "", false
+	}
+	return txt.Txt[0], true
+}
+
+// answerBackendTXT answers every query with a TXT record backend in its
+// class.
+func answerBackendTXT(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: q.Qclass}, Txt: []string{"backend"}})
+	w.WriteMsg(m)
+}
+
+func TestVersionBind(t *testing.T) {
+	up := startUpstream(t, answerBackendTXT)
+	setFlag(t, "version-bind", "dns-reverse-proxy")
+	setFlag(t, "hostname-bind", "proxy1.example.com")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	for name, want := range map[string]string{
+		"version.bind.":  "dns-reverse-proxy",
+		"VERSION.Bind.":  "dns-reverse-proxy",
+		"hostname.bind.": "proxy1.example.com",
+	} {
+		r := ask(t, "udp", addr, chaosQ(name))
+		if txt, ok := txtOf(r); !ok || txt != want || !r.Authoritative {
+			t.Errorf("%v answered %v, want the TXT record %v", name, r.Answer, want)
+		}
+	}
+	// INET queries for these names are forwarded.
+	if txt, _ := txtOf(query(t, "udp", addr, "version.bind.", dns.TypeTXT)); txt == "dns-reverse-proxy" {
+		t.Error("version.bind. in class INET answered locally")
+	}
+}
+
+func TestRefuseBind(t *testing.T) {
+	up := startUpstream(t, answerBackendTXT)
+	setFlag(t, "version-bind", "dns-reverse-proxy")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+
+	t.Run("forwarded", func(t *testing.T) {
+		addr := startProxy(t)
+		if txt, ok := txtOf(ask(t, "udp", addr, chaosQ("hostname.bind."))); !ok || txt != "backend" {
+			t.Errorf("hostname.bind. without -hostname-bind nor -refuse-bind: got %q, want it forwarded", txt)
+		}
+	})
+
+	setFlag(t, "refuse-bind", "true")
+	addr := startProxy(t)
+	if r := ask(t, "udp", addr, chaosQ("hostname.bind.")); r.Rcode != dns.RcodeRefused || len(r.Answer) != 0 {
+		t.Errorf("hostname.bind. with -refuse-bind: got %v %v, want REFUSED", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+	if txt, ok := txtOf(ask(t, "udp", addr, chaosQ("version.bind."))); !ok || txt != "dns-reverse-proxy" {
+		t.Errorf("version.bind. with -version-bind and -refuse-bind: got %q, want it answered", txt)
+	}
+	if txt, ok := txtOf(ask(t, "udp", addr, chaosQ(idServer))); !ok || txt != "backend" {
+		t.Errorf("id.server. without -nsid: got %q, want it forwarded despite -refuse-bind", txt)
+	}
+}
+
+func TestChaosTXT(t *testing.T) {
+	up := startUpstream(t, answerBackendTXT)
+	records, err := parseChaosTXT([]string{"authors.bind.=me@example.com", "Version.BIND=custom", "motd=hello=world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := chaosRecords
+	chaosRecords = records
+	t.Cleanup(func() { chaosRecords = old })
+	setFlag(t, "version-bind", "dns-reverse-proxy")
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	for name, want := range map[string]string{
+		"authors.bind.": "me@example.com",
+		"AUTHORS.bind.": "me@example.com",
+		"version.bind.": "custom", // -chaos-txt takes precedence
+		"motd.":         "hello=world",
+		"other.bind.":   "backend",
+	} {
+		if txt, ok := txtOf(ask(t, "udp", addr, chaosQ(name))); !ok || txt != want {
+			t.Errorf("%v: got %q, want %q", name, txt, want)
+		}
+	}
+	if r := query(t, "udp", addr, "authors.bind.", dns.TypeTXT); len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "backend" {
+		t.Errorf("authors.bind. in class INET: got %v, want it forwarded", r.Answer)
+	}
+
+	for _, s := range []string{"authors.bind.", "=text", "authors.bind.=", "a..b=text"} {
+		if _, err := parseChaosTXT([]string{s}); err == nil {
+			t.Errorf("-chaos-txt %q accepted", s)
+		}
+	}
+}
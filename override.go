@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	overrideLists flagStringList
+	overrideFile  = flag.String("override-file", "",
+		"File of answers overriding everything else, one name=type:value per line, read again on SIGHUP")
+	overrideTTL = flag.Uint("override-ttl", 60, "TTL of override answers")
+)
+
+// parseOverride parses an override: name=type:value, the value being the
+// data of the record as in a zone file.
+func parseOverride(s string) (dns.RR, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return nil, fmt.Errorf("invalid override %q, must be name=type:value", s)
+	}
+	return newOverrideRR(kv[0], kv[1])
+}
+
+// newOverrideRR returns the record of name given as type:value.
+func newOverrideRR(name, record string) (dns.RR, error) {
+	kv := strings.SplitN(record, ":", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return nil, fmt.Errorf("invalid override record %q for %v, must be type:value", record, name)
+	}
+	name = normalizeDomain(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid override name %q", name)
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(kv[0])]
+	if !ok || qtype == dns.TypeOPT || qtype == dns.TypeANY || qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		return nil, fmt.Errorf("invalid override record type %q for %v", kv[0], name)
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, *overrideTTL, dns.TypeToString[qtype], kv[1]))
+	if err != nil || rr == nil {
+		return nil, fmt.Errorf("invalid override %v record %q for %v: %v", kv[0], kv[1], name, err)
+	}
+	return rr, nil
+}
+
+// loadOverrides adds the overrides of a file, one per line. Comments
+// starting with # are ignored.
+func (t *staticTable) loadOverrides(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		rr, err := parseOverride(line)
+		if err == nil {
+			err = t.insert("override", rr)
+		}
+		if err != nil {
+			return fmt.Errorf("%v:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// buildOverrides returns the table of the overrides of the config file, the
+// override file and the flags, or nil if there are none. They are answered
+// like static answers, but before anything else.
+func buildOverrides(cfg *config) (*staticTable, error) {
+	t := newStaticTable(uint32(*overrideTTL))
+	for name, records := range cfg.Overrides {
+		for _, record := range records {
+			rr, err := newOverrideRR(name, record)
+			if err != nil {
+				return nil, err
+			}
+			if err := t.insert("override", rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *overrideFile != "" {
+		if err := t.loadOverrides(*overrideFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, override := range overrideLists {
+		rr, err := parseOverride(override)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.insert("override", rr); err != nil {
+			return nil, err
+		}
+	}
+	if t.len() == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
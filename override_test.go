@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestOverride(t *testing.T) {
+	captureLog(t)
+	up := startUpstream(t, answerA("192.0.2.1"))
+	setList(t, &overrideLists, "api.example.com.=AAAA:2001:db8::80")
+	setList(t, &staticLists, "www.example.com.=A:192.0.2.10")
+	setFlag(t, "override-ttl", "30")
+	overrides := writeFile(t, "overrides", "# maintenance\nmx.example.com.=MX:10 mail.example.com.\n")
+	setFlag(t, "override-file", overrides)
+	routes := fmt.Sprintf("routes:\n  .example.com.: [%v]\n", up)
+	useConfig(t, routes+"overrides:\n  www.example.com.: [\"A:192.0.2.80\", \"A:192.0.2.81\"]\n")
+	addr := startProxy(t)
+
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		// Over the static answer and the route.
+		{"www.example.com.", dns.TypeA, "[192.0.2.80 192.0.2.81]"},
+		{"api.example.com.", dns.TypeAAAA, "[2001:db8::80]"},
+		{"mx.example.com.", dns.TypeMX, "[10 mail.example.com.]"},
+		{"api.example.com.", dns.TypeA, "[]"},
+	} {
+		r := query(t, "udp", addr, tt.name, tt.qtype)
+		var got []string
+		for _, rr := range r.Answer {
+			got = append(got, strings.TrimPrefix(rr.String(), rr.Header().String()))
+			if rr.Header().Ttl != 30 {
+				t.Errorf("%v: TTL %d, want -override-ttl 30", rr.Header().Name, rr.Header().Ttl)
+			}
+		}
+		if r.Rcode != dns.RcodeSuccess || fmt.Sprint(got) != tt.want {
+			t.Errorf("%v %v: got %v %v, want the override %v", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[r.Rcode], got, tt.want)
+		}
+	}
+	if ips := answerIPs(query(t, "udp", addr, "db.example.com.", dns.TypeA)); fmt.Sprint(ips) != "[192.0.2.1]" {
+		t.Errorf("name without override answered %v, want the answer of the route", ips)
+	}
+
+	// Removed from the config file and the override file on reload.
+	if err := ioutil.WriteFile(*configFile, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(overrides, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reload()
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"www.example.com.", dns.TypeA, "[192.0.2.10]"},
+		{"mx.example.com.", dns.TypeA, "[192.0.2.1]"},
+		{"api.example.com.", dns.TypeAAAA, "[2001:db8::80]"},
+	} {
+		if ips := answerIPs(query(t, "udp", addr, tt.name, tt.qtype)); fmt.Sprint(ips) != tt.want {
+			t.Errorf("%v %v after reload: answered %v, want %v", tt.name, dns.TypeToString[tt.qtype], ips, tt.want)
+		}
+	}
+}
+
+func TestOverrideInvalid(t *testing.T) {
+	for _, override := range []string{"www.example.com.", "www.example.com.=A", "=A:192.0.2.1",
+		"www.example.com.=A:2001:db8::1", "www.example.com.=NOSUCHTYPE:1", "www.example.com.=AXFR:1",
+		"www..example.com.=A:192.0.2.1"} {
+		setList(t, &overrideLists, override)
+		setFlag(t, "config", writeFile(t, "config.yaml", ""))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("-override %v accepted", override)
+		}
+	}
+	setList(t, &overrideLists)
+	setFlag(t, "override-file", writeFile(t, "overrides", "www.example.com.=A:192.0.2.1\nbad\n"))
+	if _, err := buildSettings(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("override file with an invalid line 2: %v, want its line in the error", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+)
+
+var upstreamQPS = flag.Float64("upstream-qps", 0,
+	"Queries per second sent to each backend, excess queries being delayed until their deadline "+
+		"or else shed (0 for no limit, route-upstream-qps in the config file sets it per route)")
+
+// errPaced is the error of a query shed as it could not be sent to its
+// backend under the QPS limit before its deadline.
+var errPaced = errors.New("upstream QPS limit")
+
+// pacing spaces the queries sent to each backend.
+var pacing = &pacer{next: make(map[string]time.Time)}
+
+// pacer is a leaky bucket per backend: queries are sent at most every 1/qps,
+// waiting for their turn.
+type pacer struct {
+	mu   sync.Mutex
+	next map[string]time.Time // earliest time of the next query per backend
+}
+
+// wait waits for the turn of a query to addr under qps. The query is shed if
+// its turn comes after the deadline of ctx.
+func (p *pacer) wait(ctx context.Context, addr string, qps float64) error {
+	interval := time.Duration(float64(time.Second) / qps)
+	now := time.Now()
+	p.mu.Lock()
+	turn := p.next[addr]
+	if turn.Before(now) {
+		turn = now
+	}
+	if deadline, ok := ctx.Deadline(); ok && turn.After(deadline) {
+		p.mu.Unlock()
+		upstreamPaced.inc(addr, "shed")
+		return errPaced
+	}
+	p.next[addr] = turn.Add(interval)
+	p.mu.Unlock()
+	delay := turn.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	upstreamPaced.inc(addr, "delayed")
+	traceOf(ctx).tracef("%v paced, waiting %v", addr, delay)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
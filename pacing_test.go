@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPacerWait(t *testing.T) {
+	const addr, other = "192.0.2.1:53", "192.0.2.2:53"
+	p := &pacer{next: make(map[string]time.Time)}
+	before := upstreamPaced.snapshot()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := p.wait(ctx, addr, 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 queries at 20 QPS sent in %v, want at least 200ms", elapsed)
+	}
+	start = time.Now()
+	if err := p.wait(ctx, other, 20); err != nil || time.Since(start) > 20*time.Millisecond {
+		t.Errorf("query to another backend waited %v: %v, want it sent at once", time.Since(start), err)
+	}
+	if n := upstreamPaced.snapshot()[addr+labelSep+"delayed"] - before[addr+labelSep+"delayed"]; n != 4 {
+		t.Errorf("%d queries counted delayed, want 4", n)
+	}
+
+	// Shed if their turn comes after their deadline.
+	short, cancel := context.WithTimeout(context.Background(), 60*time.Millisecond)
+	defer cancel()
+	if err := p.wait(short, other, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.wait(short, other, 10); err != errPaced {
+		t.Errorf("query whose turn is after its deadline: %v, want %v", err, errPaced)
+	}
+	if n := upstreamPaced.snapshot()[other+labelSep+"shed"] - before[other+labelSep+"shed"]; n != 1 {
+		t.Errorf("%d queries counted shed, want 1", n)
+	}
+}
+
+// arrivals answers queries, recording when they arrived.
+type arrivals struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (a *arrivals) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	a.mu.Lock()
+	a.times = append(a.times, time.Now())
+	a.mu.Unlock()
+	answerA("192.0.2.1")(w, r)
+}
+
+// minInterval returns the shortest time between two queries received.
+func (a *arrivals) minInterval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	min := time.Duration(1<<63 - 1)
+	for i := 1; i < len(a.times); i++ {
+		if d := a.times[i].Sub(a.times[i-1]); d < min {
+			min = d
+		}
+	}
+	return min
+}
+
+func TestUpstreamQPS(t *testing.T) {
+	paced, free := &arrivals{}, &arrivals{}
+	pacedAddr, freeAddr := startServer(t, paced), startServer(t, free)
+	useConfig(t, fmt.Sprintf(`routes:
+  .paced.example.: [%v]
+  .free.example.: [%v]
+route-upstream-qps:
+  .paced.example.: 20
+`, pacedAddr, freeAddr))
+
+	t.Run("route", func(t *testing.T) {
+		addr := startProxy(t)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			for _, zone := range []string{"paced", "free"} {
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+					c := &dns.Client{Timeout: 5 * time.Second}
+					if r, _, err := c.Exchange(newQ(name, dns.TypeA), addr); err != nil || r.Rcode != dns.RcodeSuccess {
+						t.Errorf("%v: %v %v, want the answer once paced", name, r, err)
+					}
+				}(fmt.Sprintf("www%d.%v.example.", i, zone))
+			}
+		}
+		wg.Wait()
+		// 50ms apart at 20 QPS, less a margin for the timers.
+		if d := paced.minInterval(); d < 40*time.Millisecond {
+			t.Errorf("queries to the paced backend %v apart, want 50ms at 20 QPS", d)
+		}
+		if d := free.minInterval(); d > 40*time.Millisecond {
+			t.Errorf("queries to the backend of a route without limit %v apart, want no pacing", d)
+		}
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		// Shed under -upstream-qps if they would wait past their deadline.
+		setFlag(t, "upstream-qps", "1")
+		setFlag(t, "query-timeout", "300ms")
+		useConfig(t, fmt.Sprintf("default: %v\n", freeAddr))
+		addr := startProxy(t)
+		if r := query(t, "udp", addr, "a.example.com.", dns.TypeA); r.Rcode != dns.RcodeSuccess {
+			t.Fatalf("first query: got %v, want the answer", dns.RcodeToString[r.Rcode])
+		}
+		if r := query(t, "udp", addr, "b.example.com.", dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+			t.Errorf("query over -upstream-qps: got %v, want SERVFAIL as shed", dns.RcodeToString[r.Rcode])
+		}
+	})
+}
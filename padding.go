@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/miekg/dns"
+)
+
+var padding = flag.Bool("padding", false,
+	"Pad queries to DNS-over-TLS and DNS-over-HTTPS backends, and responses to queries asking for it, "+
+		"with EDNS padding (RFC 7830), for all routes (route-padding in the config file enables it per route)")
+
+// Block sizes of the padding, as recommended by RFC 8467.
+const (
+	queryPaddingBlock    = 128
+	responsePaddingBlock = 468
+)
+
+// paddedQuery returns a copy of req padded to a multiple of
+// queryPaddingBlock, with an OPT record if it has none.
+func paddedQuery(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	if m.IsEdns0() == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	pad(m, queryPaddingBlock, 0)
+	return m
+}
+
+// padResponse pads resp to a multiple of responsePaddingBlock if the query
+// req of the client carries a padding option, without exceeding the payload
+// size of a UDP client nor maxSize if not 0. Otherwise the padding of the
+// backend answering a padded query is removed, and so is the OPT record that
+// paddedQuery added for a client without EDNS.
+func padResponse(w dns.ResponseWriter, req, resp *dns.Msg, maxSize int) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		removeOPT(resp)
+		return
+	}
+	if findPadding(reqOpt) == nil {
+		if opt := resp.IsEdns0(); opt != nil {
+			opt.Option = withoutPadding(opt.Option)
+		}
+		return
+	}
+	limit, _ := udpLimit(w, req)
+	if limit == 0 {
+		limit = dns.MaxMsgSize
+	} else if limit < dns.MinMsgSize {
+		limit = dns.MinMsgSize
+	}
+	if maxSize > 0 && maxSize < limit {
+		limit = maxSize
+	}
+	if resp.IsEdns0() == nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	pad(resp, responsePaddingBlock, limit)
+}
+
+// pad sets the padding option of m, which has an OPT record, so that its
+// length is a multiple of block, or limit if that is more and not 0. Without
+// room for the option under limit m is left without padding.
+func pad(m *dns.Msg, block, limit int) {
+	opt := m.IsEdns0()
+	opt.Option = withoutPadding(opt.Option)
+	p := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, p)
+	n := m.Len()
+	if limit > 0 && n > limit {
+		opt.Option = opt.Option[:len(opt.Option)-1]
+		return
+	}
+	size := (n + block - 1) / block * block
+	if limit > 0 && size > limit {
+		size = limit
+	}
+	p.Padding = make([]byte, size-n)
+}
+
+func findPadding(opt *dns.OPT) *dns.EDNS0_PADDING {
+	for _, o := range opt.Option {
+		if p, ok := o.(*dns.EDNS0_PADDING); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+func withoutPadding(options []dns.EDNS0) []dns.EDNS0 {
+	kept := options[:0]
+	for _, o := range options {
+		if o.Option() != dns.EDNS0PADDING {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// removeOPT removes the OPT record of m.
+func removeOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
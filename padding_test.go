@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// packedLen returns the length of m on the wire.
+func packedLen(t *testing.T, m *dns.Msg) int {
+	t.Helper()
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(b)
+}
+
+// paddingQ returns a query for name with EDNS asking for padding.
+func paddingQ(name string, size uint16) *dns.Msg {
+	m := ednsQ(name, dns.TypeA, dns.ClassINET, size)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_PADDING{})
+	return m
+}
+
+func TestPaddedQuery(t *testing.T) {
+	for _, req := range []*dns.Msg{
+		newQ("www.example.com.", dns.TypeA),
+		ednsQ("a-rather-long-name-to-need-more-padding.of.a.long.zone.example.com.", dns.TypeAAAA, dns.ClassINET, 1232),
+	} {
+		m := paddedQuery(req)
+		if n := packedLen(t, m); n%queryPaddingBlock != 0 || !hasOption(m, dns.EDNS0PADDING) {
+			t.Errorf("%v padded to %d bytes, want a multiple of %d", req.Question[0].Name, n, queryPaddingBlock)
+		}
+		if hasOption(req, dns.EDNS0PADDING) {
+			t.Errorf("%v: query of the client padded", req.Question[0].Name)
+		}
+	}
+}
+
+func TestPadResponse(t *testing.T) {
+	answers := func(n int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(newQ("www.example.com.", dns.TypeA))
+		for i := 0; i < n; i++ {
+			m.Answer = append(m.Answer, rrWithTTL("www.example.com.", 300))
+		}
+		return m
+	}
+	for _, tt := range []struct {
+		what    string
+		netw    string
+		req     *dns.Msg
+		answers int
+		maxSize int
+		want    int // length, 0 for no padding
+	}{
+		{"TCP", "tcp", paddingQ("www.example.com.", 1232), 1, 0, responsePaddingBlock},
+		{"TCP over a block", "tcp", paddingQ("www.example.com.", 1232), 20, 0, 2 * responsePaddingBlock},
+		{"UDP within the payload size", "udp", paddingQ("www.example.com.", 1232), 1, 0, responsePaddingBlock},
+		{"UDP up to the payload size", "udp", paddingQ("www.example.com.", 600), 15, 0, 600},
+		{"under the maximum size", "tcp", paddingQ("www.example.com.", 1232), 20, 700, 700},
+		{"no room", "udp", paddingQ("www.example.com.", 512), 40, 0, 0},
+	} {
+		resp := answers(tt.answers)
+		padResponse(newStubWriter(tt.netw, "127.0.0.1:5353"), tt.req, resp, tt.maxSize)
+		n := packedLen(t, resp)
+		if tt.want == 0 {
+			if hasOption(resp, dns.EDNS0PADDING) {
+				t.Errorf("%v: padded to %d bytes, want no padding", tt.what, n)
+			}
+		} else if n != tt.want {
+			t.Errorf("%v: padded to %d bytes, want %d", tt.what, n, tt.want)
+		}
+	}
+
+	// The padding of the backend is not for clients not asking for it, nor
+	// the OPT record added to pad the query of a client without EDNS.
+	resp := answers(1)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+	padResponse(newStubWriter("tcp", "127.0.0.1:5353"), ednsQ("www.example.com.", dns.TypeA, dns.ClassINET, 1232), resp, 0)
+	if resp.IsEdns0() == nil || hasOption(resp, dns.EDNS0PADDING) {
+		t.Errorf("response to a client not asking for padding has OPT %v, want it without padding", resp.IsEdns0())
+	}
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+	padResponse(newStubWriter("tcp", "127.0.0.1:5353"), newQ("www.example.com.", dns.TypeA), resp, 0)
+	if resp.IsEdns0() != nil {
+		t.Error("response to a client without EDNS has an OPT record")
+	}
+}
+
+func TestRoutePadding(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int // of the queries to the backend
+	endpoint := startDoH(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		b, _ := r.Pack()
+		mu.Lock()
+		sizes = append(sizes, len(b))
+		mu.Unlock()
+		answerA("192.0.2.1")(w, r)
+	})
+	useConfig(t, fmt.Sprintf(`routes:
+  .padded.example.: [%v]
+  .plain.example.: [%v]
+route-padding: [.padded.example.]
+`, endpoint, endpoint))
+	addr := startProxy(t)
+
+	for _, tt := range []struct {
+		name   string
+		padded bool
+	}{
+		{"www.padded.example.", true},
+		{"www.plain.example.", false},
+	} {
+		mu.Lock()
+		sizes = nil
+		mu.Unlock()
+		conn, err := dns.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.WriteMsg(paddingQ(tt.name, 1232)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if padded := n%responsePaddingBlock == 0 && hasOption(resp, dns.EDNS0PADDING); padded != tt.padded {
+			t.Errorf("%v: response of %d bytes, want padded %v", tt.name, n, tt.padded)
+		}
+		mu.Lock()
+		if len(sizes) != 1 || (sizes[0]%queryPaddingBlock == 0) != tt.padded {
+			t.Errorf("%v: queries of %v bytes to the backend, want padded %v", tt.name, sizes, tt.padded)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	upstreamMaxIdleConns = flag.Int("upstream-max-idle-conns", 4,
+		"Idle TCP and TLS connections kept per backend for reuse (0 disables reuse)")
+	upstreamIdleTimeout = flag.Duration("upstream-idle-timeout", 10*time.Second,
+		"Time after which idle connections to backends are closed")
+
+	conns *connPool // nil if connections are not reused
+)
+
+// connPool keeps idle connections to backends to reuse them for TCP and TLS
+// exchanges. Connections which fail an exchange are discarded.
+type connPool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]idleConn // per key, most recently used last
+}
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+func newConnPool(maxIdle int, idleTimeout time.Duration) (*connPool, error) {
+	if maxIdle <= 0 || idleTimeout <= 0 {
+		return nil, fmt.Errorf("invalid -upstream-max-idle-conns or -upstream-idle-timeout, must be positive")
+	}
+	return &connPool{
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]idleConn),
+	}, nil
+}
+
+// run closes the connections idle for too long, forever.
+func (p *connPool) run() {
+	for {
+		time.Sleep(p.idleTimeout / 2)
+		p.prune(time.Now())
+	}
+}
+
+func (p *connPool) prune(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, idle := range p.idle {
+		kept := idle[:0]
+		for _, ic := range idle {
+			if now.Sub(ic.since) < p.idleTimeout {
+				kept = append(kept, ic)
+			} else {
+				ic.conn.Close()
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+}
+
+// get returns an idle connection for key, or nil.
+func (p *connPool) get(key string) *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := p.idle[key]
+	for len(idle) > 0 {
+		ic := idle[len(idle)-1]
+		idle = idle[:len(idle)-1]
+		if time.Since(ic.since) < p.idleTimeout {
+			p.idle[key] = idle
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// put returns a connection for key to the pool, closing it if full.
+func (p *connPool) put(key string, conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[key]) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleConn{conn: conn, since: time.Now()})
+}
+
+// exchange sends req to hostport with c over a pooled connection for key,
+// or a new one. A pooled connection failing, for instance if closed by the
+// backend while idle, is discarded and the exchange retried on a new one.
+func (p *connPool) exchange(ctx context.Context, c *dns.Client, key, hostport string, req *dns.Msg) (*dns.Msg, error) {
+	if conn := p.get(key); conn != nil {
+		resp, err := exchangeConn(ctx, c, conn, req)
+		if err == nil {
+			p.put(key, conn)
+			return resp, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	conn, err := dial(ctx, c, hostport)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchangeConn(ctx, c, conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.put(key, conn)
+	return resp, nil
+}
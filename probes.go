@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+var healthAddress = flag.String("health-address", "",
+	"Address to serve liveness at /healthz and readiness at /readyz on (HTTP, disabled if empty)")
+
+// serving tracks whether the DNS servers are up, for the probes.
+var serving struct {
+	listening int32 // servers bound
+	servers   int32 // servers to bind
+	stopping  int32 // set on shutdown
+}
+
+// serverStarted is the NotifyStartedFunc of the DNS servers.
+func serverStarted() {
+	atomic.AddInt32(&serving.listening, 1)
+}
+
+func live() bool {
+	return atomic.LoadInt32(&serving.listening) >= atomic.LoadInt32(&serving.servers)
+}
+
+// unreadyRoute returns a route, or default, without healthy backend, or an
+// empty string if all have one.
+func unreadyRoute(s *settings) string {
+	names := make([]string, 0, len(s.routes))
+	for name := range s.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(health.filter(s.routes[name])) == 0 {
+			return name
+		}
+	}
+	if defaults := s.router.defaults(); len(defaults) > 0 && len(health.filter(defaults)) == 0 {
+		return "default"
+	}
+	return ""
+}
+
+// serveHealthz answers OK once all the DNS servers are bound.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if !live() {
+		http.Error(w, "DNS servers not bound yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz answers OK if the proxy is live, not shutting down, and every
+// route has at least one healthy backend.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case !live():
+		http.Error(w, "DNS servers not bound yet", http.StatusServiceUnavailable)
+	case atomic.LoadInt32(&serving.stopping) != 0:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	default:
+		if route := unreadyRoute(loadSettings()); route != "" {
+			http.Error(w, "no healthy backend for route "+route, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setServing sets the state of the DNS servers for the duration of the test.
+func setServing(t *testing.T, listening, servers, stopping int32) {
+	old := serving
+	atomic.StoreInt32(&serving.listening, listening)
+	atomic.StoreInt32(&serving.servers, servers)
+	atomic.StoreInt32(&serving.stopping, stopping)
+	t.Cleanup(func() {
+		atomic.StoreInt32(&serving.listening, old.listening)
+		atomic.StoreInt32(&serving.servers, old.servers)
+		atomic.StoreInt32(&serving.stopping, old.stopping)
+	})
+}
+
+// probe sends a request to the probe h and returns its response.
+func probe(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestHealthz(t *testing.T) {
+	for _, tt := range []struct {
+		listening, servers int32
+		want               int
+	}{
+		{0, 2, http.StatusServiceUnavailable},
+		{1, 2, http.StatusServiceUnavailable},
+		{2, 2, http.StatusOK},
+	} {
+		setServing(t, tt.listening, tt.servers, 0)
+		if w := probe(serveHealthz, "/healthz"); w.Code != tt.want {
+			t.Errorf("%d of %d servers bound: %v %v, want %v", tt.listening, tt.servers, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	captureLog(t)
+	h, err := newHealthChecker(time.Minute, ".", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.record("192.0.2.2:53", errors.New("probe failed"))
+	old := health
+	health = h
+	t.Cleanup(func() { health = old })
+	useConfig(t, "default: 192.0.2.1:53\nroutes:\n  .example.com.: [192.0.2.1:53]\n")
+
+	setServing(t, 1, 2, 0)
+	if w := probe(serveReadyz, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("not live: %v %v, want unavailable", w.Code, w.Body)
+	}
+	setServing(t, 2, 2, 0)
+	if w := probe(serveReadyz, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("live with healthy backends: %v %v, want OK", w.Code, w.Body)
+	}
+	setServing(t, 2, 2, 1)
+	if w := probe(serveReadyz, "/readyz"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "shutting down") {
+		t.Errorf("shutting down: %v %v, want unavailable", w.Code, w.Body)
+	}
+
+	setServing(t, 2, 2, 0)
+	useConfig(t, "default: 192.0.2.1:53\nroutes:\n  .example.com.: [192.0.2.2:53]\n")
+	if w := probe(serveReadyz, "/readyz"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), ".example.com.") {
+		t.Errorf("route without healthy backend: %v %v, want it unavailable", w.Code, w.Body)
+	}
+	useConfig(t, "default: 192.0.2.2:53\nroutes:\n  .example.com.: [192.0.2.1:53]\n")
+	if w := probe(serveReadyz, "/readyz"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "default") {
+		t.Errorf("default without healthy backend: %v %v, want it unavailable", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	logQueries = flag.Bool("log-queries", false, "Log every query with its route, upstream, rcode and latency")
+	logFormat  = flag.String("log-format", "text", "Format of the query log: text or json")
+
+	queries *queryLogger
+)
+
+// queryWriter wraps the ResponseWriter of a query to record what happened to
+// it, for metrics and query logging.
+type queryWriter struct {
+	dns.ResponseWriter
+	trace     *trace
+	logRoute  bool // the route has route-log
+	req       *dns.Msg
+	start     time.Time
+	route     string
+	upstreams []string
+	rcode     int
+	answered  bool
+}
+
+func newQueryWriter(w dns.ResponseWriter, req *dns.Msg) *queryWriter {
+	return &queryWriter{ResponseWriter: w, trace: newTrace(), req: req, start: time.Now()}
+}
+
+// setRoute records how the query is routed: a route name, default, none or
+// refused.
+func (w *queryWriter) setRoute(route string) {
+	w.route = route
+	routeQueries.inc(route)
+	if len(w.req.Question) > 0 {
+		q := w.req.Question[0]
+		w.trace.tracef("%v %v from %v: route %v", q.Name, dns.TypeToString[q.Qtype], w.RemoteAddr(), route)
+	}
+}
+
+func (w *queryWriter) WriteMsg(m *dns.Msg) error {
+	if m != nil {
+		responsesTotal.inc(dns.RcodeToString[m.Rcode])
+		w.rcode = m.Rcode
+		w.answered = true
+		w.trace.tracef("answered %v", dns.RcodeToString[m.Rcode])
+		capture.dump(w.trace.id, w.RemoteAddr(), w.req, m)
+	}
+	err := w.ResponseWriter.WriteMsg(m)
+	if err != nil {
+		transport := "tcp"
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			transport = "udp"
+		}
+		writeErrors.inc(transport)
+		writeErrorLog.printf("writing response to %v over %v failed: %v", w.RemoteAddr(), transport, err)
+	}
+	return err
+}
+
+// writeErrorLog logs the failures to write responses, which can be many when
+// clients go away.
+var writeErrorLog = &limitedLog{interval: time.Second}
+
+// limitedLog logs at most one message per interval, counting the others.
+type limitedLog struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (l *limitedLog) printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return
+	}
+	if l.suppressed > 0 {
+		format += fmt.Sprintf(" (%d similar messages suppressed)", l.suppressed)
+	}
+	log.Printf(format, v...)
+	l.last, l.suppressed = now, 0
+}
+
+// queryEntry is a line of the query log.
+type queryEntry struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Route    string    `json:"route"`
+	Upstream string    `json:"upstream"`
+	Rcode    string    `json:"rcode"`
+	Latency  float64   `json:"latency_ms"`
+}
+
+// queryLogger writes the query log from its own goroutine so that logging
+// never blocks the query path: entries are dropped if it falls behind.
+type queryLogger struct {
+	format  string
+	out     io.Writer
+	entries chan queryEntry
+	done    sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+func newQueryLogger(format string, out io.Writer) (*queryLogger, error) {
+	switch format {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q, must be text or json", format)
+	}
+	l := &queryLogger{format: format, out: out, entries: make(chan queryEntry, 1024)}
+	l.done.Add(1)
+	go l.run()
+	return l, nil
+}
+
+// log queues an entry for the query req answered through w, with
+// -log-queries or if its route has route-log.
+func (l *queryLogger) log(w *queryWriter, req *dns.Msg) {
+	if l == nil || (!*logQueries && !w.logRoute) {
+		return
+	}
+	e := queryEntry{
+		Time:     w.start,
+		ID:       w.trace.id,
+		Route:    w.route,
+		Upstream: strings.Join(w.upstreams, ","),
+		Rcode:    "-",
+		Latency:  float64(time.Since(w.start)) / float64(time.Millisecond),
+	}
+	e.Client, _, _ = net.SplitHostPort(w.RemoteAddr().String())
+	if len(req.Question) > 0 {
+		e.Name = req.Question[0].Name
+		e.Type = dns.TypeToString[req.Question[0].Qtype]
+	}
+	if w.answered {
+		e.Rcode = dns.RcodeToString[w.rcode]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		l.dropped++
+	}
+}
+
+func (l *queryLogger) run() {
+	defer l.done.Done()
+	enc := json.NewEncoder(l.out)
+	text := log.New(l.out, "", log.LstdFlags)
+	for e := range l.entries {
+		if l.format == "json" {
+			enc.Encode(e)
+			continue
+		}
+		text.Printf("query id=%s client=%s name=%s type=%s route=%s upstream=%s rcode=%s latency=%.3fms",
+			e.ID, e.Client, e.Name, e.Type, e.Route, e.Upstream, e.Rcode, e.Latency)
+	}
+}
+
+// close flushes the queued entries and stops the logger.
+func (l *queryLogger) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.closed = true
+	close(l.entries)
+	l.mu.Unlock()
+	l.done.Wait()
+	if l.dropped > 0 {
+		log.Printf("query log dropped %d entries", l.dropped)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// logBuffer is a log captured by a test, which reads it while the handlers
+// of the proxy write to it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *logBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// captureLog sends the log to a buffer for the duration of the test.
+func captureLog(t *testing.T) *logBuffer {
+	buf := new(logBuffer)
+	old := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(old) })
+	return buf
+}
+
+func TestWriteErrors(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	before := writeErrors.snapshot()
+	for _, netw := range []string{"udp", "tcp"} {
+		w := newStubWriter(netw, "127.0.0.1:5353")
+		w.err = errors.New("connection reset")
+		route(w, newQ("www.example.com.", dns.TypeA))
+		if len(w.msgs) != 1 {
+			t.Fatalf("%v: %d messages written, want 1", netw, len(w.msgs))
+		}
+		if n := writeErrors.snapshot()[netw] - before[netw]; n != 1 {
+			t.Errorf("%v: %d write errors counted, want 1", netw, n)
+		}
+	}
+	// Local answers too.
+	setFlag(t, "nsid", "proxy1")
+	w := newStubWriter("udp", "127.0.0.1:5353")
+	w.err = errors.New("connection refused")
+	route(w, chaosQ(idServer))
+	if n := writeErrors.snapshot()["udp"] - before["udp"]; n != 2 {
+		t.Errorf("%d UDP write errors counted after a local answer, want 2", n)
+	}
+}
+
+func TestLimitedLog(t *testing.T) {
+	buf := captureLog(t)
+	l := &limitedLog{interval: 50 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		l.printf("failure %d", i)
+	}
+	if got := strings.Count(buf.String(), "failure"); got != 1 {
+		t.Errorf("%d messages logged within the interval, want 1:\n%v", got, buf)
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.printf("failure %d", 3)
+	if !strings.Contains(buf.String(), "failure 3 (2 similar messages suppressed)") {
+		t.Errorf("log after the interval:\n%v\nwant the count of the messages suppressed", buf)
+	}
+}
+
+func TestRouteLog(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf(`routes:
+  .logged.example.: [%v]
+  .quiet.example.: [%v]
+route-log: [.logged.example.]
+`, up, up))
+	var out bytes.Buffer
+	old := queries
+	l, err := newQueryLogger("text", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries = l
+	t.Cleanup(func() { queries = old })
+	buf := captureLog(t)
+	addr := startProxy(t)
+
+	query(t, "udp", addr, "www.quiet.example.", dns.TypeA)
+	query(t, "udp", addr, "www.logged.example.", dns.TypeA)
+	l.close()
+	if got := out.String(); strings.Contains(got, "quiet") || strings.Count(got, "name=www.logged.example.") != 1 {
+		t.Errorf("query log %q, want a line for the logged route only", got)
+	}
+	// The steps of the logged query only are traced.
+	ids, lines := traceIDs(buf.String())
+	if len(lines) == 0 || !strings.Contains(lines[0], "www.logged.example.") {
+		t.Fatalf("trace %q, want the steps of the logged route", lines)
+	}
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("trace %q, want the steps of the logged query only", lines)
+			break
+		}
+	}
+
+	setFlag(t, "config", writeFile(t, "config.yaml", "routes:\n  .example.com.: [192.0.2.1:53]\nroute-log: [.example.org.]\n"))
+	if _, err := buildSettings(); err == nil {
+		t.Error("route-log of no route accepted")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var randomSeed = flag.Int64("random-seed", 0,
+	"Seed of the random picks of backends and latency probes, and of the query IDs of the logs, "+
+		"for reproducible runs (0 seeds from the time)")
+
+// random is the source of the random picks of the proxy, none of which needs
+// to be unpredictable. It can be replaced, seeded with -random-seed, for a
+// reproducible sequence.
+var random = newRandom(time.Now().UnixNano())
+
+// newRandom returns a source of random numbers seeded with seed, safe for
+// concurrent use.
+func newRandom(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+// lockedSource is a rand.Source safe for concurrent use, like the one of the
+// top-level functions of math/rand.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
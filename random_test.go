@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// useRandom seeds the random picks with seed for the duration of the test.
+func useRandom(t *testing.T, seed int64) {
+	old := random
+	random = newRandom(seed)
+	t.Cleanup(func() { random = old })
+}
+
+func TestRandomSeed(t *testing.T) {
+	a, b := newRandom(42), newRandom(42)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Int63(), b.Int63(); x != y {
+			t.Fatalf("draw %d: %v and %v from the same seed", i, x, y)
+		}
+	}
+	same := true
+	c, d := newRandom(1), newRandom(2)
+	for i := 0; i < 10; i++ {
+		if c.Int63() != d.Int63() {
+			same = false
+		}
+	}
+	if same {
+		t.Error("seeds 1 and 2 gave the same sequence")
+	}
+
+	// Safe for concurrent use, under the race detector.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				a.Intn(10)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWeightedSequence(t *testing.T) {
+	a1, a2 := startUpstream(t, answerA("192.0.2.1")), startUpstream(t, answerA("192.0.2.2"))
+	setFlag(t, "strategy", strategyWeighted)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v#50, %v#50]\n", a1, a2))
+
+	// picks returns the backends answering 20 queries with picks seeded
+	// with seed.
+	picks := func(seed int64) []string {
+		useRandom(t, seed)
+		var ips []string
+		for i := 0; i < 20; i++ {
+			w := newStubWriter("udp", "127.0.0.1:5353")
+			route(w, newQ("www.example.com.", dns.TypeA))
+			if len(w.msgs) != 1 {
+				t.Fatalf("query %d: %d responses, want 1", i, len(w.msgs))
+			}
+			ips = append(ips, answerIPs(w.msgs[0])...)
+		}
+		return ips
+	}
+	first := picks(42)
+	if second := picks(42); fmt.Sprint(second) != fmt.Sprint(first) {
+		t.Errorf("seed 42 picked %v then %v, want the same sequence", first, second)
+	}
+	seen := make(map[string]bool)
+	for _, ip := range first {
+		seen[ip] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("seed 42 picked %v, want both backends", first)
+	}
+	if other := picks(7); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Errorf("seeds 42 and 7 both picked %v", first)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+var caseRandomization = flag.Bool("case-randomization", false,
+	"Randomize the ID and the case of the name of queries to backends (DNS 0x20), "+
+		"rejecting responses which do not echo that case")
+
+// randomizeQuery returns a copy of req to send to a backend with a random ID
+// and the letters of its name in random case.
+func randomizeQuery(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	m.Id = dns.Id()
+	m.Question[0].Name = randomizeCase(m.Question[0].Name)
+	return m
+}
+
+func randomizeCase(name string) string {
+	b := []byte(name)
+	bits := make([]byte, len(b))
+	rand.Read(bits)
+	for i, c := range b {
+		if lower := c | 0x20; lower >= 'a' && lower <= 'z' {
+			b[i] = lower &^ (bits[i] & 1 << 5)
+		}
+	}
+	return string(b)
+}
+
+// restoreQuery checks that resp answers the query sent, as returned by
+// randomizeQuery for req, with its name in the same case and restores the ID
+// and name of req in it, as well as in the records owned by that name.
+func restoreQuery(req, sent, resp *dns.Msg) error {
+	name := sent.Question[0].Name
+	if len(resp.Question) != 1 || resp.Question[0].Name != name {
+		return fmt.Errorf("response does not echo the question %v", name)
+	}
+	resp.Id = req.Id
+	resp.Question[0].Name = req.Question[0].Name
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == name {
+				rr.Header().Name = req.Question[0].Name
+			}
+		}
+	}
+	return nil
+}
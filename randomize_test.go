@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	const name = "www-1.Example.COM."
+	mixed := false
+	for i := 0; i < 20; i++ {
+		got := randomizeCase(name)
+		if !strings.EqualFold(got, name) || len(got) != len(name) {
+			t.Fatalf("randomizeCase(%v) = %v, not the same name", name, got)
+		}
+		if got != strings.ToLower(name) && got != strings.ToUpper(name) {
+			mixed = true
+		}
+	}
+	if !mixed {
+		t.Errorf("randomizeCase(%v) never mixed the case", name)
+	}
+	req := newQ(name, dns.TypeA)
+	if sent := randomizeQuery(req); sent == req || req.Question[0].Name != name {
+		t.Error("randomizeQuery changed the query of the client")
+	}
+}
+
+// echoCase answers with an A record owned by the name queried, recording the
+// names received.
+type echoCase struct {
+	lower bool // answer the question in lower case instead
+
+	mu    sync.Mutex
+	names []string
+}
+
+func (e *echoCase) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	e.mu.Lock()
+	e.names = append(e.names, r.Question[0].Name)
+	e.mu.Unlock()
+	if e.lower {
+		r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+	}
+	answerA("192.0.2.1")(w, r)
+}
+
+func TestCaseRandomization(t *testing.T) {
+	setFlag(t, "case-randomization", "true")
+	echo := &echoCase{}
+	lower := &echoCase{lower: true}
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .lower.example.: [%v]\n", startServer(t, echo), startServer(t, lower)))
+	addr := startProxy(t)
+
+	const name = "WWW.Example.com."
+	for i := 0; i < 5; i++ {
+		r := query(t, "udp", addr, name, dns.TypeA)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Fatalf("got %v %v, want the answer", dns.RcodeToString[r.Rcode], r.Answer)
+		}
+		if r.Question[0].Name != name || r.Answer[0].Header().Name != name {
+			t.Errorf("question %v, answer owned by %v; want the case of the client %v",
+				r.Question[0].Name, r.Answer[0].Header().Name, name)
+		}
+	}
+	echo.mu.Lock()
+	sent := echo.names
+	echo.mu.Unlock()
+	randomized := false
+	for _, s := range sent {
+		if !strings.EqualFold(s, name) {
+			t.Errorf("backend asked for %v, want %v in any case", s, name)
+		}
+		if s != name {
+			randomized = true
+		}
+	}
+	if !randomized {
+		t.Errorf("backend always asked for %v as is", name)
+	}
+
+	if r := query(t, "udp", addr, "WWW.lower.example.", dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("response in another case: got %v, want SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+}
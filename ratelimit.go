@@ -0,0 +1,83 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit = flag.Float64("rate-limit", 0,
+		"Queries per second allowed per client IP (0 disables rate limiting)")
+	rateLimitBurst = flag.Int("rate-limit-burst", 20,
+		"Queries a client IP can send at once above -rate-limit")
+	rateLimitClients = flag.Int("rate-limit-clients", 100000,
+		"Maximum number of client IPs tracked by the rate limiter, least recently seen are forgotten")
+	rateLimitDrop = flag.Bool("rate-limit-drop", false,
+		"Drop queries over the rate limit instead of answering REFUSED")
+
+	limiter *rateLimiter // nil if rate limiting is disabled
+)
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter per client. The buckets are kept
+// in a LRU so that a flood from spoofed sources cannot exhaust memory.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	size  int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List // front is most recently seen
+}
+
+func newRateLimiter(rate float64, burst, size int) (*rateLimiter, error) {
+	if rate <= 0 || burst <= 0 || size <= 0 {
+		return nil, fmt.Errorf("invalid rate limit: -rate-limit, -rate-limit-burst and -rate-limit-clients must be positive")
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		size:    size,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// allow returns whether client can send a query now, consuming a token.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.buckets[client]
+	if !ok {
+		el = l.lru.PushFront(&bucket{client: client, tokens: l.burst, last: now})
+		l.buckets[client] = el
+		for l.lru.Len() > l.size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).client)
+		}
+	} else {
+		l.lru.MoveToFront(el)
+	}
+	b := el.Value.(*bucket)
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	recursive = flag.Bool("recursive", false,
+		"Resolve the queries with no route and no default server iteratively, from the root servers")
+	rootHints = flag.String("root-hints", "",
+		"Zone file of the root servers and their addresses for -recursive (default built-in)")
+	qnameMin = flag.Bool("qname-min", false,
+		"With -recursive, ask the servers of each zone only for the name with its next label, "+
+			"not the full name queried (QNAME minimization, RFC 9156)")
+
+	recursor *resolver // nil if -recursive is disabled
+)
+
+// builtinRootHints are the root servers with their IPv4 address, as
+// published by IANA in named.root.
+const builtinRootHints = `
+.                   3600000 NS A.ROOT-SERVERS.NET.
+.                   3600000 NS B.ROOT-SERVERS.NET.
+.                   3600000 NS C.ROOT-SERVERS.NET.
+.                   3600000 NS D.ROOT-SERVERS.NET.
+.                   3600000 NS E.ROOT-SERVERS.NET.
+.                   3600000 NS F.ROOT-SERVERS.NET.
+.                   3600000 NS G.ROOT-SERVERS.NET.
+.                   3600000 NS H.ROOT-SERVERS.NET.
+.                   3600000 NS I.ROOT-SERVERS.NET.
+.                   3600000 NS J.ROOT-SERVERS.NET.
+.                   3600000 NS K.ROOT-SERVERS.NET.
+.                   3600000 NS L.ROOT-SERVERS.NET.
+.                   3600000 NS M.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET. 3600000 A  198.41.0.4
+B.ROOT-SERVERS.NET. 3600000 A  170.247.170.2
+C.ROOT-SERVERS.NET. 3600000 A  192.33.4.12
+D.ROOT-SERVERS.NET. 3600000 A  199.7.91.13
+E.ROOT-SERVERS.NET. 3600000 A  192.203.230.10
+F.ROOT-SERVERS.NET. 3600000 A  192.5.5.241
+G.ROOT-SERVERS.NET. 3600000 A  192.112.36.4
+H.ROOT-SERVERS.NET. 3600000 A  198.97.190.53
+I.ROOT-SERVERS.NET. 3600000 A  192.36.148.17
+J.ROOT-SERVERS.NET. 3600000 A  192.58.128.30
+K.ROOT-SERVERS.NET. 3600000 A  193.0.14.129
+L.ROOT-SERVERS.NET. 3600000 A  199.7.83.42
+M.ROOT-SERVERS.NET. 3600000 A  202.12.27.33
+`
+
+// Bounds of an iterative resolution, against loops and misconfigured zones.
+const (
+	maxReferrals = 16 // per name looked up
+	maxCNAMEs    = 8  // followed per query
+	maxGlueDepth = 3  // nested lookups of the addresses of name servers
+)
+
+// recursiveAddr stands for the upstream of recursive responses in the cache.
+const recursiveAddr = "recursive"
+
+// resolver resolves queries iteratively: from the root servers it follows the
+// referrals down to the servers authoritative for the name, querying the
+// addresses of name servers given without glue. It does not validate DNSSEC
+// and only caches the final responses, in the response cache.
+type resolver struct {
+	roots []string // addresses of the root servers
+	port  string
+}
+
+// newResolver returns a resolver starting from the IPv4 addresses of the root
+// servers in the file at path, or the built-in ones if empty.
+func newResolver(path string) (*resolver, error) {
+	var r io.Reader = strings.NewReader(builtinRootHints)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	res := &resolver{port: "53"}
+	zp := dns.NewZoneParser(r, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if a, ok := rr.(*dns.A); ok {
+			res.roots = append(res.roots, net.JoinHostPort(a.A.String(), res.port))
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.roots) == 0 {
+		return nil, fmt.Errorf("%v: no root server address", path)
+	}
+	return res, nil
+}
+
+// answer returns the response to req resolved iteratively, or from the cache.
+func (r *resolver) answer(opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	if responseCache != nil {
+		if resp, _ := responseCache.get(recursiveAddr, req, false, 0); resp != nil {
+			cacheLookups.inc("hit")
+			traceOf(opts.ctx).tracef("cached recursive response")
+			return resp, nil
+		}
+		cacheLookups.inc("miss")
+	}
+	resp, err := r.resolve(opts, req.Question[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	resp.Question = req.Question
+	resp.Authoritative = false
+	resp.RecursionAvailable = true
+	// Glue and the options of the last server are not for the client.
+	resp.Extra = nil
+	clampTTLs(resp, uint32(*ttlMin), uint32(*ttlMax))
+	if responseCache != nil {
+		responseCache.set(recursiveAddr, req, false, 0, resp)
+	}
+	return resp, nil
+}
+
+// resolve answers the question q, following the CNAME records of the answers
+// which do not include the records of their target. The records of the
+// chain are prepended to the response of its last name.
+func (r *resolver) resolve(opts routeOptions, q dns.Question, depth int) (*dns.Msg, error) {
+	var chain []dns.RR
+	for i := 0; ; i++ {
+		resp, err := r.lookup(opts, q, depth)
+		if err != nil {
+			return nil, err
+		}
+		target := unresolvedTarget(resp.Answer, q)
+		if target == "" || resp.Rcode != dns.RcodeSuccess {
+			resp.Answer = append(chain, resp.Answer...)
+			return resp, nil
+		}
+		if i == maxCNAMEs {
+			return nil, fmt.Errorf("%v: too many CNAME records", q.Name)
+		}
+		chain = append(chain, resp.Answer...)
+		q.Name = target
+	}
+}
+
+// unresolvedTarget returns the name the CNAME records of answer lead q.Name
+// to if answer has no record of type q.Qtype for it, else "".
+func unresolvedTarget(answer []dns.RR, q dns.Question) string {
+	name := q.Name
+	for range answer {
+		var next string
+		for _, rr := range answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == q.Qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	if name == q.Name {
+		return ""
+	}
+	return name
+}
+
+// lookup queries q from the root servers down the referrals, and returns the
+// first response which is not one: an answer, NXDOMAIN or NODATA. With
+// -qname-min the servers of each zone are asked for the name cut to one label
+// below it until there is no more zone cut to find, and for the full name if
+// they answer NXDOMAIN or NOTIMP, which servers not knowing empty
+// non-terminals do.
+func (r *resolver) lookup(opts routeOptions, q dns.Question, depth int) (*dns.Msg, error) {
+	servers, zone := r.roots, "."
+	minimize, labels := *qnameMin, 1
+	for referrals := 0; referrals < maxReferrals; {
+		mq := q
+		if minimize {
+			mq = minimizedQuestion(q, labels)
+		}
+		resp, err := r.query(opts, servers, mq)
+		if err != nil {
+			return nil, err
+		}
+		if mq != q && (resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeNotImplemented) {
+			traceOf(opts.ctx).tracef("%v: %v for %v, asking the full name", q.Name, dns.RcodeToString[resp.Rcode], mq.Name)
+			minimize = false
+			continue
+		}
+		child, names := referral(resp, zone, q.Name)
+		if names == nil {
+			if mq != q {
+				// No zone cut at this label, ask for the next one.
+				labels++
+				continue
+			}
+			return resp, nil
+		}
+		traceOf(opts.ctx).tracef("%v referred to %v: %v", q.Name, child, strings.Join(names, " "))
+		if servers = r.addresses(opts, resp, names, depth); len(servers) == 0 {
+			return nil, fmt.Errorf("%v: no address for the name servers of %v", q.Name, child)
+		}
+		zone, labels = child, dns.CountLabel(child)+1
+		referrals++
+	}
+	return nil, fmt.Errorf("%v: too many referrals", q.Name)
+}
+
+// minimizedQuestion returns the question asked for q with -qname-min: its
+// name cut to its last labels, of type A as RFC 9156 recommends, or q itself
+// if the name has no more labels.
+func minimizedQuestion(q dns.Question, labels int) dns.Question {
+	i, start := dns.PrevLabel(q.Name, labels)
+	if start || i == 0 {
+		return q
+	}
+	return dns.Question{Name: q.Name[i:], Qtype: dns.TypeA, Qclass: q.Qclass}
+}
+
+// referral returns the zone resp delegates name to and the names of its
+// servers if it is a referral to a child of zone, else nil.
+func referral(resp *dns.Msg, zone, name string) (string, []string) {
+	if resp.Rcode != dns.RcodeSuccess || resp.Authoritative || len(resp.Answer) > 0 {
+		return "", nil
+	}
+	var child string
+	var names []string
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		child = owner
+		names = append(names, strings.ToLower(ns.Ns))
+	}
+	return child, names
+}
+
+// addresses returns the addresses of the name servers names, from the glue
+// of the referral resp or else by looking them up.
+func (r *resolver) addresses(opts routeOptions, resp *dns.Msg, names []string, depth int) []string {
+	var addrs []string
+	for _, rr := range resp.Extra {
+		if a, ok := rr.(*dns.A); ok && containsName(names, a.Hdr.Name) {
+			addrs = append(addrs, net.JoinHostPort(a.A.String(), r.port))
+		}
+	}
+	if len(addrs) > 0 || depth == maxGlueDepth {
+		return addrs
+	}
+	for _, name := range names {
+		m, err := r.resolve(opts, dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), r.port))
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// query sends q to each of servers in turn until one answers it, over TCP if
+// truncated. Servers failing or refusing the query are skipped.
+func (r *resolver) query(opts routeOptions, servers []string, q dns.Question) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.Id = dns.Id()
+	req.Question = []dns.Question{q}
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	var err error
+	for _, addr := range servers {
+		var resp *dns.Msg
+		resp, err = exchange(addr, "udp", opts, req)
+		if err == nil && resp.Truncated {
+			resp, err = exchange(addr, "tcp", opts, req)
+		}
+		if opts.ctx.Err() != nil {
+			return nil, opts.ctx.Err()
+		}
+		if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+			err = fmt.Errorf("%v: %v from %v", q.Name, dns.RcodeToString[resp.Rcode], addr)
+		}
+		if err == nil {
+			traceOf(opts.ctx).tracef("%v %v from %v: %v", q.Name, dns.TypeToString[q.Qtype], addr, dns.RcodeToString[resp.Rcode])
+			return resp, nil
+		}
+		traceOf(opts.ctx).tracef("%v %v from %v failed: %v", q.Name, dns.TypeToString[q.Qtype], addr, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMinimizedQuestion(t *testing.T) {
+	q := dns.Question{Name: "www.Dept.corp.example.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}
+	for _, tt := range []struct {
+		labels int
+		name   string
+		qtype  uint16
+	}{
+		{1, "example.", dns.TypeA},
+		{2, "corp.example.", dns.TypeA},
+		{3, "Dept.corp.example.", dns.TypeA},
+		{4, "www.Dept.corp.example.", dns.TypeMX},
+		{5, "www.Dept.corp.example.", dns.TypeMX},
+	} {
+		got := minimizedQuestion(q, tt.labels)
+		if got.Name != tt.name || got.Qtype != tt.qtype || got.Qclass != dns.ClassINET {
+			t.Errorf("minimizedQuestion(%d) = %v, want %v %v", tt.labels, got, tt.name, dns.TypeToString[tt.qtype])
+		}
+	}
+}
+
+// zoneServer is an authoritative server for the test resolutions, logging
+// the names it is asked for.
+type zoneServer struct {
+	zone        string
+	delegated   map[string]string // child zone to the address of its server
+	records     map[string]dns.RR // A record per name
+	entNXDOMAIN bool              // answer NXDOMAIN for empty non-terminals
+	notimp      bool              // answer NOTIMP for names without records
+
+	mu    sync.Mutex
+	asked []string
+}
+
+func (z *zoneServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	z.mu.Lock()
+	z.asked = append(z.asked, name)
+	z.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for child, ip := range z.delegated {
+		if dns.IsSubDomain(child, name) {
+			ns := "ns." + child
+			m.Ns = append(m.Ns, &dns.NS{Hdr: dns.RR_Header{Name: child, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}, Ns: ns})
+			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)})
+			w.WriteMsg(m)
+			return
+		}
+	}
+	m.Authoritative = true
+	if rr, ok := z.records[name]; ok {
+		if q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+		return
+	}
+	ent := false
+	for owner := range z.records {
+		if dns.IsSubDomain(name, owner) {
+			ent = true
+		}
+	}
+	switch {
+	case z.notimp:
+		m.SetRcode(r, dns.RcodeNotImplemented)
+	case !ent || z.entNXDOMAIN:
+		m.SetRcode(r, dns.RcodeNameError)
+	}
+	w.WriteMsg(m)
+}
+
+func (z *zoneServer) names() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return append([]string(nil), z.asked...)
+}
+
+// startZoneServers starts the servers of the root, example. and
+// corp.example. zones on the same port of 127.0.0.1, .2 and .3, and returns
+// a resolver starting from the root.
+func startZoneServers(t *testing.T, root, example, corp *zoneServer) *resolver {
+	t.Helper()
+	addr := startServer(t, root)
+	_, port, _ := net.SplitHostPort(addr)
+	for i, z := range []*zoneServer{example, corp} {
+		startServerAt(t, z, net.JoinHostPort(fmt.Sprintf("127.0.0.%d", i+2), port))
+	}
+	return &resolver{roots: []string{addr}, port: port}
+}
+
+func newZoneServers() (root, example, corp *zoneServer) {
+	root = &zoneServer{zone: ".", delegated: map[string]string{"example.": "127.0.0.2"}}
+	example = &zoneServer{zone: "example.", delegated: map[string]string{"corp.example.": "127.0.0.3"}}
+	corp = &zoneServer{zone: "corp.example.", records: map[string]dns.RR{
+		"www.dept.corp.example.": rrWithTTL("www.dept.corp.example.", 300),
+	}}
+	return root, example, corp
+}
+
+func resolveA(t *testing.T, r *resolver, name string) *dns.Msg {
+	t.Helper()
+	resp, err := r.resolve(testOptions(), dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, 0)
+	if err != nil {
+		t.Fatalf("resolve %v: %v", name, err)
+	}
+	return resp
+}
+
+func TestQnameMinimization(t *testing.T) {
+	setFlag(t, "qname-min", "true")
+	root, example, corp := newZoneServers()
+	r := startZoneServers(t, root, example, corp)
+
+	resp := resolveA(t, r, "www.dept.corp.example.")
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Fatalf("answer %v, want 192.0.2.1", ips)
+	}
+	for _, tt := range []struct {
+		z    *zoneServer
+		want string
+	}{
+		{root, "[example.]"},
+		{example, "[corp.example.]"},
+		{corp, "[dept.corp.example. www.dept.corp.example.]"},
+	} {
+		if got := fmt.Sprint(tt.z.names()); got != tt.want {
+			t.Errorf("servers of %v asked for %v, want %v", tt.z.zone, got, tt.want)
+		}
+	}
+
+	if resp := resolveA(t, r, "nowhere.example."); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("name not existing: got %v, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestQnameMinimizationDisabled(t *testing.T) {
+	root, example, corp := newZoneServers()
+	r := startZoneServers(t, root, example, corp)
+	resolveA(t, r, "www.dept.corp.example.")
+	for _, z := range []*zoneServer{root, example, corp} {
+		if got := fmt.Sprint(z.names()); got != "[www.dept.corp.example.]" {
+			t.Errorf("servers of %v asked for %v without -qname-min, want the full name", z.zone, got)
+		}
+	}
+}
+
+func TestQnameMinimizationFallback(t *testing.T) {
+	setFlag(t, "qname-min", "true")
+	for _, tt := range []struct {
+		what   string
+		breaks func(corp *zoneServer)
+	}{
+		{"NXDOMAIN for an empty non-terminal", func(corp *zoneServer) { corp.entNXDOMAIN = true }},
+		{"NOTIMP", func(corp *zoneServer) { corp.notimp = true }},
+	} {
+		root, example, corp := newZoneServers()
+		tt.breaks(corp)
+		r := startZoneServers(t, root, example, corp)
+		resp := resolveA(t, r, "www.dept.corp.example.")
+		if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Errorf("%v: answer %v, want 192.0.2.1 asking the full name", tt.what, ips)
+		}
+		if got := fmt.Sprint(corp.names()); got != "[dept.corp.example. www.dept.corp.example.]" {
+			t.Errorf("%v: servers of corp.example. asked for %v", tt.what, got)
+		}
+	}
+}
+
+// useResolver makes r resolve the unrouted queries for the duration of the
+// test.
+func useResolver(t *testing.T, r *resolver) {
+	old := recursor
+	recursor = r
+	t.Cleanup(func() { recursor = old })
+}
+
+func TestRecursive(t *testing.T) {
+	root, example, corp := newZoneServers()
+	corp.records["alias.corp.example."] = &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "alias.corp.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: "www.dept.corp.example.",
+	}
+	useResolver(t, startZoneServers(t, root, example, corp))
+	useCache(t, 100)
+	up := startUpstream(t, answerA("192.0.2.9"))
+	useConfig(t, fmt.Sprintf("routes:\n  .routed.example.: [%v]\n", up))
+	addr := startProxy(t)
+
+	r := query(t, "udp", addr, "www.dept.corp.example.", dns.TypeA)
+	if ips := answerIPs(r); r.Rcode != dns.RcodeSuccess || len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Fatalf("got %v %v, want 192.0.2.1 resolved from the root", dns.RcodeToString[r.Rcode], ips)
+	}
+	if !r.RecursionAvailable || r.Authoritative || len(r.Extra) != 0 {
+		t.Errorf("response RA %v AA %v with %d additional records, want RA only", r.RecursionAvailable, r.Authoritative, len(r.Extra))
+	}
+	query(t, "udp", addr, "www.dept.corp.example.", dns.TypeA)
+	if got := len(root.names()); got != 1 {
+		t.Errorf("root servers asked %d times for a name queried twice, want once and the cache", got)
+	}
+
+	// CNAME records without the records of their target are followed.
+	r = query(t, "udp", addr, "alias.corp.example.", dns.TypeA)
+	if len(r.Answer) != 2 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("answer %v, want the CNAME record then the A record of its target", r.Answer)
+	} else if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("answer %v, want 192.0.2.1 behind the CNAME record", ips)
+	}
+
+	if r := query(t, "udp", addr, "nowhere.example.", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Errorf("name not existing: got %v, want NXDOMAIN", dns.RcodeToString[r.Rcode])
+	}
+
+	// Routes still apply, and transfers are not resolved.
+	asked := len(root.names())
+	if ips := answerIPs(query(t, "udp", addr, "www.routed.example.", dns.TypeA)); len(ips) != 1 || ips[0] != "192.0.2.9" {
+		t.Errorf("routed query answered %v, want that of its backend", ips)
+	}
+	query(t, "tcp", addr, "corp.example.", dns.TypeAXFR)
+	if got := len(root.names()); got != asked {
+		t.Errorf("root servers asked for %v, want no routed query nor transfer", root.names()[asked:])
+	}
+}
+
+func TestRootHints(t *testing.T) {
+	r, err := newResolver(writeFile(t, "root.hints", `.                3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     199.9.14.201
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(r.roots); got != "[198.41.0.4:53 199.9.14.201:53]" {
+		t.Errorf("roots %v, want the IPv4 addresses of the hints", got)
+	}
+	if r, err := newResolver(""); err != nil {
+		t.Errorf("built-in root hints: %v", err)
+	} else if len(r.roots) == 0 {
+		t.Error("no built-in root server")
+	}
+	for _, content := range []string{
+		". 3600000 NS A.ROOT-SERVERS.NET.\n",
+		". 3600000 IN BOGUS 1\n",
+	} {
+		if _, err := newResolver(writeFile(t, "root.hints", content)); err == nil {
+			t.Errorf("root hints %q accepted", content)
+		}
+	}
+	if _, err := newResolver(filepath.Join(t.TempDir(), "root.hints")); err == nil {
+		t.Error("missing root hints file accepted")
+	}
+}
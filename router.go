@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RouterConfig configures a Router.
+type RouterConfig struct {
+	// Default is the server of the queries matching no route, if any.
+	Default string
+	// QtypeDefaults are the servers of the queries of a type matching no
+	// route, instead of Default.
+	QtypeDefaults map[uint16]string
+	// Routes are the backends of the routes keyed by normalized domain, =name
+	// for exact match routes, ~pattern for regex routes and group:domain for
+	// routes of client groups.
+	Routes map[string][]string
+	// RegexRoutes are tried in order, after suffix routes unless RegexFirst.
+	RegexRoutes []regexRoute
+	RegexFirst  bool
+	// Groups are the client groups, tried in order.
+	Groups []clientGroup
+}
+
+// Router decides which route and backends handle a query. It does no I/O
+// and is safe for concurrent use once built.
+type Router struct {
+	defaultServer string
+	qtypeDefaults map[uint16]string
+	routes        map[string][]string
+	routeNames    []string // keys of suffix routes, most specific first
+	regexRoutes   []regexRoute
+	regexFirst    bool
+	groups        []clientGroup
+}
+
+// NewRouter returns a Router for c, which must not be modified afterwards.
+func NewRouter(c RouterConfig) *Router {
+	r := &Router{
+		defaultServer: c.Default,
+		qtypeDefaults: c.QtypeDefaults,
+		routes:        c.Routes,
+		regexRoutes:   c.RegexRoutes,
+		regexFirst:    c.RegexFirst,
+		groups:        make([]clientGroup, len(c.Groups)),
+	}
+	names := sortRouteNames(r.routes)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "=") && !strings.HasPrefix(name, "~") && !strings.Contains(name, ":") {
+			r.routeNames = append(r.routeNames, name)
+		}
+	}
+	for i, g := range c.Groups {
+		g.routeNames = nil
+		prefix := groupRouteKey(g.name, "")
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) && !strings.HasPrefix(name, prefix+"=") && !strings.HasPrefix(name, prefix+"~") {
+				g.routeNames = append(g.routeNames, name)
+			}
+		}
+		r.groups[i] = g
+	}
+	return r
+}
+
+// Match returns the backends of the query for name of type qtype from no
+// particular client: those of the matching route, else the default server.
+// It returns false if there is none.
+func (r *Router) Match(name string, qtype uint16) ([]string, bool) {
+	if route, ok := r.Route(name, nil); ok {
+		return r.routes[route], true
+	}
+	if server, _ := r.Default(qtype); server != "" {
+		return []string{server}, true
+	}
+	return nil, false
+}
+
+// Route returns the route matching name for the client: a route of its
+// client group, else the exact match route, else the longest matching suffix
+// route, else the first matching regex route. With RegexFirst regex routes
+// are tried before suffix routes.
+func (r *Router) Route(name string, client net.IP) (string, bool) {
+	if g := r.clientGroup(client); g != nil {
+		if route, ok := r.matchGroupRoute(g, name); ok {
+			return route, true
+		}
+	}
+	if _, ok := r.routes["="+name]; ok {
+		return "=" + name, true
+	}
+	if r.regexFirst {
+		if route, ok := r.matchRegexRoute(name); ok {
+			return route, true
+		}
+	}
+	for _, suffix := range r.routeNames {
+		if strings.HasSuffix(name, suffix) {
+			return suffix, true
+		}
+	}
+	if !r.regexFirst {
+		return r.matchRegexRoute(name)
+	}
+	return "", false
+}
+
+// Backends returns the backends of a route returned by Route.
+func (r *Router) Backends(route string) []string {
+	return r.routes[route]
+}
+
+// Default returns the server of the queries of type qtype matching no route
+// and the name of its route, default or default-<qtype>. The server is empty
+// if there is none.
+func (r *Router) Default(qtype uint16) (server, route string) {
+	if server := r.qtypeDefaults[qtype]; server != "" {
+		return server, "default-" + dns.TypeToString[qtype]
+	}
+	return r.defaultServer, "default"
+}
+
+// defaults returns the default servers, of all query types.
+func (r *Router) defaults() []string {
+	var addrs []string
+	if r.defaultServer != "" {
+		addrs = append(addrs, r.defaultServer)
+	}
+	for _, addr := range r.qtypeDefaults {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (r *Router) matchRegexRoute(name string) (string, bool) {
+	for _, re := range r.regexRoutes {
+		if re.re.MatchString(name) {
+			return re.name, true
+		}
+	}
+	return "", false
+}
+
+// clientGroup returns the first group of the client ip, or nil.
+func (r *Router) clientGroup(ip net.IP) *clientGroup {
+	if ip == nil {
+		return nil
+	}
+	for i := range r.groups {
+		for _, n := range r.groups[i].nets {
+			if n.Contains(ip) {
+				return &r.groups[i]
+			}
+		}
+	}
+	return nil
+}
+
+// matchGroupRoute returns the route of the client group g matching name:
+// the exact match route, else the most specific suffix route.
+func (r *Router) matchGroupRoute(g *clientGroup, name string) (string, bool) {
+	key := groupRouteKey(g.name, "="+name)
+	if _, ok := r.routes[key]; ok {
+		return key, true
+	}
+	prefix := groupRouteKey(g.name, "")
+	for _, key := range g.routeNames {
+		if strings.HasSuffix(name, key[len(prefix):]) {
+			return key, true
+		}
+	}
+	return "", false
+}
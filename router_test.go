@@ -0,0 +1,234 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRouteLongestSuffix(t *testing.T) {
+	r := NewRouter(RouterConfig{
+		Default: "192.0.2.1:53",
+		Routes: map[string][]string{
+			".example.com.":         {"192.0.2.2:53"},
+			".corp.example.com.":    {"192.0.2.3:53"},
+			".eu.corp.example.com.": {"192.0.2.4:53"},
+			"example.net.":          {"192.0.2.5:53"},
+		},
+	})
+	for _, tt := range []struct {
+		name, route string
+	}{
+		{"www.example.com.", ".example.com."},
+		{"www.corp.example.com.", ".corp.example.com."},
+		{"db.eu.corp.example.com.", ".eu.corp.example.com."},
+		{"us.corp.example.com.", ".corp.example.com."},
+		{"eu.example.com.", ".example.com."},
+		{"example.net.", "example.net."},
+		{"badexample.net.", "example.net."},
+		{"example.com.", ""},
+		{"example.org.", ""},
+	} {
+		route, ok := r.Route(tt.name, nil)
+		if ok != (tt.route != "") || route != tt.route {
+			t.Errorf("Route(%v) = %q, %v; want %q", tt.name, route, ok, tt.route)
+		}
+	}
+}
+
+func TestRouteOrderDeterministic(t *testing.T) {
+	routes := make(map[string][]string)
+	for _, name := range []string{".a.example.", ".b.example.", ".example.", ".ab.example.", "b.example."} {
+		routes[name] = []string{"192.0.2.1:53"}
+	}
+	want := sortRouteNames(routes)
+	for i := 0; i < 20; i++ {
+		got := NewRouter(RouterConfig{Routes: routes}).routeNames
+		if len(got) != len(want) {
+			t.Fatalf("routeNames = %v, want %v", got, want)
+		}
+		for j := range got {
+			if got[j] != want[j] {
+				t.Fatalf("routeNames = %v, want %v", got, want)
+			}
+		}
+	}
+	for i := 1; i < len(want); i++ {
+		if len(want[i-1]) < len(want[i]) {
+			t.Errorf("sortRouteNames = %v, not longest first", want)
+		}
+	}
+}
+
+func TestMatchDefault(t *testing.T) {
+	r := NewRouter(RouterConfig{
+		Default: "192.0.2.1:53",
+		Routes:  map[string][]string{".example.com.": {"192.0.2.2:53", "192.0.2.3:53"}},
+	})
+	if backends, ok := r.Match("www.example.com.", dns.TypeA); !ok || len(backends) != 2 {
+		t.Errorf("Match(www.example.com.) = %v, %v; want the 2 backends of the route", backends, ok)
+	}
+	if backends, ok := r.Match("example.org.", dns.TypeA); !ok || len(backends) != 1 || backends[0] != "192.0.2.1:53" {
+		t.Errorf("Match(example.org.) = %v, %v; want the default", backends, ok)
+	}
+	if _, ok := NewRouter(RouterConfig{}).Match("example.org.", dns.TypeA); ok {
+		t.Error("Match without route nor default succeeded")
+	}
+}
+
+func TestRegexRoute(t *testing.T) {
+	anchored, backends, err := parseRouteRegexFlag(`^db[0-9]+\.internal\.$=192.0.2.2:53`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unanchored, _, err := parseRouteRegexFlag(`cache=192.0.2.3:53`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter(RouterConfig{
+		Routes: map[string][]string{
+			anchored.name:   backends,
+			unanchored.name: {"192.0.2.3:53"},
+			".example.com.": {"192.0.2.4:53"},
+		},
+		RegexRoutes: []regexRoute{anchored, unanchored},
+	})
+	for _, name := range r.routeNames {
+		if name[0] == '~' {
+			t.Errorf("regex route %v tried as a suffix", name)
+		}
+	}
+	for _, tt := range []struct {
+		name, route string
+	}{
+		{"db1.internal.", anchored.name},
+		{"DB42.Internal.", anchored.name},
+		{"xdb1.internal.", ""},
+		{"db1.internal.example.", ""},
+		{"db.internal.", ""},
+		{"mycache.example.org.", unanchored.name},
+		{"CACHE.example.org.", unanchored.name},
+		{"cache.example.com.", ".example.com."},
+	} {
+		route, ok := r.Route(tt.name, nil)
+		if ok != (tt.route != "") || route != tt.route {
+			t.Errorf("Route(%v) = %q, %v; want %q", tt.name, route, ok, tt.route)
+		}
+	}
+
+	if _, _, err := parseRouteRegexFlag(`db[=192.0.2.2:53`); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestRegexRouteFirst(t *testing.T) {
+	re, backends, _ := parseRouteRegexFlag(`^www\.=192.0.2.2:53`)
+	routes := map[string][]string{re.name: backends, ".example.com.": {"192.0.2.3:53"}}
+	for _, tt := range []struct {
+		regexFirst bool
+		route      string
+	}{
+		{false, ".example.com."},
+		{true, re.name},
+	} {
+		r := NewRouter(RouterConfig{Routes: routes, RegexRoutes: []regexRoute{re}, RegexFirst: tt.regexFirst})
+		if route, _ := r.Route("www.example.com.", nil); route != tt.route {
+			t.Errorf("RegexFirst %v: Route = %q, want %q", tt.regexFirst, route, tt.route)
+		}
+	}
+}
+
+func TestExactRoute(t *testing.T) {
+	r := NewRouter(RouterConfig{
+		Default: "192.0.2.1:53",
+		Routes: map[string][]string{
+			"=example.com.": {"192.0.2.2:53"},
+			".example.com.": {"192.0.2.3:53"},
+			"example.net.":  {"192.0.2.4:53"},
+			"=example.net.": {"192.0.2.5:53"},
+		},
+	})
+	for _, tt := range []struct {
+		name, route string
+	}{
+		{"example.com.", "=example.com."},
+		{"www.example.com.", ".example.com."},
+		{"example.net.", "=example.net."},
+		{"www.example.net.", "example.net."},
+	} {
+		route, ok := r.Route(tt.name, nil)
+		if !ok || route != tt.route {
+			t.Errorf("Route(%v) = %q, %v; want %q", tt.name, route, ok, tt.route)
+		}
+	}
+	for _, name := range r.routeNames {
+		if name[0] == '=' {
+			t.Errorf("exact route %v tried as a suffix", name)
+		}
+	}
+}
+
+func TestQtypeDefault(t *testing.T) {
+	r := NewRouter(RouterConfig{
+		Default:       "192.0.2.1:53",
+		QtypeDefaults: map[uint16]string{dns.TypeMX: "192.0.2.2:53"},
+		Routes:        map[string][]string{".example.com.": {"192.0.2.3:53"}},
+	})
+	for _, tt := range []struct {
+		name    string
+		qtype   uint16
+		backend string
+	}{
+		{"example.org.", dns.TypeMX, "192.0.2.2:53"},
+		{"example.org.", dns.TypeA, "192.0.2.1:53"},
+		{"www.example.com.", dns.TypeMX, "192.0.2.3:53"},
+	} {
+		if backends, ok := r.Match(tt.name, tt.qtype); !ok || len(backends) != 1 || backends[0] != tt.backend {
+			t.Errorf("Match(%v, %v) = %v, %v; want %v", tt.name, dns.TypeToString[tt.qtype], backends, ok, tt.backend)
+		}
+	}
+	if _, route := r.Default(dns.TypeMX); route != "default-MX" {
+		t.Errorf("route of the MX default = %q, want default-MX", route)
+	}
+	if _, route := r.Default(dns.TypeA); route != "default" {
+		t.Errorf("route of the default = %q, want default", route)
+	}
+}
+
+func TestRoutersIndependent(t *testing.T) {
+	a := NewRouter(RouterConfig{Default: "192.0.2.1:53", Routes: map[string][]string{".example.com.": {"192.0.2.2:53"}}})
+	b := NewRouter(RouterConfig{Default: "192.0.2.3:53", Routes: map[string][]string{".example.org.": {"192.0.2.4:53"}}})
+	for _, tt := range []struct {
+		r     *Router
+		name  string
+		want  string
+		which string
+	}{
+		{a, "www.example.com.", "192.0.2.2:53", "a"},
+		{a, "www.example.org.", "192.0.2.1:53", "a"},
+		{b, "www.example.com.", "192.0.2.3:53", "b"},
+		{b, "www.example.org.", "192.0.2.4:53", "b"},
+	} {
+		if backends, ok := tt.r.Match(tt.name, dns.TypeA); !ok || len(backends) != 1 || backends[0] != tt.want {
+			t.Errorf("router %v: Match(%v) = %v, %v; want %v", tt.which, tt.name, backends, ok, tt.want)
+		}
+	}
+}
+
+func TestRouterBackendsAndDefaults(t *testing.T) {
+	r := NewRouter(RouterConfig{
+		Default:       "192.0.2.1:53",
+		QtypeDefaults: map[uint16]string{dns.TypeMX: "192.0.2.2:53"},
+		Routes:        map[string][]string{".example.com.": {"192.0.2.3:53", "192.0.2.4:53"}},
+	})
+	if got := r.Backends(".example.com."); len(got) != 2 || got[0] != "192.0.2.3:53" || got[1] != "192.0.2.4:53" {
+		t.Errorf("Backends = %v, want those of the route in order", got)
+	}
+	if got := r.Backends(".example.org."); got != nil {
+		t.Errorf("Backends of no route = %v, want none", got)
+	}
+	got := r.defaults()
+	if len(got) != 2 || got[0] != "192.0.2.1:53" || got[1] != "192.0.2.2:53" {
+		t.Errorf("defaults = %v, want the default then that of MX", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var appendDomain = flag.String("append-domain", "",
+	"Domain appended to single-label names answered NXDOMAIN, to query them again (e.g. example.com.)")
+
+// validateAppendDomain normalizes -append-domain, with or without leading or
+// trailing dot.
+func validateAppendDomain() error {
+	if *appendDomain == "" {
+		return nil
+	}
+	domain := strings.TrimPrefix(normalizeDomain(*appendDomain), ".")
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "." {
+		return fmt.Errorf("invalid -append-domain %q", *appendDomain)
+	}
+	*appendDomain = domain
+	return nil
+}
+
+// searchDomain returns the response to req, answered resp: if it is an
+// NXDOMAIN to a single-label name, the query is routed again with
+// -append-domain appended and its answer is returned behind a CNAME from the
+// single-label name, unless it fails or is NXDOMAIN too. The longer name has
+// several labels so it is never retried in turn.
+func (s *settings) searchDomain(ctx context.Context, w *queryWriter, req, resp *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if *appendDomain == "" || resp.Rcode != dns.RcodeNameError || dns.CountLabel(q.Name) != 1 ||
+		q.Qclass != dns.ClassINET || isTransfer(req) {
+		return resp
+	}
+	name := q.Name + *appendDomain
+	sreq := req.Copy()
+	sreq.Question[0].Name = name
+	var sresp *dns.Msg
+	var err error
+	if route, ok := s.router.Route(strings.ToLower(name), remoteIP(w)); ok {
+		addrs := health.filter(s.router.Backends(route))
+		if len(addrs) == 0 {
+			return resp
+		}
+		opts := s.options(ctx, route)
+		if opts.dnssec {
+			sreq = dnssecRequest(sreq)
+		}
+		sresp, err = s.forward(route, addrs, opts, w, sreq)
+	} else {
+		server, _ := s.router.Default(q.Qtype)
+		if server == "" || !health.healthy(server) {
+			return resp
+		}
+		opts := s.options(ctx, "")
+		if opts.dnssec {
+			sreq = dnssecRequest(sreq)
+		}
+		w.upstreams = append(w.upstreams, server)
+		sresp, err = proxy(server, opts, w, sreq)
+	}
+	if err != nil || sresp.Rcode == dns.RcodeNameError {
+		return resp
+	}
+	appendDomainAnswers.inc()
+	ttl, _ := minTTL(sresp)
+	sresp.Id = req.Id
+	sresp.Question = req.Question
+	sresp.Answer = append([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: name,
+	}}, sresp.Answer...)
+	// The CNAME is ours, not signed by the zone.
+	sresp.AuthenticatedData = false
+	return sresp
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// searchBackend answers A records for the names of its zone but missing, and
+// NXDOMAIN to others, recording the names queried.
+type searchBackend struct {
+	zone string
+
+	mu    sync.Mutex
+	names []string
+}
+
+func (b *searchBackend) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	name := r.Question[0].Name
+	b.mu.Lock()
+	b.names = append(b.names, name)
+	b.mu.Unlock()
+	if !dns.IsSubDomain(b.zone, name) || strings.HasPrefix(name, "missing.") {
+		answerRcode(dns.RcodeNameError)(w, r)
+		return
+	}
+	answerA("192.0.2.1")(w, r)
+}
+
+func (b *searchBackend) queried() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := fmt.Sprint(b.names)
+	b.names = nil
+	return names
+}
+
+func TestAppendDomain(t *testing.T) {
+	b := &searchBackend{zone: "example.com."}
+	useConfig(t, fmt.Sprintf("default: %v\n", startServer(t, b)))
+	setFlag(t, "append-domain", "Example.com")
+	if err := validateAppendDomain(); err != nil {
+		t.Fatal(err)
+	}
+	addr := startProxy(t)
+
+	r := query(t, "udp", addr, "host.", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("single-label name: got %v %v, want a CNAME and the answer", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+	if c, ok := r.Answer[0].(*dns.CNAME); !ok || c.Hdr.Name != "host." || c.Target != "host.example.com." {
+		t.Errorf("single-label name: first record %v, want a CNAME to host.example.com.", r.Answer[0])
+	}
+	if got := b.queried(); got != "[host. host.example.com.]" {
+		t.Errorf("backend queried for %v, want the name then with -append-domain", got)
+	}
+
+	// NXDOMAIN again, the name is not retried further.
+	if r := query(t, "udp", addr, "missing.", dns.TypeA); r.Rcode != dns.RcodeNameError || len(r.Answer) != 0 {
+		t.Errorf("single-label name missing with -append-domain: got %v %v, want NXDOMAIN", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+	if got := b.queried(); got != "[missing. missing.example.com.]" {
+		t.Errorf("backend queried for %v, want the name then once with -append-domain", got)
+	}
+
+	for _, name := range []string{"host.example.org.", "host.sub."} {
+		if r := query(t, "udp", addr, name, dns.TypeA); r.Rcode != dns.RcodeNameError {
+			t.Errorf("%v: got %v, want the NXDOMAIN of the backend", name, dns.RcodeToString[r.Rcode])
+		}
+		if got := b.queried(); got != "["+name+"]" {
+			t.Errorf("backend queried for %v, want %v only as it has several labels", got, name)
+		}
+	}
+}
+
+func TestValidateAppendDomain(t *testing.T) {
+	for value, want := range map[string]string{
+		"":              "",
+		"example.com":   "example.com.",
+		".Example.COM.": "example.com.",
+	} {
+		setFlag(t, "append-domain", value)
+		if err := validateAppendDomain(); err != nil || *appendDomain != want {
+			t.Errorf("-append-domain %q: %q, %v; want %q", value, *appendDomain, err, want)
+		}
+	}
+	for _, value := range []string{".", "a..b"} {
+		setFlag(t, "append-domain", value)
+		if err := validateAppendDomain(); err == nil {
+			t.Errorf("-append-domain %q accepted", value)
+		}
+	}
+}
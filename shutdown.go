@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second,
+	"Time to wait on SIGINT or SIGTERM for in-flight queries to complete before closing the servers")
+
+// inFlight tracks the queries being handled, to drain them on shutdown.
+var inFlight struct {
+	wg sync.WaitGroup
+	n  int64
+}
+
+func startQuery() {
+	inFlight.wg.Add(1)
+	atomic.AddInt64(&inFlight.n, 1)
+}
+
+func endQuery() {
+	atomic.AddInt64(&inFlight.n, -1)
+	inFlight.wg.Done()
+}
+
+// shutdown stops the servers from accepting new queries, waits up to timeout
+// for in-flight queries to complete, then closes the servers.
+func shutdown(timeout time.Duration, dnsServers []*dns.Server, httpServers []*http.Server) {
+	atomic.StoreInt32(&serving.stopping, 1)
+	pending := atomic.LoadInt64(&inFlight.n)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range dnsServers {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			srv.ShutdownContext(ctx)
+		}(srv)
+	}
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		inFlight.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+	cut := atomic.LoadInt64(&inFlight.n)
+	log.Printf("shutdown: %d queries drained, %d cut", pending-cut, cut)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Exit codes of the startup failures, for scripts running the proxy. Invalid
+// flags exit with 2 like those the flag package fails to parse.
+const (
+	exitFailure    = 1 // any other failure
+	exitValidation = 2 // invalid flag value
+	exitConfig     = 3 // config file, routes or files they refer to
+	exitBind       = 4 // address which could not be listened on
+)
+
+// startupError is an error preventing the proxy from starting, with the exit
+// code of its kind.
+type startupError struct {
+	code int
+	err  error
+}
+
+func (e *startupError) Error() string { return e.err.Error() }
+func (e *startupError) Unwrap() error { return e.err }
+
+func validationError(err error) error { return &startupError{code: exitValidation, err: err} }
+func configError(err error) error     { return &startupError{code: exitConfig, err: err} }
+func bindError(err error) error       { return &startupError{code: exitBind, err: err} }
+
+// exitCode returns the exit code of the error returned by run.
+func exitCode(err error) int {
+	var e *startupError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
+
+// listenDNS binds the address of srv, so that a failure to do so is returned
+// before serving with ActivateAndServe.
+func listenDNS(srv *dns.Server) error {
+	if strings.HasPrefix(srv.Net, "udp") {
+		pc, err := net.ListenPacket(srv.Net, srv.Addr)
+		if err != nil {
+			return bindError(err)
+		}
+		srv.PacketConn = pc
+		return nil
+	}
+	l, err := net.Listen(srv.Net, srv.Addr)
+	if err != nil {
+		return bindError(err)
+	}
+	srv.Listener = l
+	return nil
+}
+
+// listenHTTP binds the address of srv, so that a failure to do so is returned
+// before serving.
+func listenHTTP(srv *http.Server) (net.Listener, error) {
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, bindError(err)
+	}
+	return l, nil
+}
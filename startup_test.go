@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExitCode(t *testing.T) {
+	cause := errors.New("cause")
+	for _, tt := range []struct {
+		err  error
+		code int
+	}{
+		{validationError(cause), exitValidation},
+		{configError(cause), exitConfig},
+		{bindError(cause), exitBind},
+		{cause, exitFailure},
+	} {
+		if got := exitCode(tt.err); got != tt.code {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.code)
+		}
+		if !errors.Is(tt.err, cause) || tt.err.Error() != "cause" {
+			t.Errorf("%v does not wrap its cause", tt.err)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, tt := range []struct {
+		flag, value string
+		code        int
+		msg         string
+	}{
+		{"timeout", "0", exitValidation, "invalid -timeout"},
+		{"strategy", "random", exitValidation, "invalid -strategy"},
+		{"no-route-rcode", "noerror", exitValidation, "invalid -no-route-rcode"},
+		{"udp-max-response-size", "100", exitValidation, "invalid -udp-max-response-size"},
+		{"tcp-idle-timeout", "0", exitValidation, "invalid -tcp-idle-timeout"},
+		{"config", "/nonexistent/config.yaml", exitConfig, "/nonexistent/config.yaml"},
+	} {
+		t.Run(tt.flag, func(t *testing.T) {
+			setFlag(t, tt.flag, tt.value)
+			err := run()
+			if err == nil || exitCode(err) != tt.code || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("run with -%v %v: %v (exit code %d), want %q with exit code %d",
+					tt.flag, tt.value, err, exitCode(err), tt.msg, tt.code)
+			}
+		})
+	}
+	t.Run("route", func(t *testing.T) {
+		setList(t, &routeLists, ".example.com.=")
+		if err := run(); exitCode(err) != exitConfig {
+			t.Errorf("run with an invalid -route: %v (exit code %d), want exit code %d", err, exitCode(err), exitConfig)
+		}
+	})
+}
+
+func TestListenErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := listenDNS(&dns.Server{Net: "tcp", Addr: l.Addr().String()}); exitCode(err) != exitBind {
+		t.Errorf("listenDNS on an address in use: %v, want exit code %d", err, exitBind)
+	}
+	if _, err := listenHTTP(&http.Server{Addr: l.Addr().String()}); exitCode(err) != exitBind {
+		t.Errorf("listenHTTP on an address in use: %v, want exit code %d", err, exitBind)
+	}
+	srv := &dns.Server{Net: "udp", Addr: "127.0.0.1:0"}
+	if err := listenDNS(srv); err != nil || srv.PacketConn == nil {
+		t.Fatalf("listenDNS over UDP: %v", err)
+	}
+	srv.PacketConn.Close()
+}
+
+func TestParseFlagErrors(t *testing.T) {
+	for what, parse := range map[string]func() error{
+		"-route without backends": func() error { _, _, err := parseRouteFlag(".example.com."); return err },
+		"-route without domain":   func() error { _, _, err := parseRouteFlag("=192.0.2.1:53"); return err },
+		"-route-regex with an invalid pattern": func() error {
+			_, _, err := parseRouteRegexFlag("db[=192.0.2.1:53")
+			return err
+		},
+		"-client-group without networks": func() error { _, _, err := parseClientGroupFlag("lan"); return err },
+		"-client-route without group": func() error {
+			_, _, _, err := parseClientRouteFlag(".example.com.=192.0.2.1:53")
+			return err
+		},
+		"-static without address":  func() error { _, _, err := parseStaticFlag("host.example."); return err },
+		"-local-zone without file": func() error { _, _, err := parseLocalZoneFlag("example.com."); return err },
+	} {
+		err := parse()
+		if err == nil {
+			t.Errorf("%v accepted", what)
+		} else if !strings.HasPrefix(err.Error(), "invalid -") {
+			t.Errorf("%v: %q, want it to name the invalid flag", what, err)
+		}
+	}
+}
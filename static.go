@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	staticLists flagStringList
+	staticFile  = flag.String("static-file", "",
+		"Hosts file of static answers, one IP followed by its names per line")
+	staticTTL = flag.Uint("static-ttl", 300, "TTL of static answers")
+)
+
+// maxCNAMEChain bounds the static CNAME records followed in an answer.
+const maxCNAMEChain = 8
+
+// staticTable holds records answered without consulting any upstream.
+type staticTable struct {
+	ttl     uint32
+	records map[string][]dns.RR // per lowercase name
+}
+
+func newStaticTable(ttl uint32) *staticTable {
+	return &staticTable{ttl: ttl, records: make(map[string][]dns.RR)}
+}
+
+// parseStaticFlag parses a -static flag: name=type:value.
+func parseStaticFlag(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return "", "", fmt.Errorf("invalid -static, must be name=type:value")
+	}
+	return kv[0], kv[1], nil
+}
+
+// add adds a record for name given as type:value, the type being A, AAAA or
+// CNAME.
+func (t *staticTable) add(name, record string) error {
+	kv := strings.SplitN(record, ":", 2)
+	if len(kv) != 2 || len(kv[1]) == 0 {
+		return fmt.Errorf("invalid static record %q for %v, must be type:value", record, name)
+	}
+	name = normalizeDomain(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid static name %q", name)
+	}
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: t.ttl}
+	var rr dns.RR
+	switch strings.ToUpper(kv[0]) {
+	case "A":
+		ip := net.ParseIP(kv[1]).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid static A record %q for %v", kv[1], name)
+		}
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: ip}
+	case "AAAA":
+		ip := net.ParseIP(kv[1])
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid static AAAA record %q for %v", kv[1], name)
+		}
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	case "CNAME":
+		target := normalizeDomain(kv[1])
+		if _, ok := dns.IsDomainName(target); !ok {
+			return fmt.Errorf("invalid static CNAME record %q for %v", kv[1], name)
+		}
+		hdr.Rrtype = dns.TypeCNAME
+		rr = &dns.CNAME{Hdr: hdr, Target: target}
+	default:
+		return fmt.Errorf("invalid static record type %q for %v, must be A, AAAA or CNAME", kv[0], name)
+	}
+	return t.insert("static", rr)
+}
+
+// insert adds rr to the records of its lowercase name, which may have a
+// single CNAME and no other records. kind names the records in errors.
+func (t *staticTable) insert(kind string, rr dns.RR) error {
+	name := strings.ToLower(rr.Header().Name)
+	for _, other := range t.records[name] {
+		cname := other.Header().Rrtype == dns.TypeCNAME
+		if cname != (rr.Header().Rrtype == dns.TypeCNAME) {
+			return fmt.Errorf("invalid %v records for %v, a CNAME cannot have other records", kind, name)
+		}
+		if cname {
+			return fmt.Errorf("invalid %v records for %v, only one CNAME is allowed", kind, name)
+		}
+	}
+	t.records[name] = append(t.records[name], rr)
+	return nil
+}
+
+// loadHosts adds the records of a hosts file: an IP followed by its names on
+// each line. Comments starting with # are ignored.
+func (t *staticTable) loadHosts(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("%v:%d: invalid line, must be an IP followed by names", path, n)
+		}
+		qtype := "AAAA"
+		if ip.To4() != nil {
+			qtype = "A"
+		}
+		for _, name := range fields[1:] {
+			if err := t.add(name, qtype+":"+fields[0]); err != nil {
+				return fmt.Errorf("%v:%d: %v", path, n, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// buildStatic returns the table of the static answers of the config file,
+// the hosts file and the flags, or nil if there are none.
+func buildStatic(cfg *config) (*staticTable, error) {
+	t := newStaticTable(uint32(*staticTTL))
+	for name, records := range cfg.Static {
+		for _, record := range records {
+			if err := t.add(name, record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *staticFile != "" {
+		if err := t.loadHosts(*staticFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, static := range staticLists {
+		name, record, err := parseStaticFlag(static)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.add(name, record); err != nil {
+			return nil, err
+		}
+	}
+	if t.len() == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// len returns the number of names of the table.
+func (t *staticTable) len() int {
+	return len(t.records)
+}
+
+// answer returns the static answer to req, or nil if its name has no static
+// records. A name with records of other types only is answered with no
+// records. Static CNAME records are followed.
+func (t *staticTable) answer(req *dns.Msg) *dns.Msg {
+	if t == nil {
+		return nil
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if _, ok := t.records[name]; !ok || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	for i := 0; i < maxCNAMEChain; i++ {
+		rrs := t.records[name]
+		if len(rrs) == 1 && rrs[0].Header().Rrtype == dns.TypeCNAME && q.Qtype != dns.TypeCNAME {
+			rr := dns.Copy(rrs[0])
+			m.Answer = append(m.Answer, rr)
+			name = rr.(*dns.CNAME).Target
+			continue
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, dns.Copy(rr))
+			}
+		}
+		break
+	}
+	if len(m.Answer) > 0 {
+		m.Answer[0].Header().Name = q.Name
+	}
+	return m
+}
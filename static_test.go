@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticPrecedence(t *testing.T) {
+	h, n := counting(answerA("192.0.2.1"))
+	up := startUpstream(t, h)
+	setList(t, &staticLists, "www.example.com.=A:192.0.2.10", "alias.example.com=CNAME:www.example.com.",
+		"v6.example.com.=AAAA:2001:db8::10")
+	setFlag(t, "static-ttl", "120")
+	setFlag(t, "static-file", writeFile(t, "hosts", "# hosts\n192.0.2.20 host.example.com other.example.com\n"))
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .example.com.: [%v]\n", up, up))
+	addr := startProxy(t)
+
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"www.example.com.", dns.TypeA, []string{"192.0.2.10"}},
+		{"WWW.Example.COM.", dns.TypeA, []string{"192.0.2.10"}},
+		{"alias.example.com.", dns.TypeA, []string{"192.0.2.10"}},
+		{"v6.example.com.", dns.TypeAAAA, []string{"2001:db8::10"}},
+		{"v6.example.com.", dns.TypeA, nil},
+		{"host.example.com.", dns.TypeA, []string{"192.0.2.20"}},
+		{"other.example.com.", dns.TypeA, []string{"192.0.2.20"}},
+	} {
+		r := query(t, "udp", addr, tt.name, tt.qtype)
+		ips := answerIPs(r)
+		if r.Rcode != dns.RcodeSuccess || !r.Authoritative || fmt.Sprint(ips) != fmt.Sprint(tt.want) {
+			t.Errorf("%v %v: got %v %v, want the static answer %v", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[r.Rcode], ips, tt.want)
+		}
+		for _, rr := range r.Answer {
+			if rr.Header().Ttl != 120 {
+				t.Errorf("%v: TTL %d, want -static-ttl 120", rr.Header().Name, rr.Header().Ttl)
+			}
+		}
+	}
+	if got := atomic.LoadInt64(n); got != 0 {
+		t.Errorf("%d static queries forwarded", got)
+	}
+	if ips := answerIPs(query(t, "udp", addr, "db.example.com.", dns.TypeA)); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("name without static records answered %v, want the answer of the route", ips)
+	}
+}
+
+func TestStaticInvalid(t *testing.T) {
+	for _, static := range []string{"www.example.com.=A:2001:db8::1", "www.example.com.=AAAA:192.0.2.1",
+		"www.example.com.=MX:mail.example.com.", "www.example.com.", "www.example.com.=A"} {
+		setList(t, &staticLists, static)
+		setFlag(t, "config", writeFile(t, "config.yaml", ""))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("-static %v accepted", static)
+		}
+	}
+	setList(t, &staticLists, "www.example.com.=CNAME:a.example.", "www.example.com.=A:192.0.2.1")
+	if _, err := buildSettings(); err == nil {
+		t.Error("CNAME with other records accepted")
+	}
+}
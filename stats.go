@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var statsAddress = flag.String("stats-address", "",
+	"Address to serve statistics on at /stats as JSON (HTTP, disabled if empty)")
+
+// startTime is when the proxy started, for its uptime.
+var startTime = time.Now()
+
+// count is the value of a counter, in total and since the previous request
+// of the statistics.
+type count struct {
+	Total uint64 `json:"total"`
+	Delta uint64 `json:"delta"`
+}
+
+type stats struct {
+	UptimeSeconds float64                   `json:"uptime_seconds"`
+	DeltaSeconds  float64                   `json:"delta_seconds"`
+	Queries       count                     `json:"queries"`
+	Blocked       count                     `json:"blocked"`
+	Routes        map[string]count          `json:"routes"`
+	Responses     map[string]count          `json:"responses"`
+	Upstreams     map[string]*upstreamStats `json:"upstreams"`
+	Cache         *cacheStats               `json:"cache,omitempty"`
+}
+
+type upstreamStats struct {
+	Up            *bool            `json:"up,omitempty"` // unknown without health checks
+	Responses     map[string]count `json:"responses"`
+	Retries       count            `json:"retries"`
+	MeanLatencyMs float64          `json:"mean_latency_ms"`
+}
+
+type cacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int   `json:"size"`
+	Hits    count `json:"hits"`
+	Misses  count `json:"misses"`
+}
+
+// statsHandler serves the statistics as JSON. Deltas are computed against
+// the values of the previous request, whoever made it.
+type statsHandler struct {
+	mu   sync.Mutex
+	last map[*counterVec]map[string]uint64
+	at   time.Time
+}
+
+func newStatsHandler() *statsHandler {
+	return &statsHandler{last: make(map[*counterVec]map[string]uint64), at: startTime}
+}
+
+// counts returns the totals and deltas of c keyed by joined label values,
+// h.mu must be held.
+func (h *statsHandler) counts(c *counterVec) map[string]count {
+	values := c.snapshot()
+	last := h.last[c]
+	counts := make(map[string]count, len(values))
+	for key, v := range values {
+		counts[key] = count{Total: v, Delta: v - last[key]}
+	}
+	h.last[c] = values
+	return counts
+}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := h.collect()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
+
+// dump logs the statistics as a line of JSON, then the current settings
+// with the route table, on SIGUSR1.
+func (h *statsHandler) dump() {
+	b, err := json.Marshal(h.collect())
+	if err != nil {
+		log.Printf("stats: %v", err)
+		return
+	}
+	log.Printf("stats: %s", b)
+	var buf bytes.Buffer
+	loadSettings().summary(&buf)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		log.Printf("settings: %v", line)
+	}
+}
+
+// collect returns the statistics, with deltas since the previous call.
+func (h *statsHandler) collect() *stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	st := &stats{
+		UptimeSeconds: now.Sub(startTime).Seconds(),
+		DeltaSeconds:  now.Sub(h.at).Seconds(),
+		Queries:       h.counts(queriesTotal)[""],
+		Blocked:       h.counts(blockedQueries)[""],
+		Routes:        h.counts(routeQueries),
+		Responses:     h.counts(responsesTotal),
+		Upstreams:     make(map[string]*upstreamStats),
+	}
+	upstream := func(addr string) *upstreamStats {
+		u, ok := st.Upstreams[addr]
+		if !ok {
+			u = &upstreamStats{Responses: make(map[string]count)}
+			st.Upstreams[addr] = u
+		}
+		return u
+	}
+	for addr := range loadSettings().backends() {
+		upstream(addr)
+	}
+	for key, c := range h.counts(upstreamResponses) {
+		labels := strings.SplitN(key, labelSep, 2)
+		upstream(labels[0]).Responses[labels[1]] = c
+	}
+	for addr, c := range h.counts(upstreamRetries) {
+		upstream(addr).Retries = c
+	}
+	for addr, hist := range upstreamDuration.snapshot() {
+		if hist.count > 0 {
+			upstream(addr).MeanLatencyMs = hist.sum / float64(hist.count) * 1000
+		}
+	}
+	if health != nil {
+		for addr, b := range health.status() {
+			up := b.up
+			upstream(addr).Up = &up
+		}
+	}
+	if responseCache != nil {
+		lookups := h.counts(cacheLookups)
+		st.Cache = &cacheStats{
+			Entries: responseCache.len(),
+			Size:    responseCache.size,
+			Hits:    lookups["hit"],
+			Misses:  lookups["miss"],
+		}
+	}
+	h.at = now
+	return st
+}
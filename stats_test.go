@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dumped returns the statistics and the settings lines logged by a dump of
+// h.
+func dumped(t *testing.T, h *statsHandler) (*stats, []string) {
+	t.Helper()
+	buf := captureLog(t)
+	h.dump()
+	var st *stats
+	var settings []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		switch {
+		case strings.Contains(line, "stats: "):
+			if st != nil {
+				t.Fatalf("statistics logged twice: %q", buf.String())
+			}
+			st = new(stats)
+			if err := json.Unmarshal([]byte(line[strings.Index(line, "stats: ")+len("stats: "):]), st); err != nil {
+				t.Fatalf("statistics %q: %v", line, err)
+			}
+		case strings.Contains(line, "settings: "):
+			settings = append(settings, line[strings.Index(line, "settings: ")+len("settings: "):])
+		default:
+			t.Errorf("unexpected log line %q", line)
+		}
+	}
+	if st == nil {
+		t.Fatalf("no statistics logged: %q", buf.String())
+	}
+	return st, settings
+}
+
+func TestStatsDump(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .dump.example.: [%v]\n", up, up))
+	h := newStatsHandler()
+	h.collect() // the counters of the other tests
+
+	for i := 0; i < 3; i++ {
+		w := newStubWriter("udp", "127.0.0.1:5353")
+		route(w, newQ("www.dump.example.", dns.TypeA))
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeSuccess {
+			t.Fatalf("query %d failed: %v", i, w.msgs)
+		}
+	}
+
+	st, settings := dumped(t, h)
+	if st.Queries.Delta != 3 || st.Queries.Total < 3 {
+		t.Errorf("queries %+v, want a delta of 3", st.Queries)
+	}
+	if c := st.Routes[".dump.example."]; c.Delta != 3 {
+		t.Errorf("queries of the route %+v, want a delta of 3", c)
+	}
+	u, ok := st.Upstreams[up]
+	if !ok {
+		t.Fatalf("upstreams %v, want %v", st.Upstreams, up)
+	}
+	if c := u.Responses["success"]; c.Delta != 3 {
+		t.Errorf("successful responses of the backend %+v, want a delta of 3", c)
+	}
+	want := []string{"default: " + up, "route .dump.example.: " + up}
+	for _, line := range want {
+		found := false
+		for _, s := range settings {
+			found = found || s == line
+		}
+		if !found {
+			t.Errorf("settings %q, want the line %q", settings, line)
+		}
+	}
+
+	// Deltas are since the previous dump.
+	if st, _ := dumped(t, h); st.Queries.Delta != 0 || st.Routes[".dump.example."].Total != 3 {
+		t.Errorf("second dump: queries %+v, route %+v; want no delta", st.Queries, st.Routes[".dump.example."])
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation, after stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// activationSockets returns the UDP and TCP sockets passed by systemd socket
+// activation, as told by LISTEN_PID and LISTEN_FDS, or none if the proxy was
+// not socket activated. The variables are unset so that they are not
+// inherited.
+func activationSockets() ([]net.PacketConn, []net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var pcs []net.PacketConn
+	var ls []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// The socket is duplicated by the net package, f can be closed.
+		pc, err := net.FilePacketConn(f)
+		if err == nil {
+			pcs = append(pcs, pc)
+			f.Close()
+			continue
+		}
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket %d passed by systemd is neither UDP nor TCP: %v", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return pcs, ls, nil
+}
+
+// activatedServers returns the DNS servers of the sockets pcs and ls, bound
+// already, to be served with ActivateAndServe.
+func activatedServers(pcs []net.PacketConn, ls []net.Listener) []*dns.Server {
+	var servers []*dns.Server
+	for _, pc := range pcs {
+		servers = append(servers, &dns.Server{
+			Addr:              pc.LocalAddr().String(),
+			Net:               "udp",
+			PacketConn:        pc,
+			MsgAcceptFunc:     acceptMsg,
+			NotifyStartedFunc: serverStarted,
+		})
+	}
+	for _, l := range ls {
+		servers = append(servers, &dns.Server{
+			Addr:              l.Addr().String(),
+			Net:               "tcp",
+			Listener:          l,
+			MsgAcceptFunc:     acceptMsg,
+			IdleTimeout:       idleTimeout,
+			NotifyStartedFunc: serverStarted,
+		})
+	}
+	return servers
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// setEnv sets the environment variable key to value for the duration of the
+// test.
+func setEnv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestActivationSockets(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	setEnv(t, "LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	setEnv(t, "LISTEN_FDS", "2")
+	if pcs, ls, err := activationSockets(); err != nil || pcs != nil || ls != nil {
+		t.Errorf("sockets of another process = %v, %v, %v; want none", pcs, ls, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "2" {
+		t.Error("LISTEN_FDS of another process unset")
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	if pcs, ls, err := activationSockets(); err != nil || pcs != nil || ls != nil {
+		t.Errorf("sockets without LISTEN_PID = %v, %v, %v; want none", pcs, ls, err)
+	}
+
+	setEnv(t, "LISTEN_PID", pid)
+	setEnv(t, "LISTEN_FDS", "0")
+	setEnv(t, "LISTEN_FDNAMES", "")
+	if pcs, ls, err := activationSockets(); err != nil || len(pcs)+len(ls) != 0 {
+		t.Errorf("no socket passed = %v, %v, %v; want none", pcs, ls, err)
+	}
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Errorf("%v still set, inherited", key)
+		}
+	}
+
+	for _, fds := range []string{"x", "-1"} {
+		setEnv(t, "LISTEN_PID", pid)
+		setEnv(t, "LISTEN_FDS", fds)
+		if _, _, err := activationSockets(); err == nil {
+			t.Errorf("LISTEN_FDS %q accepted", fds)
+		}
+	}
+}
+
+func TestActivatedServers(t *testing.T) {
+	backend := startUpstream(t, answerA("192.0.2.1"))
+	useConfig(t, "default: "+backend+"\n")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := activatedServers([]net.PacketConn{pc}, []net.Listener{l})
+	if len(servers) != 2 {
+		t.Fatalf("%d servers, want 2", len(servers))
+	}
+	if servers[0].Net != "udp" || servers[0].PacketConn != pc || servers[0].Addr != pc.LocalAddr().String() {
+		t.Errorf("UDP server = %v on %v, want on the socket passed", servers[0].Net, servers[0].Addr)
+	}
+	if servers[1].Net != "tcp" || servers[1].Listener != l || servers[1].Addr != l.Addr().String() {
+		t.Errorf("TCP server = %v on %v, want on the socket passed", servers[1].Net, servers[1].Addr)
+	}
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		srv := srv
+		srv.Handler = dns.HandlerFunc(route)
+		started := srv.NotifyStartedFunc
+		wg.Add(1)
+		srv.NotifyStartedFunc = func() {
+			started()
+			wg.Done()
+		}
+		go srv.ActivateAndServe()
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	wg.Wait()
+
+	for _, tt := range []struct{ netw, addr string }{
+		{"udp", pc.LocalAddr().String()},
+		{"tcp", l.Addr().String()},
+	} {
+		r := query(t, tt.netw, tt.addr, "www.example.com.", dns.TypeA)
+		if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Errorf("%v: answer %v, want that of the backend", tt.netw, ips)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+)
+
+var logTrace = flag.Bool("log-trace", false,
+	"Log the steps of every query: route, upstream exchanges, retries and rcode, "+
+		"tagged with the ID of the query also in the query log")
+
+// trace identifies a query in the logs.
+type trace struct {
+	id      string // short and random
+	verbose bool   // its steps are logged, with -log-trace or route-log
+}
+
+func newTrace() *trace {
+	return &trace{id: fmt.Sprintf("%08x", random.Uint32()), verbose: *logTrace}
+}
+
+// traceKey is the context key of the trace of a query.
+type traceKey struct{}
+
+// withTrace returns a copy of ctx carrying the trace of its query.
+func withTrace(ctx context.Context, t *trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceOf returns the trace of the query of ctx, nil if it is not one, such
+// as a health check.
+func traceOf(ctx context.Context) *trace {
+	t, _ := ctx.Value(traceKey{}).(*trace)
+	return t
+}
+
+// logf logs a message about the query, tagged with its ID.
+func (t *trace) logf(format string, v ...interface{}) {
+	if t == nil {
+		log.Printf(format, v...)
+		return
+	}
+	log.Printf("id=%s "+format, append([]interface{}{t.id}, v...)...)
+}
+
+// tracef logs a step of the query if it is verbose.
+func (t *trace) tracef(format string, v ...interface{}) {
+	if t == nil || !t.verbose {
+		return
+	}
+	log.Printf("trace id=%s "+format, append([]interface{}{t.id}, v...)...)
+}
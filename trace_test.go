@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var traceID = regexp.MustCompile(`trace id=([0-9a-f]{8}) `)
+
+// traceIDs returns the IDs of the trace lines of log, in order, and the lines.
+func traceIDs(log string) ([]string, []string) {
+	var ids, lines []string
+	for _, line := range strings.Split(log, "\n") {
+		if m := traceID.FindStringSubmatch(line); m != nil {
+			ids = append(ids, m[1])
+			lines = append(lines, line)
+		}
+	}
+	return ids, lines
+}
+
+func TestLogTrace(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.1"))
+	down := closedAddr(t)
+	setFlag(t, "strategy", strategyRoundRobin)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v, %v]\n", down, up))
+	buf := captureLog(t)
+
+	t.Run("on", func(t *testing.T) {
+		setFlag(t, "log-trace", "true")
+		addr := startProxy(t)
+
+		query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		ids, lines := traceIDs(buf.String())
+		for _, want := range []string{"route .example.com.", down, up, "answered NOERROR"} {
+			found := false
+			for _, line := range lines {
+				if strings.Contains(line, want) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("no trace line with %q in:\n%v", want, strings.Join(lines, "\n"))
+			}
+		}
+		for _, id := range ids {
+			if id != ids[0] {
+				t.Errorf("trace lines of a single query with IDs %v, want the same", ids)
+				break
+			}
+		}
+
+		buf.Reset()
+		query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if next, _ := traceIDs(buf.String()); len(next) == 0 || next[0] == ids[0] {
+			t.Errorf("another query traced with IDs %v, want another than %v", next, ids[0])
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		buf.Reset()
+		addr := startProxy(t)
+		query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if ids, _ := traceIDs(buf.String()); len(ids) != 0 {
+			t.Errorf("query traced without -log-trace:\n%v", buf)
+		}
+	})
+}
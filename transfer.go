@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errNoIXFR is the error of a backend answering an IXFR with NOTIMP or
+// FORMERR, which does not implement it.
+var errNoIXFR = errors.New("IXFR not implemented")
+
+// relayTransfer sends the transfer query req to the backend addr and relays
+// the messages of the response to w as they come, until the end of the zone.
+// Unlike dns.Transfer, which only keeps their records, the messages are
+// relayed whole so that their EDNS options, such as the EXPIRE timer of the
+// primary (RFC 7314), reach the secondary. It returns whether a message was
+// written, after which the client cannot get another response.
+//
+// An IXFR the backend does not implement is sent again as an AXFR, whose full
+// zone is relayed as the response to the IXFR as RFC 1995 allows. A backend
+// answering the IXFR with the full zone itself needs no such fallback.
+func relayTransfer(addr string, opts routeOptions, w dns.ResponseWriter, req *dns.Msg) (bool, error) {
+	written, err := relayResponse(addr, opts, w, req, req)
+	if err == errNoIXFR {
+		traceOf(opts.ctx).logf("%v does not implement IXFR of %v, falling back to AXFR", addr, req.Question[0].Name)
+		axfr := req.Copy()
+		axfr.Question[0].Qtype = dns.TypeAXFR
+		// The SOA record of the secondary is for IXFR only.
+		axfr.Ns = nil
+		written, err = relayResponse(addr, opts, w, req, axfr)
+	}
+	return written, err
+}
+
+// relayResponse sends the transfer query sent to addr and relays the messages
+// of its response to w as the response to req, waiting up to the timeout of
+// opts for each.
+func relayResponse(addr string, opts routeOptions, w dns.ResponseWriter, req, sent *dns.Msg) (bool, error) {
+	conn, err := dialTransfer(addr, opts)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(opts.timeout))
+	if err := conn.WriteMsg(sent); err != nil {
+		return false, err
+	}
+	ixfr := sent.Question[0].Qtype == dns.TypeIXFR
+	end := newTransferEnd(sent)
+	for written := false; ; written = true {
+		conn.SetReadDeadline(time.Now().Add(opts.timeout))
+		m, err := conn.ReadMsg()
+		if err == nil && m.Id != sent.Id {
+			err = dns.ErrId
+		}
+		if err == nil && ixfr && !written && (m.Rcode == dns.RcodeNotImplemented || m.Rcode == dns.RcodeFormatError) {
+			return false, errNoIXFR
+		}
+		var done bool
+		if err == nil {
+			done, err = end.done(m)
+		}
+		if err != nil {
+			return written, err
+		}
+		m.Question = req.Question
+		if err := w.WriteMsg(m); err != nil {
+			return true, err
+		}
+		if done {
+			return true, nil
+		}
+	}
+}
+
+// transferEnd tells the last message of a zone transfer from its SOA records,
+// like dns.Transfer: an AXFR ends with the SOA record it starts with, an
+// incremental IXFR with the third occurrence of the new SOA record, and an
+// IXFR answered with a single SOA record or the serial of the secondary is
+// up to date. An error response ends it too.
+type transferEnd struct {
+	ixfr     bool
+	qserial  uint32 // of the secondary, for IXFR
+	serial   uint32 // of the primary, from the first record
+	messages int
+	soas     int  // SOA records with serial
+	axfr     bool // the IXFR is answered with the full zone
+}
+
+func newTransferEnd(req *dns.Msg) *transferEnd {
+	e := &transferEnd{ixfr: req.Question[0].Qtype == dns.TypeIXFR, axfr: true}
+	if len(req.Ns) > 0 {
+		if soa, ok := req.Ns[0].(*dns.SOA); ok {
+			e.qserial = soa.Serial
+		}
+	}
+	return e
+}
+
+// done returns whether m is the last message of the transfer.
+func (e *transferEnd) done(m *dns.Msg) (bool, error) {
+	if m.Rcode != dns.RcodeSuccess {
+		return true, nil
+	}
+	if e.messages++; e.messages == 1 {
+		if len(m.Answer) == 0 || m.Answer[0].Header().Rrtype != dns.TypeSOA {
+			return false, dns.ErrSoa
+		}
+		e.serial = m.Answer[0].(*dns.SOA).Serial
+		if e.ixfr && (len(m.Answer) == 1 || e.qserial >= e.serial) {
+			return true, nil
+		}
+	}
+	for _, rr := range m.Answer {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if soa.Serial != e.serial {
+			e.axfr = false
+			continue
+		}
+		if e.soas++; (e.axfr && e.soas == 2) || e.soas == 3 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// primary answers transfers of example.com. in two messages with the EXPIRE
+// option of RFC 7314, recording the queries received. IXFR is answered with
+// the changes from serial 1 to 2 if ixfr is set, the full zone if full is
+// set, and NOTIMP otherwise.
+type primary struct {
+	ixfr, full bool
+
+	mu      sync.Mutex
+	queries []*dns.Msg
+}
+
+func testSOA(serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: serial,
+		Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 300,
+	}
+}
+
+func (p *primary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	p.mu.Lock()
+	p.queries = append(p.queries, r)
+	p.mu.Unlock()
+	if r.Question[0].Qtype == dns.TypeIXFR && !p.ixfr && !p.full {
+		answerRcode(dns.RcodeNotImplemented)(w, r)
+		return
+	}
+	var incremental [][]dns.RR
+	if r.Question[0].Qtype == dns.TypeIXFR && p.ixfr {
+		// From serial 1 to 2: www removed then added with another address.
+		incremental = [][]dns.RR{
+			{testSOA(2), testSOA(1), rrWithTTL("www.example.com.", 300)},
+			{testSOA(2), answerRecord("www.example.com.", "192.0.2.2"), testSOA(2)},
+		}
+	} else {
+		incremental = [][]dns.RR{
+			{testSOA(2), rrWithTTL("www.example.com.", 300)},
+			{rrWithTTL("mail.example.com.", 300), testSOA(2)},
+		}
+	}
+	for _, rrs := range incremental {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = rrs
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 7200})
+		w.WriteMsg(m)
+	}
+}
+
+func answerRecord(name, ip string) dns.RR {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}
+}
+
+// transfer sends the transfer query req over TCP to addr and returns the
+// messages of its response.
+func transfer(t *testing.T, addr string, req *dns.Msg) []*dns.Msg {
+	t.Helper()
+	conn, err := dns.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMsg(req); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*dns.Msg
+	end := newTransferEnd(req)
+	for {
+		m, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatalf("message %d of the transfer: %v", len(msgs), err)
+		}
+		msgs = append(msgs, m)
+		if done, err := end.done(m); err != nil || done {
+			return msgs
+		}
+	}
+}
+
+// expireOf returns the EXPIRE option of m, or nil.
+func expireOf(m *dns.Msg) *dns.EDNS0_EXPIRE {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EXPIRE); ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// useTransfers routes example.com. to a primary p, allowing transfers from
+// the loopback, and returns the address of the proxy.
+func useTransfers(t *testing.T, p *primary) string {
+	t.Helper()
+	setFlag(t, "allow-transfer", "127.0.0.1")
+	useConfig(t, fmt.Sprintf("routes:\n  example.com.: [%v]\n", startServer(t, p)))
+	return startProxy(t)
+}
+
+func TestTransferExpire(t *testing.T) {
+	p := &primary{}
+	addr := useTransfers(t, p)
+
+	req := newQ("example.com.", dns.TypeAXFR)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true})
+	msgs := transfer(t, addr, req)
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages, want the 2 of the primary", len(msgs))
+	}
+	for i, m := range msgs {
+		if e := expireOf(m); e == nil || e.Expire != 7200 {
+			t.Errorf("message %d: EXPIRE %v, want that of the primary, 7200", i, e)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queries) != 1 || expireOf(p.queries[0]) == nil {
+		t.Errorf("primary queried %v, want a query with the EXPIRE option of the secondary", p.queries)
+	}
+}
+
+// ixfrQ returns an IXFR query for example.com. from serial.
+func ixfrQ(serial uint32) *dns.Msg {
+	m := newQ("example.com.", dns.TypeIXFR)
+	m.Ns = []dns.RR{testSOA(serial)}
+	return m
+}
+
+// records returns the records in the answers of msgs, in presentation format.
+func records(msgs []*dns.Msg) []string {
+	var rrs []string
+	for _, m := range msgs {
+		for _, rr := range m.Answer {
+			rrs = append(rrs, rr.String())
+		}
+	}
+	return rrs
+}
+
+func TestIXFRFallback(t *testing.T) {
+	full := transfer(t, startServer(t, &primary{}), newQ("example.com.", dns.TypeAXFR))
+	incremental := transfer(t, startServer(t, &primary{ixfr: true}), ixfrQ(1))
+	for _, tt := range []struct {
+		what    string
+		p       *primary
+		want    []*dns.Msg
+		queried []uint16
+	}{
+		{"IXFR not implemented", &primary{}, full, []uint16{dns.TypeIXFR, dns.TypeAXFR}},
+		{"IXFR answered with the full zone", &primary{full: true}, full, []uint16{dns.TypeIXFR}},
+		{"IXFR", &primary{ixfr: true}, incremental, []uint16{dns.TypeIXFR}},
+	} {
+		addr := useTransfers(t, tt.p)
+		msgs := transfer(t, addr, ixfrQ(1))
+		if got, want := records(msgs), records(tt.want); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: relayed %q, want %q", tt.what, got, want)
+		}
+		for i, m := range msgs {
+			if q := m.Question[0]; q.Name != "example.com." || q.Qtype != dns.TypeIXFR {
+				t.Errorf("%v: message %d for %v %v, want the IXFR of the secondary", tt.what, i, q.Name, dns.TypeToString[q.Qtype])
+			}
+		}
+		tt.p.mu.Lock()
+		var queried []uint16
+		for _, q := range tt.p.queries {
+			queried = append(queried, q.Question[0].Qtype)
+			if q.Question[0].Qtype == dns.TypeAXFR && len(q.Ns) != 0 {
+				t.Errorf("%v: AXFR sent with the SOA record of the secondary", tt.what)
+			}
+		}
+		tt.p.mu.Unlock()
+		if fmt.Sprint(queried) != fmt.Sprint(tt.queried) {
+			t.Errorf("%v: primary queried %v, want %v", tt.what, queried, tt.queried)
+		}
+	}
+}
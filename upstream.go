@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	netproxy "golang.org/x/net/proxy"
+)
+
+var (
+	upstreamTLSServerName = flag.String("upstream-tls-servername", "",
+		"Server name to verify the certificate of tls:// backends against (default their host)")
+	upstreamTLSInsecure = flag.Bool("upstream-tls-insecure", false,
+		"Do not verify the certificate of tls:// backends (for testing only)")
+	upstreamProxy = flag.String("upstream-proxy", "",
+		"SOCKS5 proxy to connect to backends through (socks5://[user:password@]host:port), "+
+			"plain DNS backends being then queried over TCP")
+	upstreamSourceIP = flag.String("upstream-source-ip", "",
+		"Local IP to send queries to backends from (default chosen by the system)")
+
+	upstreamDialer netproxy.ContextDialer // nil to connect to backends directly
+	upstreamSource net.IP                 // nil to let the system choose
+)
+
+// Prefixes of the backends queried over TCP only, DNS-over-TLS and
+// DNS-over-HTTPS.
+const (
+	tcpScheme   = "tcp://"
+	tlsScheme   = "tls://"
+	httpsScheme = "https://"
+)
+
+// dohMediaType is the content type of DNS-over-HTTPS messages.
+const dohMediaType = "application/dns-message"
+
+// dohClient is shared by all DNS-over-HTTPS exchanges to reuse connections.
+var dohClient = &http.Client{Transport: &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90 * time.Second,
+	ForceAttemptHTTP2:   true,
+}}
+
+// routeOptions are the settings of the exchanges with the backends of a route.
+type routeOptions struct {
+	timeout       time.Duration
+	tlsServerName string
+	dnssec        bool            // validate responses
+	stripAAAA     bool            // remove AAAA records from responses
+	clearRD       bool            // clear recursion desired in queries
+	padding       bool            // pad queries over encrypted transports and responses
+	maxSize       int             // of responses, 0 for no limit
+	ttl           uint32          // of all the records of responses, 0 to keep theirs
+	upstreamQPS   float64         // per backend, 0 for no limit
+	route         string          // name of the route, empty for the default
+	ctx           context.Context // cancelled when the answer is no longer needed
+}
+
+// validBackend returns whether s is a valid backend: host:port, optionally
+// prefixed by tcp:// to always use TCP or tls:// for DNS-over-TLS, or an
+// https:// URL for DNS-over-HTTPS.
+func validBackend(s string) bool {
+	if strings.HasPrefix(s, httpsScheme) {
+		u, err := url.Parse(s)
+		return err == nil && u.Host != ""
+	}
+	return validHostPort(strings.TrimPrefix(strings.TrimPrefix(s, tcpScheme), tlsScheme))
+}
+
+// exchangeRetry exchanges req with addr, retrying up to -retries times with
+// exponential backoff on transient errors. Responses, even SERVFAIL, are
+// never retried. Exchanges and retries stop when the context of opts is done.
+func exchangeRetry(addr, transport string, opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	backoff := *retryBackoff
+	t := traceOf(opts.ctx)
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := exchange(addr, transport, opts, req)
+		if err != nil {
+			t.tracef("%v over %v, attempt %d: %v", addr, transport, attempt+1, err)
+		} else {
+			t.tracef("%v over %v, attempt %d: %v in %v", addr, transport, attempt+1,
+				dns.RcodeToString[resp.Rcode], time.Since(start))
+		}
+		if err == nil || attempt >= *retries || !transient(err) || opts.ctx.Err() != nil {
+			return resp, err
+		}
+		if deadline, ok := opts.ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		upstreamRetries.inc(addr)
+		t.tracef("retrying %v in %v", addr, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-opts.ctx.Done():
+			return nil, opts.ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// transient returns whether err is worth retrying: a timeout or a refused or
+// reset connection.
+func transient(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// malformed returns whether err is that of a response which could not be
+// parsed, such as a truncated or corrupt message.
+func malformed(err error) bool {
+	var de *dns.Error
+	return errors.As(err, &de)
+}
+
+// exchange sends req to the backend addr and returns its response. It gives
+// up as soon as the context of opts is done, or with errUpstreamBusy if it
+// cannot start within -max-concurrent-upstream.
+func exchange(addr, transport string, opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	if err := startExchange(opts.ctx); err != nil {
+		return nil, err
+	}
+	defer endExchange()
+	if strings.HasPrefix(addr, httpsScheme) {
+		return exchangeHTTPS(addr, opts, req)
+	}
+	sent := req
+	if *caseRandomization {
+		sent = randomizeQuery(req)
+	}
+	var resp *dns.Msg
+	var err error
+	if cookies != nil {
+		resp, err = cookies.exchange(addr, transport, opts, sent)
+	} else {
+		resp, err = exchangeDNS(addr, transport, opts, sent)
+	}
+	if err == nil && sent != req {
+		if err = restoreQuery(req, sent, resp); err != nil {
+			return nil, fmt.Errorf("%v: %v", addr, err)
+		}
+	}
+	return resp, err
+}
+
+// exchangeDNS is exchange over UDP, TCP or TLS.
+func exchangeDNS(addr, transport string, opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	if opts.padding && strings.HasPrefix(addr, tlsScheme) {
+		req = paddedQuery(req)
+	}
+	c, hostport := newClient(addr, transport, opts)
+	if conns != nil && c.Net != "udp" {
+		// The TLS configuration depends on the route.
+		return conns.exchange(opts.ctx, c, addr+" "+opts.tlsServerName, hostport, req)
+	}
+	conn, err := dial(opts.ctx, c, hostport)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeConn(opts.ctx, c, conn, req)
+}
+
+// exchangeConn sends req over conn with c and returns its response. If ctx
+// is done first conn is closed and the context error returned.
+func exchangeConn(ctx context.Context, c *dns.Client, conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	// The client does not watch the context once connected, closing the
+	// connection unblocks it when the context is done.
+	done := make(chan struct{})
+	interrupted := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	resp, _, err := c.ExchangeWithConn(req, conn)
+	close(done)
+	if <-interrupted {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// exchangeHTTPS sends req to a DNS-over-HTTPS endpoint (RFC 8484).
+func exchangeHTTPS(endpoint string, opts routeOptions, req *dns.Msg) (*dns.Msg, error) {
+	// The ID is zero as recommended for HTTP caches, restored on the response.
+	var q *dns.Msg
+	if opts.padding {
+		q = paddedQuery(req)
+	} else {
+		q = req.Copy()
+	}
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(opts.ctx, opts.timeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", dohMediaType)
+	hreq.Header.Set("Accept", dohMediaType)
+	hresp, err := dohClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: HTTP status %v", endpoint, hresp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("%v: %w", endpoint, err)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// newClient returns a client to exchange with backend addr, and the address
+// to give to it. The transport (udp or tcp) is used for plain DNS backends
+// while tcp:// and DNS-over-TLS backends, and all backends behind
+// -upstream-proxy, are always queried over TCP.
+func newClient(addr, transport string, opts routeOptions) (*dns.Client, string) {
+	if upstreamDialer != nil {
+		transport = "tcp"
+	}
+	c, hostport := &dns.Client{Net: transport, Timeout: opts.timeout}, addr
+	if strings.HasPrefix(addr, tcpScheme) {
+		c.Net, hostport = "tcp", strings.TrimPrefix(addr, tcpScheme)
+	}
+	if strings.HasPrefix(addr, tlsScheme) {
+		hostport = strings.TrimPrefix(addr, tlsScheme)
+		c.Net, c.TLSConfig = "tcp-tls", upstreamTLSConfig(hostport, opts)
+	}
+	if upstreamSource != nil {
+		c.Dialer = sourceDialer(c.Net)
+		c.Dialer.Timeout = opts.timeout
+	}
+	return c, hostport
+}
+
+// setUpstreamSource makes connections to the backends from the local IP s,
+// failing if it is not one of this host.
+func setUpstreamSource(s string) error {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return fmt.Errorf("invalid -upstream-source-ip %q, must be an IP", s)
+	}
+	l, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("invalid -upstream-source-ip %q: %v", s, err)
+	}
+	l.Close()
+	upstreamSource = ip
+	d := sourceDialer("tcp")
+	d.Timeout, d.KeepAlive = 30*time.Second, 30*time.Second
+	dohClient.Transport.(*http.Transport).DialContext = d.DialContext
+	return nil
+}
+
+// sourceDialer returns a dialer for network from -upstream-source-ip.
+func sourceDialer(network string) *net.Dialer {
+	if upstreamSource == nil {
+		return &net.Dialer{}
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.Dialer{LocalAddr: &net.UDPAddr{IP: upstreamSource}}
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: upstreamSource}}
+}
+
+// upstreamTLSConfig returns the TLS configuration to connect to hostport,
+// with the settings of its DNS-over-TLS backend in upstream-tls if any.
+func upstreamTLSConfig(hostport string, opts routeOptions) *tls.Config {
+	var u *upstreamTLSSettings
+	if s := loadSettings(); s != nil {
+		u = s.upstreamTLS[tlsScheme+hostport]
+	}
+	serverName := opts.tlsServerName
+	if u != nil && u.serverName != "" {
+		serverName = u.serverName
+	}
+	if serverName == "" {
+		serverName = *upstreamTLSServerName
+	}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(hostport)
+	}
+	c := &tls.Config{ServerName: serverName, InsecureSkipVerify: *upstreamTLSInsecure}
+	if u != nil {
+		c.RootCAs = u.roots
+		if len(u.pins) > 0 {
+			if u.roots == nil {
+				// The pin alone authenticates a self-signed certificate.
+				c.InsecureSkipVerify = true
+			}
+			c.VerifyConnection = u.verifyPin
+		}
+	}
+	return c
+}
+
+// upstreamTLSSettings are the settings of a DNS-over-TLS backend given in
+// upstream-tls.
+type upstreamTLSSettings struct {
+	roots      *x509.CertPool // nil for the system ones
+	pins       [][]byte       // SHA-256 of the accepted public keys
+	serverName string
+}
+
+// newUpstreamTLSSettings loads the settings of the backend addr.
+func newUpstreamTLSSettings(addr string, cfg upstreamTLS) (*upstreamTLSSettings, error) {
+	if !strings.HasPrefix(addr, tlsScheme) || !validBackend(addr) {
+		return nil, fmt.Errorf("invalid upstream-tls backend %v, must be tls://host:port", addr)
+	}
+	u := &upstreamTLSSettings{serverName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		u.roots = x509.NewCertPool()
+		if !u.roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%v: no PEM certificate for %v", cfg.CAFile, addr)
+		}
+	}
+	for _, pin := range cfg.SPKIPins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q for %v, must be the base64 SHA-256 of a public key", pin, addr)
+		}
+		u.pins = append(u.pins, b)
+	}
+	return u, nil
+}
+
+// verifyPin checks that the public key of the certificate of the backend is
+// one of the pins, after the verification of its chain if any.
+func (u *upstreamTLSSettings) verifyPin(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate to check the SPKI pins against")
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range u.pins {
+		if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate public key %v matches no SPKI pin", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// dialTransfer connects to the backend addr to transfer a zone, over TLS if
+// needed.
+func dialTransfer(addr string, opts routeOptions) (*dns.Conn, error) {
+	if strings.HasPrefix(addr, httpsScheme) {
+		return nil, fmt.Errorf("%v: transfers are not supported over HTTPS", addr)
+	}
+	c, hostport := newClient(addr, "tcp", opts)
+	return dial(opts.ctx, c, hostport)
+}
+
+// setUpstreamProxy makes connections to backends go through the SOCKS5 proxy
+// given as a URL.
+func setUpstreamProxy(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+		return fmt.Errorf("invalid -upstream-proxy %q, must be socks5://host:port", s)
+	}
+	d, err := netproxy.FromURL(u, sourceDialer("tcp"))
+	if err != nil {
+		return err
+	}
+	upstreamDialer = d.(netproxy.ContextDialer)
+	dohClient.Transport.(*http.Transport).Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// dial connects c to hostport, through -upstream-proxy if set.
+func dial(ctx context.Context, c *dns.Client, hostport string) (*dns.Conn, error) {
+	if upstreamDialer == nil {
+		return c.DialContext(ctx, hostport)
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	conn, err := upstreamDialer.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	if c.Net == "tcp-tls" {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		tlsConn := tls.Client(conn, c.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return &dns.Conn{Conn: conn, UDPSize: c.UDPSize}, nil
+}
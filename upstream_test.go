@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDoH starts a DNS-over-HTTPS endpoint answering with h, trusted by the
+// DoH client for the duration of the test, and returns its URL.
+func startDoH(t *testing.T, h dns.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(hw http.ResponseWriter, hr *http.Request) {
+		if hr.Method != http.MethodPost || hr.Header.Get("Content-Type") != dohMediaType {
+			http.Error(hw, "bad request", http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(hr.Body)
+		if err != nil {
+			http.Error(hw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(b); err != nil || req.Id != 0 {
+			http.Error(hw, "bad query", http.StatusBadRequest)
+			return
+		}
+		w := newStubWriter("tcp", hr.RemoteAddr)
+		h(w, req)
+		out, err := w.msgs[0].Pack()
+		if err != nil {
+			http.Error(hw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hw.Header().Set("Content-Type", dohMediaType)
+		hw.Write(out)
+	}))
+	trust(t, srv)
+	return srv.URL + "/dns-query"
+}
+
+// trust makes the DoH client trust srv for the duration of the test, and
+// closes it afterwards.
+func trust(t *testing.T, srv *httptest.Server) {
+	t.Cleanup(srv.Close)
+	old := dohClient
+	dohClient = srv.Client()
+	t.Cleanup(func() { dohClient = old })
+}
+
+func testOptions() routeOptions {
+	return routeOptions{timeout: 2 * time.Second, ctx: context.Background()}
+}
+
+func TestExchangeHTTPS(t *testing.T) {
+	endpoint := startDoH(t, answerA("192.0.2.1"))
+	req := newQ("www.example.com.", dns.TypeA)
+	resp, err := exchangeHTTPS(endpoint, testOptions(), req)
+	if err != nil {
+		t.Fatalf("exchangeHTTPS: %v", err)
+	}
+	if resp.Id != req.Id {
+		t.Errorf("response ID %d, want that of the query %d", resp.Id, req.Id)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("answer %v, want 192.0.2.1", ips)
+	}
+}
+
+func TestExchangeHTTPSStatus(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(hw http.ResponseWriter, hr *http.Request) {
+		http.Error(hw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	trust(t, srv)
+	if _, err := exchangeHTTPS(srv.URL, testOptions(), newQ("example.com.", dns.TypeA)); err == nil {
+		t.Error("exchangeHTTPS succeeded on HTTP status 503")
+	}
+
+	setFlag(t, "strategy", strategyMerge)
+	useConfig(t, fmt.Sprintf("default: %v/dns-query\n", srv.URL))
+	w := newStubWriter("udp", "127.0.0.1:5353")
+	route(w, newQ("example.com.", dns.TypeA))
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeServerFailure {
+		t.Errorf("query to a failing DoH backend answered with %v, want SERVFAIL", w.msgs)
+	}
+}
+
+func TestDoHWithPlainBackends(t *testing.T) {
+	endpoint := startDoH(t, answerA("192.0.2.1"))
+	plain := startUpstream(t, answerA("192.0.2.2"))
+	setFlag(t, "strategy", strategyMerge)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v, %v]\n", endpoint, plain))
+	addr := startProxy(t)
+	for _, netw := range []string{"udp", "tcp"} {
+		r := query(t, netw, addr, "www.example.com.", dns.TypeA)
+		ips := answerIPs(r)
+		sort.Strings(ips)
+		if len(ips) != 2 || ips[0] != "192.0.2.1" || ips[1] != "192.0.2.2" {
+			t.Errorf("%v: merged answer %v, want those of the DoH and plain backends", netw, ips)
+		}
+	}
+}
+
+// failingFirst returns a handler which does not answer the first n queries,
+// then answers them with h.
+func failingFirst(n int64, h dns.HandlerFunc) dns.HandlerFunc {
+	var seen int64
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.AddInt64(&seen, 1) > n {
+			h(w, r)
+		}
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	h, n := counting(failingFirst(1, answerA("192.0.2.1")))
+	addr := startUpstream(t, h)
+	setFlag(t, "retries", "2")
+	setFlag(t, "retry-backoff", "10ms")
+	opts := testOptions()
+	opts.timeout = 100 * time.Millisecond
+	resp, err := exchangeRetry(addr, "udp", opts, newQ("www.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("exchangeRetry: %v", err)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("answer %v, want that of the retry", ips)
+	}
+	if got := atomic.LoadInt64(n); got != 2 {
+		t.Errorf("%d exchanges, want 2", got)
+	}
+}
+
+func TestRetryNotOnResponse(t *testing.T) {
+	h, n := counting(answerRcode(dns.RcodeServerFailure))
+	addr := startUpstream(t, h)
+	setFlag(t, "retries", "2")
+	resp, err := exchangeRetry(addr, "udp", testOptions(), newQ("www.example.com.", dns.TypeA))
+	if err != nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("exchangeRetry = %v, %v; want the SERVFAIL of the backend", resp, err)
+	}
+	if got := atomic.LoadInt64(n); got != 1 {
+		t.Errorf("%d exchanges, want a single one", got)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	h, n := counting(blackhole)
+	addr := startUpstream(t, h)
+	setFlag(t, "retries", "10")
+	setFlag(t, "retry-backoff", "10ms")
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	opts := testOptions()
+	opts.timeout, opts.ctx = 100*time.Millisecond, ctx
+	start := time.Now()
+	if _, err := exchangeRetry(addr, "udp", opts, newQ("www.example.com.", dns.TypeA)); err == nil {
+		t.Fatal("exchangeRetry succeeded with a backend never answering")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("retries went on for %v, past the deadline of 250ms", elapsed)
+	}
+	if got := atomic.LoadInt64(n); got > 3 {
+		t.Errorf("%d exchanges within the deadline, want at most 3", got)
+	}
+}
+
+// waitFor waits up to a second for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
+
+func TestFastestCancelsSlow(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(hw http.ResponseWriter, hr *http.Request) {
+		select {
+		case <-hr.Context().Done():
+		case <-release:
+		}
+	}))
+	trust(t, srv)
+	t.Cleanup(func() { close(release) })
+	slowDoH := srv.URL + "/dns-query"
+	slowUDP := startUpstream(t, blackhole)
+	fast := startUpstream(t, answerA("192.0.2.1"))
+	setFlag(t, "strategy", strategyFastest)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v, %v, %v]\n", slowDoH, slowUDP, fast))
+	addr := startProxy(t)
+
+	start := time.Now()
+	r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+	if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Fatalf("answer %v, want that of the fast backend", ips)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answered in %v, waiting for the slow backends", elapsed)
+	}
+	for _, slow := range []string{slowDoH, slowUDP} {
+		waitFor(t, "the cancellation of "+slow, func() bool {
+			return upstreamResponses.snapshot()[slow+labelSep+"cancelled"] == 1
+		})
+	}
+}
+
+// answerTransport answers every query with an A record of tcpIP over TCP
+// and udpIP over UDP.
+func answerTransport(tcpIP, udpIP string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			answerA(tcpIP)(w, r)
+		} else {
+			answerA(udpIP)(w, r)
+		}
+	}
+}
+
+func TestForceTCP(t *testing.T) {
+	up := startUpstream(t, answerTransport("192.0.2.1", "192.0.2.2"))
+	useConfig(t, fmt.Sprintf("default: %v\nroutes:\n  .tcp.example.: [tcp://%v]\n", up, up))
+	addr := startProxy(t)
+	for _, tt := range []struct {
+		netw, name, want string
+	}{
+		{"udp", "www.tcp.example.", "192.0.2.1"},
+		{"tcp", "www.tcp.example.", "192.0.2.1"},
+		{"udp", "www.example.", "192.0.2.2"},
+		{"tcp", "www.example.", "192.0.2.1"},
+	} {
+		if ips := answerIPs(query(t, tt.netw, addr, tt.name, dns.TypeA)); len(ips) != 1 || ips[0] != tt.want {
+			t.Errorf("%v query for %v: answer %v, want %v", tt.netw, tt.name, ips, tt.want)
+		}
+	}
+}
+
+func TestValidBackend(t *testing.T) {
+	for _, tt := range []struct {
+		backend string
+		want    bool
+	}{
+		{"192.0.2.1:53", true},
+		{"[2001:db8::1]:53", true},
+		{"tcp://192.0.2.1:53", true},
+		{"tls://192.0.2.1:853", true},
+		{"https://dns.example/dns-query", true},
+		{"192.0.2.1", false},
+		{"tcp://192.0.2.1", false},
+		{"udp://192.0.2.1:53", false},
+		{"https://", false},
+	} {
+		if got := validBackend(tt.backend); got != tt.want {
+			t.Errorf("validBackend(%q) = %v, want %v", tt.backend, got, tt.want)
+		}
+	}
+}
+
+// startSOCKS5 starts a SOCKS5 proxy without authentication supporting
+// CONNECT, and returns its address and a channel of the addresses it
+// connected to.
+func startSOCKS5(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(c, targets)
+		}
+	}()
+	return l.Addr().String(), targets
+}
+
+func serveSOCKS5(c net.Conn, targets chan<- string) {
+	defer c.Close()
+	buf := make([]byte, 262)
+	// Greeting: version, methods; no authentication chosen.
+	if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+	// Request: version, CONNECT, reserved, address type.
+	if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(c, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 4:
+		io.ReadFull(c, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	case 3:
+		io.ReadFull(c, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(c, buf[:n])
+		host = string(buf[:n])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+	up, err := net.Dial("tcp", target)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	targets <- target
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(up, c)
+	io.Copy(c, up)
+}
+
+// useUpstreamProxy connects to the backends through the SOCKS5 proxy addr for
+// the duration of the test.
+func useUpstreamProxy(t *testing.T, addr string) {
+	t.Helper()
+	transport := dohClient.Transport.(*http.Transport)
+	oldDialer, oldProxy := upstreamDialer, transport.Proxy
+	t.Cleanup(func() { upstreamDialer, transport.Proxy = oldDialer, oldProxy })
+	if err := setUpstreamProxy("socks5://" + addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	socks, targets := startSOCKS5(t)
+	up := startUpstream(t, answerTransport("192.0.2.1", "192.0.2.2"))
+	useUpstreamProxy(t, socks)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	// UDP cannot go through the proxy, the backend is queried over TCP.
+	for _, netw := range []string{"udp", "tcp"} {
+		if ips := answerIPs(query(t, netw, addr, "www.example.com.", dns.TypeA)); len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Errorf("%v query: answer %v, want that of the backend over TCP", netw, ips)
+		}
+		select {
+		case target := <-targets:
+			if target != up {
+				t.Errorf("%v query: proxy connected to %v, want the backend %v", netw, target, up)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v query: backend not reached through the proxy", netw)
+		}
+	}
+}
+
+func TestUpstreamProxyInvalid(t *testing.T) {
+	useUpstreamProxy(t, "127.0.0.1:1080")
+	for _, s := range []string{"http://127.0.0.1:8080", "socks5://", "127.0.0.1:1080"} {
+		if err := setUpstreamProxy(s); err == nil {
+			t.Errorf("-upstream-proxy %v accepted", s)
+		}
+	}
+}
+
+// answerSource answers every query with an A record of the address the query
+// came from.
+func answerSource(w dns.ResponseWriter, r *dns.Msg) {
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	answerA(host)(w, r)
+}
+
+func TestUpstreamSourceIP(t *testing.T) {
+	up := startUpstream(t, answerSource)
+	old, oldDial := upstreamSource, dohClient.Transport.(*http.Transport).DialContext
+	t.Cleanup(func() {
+		upstreamSource = old
+		dohClient.Transport.(*http.Transport).DialContext = oldDial
+	})
+	if err := setUpstreamSource("127.0.0.2"); err != nil {
+		t.Skipf("127.0.0.2 unusable: %v", err)
+	}
+	for _, transport := range []string{"udp", "tcp"} {
+		resp, err := exchangeDNS(up, transport, testOptions(), newQ("example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%v: %v", transport, err)
+		}
+		if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "127.0.0.2" {
+			t.Errorf("%v query from %v, want 127.0.0.2", transport, ips)
+		}
+	}
+	if d := sourceDialer("udp"); d.LocalAddr.String() != "127.0.0.2:0" {
+		t.Errorf("UDP dialer from %v, want 127.0.0.2:0", d.LocalAddr)
+	}
+
+	for _, s := range []string{"bogus", "192.0.2.1"} {
+		if err := setUpstreamSource(s); err == nil {
+			t.Errorf("-upstream-source-ip %v accepted", s)
+		}
+	}
+}
+
+// startGarbage starts a UDP backend answering every query with a header
+// announcing an answer which is missing, followed by garbage.
+func startGarbage(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if n < 2 {
+				continue
+			}
+			resp := append([]byte{b[0], b[1], 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}, 0xc0, 0xff, 0xee)
+			pc.WriteTo(resp, from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestMalformedResponse(t *testing.T) {
+	garbage := startGarbage(t)
+	if _, err := exchangeDNS(garbage, "udp", testOptions(), newQ("example.com.", dns.TypeA)); err == nil || !malformed(err) {
+		t.Fatalf("exchange with a garbage backend: %v, want a malformed response error", err)
+	}
+
+	up := startUpstream(t, answerA("192.0.2.1"))
+	setFlag(t, "strategy", strategyRoundRobin)
+	useConfig(t, fmt.Sprintf("routes:\n  .example.com.: [%v, %v]\n  .garbage.example.: [%v]\n", garbage, up, garbage))
+	buf := captureLog(t)
+	addr := startProxy(t)
+	before := upstreamResponses.snapshot()[garbage+labelSep+"malformed"]
+
+	for i := 0; i < 2; i++ {
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if ips := answerIPs(r); r.Rcode != dns.RcodeSuccess || len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Errorf("query %d: got %v %v, want the answer of the next backend", i, dns.RcodeToString[r.Rcode], ips)
+		}
+	}
+	if r := query(t, "udp", addr, "www.garbage.example.", dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query to the garbage backend only: got %v, want SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+	if n := upstreamResponses.snapshot()[garbage+labelSep+"malformed"] - before; n == 0 {
+		t.Error("malformed responses not counted")
+	}
+	if strings.Contains(buf.String(), "malformed") {
+		t.Errorf("malformed responses logged without -log-trace:\n%v", buf)
+	}
+}
+
+// truncatingUDP answers with several A records over TCP, and truncated
+// without any over UDP.
+func truncatingUDP(w dns.ResponseWriter, r *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		answerMany(3)(w, r)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Truncated = true
+	w.WriteMsg(m)
+}
+
+func TestTCPRetry(t *testing.T) {
+	h, n := counting(truncatingUDP)
+	up := startUpstream(t, h)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+
+	t.Run("retry", func(t *testing.T) {
+		addr := startProxy(t)
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if r.Truncated || len(r.Answer) != 3 {
+			t.Errorf("truncated over UDP: got TC %v and %d records, want the 3 records over TCP", r.Truncated, len(r.Answer))
+		}
+		if got := atomic.LoadInt64(n); got != 2 {
+			t.Errorf("%d queries to the backend, want 2 over UDP then TCP", got)
+		}
+	})
+
+	t.Run("no-tcp-retry", func(t *testing.T) {
+		setFlag(t, "no-tcp-retry", "true")
+		addr := startProxy(t)
+		r := query(t, "udp", addr, "www.example.com.", dns.TypeA)
+		if !r.Truncated || len(r.Answer) != 0 {
+			t.Errorf("with -no-tcp-retry: got TC %v and %d records, want the truncated response", r.Truncated, len(r.Answer))
+		}
+	})
+}
+
+// startDoT starts a DNS-over-TLS backend answering with h, with a
+// self-signed certificate for dns.example. and 127.0.0.1. It returns its
+// address as a backend, the path of its certificate in PEM and the SPKI pin
+// of its key.
+func startDoT(t *testing.T, h dns.HandlerFunc) (addr, certFile, pin string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example."},
+		DNSNames:              []string{"dns.example."},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	certFile = writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	return tlsScheme + l.Addr().String(), certFile, base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	addr, certFile, pin := startDoT(t, answerA("192.0.2.1"))
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	for _, tt := range []struct {
+		what     string
+		settings string
+		ok       bool
+	}{
+		{"no settings", "", false},
+		{"CA file", fmt.Sprintf("ca-file: %v", certFile), true},
+		{"CA file and server name", fmt.Sprintf("ca-file: %v, server-name: dns.example.", certFile), true},
+		{"CA file and wrong server name", fmt.Sprintf("ca-file: %v, server-name: other.example.", certFile), false},
+		{"pin", fmt.Sprintf("spki-pins: [%v]", pin), true},
+		{"pins", fmt.Sprintf("spki-pins: [%v, %v]", wrongPin, pin), true},
+		{"wrong pin", fmt.Sprintf("spki-pins: [%v]", wrongPin), false},
+		{"CA file and wrong pin", fmt.Sprintf("ca-file: %v, spki-pins: [%v]", certFile, wrongPin), false},
+	} {
+		config := fmt.Sprintf("default: %v\n", addr)
+		if tt.settings != "" {
+			config += fmt.Sprintf("upstream-tls:\n  %v: {%v}\n", addr, tt.settings)
+		}
+		useConfig(t, config)
+		resp, err := exchange(addr, "tcp", testOptions(), newQ("www.example.com.", dns.TypeA))
+		if tt.ok && (err != nil || len(answerIPs(resp)) != 1) {
+			t.Errorf("%v: %v, want the answer", tt.what, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%v: exchange succeeded, want the certificate rejected", tt.what)
+		}
+	}
+
+	for _, settings := range []string{
+		fmt.Sprintf("127.0.0.1:853: {spki-pins: [%v]}", pin),
+		"tls://127.0.0.1:853: {spki-pins: [not-base64]}",
+		"tls://127.0.0.1:853: {spki-pins: [AAAA]}",
+		"tls://127.0.0.1:853: {ca-file: /nonexistent/ca.pem}",
+		fmt.Sprintf("tls://127.0.0.1:853: {ca-file: %v}", writeFile(t, "empty.pem", "")),
+	} {
+		setFlag(t, "config", writeFile(t, "config.yaml", "default: 192.0.2.1:53\nupstream-tls:\n  "+settings+"\n"))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("upstream-tls %v accepted", settings)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+)
+
+// Policies of -upstream-queue-policy, when the queue of a backend is full.
+const (
+	queueReject             = "reject"
+	queueDropOldest         = "drop-oldest"
+	queueBlockUntilDeadline = "block-until-deadline"
+)
+
+var (
+	upstreamMaxInFlight = flag.Int("upstream-max-in-flight", 0,
+		"Maximum queries in flight at once to each backend, further ones waiting in its queue (0 for no limit)")
+	upstreamQueueSize = flag.Int("upstream-queue-size", 100,
+		"Queries which may wait for a slot of their backend under -upstream-max-in-flight")
+	upstreamQueuePolicy = flag.String("upstream-queue-policy", queueReject,
+		"What to do with a query when the queue of its backend is full: reject it, drop-oldest to fail "+
+			"the query waiting the longest instead, or block-until-deadline to wait anyway")
+
+	backendQueues *upstreamQueues // nil if queries to each backend are not limited
+)
+
+// errQueueFull is the error of queries rejected or dropped as the queue of
+// their backend was full.
+var errQueueFull = errors.New("backend queue full")
+
+// upstreamQueues bounds the queries in flight to each backend, those over the
+// limit waiting in a queue per backend for a slot, first come first served.
+type upstreamQueues struct {
+	max    int
+	size   int
+	policy string
+
+	mu       sync.Mutex
+	backends map[string]*backendQueue
+}
+
+// backendQueue is the state of a backend with queries in flight.
+type backendQueue struct {
+	inFlight int
+	waiting  []chan error // oldest first, each told nil for a slot or errQueueFull
+}
+
+func newUpstreamQueues(max, size int, policy string) (*upstreamQueues, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("invalid -upstream-max-in-flight %d, must be positive", max)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid -upstream-queue-size %d, must be positive", size)
+	}
+	switch policy {
+	case queueReject, queueDropOldest, queueBlockUntilDeadline:
+	default:
+		return nil, fmt.Errorf("invalid -upstream-queue-policy %q, must be %v, %v or %v",
+			policy, queueReject, queueDropOldest, queueBlockUntilDeadline)
+	}
+	return &upstreamQueues{max: max, size: size, policy: policy, backends: make(map[string]*backendQueue)}, nil
+}
+
+// acquire takes a slot of addr, waiting in its queue until ctx is done. On
+// success release must be called once the query is over.
+func (q *upstreamQueues) acquire(ctx context.Context, addr string) error {
+	q.mu.Lock()
+	b, ok := q.backends[addr]
+	if !ok {
+		b = &backendQueue{}
+		q.backends[addr] = b
+	}
+	if b.inFlight < q.max && len(b.waiting) == 0 {
+		b.inFlight++
+		q.mu.Unlock()
+		return nil
+	}
+	if len(b.waiting) >= q.size {
+		switch {
+		case q.policy == queueDropOldest && len(b.waiting) > 0:
+			b.waiting[0] <- errQueueFull
+			b.waiting = b.waiting[1:]
+			upstreamQueued.inc(addr, "dropped")
+		case q.policy != queueBlockUntilDeadline:
+			q.mu.Unlock()
+			upstreamQueued.inc(addr, "rejected")
+			return errQueueFull
+		}
+	}
+	// Buffered so that release and acquire do not wait for the receiver.
+	turn := make(chan error, 1)
+	b.waiting = append(b.waiting, turn)
+	q.mu.Unlock()
+	upstreamQueued.inc(addr, "queued")
+	traceOf(ctx).tracef("%v busy, queued", addr)
+
+	select {
+	case err := <-turn:
+		return err
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	for i, other := range b.waiting {
+		if other == turn {
+			b.waiting = append(b.waiting[:i], b.waiting[i+1:]...)
+			q.mu.Unlock()
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				upstreamQueued.inc(addr, "expired")
+			}
+			return ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	// Given a slot or dropped meanwhile.
+	if err := <-turn; err == nil {
+		q.release(addr)
+	}
+	return ctx.Err()
+}
+
+// release frees a slot taken by acquire, handing it to the oldest query
+// waiting if any.
+func (q *upstreamQueues) release(addr string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := q.backends[addr]
+	if len(b.waiting) > 0 {
+		b.waiting[0] <- nil
+		b.waiting = b.waiting[1:]
+		return
+	}
+	b.inFlight--
+	if b.inFlight == 0 {
+		delete(q.backends, addr)
+	}
+}
+
+// lengths returns the number of queries waiting per backend.
+func (q *upstreamQueues) lengths() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lengths := make(map[string]int, len(q.backends))
+	for addr, b := range q.backends {
+		lengths[addr] = len(b.waiting)
+	}
+	return lengths
+}
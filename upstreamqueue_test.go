@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useUpstreamQueues bounds the queries in flight to each backend for the
+// duration of the test.
+func useUpstreamQueues(t *testing.T, max, size int, policy string) *upstreamQueues {
+	t.Helper()
+	q, err := newUpstreamQueues(max, size, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := backendQueues
+	backendQueues = q
+	t.Cleanup(func() { backendQueues = old })
+	return q
+}
+
+// acquireAsync acquires a slot of addr from q in the background, and returns
+// the result.
+func acquireAsync(ctx context.Context, q *upstreamQueues, addr string) <-chan error {
+	c := make(chan error, 1)
+	go func() { c <- q.acquire(ctx, addr) }()
+	return c
+}
+
+// waitQueued waits for n queries to wait in the queue of addr.
+func waitQueued(t *testing.T, q *upstreamQueues, addr string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); q.lengths()[addr] != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d queries queued, want %d", q.lengths()[addr], n)
+		}
+	}
+}
+
+// received returns the error of c, failing if it takes over a second.
+func received(t *testing.T, c <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-c:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("no slot nor error")
+		return nil
+	}
+}
+
+// queued returns how many queries to addr were counted with result since
+// before.
+func queued(before map[string]uint64, addr, result string) uint64 {
+	key := addr + labelSep + result
+	return upstreamQueued.snapshot()[key] - before[key]
+}
+
+func TestUpstreamQueueReject(t *testing.T) {
+	const addr = "192.0.2.1:53"
+	q := useUpstreamQueues(t, 1, 1, queueReject)
+	before := upstreamQueued.snapshot()
+	ctx := context.Background()
+
+	if err := q.acquire(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+	waiting := acquireAsync(ctx, q, addr)
+	waitQueued(t, q, addr, 1)
+	if got := upstreamQueueLengths()[addr]; got != 1 {
+		t.Errorf("queue length metric %v, want 1", got)
+	}
+	if err := q.acquire(ctx, addr); err != errQueueFull {
+		t.Errorf("query over a full queue: %v, want %v", err, errQueueFull)
+	}
+	if err := q.acquire(ctx, "192.0.2.2:53"); err != nil {
+		t.Errorf("query to another backend: %v, want a slot", err)
+	}
+	q.release("192.0.2.2:53")
+
+	q.release(addr)
+	if err := received(t, waiting); err != nil {
+		t.Errorf("queued query after a release: %v, want the slot", err)
+	}
+	q.release(addr)
+	if len(q.backends) != 0 {
+		t.Errorf("backends %v kept once idle", q.backends)
+	}
+	if n := queued(before, addr, "queued"); n != 1 {
+		t.Errorf("%d queries counted queued, want 1", n)
+	}
+	if n := queued(before, addr, "rejected"); n != 1 {
+		t.Errorf("%d queries counted rejected, want 1", n)
+	}
+}
+
+func TestUpstreamQueueDropOldest(t *testing.T) {
+	const addr = "192.0.2.3:53"
+	q := useUpstreamQueues(t, 1, 1, queueDropOldest)
+	before := upstreamQueued.snapshot()
+	ctx := context.Background()
+
+	if err := q.acquire(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+	oldest := acquireAsync(ctx, q, addr)
+	waitQueued(t, q, addr, 1)
+	newest := acquireAsync(ctx, q, addr)
+	if err := received(t, oldest); err != errQueueFull {
+		t.Errorf("oldest query of a full queue: %v, want %v", err, errQueueFull)
+	}
+	waitQueued(t, q, addr, 1)
+	q.release(addr)
+	if err := received(t, newest); err != nil {
+		t.Errorf("newest query after a release: %v, want the slot", err)
+	}
+	q.release(addr)
+	if n := queued(before, addr, "dropped"); n != 1 {
+		t.Errorf("%d queries counted dropped, want 1", n)
+	}
+	if n := queued(before, addr, "rejected"); n != 0 {
+		t.Errorf("%d queries counted rejected, want none", n)
+	}
+}
+
+func TestUpstreamQueueBlockUntilDeadline(t *testing.T) {
+	const addr = "192.0.2.4:53"
+	q := useUpstreamQueues(t, 1, 1, queueBlockUntilDeadline)
+	before := upstreamQueued.snapshot()
+	ctx := context.Background()
+
+	if err := q.acquire(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+	first := acquireAsync(ctx, q, addr)
+	waitQueued(t, q, addr, 1)
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := q.acquire(short, addr); err != context.DeadlineExceeded {
+		t.Errorf("query over a full queue: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("query over a full queue failed in %v, want at its deadline", elapsed)
+	}
+	waitQueued(t, q, addr, 1)
+	q.release(addr)
+	if err := received(t, first); err != nil {
+		t.Errorf("queued query after a release: %v, want the slot", err)
+	}
+	q.release(addr)
+	if n := queued(before, addr, "expired"); n != 1 {
+		t.Errorf("%d queries counted expired, want 1", n)
+	}
+	if n := queued(before, addr, "queued"); n != 2 {
+		t.Errorf("%d queries counted queued, want 2", n)
+	}
+}
+
+func TestUpstreamQueueProxy(t *testing.T) {
+	slow := func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		answerA("192.0.2.1")(w, r)
+	}
+	h, n := counting(slow)
+	up := startUpstream(t, h)
+	useUpstreamQueues(t, 1, 0, queueReject)
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	answered := make(chan *dns.Msg, 1)
+	go func() {
+		c := &dns.Client{Timeout: 5 * time.Second}
+		r, _, _ := c.Exchange(newQ("first.example.com.", dns.TypeA), addr)
+		answered <- r
+	}()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(n) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first query not forwarded")
+		}
+	}
+	start := time.Now()
+	if r := query(t, "udp", addr, "second.example.com.", dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query over the limit: got %v, want SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("query over the limit failed in %v, want at once", elapsed)
+	}
+	if r := <-answered; r == nil || len(answerIPs(r)) != 1 {
+		t.Errorf("query in flight: got %v, want the answer", r)
+	}
+}
+
+func TestUpstreamQueueInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		max, size int
+		policy    string
+	}{
+		{-1, 100, queueReject},
+		{1, -1, queueReject},
+		{1, 100, "drop-newest"},
+	} {
+		if _, err := newUpstreamQueues(tt.max, tt.size, tt.policy); err == nil {
+			t.Errorf("newUpstreamQueues(%d, %d, %q) accepted", tt.max, tt.size, tt.policy)
+		}
+	}
+}
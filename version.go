@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=..." as done by the Makefile.
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+var showVersion = flag.Bool("version", false, "Print the version and exit")
+
+// versionString returns the version, commit and build date of the binary.
+// Without build information, the version is that of the module if installed
+// with go install, else dev.
+func versionString() string {
+	v := version
+	if v == "dev" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+	}
+	c, d := commit, date
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("dns-reverse-proxy %v (commit %v, built %v)", v, c, d)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var localZoneLists flagStringList
+
+// localZone is a zone answered authoritatively from the records of its zone
+// file, without consulting any upstream.
+type localZone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR // per lowercase owner name
+	names   map[string]bool     // owner names and the empty non-terminals above them
+	keys    []*signingKey       // signing answers asking for DNSSEC records, if any
+}
+
+// parseLocalZoneFlag parses a -local-zone flag: origin=file.
+func parseLocalZoneFlag(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return "", "", fmt.Errorf("invalid -local-zone, must be origin=file")
+	}
+	return kv[0], kv[1], nil
+}
+
+// loadLocalZone loads the zone file at path of the zone origin, which must
+// have a SOA record at its apex and no record out of the zone.
+func loadLocalZone(origin, path string) (*localZone, error) {
+	origin = normalizeDomain(origin)
+	if _, ok := dns.IsDomainName(origin); !ok {
+		return nil, fmt.Errorf("invalid local zone origin %q", origin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z := &localZone{
+		origin:  origin,
+		records: make(map[string][]dns.RR),
+		names:   map[string]bool{origin: true},
+	}
+	zp := dns.NewZoneParser(f, origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		h.Name = strings.ToLower(h.Name)
+		if !dns.IsSubDomain(origin, h.Name) {
+			return nil, fmt.Errorf("%v: record for %v out of zone %v", path, h.Name, origin)
+		}
+		if soa, ok := rr.(*dns.SOA); ok && h.Name == origin {
+			z.soa = soa
+		}
+		z.records[h.Name] = append(z.records[h.Name], rr)
+		for name := h.Name; name != origin; name = parentName(name) {
+			z.names[name] = true
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%v: zone %v has no SOA record", path, origin)
+	}
+	return z, nil
+}
+
+// buildLocalZones returns the local zones of the config file and the flags,
+// the most specific origin first.
+func buildLocalZones(cfg *config) ([]*localZone, error) {
+	files := make(map[string]string)
+	for origin, path := range cfg.LocalZones {
+		files[origin] = path
+	}
+	for _, lz := range localZoneLists {
+		origin, path, err := parseLocalZoneFlag(lz)
+		if err != nil {
+			return nil, err
+		}
+		files[origin] = path
+	}
+	keys := make(map[string][]string)
+	for origin, paths := range cfg.ZoneKeys {
+		keys[normalizeDomain(origin)] = append(keys[normalizeDomain(origin)], paths...)
+	}
+	for _, zk := range zoneKeyLists {
+		origin, path, err := parseZoneKeyFlag(zk)
+		if err != nil {
+			return nil, err
+		}
+		keys[normalizeDomain(origin)] = append(keys[normalizeDomain(origin)], path)
+	}
+	var zones []*localZone
+	for origin, path := range files {
+		z, err := loadLocalZone(origin, path)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range keys[z.origin] {
+			k, err := loadSigningKey(z.origin, path)
+			if err != nil {
+				return nil, err
+			}
+			z.addSigningKey(k)
+		}
+		delete(keys, z.origin)
+		zones = append(zones, z)
+	}
+	for origin := range keys {
+		return nil, fmt.Errorf("invalid zone key for %v: no such local zone", origin)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if li, lj := dns.CountLabel(zones[i].origin), dns.CountLabel(zones[j].origin); li != lj {
+			return li > lj
+		}
+		return zones[i].origin < zones[j].origin
+	})
+	return zones, nil
+}
+
+// parentName returns the name above name, which must not be the root.
+func parentName(name string) string {
+	i, _ := dns.NextLabel(name, 0)
+	return name[i:]
+}
+
+// lookup returns the records of the lowercase name, synthesized from a
+// wildcard if it does not exist, or nil.
+func (z *localZone) lookup(name string) []dns.RR {
+	if rrs, ok := z.records[name]; ok || z.names[name] {
+		return rrs
+	}
+	encloser := parentName(name)
+	for !z.names[encloser] {
+		encloser = parentName(encloser)
+	}
+	var rrs []dns.RR
+	for _, rr := range z.records["*."+encloser] {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// delegation returns the NS records of the zone cut below the origin at or
+// above the lowercase name, or nil if it is not delegated.
+func (z *localZone) delegation(name string) []dns.RR {
+	for ; name != z.origin; name = parentName(name) {
+		var ns []dns.RR
+		for _, rr := range z.records[name] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				ns = append(ns, rr)
+			}
+		}
+		if ns != nil {
+			return ns
+		}
+	}
+	return nil
+}
+
+// addresses returns the A and AAAA records in the zone of the name servers of
+// the NS records ns: the glue of a referral, or the addresses of the name
+// servers of the zone in the additional section of the answer to its NS
+// query. Servers out of the zone must be resolved by the client.
+func (z *localZone) addresses(ns []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		for _, addr := range z.records[target] {
+			if t := addr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				rrs = append(rrs, dns.Copy(addr))
+			}
+		}
+	}
+	return rrs
+}
+
+// negativeSOA returns the SOA record of negative answers, its TTL being the
+// negative TTL of RFC 2308.
+func (z *localZone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// answer returns the authoritative answer to req, whose name is in the zone.
+// CNAME records are followed within the zone, delegated names are answered
+// with a referral, not authoritative, of the NS records of the zone cut and
+// their glue, and missing ones with NXDOMAIN or NODATA.
+func (z *localZone) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	name := strings.ToLower(q.Name)
+	for i := 0; i < maxCNAMEChain; i++ {
+		if ns := z.delegation(name); ns != nil && !(name == ns[0].Header().Name && q.Qtype == dns.TypeDS) {
+			m.Authoritative = len(m.Answer) > 0
+			for _, rr := range ns {
+				m.Ns = append(m.Ns, dns.Copy(rr))
+			}
+			m.Extra = append(m.Extra, z.addresses(ns)...)
+			break
+		}
+		rrs := z.lookup(name)
+		if rrs == nil && !z.names[name] {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, z.negativeSOA())
+			break
+		}
+		var cname dns.RR
+		var answers []dns.RR
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeCNAME {
+				cname = rr
+			}
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				answers = append(answers, dns.Copy(rr))
+			}
+		}
+		if cname != nil && q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+			m.Answer = append(m.Answer, dns.Copy(cname))
+			name = strings.ToLower(cname.(*dns.CNAME).Target)
+			if !dns.IsSubDomain(z.origin, name) {
+				break
+			}
+			continue
+		}
+		if len(answers) == 0 {
+			m.Ns = append(m.Ns, z.negativeSOA())
+		}
+		m.Answer = append(m.Answer, answers...)
+		if q.Qtype == dns.TypeNS {
+			m.Extra = append(m.Extra, z.addresses(answers)...)
+		}
+		break
+	}
+	lcName := strings.ToLower(q.Name)
+	for _, rr := range m.Answer {
+		if rr.Header().Name == lcName {
+			rr.Header().Name = q.Name
+		}
+	}
+	if z.signed(req) {
+		if err := z.sign(req, m, name); err != nil {
+			log.Printf("local zone %v: %v", z.origin, err)
+			m = new(dns.Msg)
+			m.SetRcode(req, dns.RcodeServerFailure)
+		}
+	}
+	return m
+}
+
+// localZone returns the local zone of the lowercase name, or nil.
+func (s *settings) localZone(name string) *localZone {
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 3600
+@	IN SOA ns1 hostmaster 1 7200 900 1209600 300
+	IN NS ns1
+	IN MX 10 mail
+	IN A 192.0.2.1
+ns1	IN A 192.0.2.53
+mail	IN A 192.0.2.25
+www	IN CNAME web.dept
+web.dept	IN A 192.0.2.80
+*.wild	IN A 192.0.2.99
+`
+
+// useLocalZone loads testZone as example.com. with -local-zone, forwarding
+// other names to a backend answering 192.0.2.2, and returns the address of
+// the proxy.
+func useLocalZone(t *testing.T) string {
+	t.Helper()
+	up := startUpstream(t, answerA("192.0.2.2"))
+	setList(t, &localZoneLists, "example.com.="+writeFile(t, "example.com.zone", testZone))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	return startProxy(t)
+}
+
+func TestLocalZone(t *testing.T) {
+	addr := useLocalZone(t)
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string // types of the answer records
+		soa    bool   // SOA in the authority section
+	}{
+		{"example.com.", dns.TypeSOA, dns.RcodeSuccess, "[SOA]", false},
+		{"example.com.", dns.TypeNS, dns.RcodeSuccess, "[NS]", false},
+		{"Example.COM.", dns.TypeA, dns.RcodeSuccess, "[A]", false},
+		{"example.com.", dns.TypeMX, dns.RcodeSuccess, "[MX]", false},
+		{"mail.example.com.", dns.TypeA, dns.RcodeSuccess, "[A]", false},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, "[CNAME A]", false},
+		{"x.wild.example.com.", dns.TypeA, dns.RcodeSuccess, "[A]", false},
+		{"mail.example.com.", dns.TypeAAAA, dns.RcodeSuccess, "[]", true},
+		{"dept.example.com.", dns.TypeA, dns.RcodeSuccess, "[]", true},
+		{"nowhere.example.com.", dns.TypeA, dns.RcodeNameError, "[]", true},
+		{"a.b.mail.example.com.", dns.TypeA, dns.RcodeNameError, "[]", true},
+	} {
+		r := query(t, "udp", addr, tt.name, tt.qtype)
+		var types []string
+		for _, rr := range r.Answer {
+			types = append(types, dns.TypeToString[rr.Header().Rrtype])
+		}
+		soa := len(r.Ns) == 1 && r.Ns[0].Header().Rrtype == dns.TypeSOA
+		if r.Rcode != tt.rcode || fmt.Sprint(types) != tt.answer || soa != tt.soa || !r.Authoritative {
+			t.Errorf("%v %v: got %v %v, SOA %v, AA %v; want %v %v, SOA %v, AA",
+				tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[r.Rcode], types, soa, r.Authoritative,
+				dns.RcodeToString[tt.rcode], tt.answer, tt.soa)
+		}
+		if soa && r.Ns[0].Header().Ttl != 300 {
+			t.Errorf("%v %v: SOA TTL %d, want the negative TTL 300", tt.name, dns.TypeToString[tt.qtype], r.Ns[0].Header().Ttl)
+		}
+	}
+
+	r := query(t, "udp", addr, "Example.COM.", dns.TypeA)
+	if ips := answerIPs(r); len(ips) != 1 || ips[0] != "192.0.2.1" || r.Answer[0].Header().Name != "Example.COM." {
+		t.Errorf("apex A: %v, want 192.0.2.1 owned by the name as queried", r.Answer)
+	}
+	if ips := answerIPs(query(t, "udp", addr, "x.wild.example.com.", dns.TypeA)); len(ips) != 1 || ips[0] != "192.0.2.99" {
+		t.Errorf("wildcard: %v, want 192.0.2.99", ips)
+	}
+	if r := query(t, "udp", addr, "example.com.", dns.TypeNS); len(r.Extra) != 1 {
+		t.Errorf("NS: additional %v, want the address of ns1", r.Extra)
+	}
+	// Names out of the zone are forwarded.
+	if ips := answerIPs(query(t, "udp", addr, "www.example.org.", dns.TypeA)); len(ips) != 1 || ips[0] != "192.0.2.2" {
+		t.Errorf("name out of the zone: %v, want the answer of the backend", ips)
+	}
+}
+
+func TestLoadLocalZoneInvalid(t *testing.T) {
+	for what, content := range map[string]string{
+		"no SOA":          "$TTL 3600\n@ IN A 192.0.2.1\n",
+		"out of zone":     testZone + "www.example.org. IN A 192.0.2.1\n",
+		"not a zone file": "@ IN BOGUS 1\n",
+	} {
+		if _, err := loadLocalZone("example.com.", writeFile(t, "zone", content)); err == nil {
+			t.Errorf("zone file with %v loaded", what)
+		}
+	}
+	if _, err := loadLocalZone("example.com.", "/nonexistent"); err == nil {
+		t.Error("missing zone file loaded")
+	}
+	if _, _, err := parseLocalZoneFlag("example.com."); err == nil {
+		t.Error("-local-zone without file accepted")
+	}
+}
+
+func TestLocalZoneDelegation(t *testing.T) {
+	up := startUpstream(t, answerA("192.0.2.2"))
+	zone := testZone + `sub	IN NS ns1.sub
+	IN NS ns.example.net.
+ns1.sub	IN A 192.0.2.54
+	IN AAAA 2001:db8::54
+hidden.sub	IN A 192.0.2.55
+`
+	setList(t, &localZoneLists, "example.com.="+writeFile(t, "example.com.zone", zone))
+	useConfig(t, fmt.Sprintf("default: %v\n", up))
+	addr := startProxy(t)
+
+	// referral checks that r is the referral to sub.example.com.
+	referral := func(what string, r *dns.Msg) {
+		t.Helper()
+		if r.Rcode != dns.RcodeSuccess || r.Authoritative || len(r.Answer) != 0 {
+			t.Errorf("%v: got %v, AA %v, answer %v; want a referral", what, dns.RcodeToString[r.Rcode], r.Authoritative, r.Answer)
+		}
+		var servers []string
+		for _, rr := range r.Ns {
+			ns, ok := rr.(*dns.NS)
+			if !ok || ns.Hdr.Name != "sub.example.com." {
+				t.Errorf("%v: authority %v, want the NS records of sub.example.com.", what, rr)
+				continue
+			}
+			servers = append(servers, ns.Ns)
+		}
+		if fmt.Sprint(servers) != "[ns1.sub.example.com. ns.example.net.]" {
+			t.Errorf("%v: name servers %v, want ns1.sub.example.com. and ns.example.net.", what, servers)
+		}
+		var glue []string
+		for _, rr := range r.Extra {
+			if rr.Header().Name != "ns1.sub.example.com." {
+				t.Errorf("%v: additional %v, want the glue of ns1.sub.example.com. only", what, rr)
+			}
+			glue = append(glue, dns.TypeToString[rr.Header().Rrtype])
+		}
+		if fmt.Sprint(glue) != "[A AAAA]" {
+			t.Errorf("%v: glue %v, want the A and AAAA records of ns1.sub.example.com.", what, glue)
+		}
+	}
+	referral("below the cut", query(t, "udp", addr, "www.sub.example.com.", dns.TypeA))
+	referral("NS at the cut", query(t, "udp", addr, "sub.example.com.", dns.TypeNS))
+	referral("name server below the cut", query(t, "tcp", addr, "ns1.sub.example.com.", dns.TypeA))
+	r := query(t, "udp", addr, "hidden.sub.example.com.", dns.TypeA)
+	referral("record below the cut", r)
+	if ips := answerIPs(r); len(ips) != 0 {
+		t.Errorf("record below the cut: answer %v, want it hidden", ips)
+	}
+
+	setFlag(t, "minimal-responses", "true")
+	referral("with -minimal-responses", query(t, "udp", addr, "www.sub.example.com.", dns.TypeA))
+
+	// The zone itself is still answered authoritatively.
+	if r := query(t, "udp", addr, "mail.example.com.", dns.TypeA); !r.Authoritative || len(answerIPs(r)) != 1 {
+		t.Errorf("name above the cut: AA %v, answer %v; want an authoritative answer", r.Authoritative, r.Answer)
+	}
+}
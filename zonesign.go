@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var zoneKeyLists flagStringList
+
+// Signatures of local zones are valid from an hour ago, for clients whose
+// clock is late, until signatureValidity from now.
+const (
+	signatureInception = time.Hour
+	signatureValidity  = 24 * time.Hour
+)
+
+// typeNXNAME marks in NSEC records that their owner name does not exist, in
+// the compact denial of existence of RFC 9824.
+const typeNXNAME = 128
+
+// signingKey is a key signing the answers of a local zone.
+type signingKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// parseZoneKeyFlag parses a -zone-key flag: origin=file.
+func parseZoneKeyFlag(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return "", "", fmt.Errorf("invalid -zone-key, must be origin=file")
+	}
+	return kv[0], kv[1], nil
+}
+
+// loadSigningKey loads the key of the zone origin from the files written by
+// dnssec-keygen: path, with or without extension, followed by .key for the
+// DNSKEY record and .private for the private key.
+func loadSigningKey(origin, path string) (*signingKey, error) {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+	f, err := os.Open(path + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, origin, path+".key")
+	rr, _ := zp.Next()
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%v.key: no DNSKEY record", path)
+	}
+	dnskey.Hdr.Name = strings.ToLower(dnskey.Hdr.Name)
+	if dnskey.Hdr.Name != origin {
+		return nil, fmt.Errorf("%v.key: key of %v, not of zone %v", path, dnskey.Hdr.Name, origin)
+	}
+	pf, err := os.Open(path + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer pf.Close()
+	priv, err := dnskey.ReadPrivateKey(pf, path+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%v.private: unsupported key", path)
+	}
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// addSigningKey signs the answers of the zone with k from now on, and
+// publishes its DNSKEY record at the apex.
+func (z *localZone) addSigningKey(k *signingKey) {
+	z.keys = append(z.keys, k)
+	z.records[z.origin] = append(z.records[z.origin], k.dnskey)
+}
+
+// signed returns whether the answer to req is signed: the zone has keys and
+// the client asks for DNSSEC records.
+func (z *localZone) signed(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return len(z.keys) > 0 && opt != nil && opt.Do()
+}
+
+// sign adds to m, the answer to a query whose final name in the zone is
+// name, the proofs of denial of existence of the RRsets it lacks and the
+// signatures of its authoritative RRsets, additional addresses included.
+// Names which do not exist are answered NOERROR with an NSEC record of that
+// name, as by RFC 9824, so that the zone need not be walked: each NSEC record
+// covers only its owner.
+func (z *localZone) sign(req, m *dns.Msg, name string) error {
+	if m.IsEdns0() == nil {
+		m.SetEdns0(req.IsEdns0().UDPSize(), true)
+	}
+	if nsec := z.denial(m, name); nsec != nil {
+		m.Ns = append(m.Ns, nsec)
+	}
+	now := time.Now()
+	for _, section := range []*[]dns.RR{&m.Answer, &m.Ns, &m.Extra} {
+		rrsets, _ := splitRRsets(*section)
+		for _, rrset := range rrsets {
+			h := rrset[0].Header()
+			if h.Rrtype == dns.TypeNS && !strings.EqualFold(h.Name, z.origin) {
+				// A delegation is not authoritative.
+				continue
+			}
+			if section == &m.Extra && z.delegation(strings.ToLower(h.Name)) != nil {
+				// Nor is glue below a zone cut.
+				continue
+			}
+			for _, k := range z.keysFor(h.Rrtype) {
+				sig := &dns.RRSIG{
+					Hdr:        dns.RR_Header{Ttl: h.Ttl},
+					Algorithm:  k.dnskey.Algorithm,
+					KeyTag:     k.dnskey.KeyTag(),
+					SignerName: z.origin,
+					Inception:  uint32(now.Add(-signatureInception).Unix()),
+					Expiration: uint32(now.Add(signatureValidity).Unix()),
+				}
+				if err := sig.Sign(k.signer, rrset); err != nil {
+					return fmt.Errorf("signing %v %v: %v", h.Name, dns.TypeToString[h.Rrtype], err)
+				}
+				*section = append(*section, sig)
+			}
+		}
+	}
+	return nil
+}
+
+// denial returns the NSEC record proving what m lacks for name, or nil if it
+// is a positive answer: that the name does not exist, that it has no record
+// of the type asked, or that a delegation has no DS record. The DS records
+// of a signed delegation are added to m instead.
+func (z *localZone) denial(m *dns.Msg, name string) dns.RR {
+	var owner string
+	var types []uint16
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		m.Rcode = dns.RcodeSuccess
+		owner, types = name, []uint16{typeNXNAME}
+	case len(m.Ns) > 0 && m.Ns[0].Header().Rrtype == dns.TypeSOA:
+		owner = name
+		for _, rr := range z.lookup(name) {
+			types = append(types, rr.Header().Rrtype)
+		}
+	case len(m.Ns) > 0 && m.Ns[0].Header().Rrtype == dns.TypeNS:
+		owner = strings.ToLower(m.Ns[0].Header().Name)
+		for _, rr := range z.records[owner] {
+			if rr.Header().Rrtype == dns.TypeDS {
+				m.Ns = append(m.Ns, dns.Copy(rr))
+			}
+			types = append(types, rr.Header().Rrtype)
+		}
+		if containsType(types, dns.TypeDS) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: z.negativeSOA().Header().Ttl},
+		NextDomain: "\\000." + owner,
+		TypeBitMap: uniqueTypes(types),
+	}
+}
+
+// keysFor returns the keys signing the RRsets of type rrtype: the key
+// signing keys for the DNSKEY RRset and the others for the rest, or all the
+// keys if they are all of a kind.
+func (z *localZone) keysFor(rrtype uint16) []*signingKey {
+	var ksks, zsks []*signingKey
+	for _, k := range z.keys {
+		if k.dnskey.Flags&dns.SEP != 0 {
+			ksks = append(ksks, k)
+		} else {
+			zsks = append(zsks, k)
+		}
+	}
+	if len(ksks) == 0 || len(zsks) == 0 {
+		return z.keys
+	}
+	if rrtype == dns.TypeDNSKEY {
+		return ksks
+	}
+	return zsks
+}
+
+func containsType(types []uint16, t uint16) bool {
+	for _, other := range types {
+		if other == t {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueTypes returns types sorted without duplicates, as in the type bitmap
+// of an NSEC record.
+func uniqueTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	unique := types[:0]
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			unique = append(unique, t)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeZoneKey generates a key of origin with flags, writes it as
+// dnssec-keygen does and returns the path of its files, without extension,
+// and its DNSKEY record.
+func writeZoneKey(t *testing.T, origin string, flags uint16) (string, *dns.DNSKEY) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), fmt.Sprintf("K%s+%03d+%05d", origin, key.Algorithm, key.KeyTag()))
+	if err := ioutil.WriteFile(path+".key", []byte(key.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+// verifySigned checks that every RRset of rrs has a single valid signature,
+// by the key keyFor its type.
+func verifySigned(t *testing.T, what string, rrs []dns.RR, keyFor func(rrtype uint16) *dns.DNSKEY) {
+	t.Helper()
+	rrsets, sigs := splitRRsets(rrs)
+	for _, rrset := range rrsets {
+		h := rrset[0].Header()
+		key := keyFor(h.Rrtype)
+		set := sigs[rrsetKey{strings.ToLower(h.Name), h.Rrtype, h.Class}]
+		if len(set) != 1 || set[0].KeyTag != key.KeyTag() {
+			t.Errorf("%v: %v %v signed by %v, want a single signature by key %d", what, h.Name, dns.TypeToString[h.Rrtype], set, key.KeyTag())
+			continue
+		}
+		if err := set[0].Verify(key, rrset); err != nil {
+			t.Errorf("%v: signature of %v %v: %v", what, h.Name, dns.TypeToString[h.Rrtype], err)
+		}
+		if !set[0].ValidityPeriod(time.Now()) {
+			t.Errorf("%v: signature of %v %v not valid now", what, h.Name, dns.TypeToString[h.Rrtype])
+		}
+	}
+}
+
+// dnssecQ returns a query for name of type qtype with the DNSSEC OK bit.
+func dnssecQ(name string, qtype uint16) *dns.Msg {
+	m := newQ(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	return m
+}
+
+// nsecOf returns the NSEC record of the authority section of m, or nil.
+func nsecOf(m *dns.Msg) *dns.NSEC {
+	for _, rr := range m.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func TestZoneSigning(t *testing.T) {
+	path, key := writeZoneKey(t, "example.com.", 257)
+	setList(t, &zoneKeyLists, "example.com.="+path+".private")
+	addr := useLocalZone(t)
+	byKey := func(uint16) *dns.DNSKEY { return key }
+
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"example.com.", dns.TypeA},
+		{"example.com.", dns.TypeNS},
+		{"www.example.com.", dns.TypeA},
+		{"mail.example.com.", dns.TypeA},
+	} {
+		what := fmt.Sprintf("%v %v", tt.name, dns.TypeToString[tt.qtype])
+		r := ask(t, "tcp", addr, dnssecQ(tt.name, tt.qtype))
+		if r.Rcode != dns.RcodeSuccess || !hasRRSIG(r) {
+			t.Errorf("%v: got %v, want a signed answer", what, dns.RcodeToString[r.Rcode])
+		}
+		verifySigned(t, what, r.Answer, byKey)
+		verifySigned(t, what, r.Ns, byKey)
+	}
+
+	r := ask(t, "tcp", addr, dnssecQ("example.com.", dns.TypeDNSKEY))
+	if len(r.Answer) != 2 || r.Answer[0].String() != key.String() {
+		t.Errorf("DNSKEY: %v, want the key and its signature", r.Answer)
+	}
+	verifySigned(t, "DNSKEY", r.Answer, byKey)
+
+	// Denials of existence, of a type then of the name.
+	for _, tt := range []struct {
+		name  string
+		types []uint16
+	}{
+		{"mail.example.com.", []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"nowhere.example.com.", []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}},
+	} {
+		r := ask(t, "tcp", addr, dnssecQ(tt.name, dns.TypeAAAA))
+		nsec := nsecOf(r)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || nsec == nil {
+			t.Errorf("%v AAAA: got %v %v, want NOERROR with an NSEC record", tt.name, dns.RcodeToString[r.Rcode], r.Ns)
+			continue
+		}
+		if nsec.Hdr.Name != tt.name || nsec.NextDomain != "\\000."+tt.name || fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint(tt.types) {
+			t.Errorf("%v AAAA: NSEC %v, want that of the name only with types %v", tt.name, nsec, tt.types)
+		}
+		verifySigned(t, tt.name+" AAAA", r.Ns, byKey)
+	}
+
+	// Not signed for clients not asking for DNSSEC records.
+	if r := query(t, "tcp", addr, "example.com.", dns.TypeA); hasRRSIG(r) {
+		t.Error("answer signed without the DNSSEC OK bit")
+	}
+	if r := query(t, "tcp", addr, "nowhere.example.com.", dns.TypeA); r.Rcode != dns.RcodeNameError || nsecOf(r) != nil {
+		t.Errorf("name not existing without the DNSSEC OK bit: %v %v, want NXDOMAIN", dns.RcodeToString[r.Rcode], r.Ns)
+	}
+}
+
+func TestZoneSigningKeys(t *testing.T) {
+	kskPath, ksk := writeZoneKey(t, "example.com.", 257)
+	zskPath, zsk := writeZoneKey(t, "example.com.", 256)
+	zone := writeFile(t, "example.com.zone", testZone)
+	setList(t, &localZoneLists, "example.com.="+zone)
+	setList(t, &zoneKeyLists, "example.com.="+kskPath)
+	useConfig(t, fmt.Sprintf("zone-keys:\n  Example.COM.: [%v.key]\n", zskPath))
+	addr := startProxy(t)
+
+	// The key signing key signs the DNSKEY records, the other the rest.
+	byType := func(rrtype uint16) *dns.DNSKEY {
+		if rrtype == dns.TypeDNSKEY {
+			return ksk
+		}
+		return zsk
+	}
+	r := ask(t, "tcp", addr, dnssecQ("example.com.", dns.TypeDNSKEY))
+	if keys := len(r.Answer) - 1; keys != 2 {
+		t.Errorf("%d DNSKEY records, want the 2 keys", keys)
+	}
+	verifySigned(t, "DNSKEY", r.Answer, byType)
+	verifySigned(t, "A", ask(t, "tcp", addr, dnssecQ("example.com.", dns.TypeA)).Answer, byType)
+
+	otherPath, _ := writeZoneKey(t, "example.org.", 256)
+	for _, keys := range [][]string{
+		{"example.com.=" + otherPath},
+		{"example.org.=" + otherPath},
+		{"example.com.=" + filepath.Join(t.TempDir(), "Kexample.com.+013+00000")},
+		{"example.com."},
+	} {
+		setList(t, &zoneKeyLists, keys...)
+		setFlag(t, "config", writeFile(t, "config.yaml", ""))
+		if _, err := buildSettings(); err == nil {
+			t.Errorf("-zone-key %v accepted", keys)
+		}
+	}
+}